@@ -3,6 +3,7 @@ package agent
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -1463,6 +1464,37 @@ func newConsulConfig(runtimeCfg *config.RuntimeConfig, logger hclog.Logger) (*co
 
 	cfg.PeeringEnabled = runtimeCfg.PeeringEnabled
 	cfg.PeeringTestAllowPeerRegistrations = runtimeCfg.PeeringTestAllowPeerRegistrations
+	cfg.PeeringMeshGatewayTaggedAddress = runtimeCfg.PeeringMeshGatewayTaggedAddress
+	cfg.PeeringMeshGatewayIncludeWarning = runtimeCfg.PeeringMeshGatewayIncludeWarning
+	cfg.PeeringServerPortPrecedence = consul.PeeringPortPrecedence(runtimeCfg.PeeringServerPortPrecedence)
+	cfg.PeeringExcludeLocalServerAddress = runtimeCfg.PeeringExcludeLocalServerAddress
+	cfg.PeeringMaxServerAddresses = runtimeCfg.PeeringMaxServerAddresses
+	cfg.PeeringMaxPerPartition = runtimeCfg.PeeringMaxPerPartition
+	cfg.PeeringWriteRate = runtimeCfg.PeeringWriteRate
+	cfg.PeeringWriteBurst = runtimeCfg.PeeringWriteBurst
+	cfg.PeeringIdempotencyKeyTTL = runtimeCfg.PeeringIdempotencyKeyTTL
+	cfg.PeeringTokenChecksum = runtimeCfg.PeeringTokenChecksum
+	cfg.PeeringTokenVerifyEncoding = runtimeCfg.PeeringTokenVerifyEncoding
+	cfg.PeeringTokenLogFingerprint = runtimeCfg.PeeringTokenLogFingerprint
+	cfg.PeeringDedupeCatalogRegister = runtimeCfg.PeeringDedupeCatalogRegister
+	cfg.PeeringTokenTTL = runtimeCfg.PeeringTokenTTL
+	cfg.PeeringTokenEnforceExpiry = runtimeCfg.PeeringTokenEnforceExpiry
+	cfg.PeeringTokenCompression = runtimeCfg.PeeringTokenCompression
+	if runtimeCfg.PeeringTokenEncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(runtimeCfg.PeeringTokenEncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode peering token encryption key: %v", err)
+		}
+		cfg.PeeringTokenEncryptionKey = key
+	}
+	cfg.PeeringImportLimits = runtimeCfg.PeeringImportLimits
+	cfg.PeeringOperatorContact = runtimeCfg.PeeringOperatorContact
+	cfg.PeeringClusterName = runtimeCfg.PeeringClusterName
+	cfg.PeeringCARootsMaxStale = runtimeCfg.PeeringCARootsMaxStale
+	cfg.PeeringServerAddressesCacheTTL = runtimeCfg.PeeringServerAddressesCacheTTL
+	cfg.PeeringLeaderAddressMaxWait = runtimeCfg.PeeringLeaderAddressMaxWait
+	cfg.PeeringTrustDomainMismatchPolicy = consul.PeeringTrustDomainMismatchPolicy(runtimeCfg.PeeringTrustDomainMismatchPolicy)
+	cfg.PeeringLegacyTrustDomains = runtimeCfg.PeeringLegacyTrustDomains
 
 	enterpriseConsulConfig(cfg, runtimeCfg)
 	return cfg, nil
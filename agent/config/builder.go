@@ -1022,6 +1022,30 @@ func (b *builder) build() (rt RuntimeConfig, err error) {
 		ReadReplica:                       boolVal(c.ReadReplica),
 		PeeringEnabled:                    boolVal(c.Peering.Enabled),
 		PeeringTestAllowPeerRegistrations: boolValWithDefault(c.Peering.TestAllowPeerRegistrations, false),
+		PeeringMeshGatewayTaggedAddress:   stringVal(c.Peering.MeshGatewayTaggedAddress),
+		PeeringMeshGatewayIncludeWarning:  boolVal(c.Peering.MeshGatewayIncludeWarning),
+		PeeringServerPortPrecedence:       stringVal(c.Peering.ServerPortPrecedence),
+		PeeringExcludeLocalServerAddress:  boolVal(c.Peering.ExcludeLocalServerAddress),
+		PeeringMaxServerAddresses:         intVal(c.Peering.MaxServerAddresses),
+		PeeringMaxPerPartition:            intVal(c.Peering.MaxPerPartition),
+		PeeringWriteRate:                  rate.Limit(float64Val(c.Peering.WriteRate)),
+		PeeringWriteBurst:                 intVal(c.Peering.WriteBurst),
+		PeeringIdempotencyKeyTTL:          b.durationVal("peering.idempotency_key_ttl", c.Peering.IdempotencyKeyTTL),
+		PeeringTokenChecksum:              boolVal(c.Peering.TokenChecksum),
+		PeeringTokenVerifyEncoding:        boolVal(c.Peering.TokenVerifyEncoding),
+		PeeringTokenLogFingerprint:        boolVal(c.Peering.TokenLogFingerprint),
+		PeeringDedupeCatalogRegister:      boolVal(c.Peering.DedupeCatalogRegister),
+		PeeringTokenTTL:                   b.durationVal("peering.token_ttl", c.Peering.TokenTTL),
+		PeeringTokenEnforceExpiry:         boolVal(c.Peering.TokenEnforceExpiry),
+		PeeringTokenCompression:           boolVal(c.Peering.TokenCompression),
+		PeeringTokenEncryptionKey:         stringVal(c.Peering.TokenEncryptionKey),
+		PeeringOperatorContact:            stringVal(c.Peering.OperatorContact),
+		PeeringClusterName:                stringVal(c.Peering.ClusterName),
+		PeeringCARootsMaxStale:            b.durationVal("peering.ca_roots_max_stale", c.Peering.CARootsMaxStale),
+		PeeringServerAddressesCacheTTL:    b.durationVal("peering.server_addresses_cache_ttl", c.Peering.ServerAddressesCacheTTL),
+		PeeringLeaderAddressMaxWait:       b.durationVal("peering.leader_address_max_wait", c.Peering.LeaderAddressMaxWait),
+		PeeringTrustDomainMismatchPolicy:  stringVal(c.Peering.TrustDomainMismatchPolicy),
+		PeeringLegacyTrustDomains:         c.Peering.LegacyTrustDomains,
 		PidFile:                           stringVal(c.PidFile),
 		PrimaryDatacenter:                 primaryDatacenter,
 		PrimaryGateways:                   b.expandAllOptionalAddrs("primary_gateways", c.PrimaryGateways),
@@ -1089,6 +1113,12 @@ func (b *builder) build() (rt RuntimeConfig, err error) {
 		rt.RaftBoltDBConfig = *c.RaftBoltDBConfig
 	}
 
+	rt.PeeringImportLimits = consul.PeeringImportLimits{
+		MaxServiceTags:      intVal(c.Peering.ImportLimits.MaxServiceTags),
+		MaxServiceMetaBytes: intVal(c.Peering.ImportLimits.MaxServiceMetaBytes),
+		MaxChecks:           intVal(c.Peering.ImportLimits.MaxChecks),
+	}
+
 	if rt.Cache.EntryFetchMaxBurst <= 0 {
 		return RuntimeConfig{}, fmt.Errorf("cache.entry_fetch_max_burst must be strictly positive, was: %v", rt.Cache.EntryFetchMaxBurst)
 	}
@@ -1225,6 +1255,10 @@ func (b *builder) validate(rt RuntimeConfig) error {
 		}
 	}
 
+	if err := validatePeering(rt); err != nil {
+		return err
+	}
+
 	if !rt.DevMode {
 		fi, err := os.Stat(rt.DataDir)
 		switch {
@@ -2352,6 +2386,30 @@ func (b *builder) autoConfigAuthorizerVal(raw AutoConfigAuthorizationRaw, agentP
 	return val
 }
 
+// validatePeering runs the same peering checks the server performs at
+// startup, so that a bad peering block is reported against the agent config.
+func validatePeering(rt RuntimeConfig) error {
+	var key []byte
+	if rt.PeeringTokenEncryptionKey != "" {
+		var err error
+		key, err = base64.StdEncoding.DecodeString(rt.PeeringTokenEncryptionKey)
+		if err != nil {
+			return fmt.Errorf("peering.token_encryption_key must be base64 encoded: %v", err)
+		}
+	}
+	cfg := &consul.Config{
+		PeeringTokenEncryptionKey:        key,
+		PeeringServerPortPrecedence:      consul.PeeringPortPrecedence(rt.PeeringServerPortPrecedence),
+		PeeringTrustDomainMismatchPolicy: consul.PeeringTrustDomainMismatchPolicy(rt.PeeringTrustDomainMismatchPolicy),
+		PeeringWriteRate:                 rt.PeeringWriteRate,
+		PeeringWriteBurst:                rt.PeeringWriteBurst,
+	}
+	if err := cfg.CheckPeering(); err != nil {
+		return fmt.Errorf("peering: %v", err)
+	}
+	return nil
+}
+
 func (b *builder) validateAutoConfig(rt RuntimeConfig) error {
 	autoconf := rt.AutoConfig
 
@@ -907,4 +907,36 @@ type Peering struct {
 	// TestAllowPeerRegistrations controls whether CatalogRegister endpoints allow registrations for objects with `PeerName`
 	// This always gets overridden in NonUserSource()
 	TestAllowPeerRegistrations *bool `mapstructure:"test_allow_peer_registrations"`
+
+	MeshGatewayTaggedAddress  *string             `mapstructure:"mesh_gateway_tagged_address"`
+	MeshGatewayIncludeWarning *bool               `mapstructure:"mesh_gateway_include_warning"`
+	ServerPortPrecedence      *string             `mapstructure:"server_port_precedence"`
+	ExcludeLocalServerAddress *bool               `mapstructure:"exclude_local_server_address"`
+	MaxServerAddresses        *int                `mapstructure:"max_server_addresses"`
+	MaxPerPartition           *int                `mapstructure:"max_per_partition"`
+	WriteRate                 *float64            `mapstructure:"write_rate"`
+	WriteBurst                *int                `mapstructure:"write_burst"`
+	IdempotencyKeyTTL         *string             `mapstructure:"idempotency_key_ttl"`
+	TokenChecksum             *bool               `mapstructure:"token_checksum"`
+	TokenVerifyEncoding       *bool               `mapstructure:"token_verify_encoding"`
+	TokenLogFingerprint       *bool               `mapstructure:"token_log_fingerprint"`
+	DedupeCatalogRegister     *bool               `mapstructure:"dedupe_catalog_register"`
+	TokenTTL                  *string             `mapstructure:"token_ttl"`
+	TokenEnforceExpiry        *bool               `mapstructure:"token_enforce_expiry"`
+	TokenCompression          *bool               `mapstructure:"token_compression"`
+	TokenEncryptionKey        *string             `mapstructure:"token_encryption_key"`
+	ImportLimits              PeeringImportLimits `mapstructure:"import_limits"`
+	OperatorContact           *string             `mapstructure:"operator_contact"`
+	ClusterName               *string             `mapstructure:"cluster_name"`
+	CARootsMaxStale           *string             `mapstructure:"ca_roots_max_stale"`
+	ServerAddressesCacheTTL   *string             `mapstructure:"server_addresses_cache_ttl"`
+	LeaderAddressMaxWait      *string             `mapstructure:"leader_address_max_wait"`
+	TrustDomainMismatchPolicy *string             `mapstructure:"trust_domain_mismatch_policy"`
+	LegacyTrustDomains        []string            `mapstructure:"legacy_trust_domains"`
+}
+
+type PeeringImportLimits struct {
+	MaxServiceTags      *int `mapstructure:"max_service_tags"`
+	MaxServiceMetaBytes *int `mapstructure:"max_service_meta_bytes"`
+	MaxChecks           *int `mapstructure:"max_checks"`
 }
@@ -848,6 +848,146 @@ type RuntimeConfig struct {
 	// registrations for objects with `PeerName`
 	PeeringTestAllowPeerRegistrations bool
 
+	// PeeringMeshGatewayTaggedAddress is the key of the mesh gateway tagged
+	// address embedded into peering tokens.
+	//
+	// hcl: peering { mesh_gateway_tagged_address = string }
+	PeeringMeshGatewayTaggedAddress string
+
+	// PeeringMeshGatewayIncludeWarning embeds mesh gateways with warning
+	// health checks into peering tokens.
+	//
+	// hcl: peering { mesh_gateway_include_warning = (true|false) }
+	PeeringMeshGatewayIncludeWarning bool
+
+	// PeeringServerPortPrecedence controls whether the TLS or plain-text gRPC
+	// port of each server is embedded into peering tokens.
+	//
+	// hcl: peering { server_port_precedence = ("tls-first"|"plain-first"|"tls-only") }
+	PeeringServerPortPrecedence string
+
+	// PeeringExcludeLocalServerAddress omits this server's own address from
+	// peering tokens.
+	//
+	// hcl: peering { exclude_local_server_address = (true|false) }
+	PeeringExcludeLocalServerAddress bool
+
+	// PeeringMaxServerAddresses limits the number of server addresses
+	// embedded in peering tokens. Zero means unlimited.
+	//
+	// hcl: peering { max_server_addresses = int }
+	PeeringMaxServerAddresses int
+
+	// PeeringMaxPerPartition limits the number of active peerings in each
+	// partition. Zero means unlimited.
+	//
+	// hcl: peering { max_per_partition = int }
+	PeeringMaxPerPartition int
+
+	// PeeringWriteRate and PeeringWriteBurst limit how often clients can
+	// write each peering. A zero PeeringWriteRate disables the limit.
+	//
+	// hcl: peering { write_rate = float64 write_burst = int }
+	PeeringWriteRate  rate.Limit
+	PeeringWriteBurst int
+
+	// PeeringIdempotencyKeyTTL is how long the leader remembers the keys of
+	// successful peering writes. Zero disables idempotency keys.
+	//
+	// hcl: peering { idempotency_key_ttl = "duration" }
+	PeeringIdempotencyKeyTTL time.Duration
+
+	// PeeringTokenChecksum appends a checksum to generated peering tokens.
+	//
+	// hcl: peering { token_checksum = (true|false) }
+	PeeringTokenChecksum bool
+
+	// PeeringTokenVerifyEncoding checks that each generated peering token
+	// decodes to the same token.
+	//
+	// hcl: peering { token_verify_encoding = (true|false) }
+	PeeringTokenVerifyEncoding bool
+
+	// PeeringTokenLogFingerprint logs the fingerprint of each generated
+	// peering token.
+	//
+	// hcl: peering { token_log_fingerprint = (true|false) }
+	PeeringTokenLogFingerprint bool
+
+	// PeeringDedupeCatalogRegister skips imported registrations that are
+	// identical to the last one applied.
+	//
+	// hcl: peering { dedupe_catalog_register = (true|false) }
+	PeeringDedupeCatalogRegister bool
+
+	// PeeringTokenTTL is how long generated peering tokens are valid for.
+	// Zero means tokens do not expire.
+	//
+	// hcl: peering { token_ttl = "duration" }
+	PeeringTokenTTL time.Duration
+
+	// PeeringTokenEnforceExpiry rejects expired peering tokens.
+	//
+	// hcl: peering { token_enforce_expiry = (true|false) }
+	PeeringTokenEnforceExpiry bool
+
+	// PeeringTokenCompression gzips large generated peering tokens.
+	//
+	// hcl: peering { token_compression = (true|false) }
+	PeeringTokenCompression bool
+
+	// PeeringTokenEncryptionKey is the base64 encoded AES key used to encrypt
+	// generated peering tokens. It decodes to 16, 24 or 32 bytes.
+	//
+	// hcl: peering { token_encryption_key = string }
+	PeeringTokenEncryptionKey string
+
+	// PeeringImportLimits bounds the size of catalog registrations imported
+	// from peers. Zero limits are not enforced.
+	//
+	// hcl: peering { import_limits { max_service_tags = int max_service_meta_bytes = int max_checks = int } }
+	PeeringImportLimits consul.PeeringImportLimits
+
+	// PeeringOperatorContact is embedded in generated peering tokens.
+	//
+	// hcl: peering { operator_contact = string }
+	PeeringOperatorContact string
+
+	// PeeringClusterName is embedded in generated peering tokens for display.
+	//
+	// hcl: peering { cluster_name = string }
+	PeeringClusterName string
+
+	// PeeringCARootsMaxStale allows peering operations to use CA roots read
+	// up to this long ago. Zero disables stale reads.
+	//
+	// hcl: peering { ca_roots_max_stale = "duration" }
+	PeeringCARootsMaxStale time.Duration
+
+	// PeeringServerAddressesCacheTTL is how long the server addresses
+	// embedded in peering tokens are reused. Zero disables caching.
+	//
+	// hcl: peering { server_addresses_cache_ttl = "duration" }
+	PeeringServerAddressesCacheTTL time.Duration
+
+	// PeeringLeaderAddressMaxWait caps the backoff while waiting for a leader
+	// address.
+	//
+	// hcl: peering { leader_address_max_wait = "duration" }
+	PeeringLeaderAddressMaxWait time.Duration
+
+	// PeeringTrustDomainMismatchPolicy controls whether a trust bundle with an
+	// unexpected trust domain is rejected or accepted with a warning.
+	//
+	// hcl: peering { trust_domain_mismatch_policy = ("strict-reject"|"warn-and-update") }
+	PeeringTrustDomainMismatchPolicy string
+
+	// PeeringLegacyTrustDomains lists previous trust domains of this cluster
+	// that peers may still use.
+	//
+	// hcl: peering { legacy_trust_domains = []string }
+	PeeringLegacyTrustDomains []string
+
 	// PidFile is the file to store our PID in.
 	//
 	// hcl: pid_file = string
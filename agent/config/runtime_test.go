@@ -2208,6 +2208,45 @@ func TestLoad_IntegrationWithFlags(t *testing.T) {
 				`},
 		expectedErr: "Serf Advertise WAN address 10.0.0.1:1000 already configured for RPC Advertise",
 	})
+	run(t, testCase{
+		desc: "peering token encryption key must be a valid AES key length",
+		args: []string{
+			`-data-dir=` + dataDir,
+		},
+		json: []string{`{
+					"peering": { "token_encryption_key": "c2hvcnQ=" }
+				}`},
+		hcl: []string{`
+					peering = { token_encryption_key = "c2hvcnQ=" }
+				`},
+		expectedErr: "peering: Peering token encryption key must be 16, 24 or 32 bytes long, got 5 bytes",
+	})
+	run(t, testCase{
+		desc: "peering token encryption key must be base64 encoded",
+		args: []string{
+			`-data-dir=` + dataDir,
+		},
+		json: []string{`{
+					"peering": { "token_encryption_key": "not base64" }
+				}`},
+		hcl: []string{`
+					peering = { token_encryption_key = "not base64" }
+				`},
+		expectedErr: "peering.token_encryption_key must be base64 encoded",
+	})
+	run(t, testCase{
+		desc: "peering trust domain mismatch policy must be known",
+		args: []string{
+			`-data-dir=` + dataDir,
+		},
+		json: []string{`{
+					"peering": { "trust_domain_mismatch_policy": "ignore" }
+				}`},
+		hcl: []string{`
+					peering = { trust_domain_mismatch_policy = "ignore" }
+				`},
+		expectedErr: "peering: Unsupported peering trust domain mismatch policy: ignore",
+	})
 	run(t, testCase{
 		desc: "http use_cache defaults to true",
 		args: []string{
@@ -6518,6 +6557,35 @@ func TestLoad_FullConfig(t *testing.T) {
 		},
 		RaftBoltDBConfig:                 consul.RaftBoltDBConfig{NoFreelistSync: true},
 		AutoReloadConfigCoalesceInterval: 1 * time.Second,
+		PeeringMeshGatewayTaggedAddress:  "Ieb6ohph",
+		PeeringMeshGatewayIncludeWarning: true,
+		PeeringServerPortPrecedence:      "plain-first",
+		PeeringExcludeLocalServerAddress: true,
+		PeeringMaxServerAddresses:        3621,
+		PeeringMaxPerPartition:           2863,
+		PeeringWriteRate:                 7394.43,
+		PeeringWriteBurst:                8719,
+		PeeringIdempotencyKeyTTL:         5167 * time.Second,
+		PeeringTokenChecksum:             true,
+		PeeringTokenVerifyEncoding:       true,
+		PeeringTokenLogFingerprint:       true,
+		PeeringDedupeCatalogRegister:     true,
+		PeeringTokenTTL:                  3472 * time.Second,
+		PeeringTokenEnforceExpiry:        true,
+		PeeringTokenCompression:          true,
+		PeeringTokenEncryptionKey:        "ZWVjaGFpMWVpbmdlaTZVYQ==",
+		PeeringImportLimits: consul.PeeringImportLimits{
+			MaxServiceTags:      8391,
+			MaxServiceMetaBytes: 2241,
+			MaxChecks:           5907,
+		},
+		PeeringOperatorContact:           "Ooh4uv3s",
+		PeeringClusterName:               "aiG9oosh",
+		PeeringCARootsMaxStale:           6118 * time.Second,
+		PeeringServerAddressesCacheTTL:   4283 * time.Second,
+		PeeringLeaderAddressMaxWait:      9124 * time.Second,
+		PeeringTrustDomainMismatchPolicy: "warn-and-update",
+		PeeringLegacyTrustDomains:        []string{"Choh3pei", "ue8Aitho"},
 	}
 	entFullRuntimeConfig(expected)
 
@@ -315,6 +315,35 @@ non_voting_server = true
 partition = ""
 peering {
     enabled = true
+    mesh_gateway_tagged_address = "Ieb6ohph"
+    mesh_gateway_include_warning = true
+    server_port_precedence = "plain-first"
+    exclude_local_server_address = true
+    max_server_addresses = 3621
+    max_per_partition = 2863
+    write_rate = 7394.43
+    write_burst = 8719
+    idempotency_key_ttl = "5167s"
+    token_checksum = true
+    token_verify_encoding = true
+    token_log_fingerprint = true
+    dedupe_catalog_register = true
+    token_ttl = "3472s"
+    token_enforce_expiry = true
+    token_compression = true
+    token_encryption_key = "ZWVjaGFpMWVpbmdlaTZVYQ=="
+    import_limits {
+        max_service_tags = 8391
+        max_service_meta_bytes = 2241
+        max_checks = 5907
+    }
+    operator_contact = "Ooh4uv3s"
+    cluster_name = "aiG9oosh"
+    ca_roots_max_stale = "6118s"
+    server_addresses_cache_ttl = "4283s"
+    leader_address_max_wait = "9124s"
+    trust_domain_mismatch_policy = "warn-and-update"
+    legacy_trust_domains = ["Choh3pei", "ue8Aitho"]
 }
 performance {
     leave_drain_time = "8265s"
@@ -404,6 +404,124 @@ type Config struct {
 
 	PeeringTestAllowPeerRegistrations bool
 
+	// PeeringMeshGatewayTaggedAddress is the key of the service tagged
+	// address used when embedding mesh gateway addresses into peering
+	// tokens. When unset, or when a gateway does not have the tagged
+	// address, the gateway's best WAN address is used.
+	PeeringMeshGatewayTaggedAddress string
+
+	// PeeringMeshGatewayIncludeWarning includes mesh gateways with warning
+	// health checks in peering tokens. Gateways with critical checks are
+	// always left out.
+	PeeringMeshGatewayIncludeWarning bool
+
+	// PeeringServerPortPrecedence controls whether the TLS or plain-text gRPC
+	// port of each server is embedded into peering tokens. Defaults to
+	// preferring the TLS port.
+	PeeringServerPortPrecedence PeeringPortPrecedence
+
+	// PeeringExcludeLocalServerAddress omits this server's own address from
+	// the server addresses embedded into peering tokens.
+	PeeringExcludeLocalServerAddress bool
+
+	// PeeringMaxServerAddresses limits the number of server addresses
+	// embedded in peering tokens, preferring voters and TLS-enabled servers.
+	// Zero means unlimited.
+	PeeringMaxServerAddresses int
+
+	// PeeringMaxPerPartition limits the number of active peerings in each
+	// partition. Zero means unlimited.
+	PeeringMaxPerPartition int
+
+	// PeeringWriteRate is the sustained number of writes per second allowed
+	// for each peering, and PeeringWriteBurst the number allowed at once. They
+	// stop a misbehaving client from flooding raft with writes for a single
+	// peering. A zero PeeringWriteRate disables the limit.
+	PeeringWriteRate  rate.Limit
+	PeeringWriteBurst int
+
+	// PeeringIdempotencyKeyTTL is how long the key of a successful
+	// PeeringWrite is remembered, so that retries with the same key are not
+	// applied again. Keys are kept in memory on the leader only. Zero
+	// disables idempotency keys.
+	PeeringIdempotencyKeyTTL time.Duration
+
+	// PeeringTokenChecksum appends a short checksum to generated peering
+	// tokens so that truncated or altered tokens are detected on decode.
+	PeeringTokenChecksum bool
+
+	// PeeringTokenVerifyEncoding makes EncodeToken decode each token it
+	// generates and fail if the result differs from the input, to catch
+	// fields that are lost by the token codec.
+	PeeringTokenVerifyEncoding bool
+
+	// PeeringTokenLogFingerprint logs the fingerprint of each generated
+	// peering token, so that a leaked token can be traced back to when and for
+	// which peering it was generated without logging the token itself.
+	PeeringTokenLogFingerprint bool
+
+	// PeeringDedupeCatalogRegister skips registrations imported from a peer
+	// that are identical to the last one applied for the same node and
+	// service, to avoid redundant raft applies when peer streams reconnect and
+	// replay their catalog.
+	PeeringDedupeCatalogRegister bool
+
+	// PeeringTokenTTL stamps generated peering tokens with an expiry this
+	// long after they are issued. Zero means tokens do not expire.
+	PeeringTokenTTL time.Duration
+
+	// PeeringTokenEnforceExpiry rejects peering tokens whose expiry has
+	// passed when they are decoded. Tokens without an expiry are accepted.
+	PeeringTokenEnforceExpiry bool
+
+	// PeeringTokenCompression gzips generated peering tokens that are large
+	// enough to benefit, such as those carrying many CA roots or addresses.
+	// Compressed tokens are always accepted on decode.
+	PeeringTokenCompression bool
+
+	// PeeringTokenEncryptionKey, when set, AES-GCM-encrypts the payload of
+	// generated peering tokens. It must be 16, 24 or 32 bytes long, and the
+	// dialing cluster must be configured with the same key to decode them.
+	// Unencrypted tokens are still accepted on decode.
+	PeeringTokenEncryptionKey []byte
+
+	// PeeringImportLimits bounds the size of catalog registrations imported
+	// from peers.
+	PeeringImportLimits PeeringImportLimits
+
+	// PeeringOperatorContact is embedded in generated peering tokens to tell
+	// the accepting operator who to contact about this cluster.
+	PeeringOperatorContact string
+
+	// PeeringClusterName is a human-readable name for this cluster that is
+	// embedded in generated peering tokens for display.
+	PeeringClusterName string
+
+	// PeeringCARootsMaxStale allows peering operations to use CA roots read
+	// up to this long ago while fresh roots are fetched in the background.
+	// Zero disables stale reads.
+	PeeringCARootsMaxStale time.Duration
+
+	// PeeringServerAddressesCacheTTL is how long the addresses returned by
+	// GetServerAddresses are reused before the catalog is read again. Zero
+	// disables caching.
+	PeeringServerAddressesCacheTTL time.Duration
+
+	// PeeringLeaderAddressMaxWait caps the backoff between checks for a
+	// leader address in WaitForLeaderAddress. Zero uses a default of one
+	// second.
+	PeeringLeaderAddressMaxWait time.Duration
+
+	// PeeringTrustDomainMismatchPolicy controls whether a trust bundle from a
+	// peer with an unexpected trust domain is rejected (the default) or
+	// accepted with a warning.
+	PeeringTrustDomainMismatchPolicy PeeringTrustDomainMismatchPolicy
+
+	// PeeringLegacyTrustDomains lists previous trust domains of this cluster
+	// whose peering server names should still be accepted while migrating
+	// to a new CA.
+	PeeringLegacyTrustDomains []string
+
 	// Embedded Consul Enterprise specific configuration
 	*EnterpriseConfig
 }
@@ -419,6 +537,27 @@ func (c *Config) CheckProtocolVersion() error {
 	return nil
 }
 
+// CheckPeering validates the peering configuration.
+func (c *Config) CheckPeering() error {
+	switch len(c.PeeringTokenEncryptionKey) {
+	case 0, 16, 24, 32:
+	default:
+		return fmt.Errorf("Peering token encryption key must be 16, 24 or 32 bytes long, got %d bytes", len(c.PeeringTokenEncryptionKey))
+	}
+	if _, err := c.PeeringServerPortPrecedence.metaKeys(); err != nil {
+		return err
+	}
+	switch c.PeeringTrustDomainMismatchPolicy {
+	case "", PeeringTrustDomainMismatchReject, PeeringTrustDomainMismatchWarn:
+	default:
+		return fmt.Errorf("Unsupported peering trust domain mismatch policy: %s", c.PeeringTrustDomainMismatchPolicy)
+	}
+	if c.PeeringWriteRate < 0 || c.PeeringWriteBurst < 0 {
+		return fmt.Errorf("Peering write rate and burst must not be negative")
+	}
+	return nil
+}
+
 // CheckACL validates the ACL configuration.
 // TODO: move this to ACLResolverSettings
 func (c *Config) CheckACL() error {
@@ -521,6 +660,10 @@ func DefaultConfig() *Config {
 		MaxQueryTime:             600 * time.Second,
 
 		PeeringTestAllowPeerRegistrations: false,
+		PeeringServerAddressesCacheTTL:    time.Second,
+		PeeringWriteRate:                  10,
+		PeeringWriteBurst:                 20,
+		PeeringIdempotencyKeyTTL:          10 * time.Minute,
 
 		EnterpriseConfig: DefaultEnterpriseConfig(),
 	}
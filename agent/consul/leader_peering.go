@@ -521,7 +521,9 @@ func (s *Server) removePeeringAndData(ctx context.Context, logger hclog.Logger,
 
 	// First delete all imported data.
 	// By deleting all imported nodes we also delete all services and checks registered on them.
-	if err := s.deleteAllNodes(ctx, limiter, entMeta, peer.Name); err != nil {
+	_, err := s.deleteAllNodes(ctx, limiter, entMeta, peer.Name)
+	s.peeringBackend.forgetPeerRegistrations(peer.Name, entMeta.PartitionOrDefault())
+	if err != nil {
 		logger.Error("Failed to remove Nodes for peer", "error", err)
 		return
 	}
@@ -545,7 +547,7 @@ func (s *Server) removePeeringAndData(ctx context.Context, logger hclog.Logger,
 		Name:      peer.Name,
 		Partition: acl.PartitionOrDefault(peer.Partition),
 	}
-	_, err := s.raftApplyProtobuf(structs.PeeringDeleteType, req)
+	_, err = s.raftApplyProtobuf(structs.PeeringDeleteType, req)
 	if err != nil {
 		logger.Error("failed to apply full peering deletion", "error", err)
 		return
@@ -553,21 +555,24 @@ func (s *Server) removePeeringAndData(ctx context.Context, logger hclog.Logger,
 }
 
 // deleteAllNodes will delete all nodes in a partition or all nodes imported from a given peer name.
-func (s *Server) deleteAllNodes(ctx context.Context, limiter *rate.Limiter, entMeta acl.EnterpriseMeta, peerName string) error {
+// It returns the number of catalog entries removed: each node along with its services and checks.
+func (s *Server) deleteAllNodes(ctx context.Context, limiter *rate.Limiter, entMeta acl.EnterpriseMeta, peerName string) (int, error) {
 	// Same as ACL batch upsert size
 	nodeBatchSizeBytes := 256 * 1024
 
 	_, nodes, err := s.fsm.State().NodeDump(nil, &entMeta, peerName)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if len(nodes) == 0 {
-		return nil
+		return 0, nil
 	}
 
+	var removed int
 	i := 0
 	for {
 		var ops structs.TxnOps
+		var entries int
 		for batchSize := 0; batchSize < nodeBatchSizeBytes && i < len(nodes); i++ {
 			entry := nodes[i]
 
@@ -582,6 +587,7 @@ func (s *Server) deleteAllNodes(ctx context.Context, limiter *rate.Limiter, entM
 				},
 			}
 			ops = append(ops, &op)
+			entries += 1 + len(entry.Services) + len(entry.Checks)
 
 			// Add entries to the transaction until it reaches the max batch size
 			batchSize += len(entry.Node) + len(entry.Partition) + len(entry.PeerName)
@@ -594,19 +600,20 @@ func (s *Server) deleteAllNodes(ctx context.Context, limiter *rate.Limiter, entM
 		}
 		if len(req.Ops) > 0 {
 			if err := limiter.Wait(ctx); err != nil {
-				return err
+				return removed, err
 			}
 
 			_, err := s.raftApplyMsgpack(structs.TxnRequestType, &req)
 			if err != nil {
-				return err
+				return removed, err
 			}
+			removed += entries
 		} else {
 			break
 		}
 	}
 
-	return nil
+	return removed, nil
 }
 
 // deleteTrustBundleFromPeer deletes the trust bundle imported from a peer, if present.
@@ -1,176 +1,516 @@
 package consul
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"strconv"
 	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/go-version"
+	"golang.org/x/time/rate"
 
 	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/acl/resolver"
-	"github.com/hashicorp/consul/agent/connect"
 	"github.com/hashicorp/consul/agent/consul/state"
 	"github.com/hashicorp/consul/agent/consul/stream"
 	"github.com/hashicorp/consul/agent/grpc-external/services/peerstream"
 	"github.com/hashicorp/consul/agent/rpc/peering"
 	"github.com/hashicorp/consul/agent/structs"
-	"github.com/hashicorp/consul/ipaddr"
 	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/lib/retry"
+	"github.com/hashicorp/consul/logging"
 	"github.com/hashicorp/consul/proto/pbpeering"
 )
 
 type PeeringBackend struct {
-	// TODO(peering): accept a smaller interface; maybe just funcs from the server that we actually need: DC, IsLeader, etc
-	srv *Server
-
-	leaderAddrLock sync.RWMutex
-	leaderAddr     string
+	srv PeeringBackendServer
+
+	// logger records failures of the backend's raft applies and token
+	// operations. When nil, nothing is logged.
+	logger hclog.Logger
+
+	leaderAddrLock  sync.RWMutex
+	leaderAddr      string
+	leaderAddrSetAt time.Time
+
+	// leaderAddrMaxWait caps the backoff in WaitForLeaderAddress. Zero means
+	// defaultLeaderAddrMaxWait.
+	leaderAddrMaxWait time.Duration
+
+	// tokenChecksum controls whether EncodeToken appends a checksum to tokens.
+	// It only applies to the default codec.
+	tokenChecksum bool
+
+	// tokenVerify controls whether EncodeToken checks that its output decodes
+	// back to the token it was given.
+	tokenVerify bool
+
+	// tokenTTL is how long after issue EncodeToken sets tokens to expire. Zero
+	// means tokens are not given an expiry.
+	tokenTTL time.Duration
+
+	// tokenEnforceExpiry controls whether DecodeToken rejects expired tokens.
+	tokenEnforceExpiry bool
+
+	// tokenLogFingerprint controls whether EncodeToken logs the fingerprint
+	// of each token it generates.
+	tokenLogFingerprint bool
+
+	// timeNow is a shim for testing. When nil, time.Now is used.
+	timeNow func() time.Time
+
+	// tokenCompression controls whether the default token codec gzips large
+	// tokens. It is ignored when tokenCodec is set.
+	tokenCompression bool
+
+	// tokenEncryptionKey is the AES key the default token codec encrypts
+	// tokens with. It is ignored when tokenCodec is set.
+	tokenEncryptionKey []byte
+
+	// tokenCodec serializes peering tokens. When nil, tokens are encoded as
+	// base64-encoded JSON.
+	tokenCodec TokenCodec
+
+	// generateSecret is a shim for testing, allowing establishment secrets to
+	// be deterministic. When nil, random UUIDs are used.
+	generateSecret func() (string, error)
+
+	// generatePeeringID is a shim for testing, allowing peering IDs to be
+	// deterministic. When nil, random UUIDs are used.
+	generatePeeringID func() (string, error)
+
+	trustBundleValidatorsLock sync.RWMutex
+	trustBundleValidators     []TrustBundleValidator
+
+	// idempotentWritesLock protects idempotentWrites, which tracks the
+	// PeeringWrite calls made with an idempotency key.
+	idempotentWritesLock sync.Mutex
+	idempotentWrites     map[string]*idempotentWrite
+
+	// caRootsLock protects the last observed CA roots and the hooks to run
+	// when they change.
+	caRootsLock        sync.Mutex
+	caRootsObserved    bool
+	caRootsIndex       uint64
+	caRootsTrustDomain string
+	caRootsHooks       []CARootsChangeHook
+
+	// rootsCacheLock protects the last fetched CA roots, which are served
+	// when stale reads are allowed by PeeringCARootsMaxStale, and the CA PEMs
+	// built from them. The PEMs are discarded whenever the roots' raft index
+	// or trust domain changes.
+	rootsCacheLock        sync.Mutex
+	rootsCache            *structs.IndexedCARoots
+	rootsCacheIndex       uint64
+	rootsCacheTrustDomain string
+	rootsCacheFetched     time.Time
+	rootsCacheRefreshing  bool
+	rootsCachePEMs        []string
+
+	// establishmentsLock protects establishmentStarts, which maps the IDs of
+	// peerings that have not connected yet to the time of the first
+	// PeeringWrite seen for them, and establishmentDurations, which maps the
+	// IDs of connected peerings to how long they took to connect. Peerings
+	// are removed from both once they are deleted.
+	establishmentsLock     sync.Mutex
+	establishmentStarts    map[string]time.Time
+	establishmentDurations map[string]time.Duration
+
+	// serverAddrsCache holds recent GetServerAddresses results for up to
+	// PeeringServerAddressesCacheTTL.
+	serverAddrsCache serverAddressCache
+
+	// registrationHashesLock protects registrationHashes, which maps imported
+	// node and service instances to a hash of the last registration applied
+	// for them when PeeringDedupeCatalogRegister is enabled.
+	registrationHashesLock sync.Mutex
+	registrationHashes     map[string]uint64
+
+	// quotaLock is held while a peering write is checked against
+	// PeeringMaxPerPartition and applied, so that concurrent writes on the
+	// leader cannot both pass the quota.
+	quotaLock sync.Mutex
+
+	// writeLimitersLock protects writeLimiters, which rate limit PeeringWrite
+	// for each peering by partition and name.
+	writeLimitersLock sync.Mutex
+	writeLimiters     map[string]*peeringWriteLimiter
 }
 
+// CARootsChangeHook is called with the new trust domain and number of roots
+// after the backend observes that the CA roots have changed.
+type CARootsChangeHook func(newTrustDomain string, rootCount int)
+
+// TrustBundleValidator is run against a peer's trust bundle before it is
+// written. Returning an error aborts the write.
+type TrustBundleValidator func(*pbpeering.PeeringTrustBundle) error
+
 var _ peering.Backend = (*PeeringBackend)(nil)
 var _ peerstream.Backend = (*PeeringBackend)(nil)
 
-// NewPeeringBackend returns a peering.Backend implementation that is bound to the given server.
-func NewPeeringBackend(srv *Server) *PeeringBackend {
-	return &PeeringBackend{
-		srv: srv,
+// SelfCheck verifies that the backend was constructed with the server
+// dependencies it uses, so that embedders can detect a miswired backend at
+// startup rather than on first use. It must be called after the server has
+// finished setting up its peering components.
+func (b *PeeringBackend) SelfCheck() error {
+	switch {
+	case b.srv == nil:
+		return fmt.Errorf("peering backend has no server")
+	case b.srv.PeeringConfig() == nil:
+		return fmt.Errorf("peering backend server has no config")
+	case b.srv.PeeringState() == nil:
+		return fmt.Errorf("peering backend server has no FSM")
+	case b.srv.PeeringPublisher() == nil:
+		return fmt.Errorf("peering backend server has no event publisher")
+	case b.srv.PeeringStreamTracker() == nil:
+		return fmt.Errorf("peering backend server has no peer stream tracker")
+	}
+
+	store := b.srv.PeeringState()
+	if _, _, err := store.PeeringList(nil, *structs.NodeEnterpriseMetaInPartition(structs.WildcardSpecifier)); err != nil {
+		return fmt.Errorf("peering backend cannot read from the state store: %w", err)
 	}
+	return nil
 }
 
-// SetLeaderAddress is called on a raft.LeaderObservation in a go routine
-// in the consul server; see trackLeaderChanges()
-func (b *PeeringBackend) SetLeaderAddress(addr string) {
-	b.leaderAddrLock.Lock()
-	b.leaderAddr = addr
-	b.leaderAddrLock.Unlock()
+// PeeringBackendServer is the subset of the server used by PeeringBackend. It
+// is satisfied by *Server, and can be mocked to test the backend without a
+// running server.
+type PeeringBackendServer interface {
+	IsLeader() bool
+	InPrimaryDatacenter() bool
+	ResolveTokenAndDefaultMeta(token string, entMeta *acl.EnterpriseMeta, authzCtx *acl.AuthorizerContext) (resolver.Result, error)
+
+	// PeeringCARoots returns the cluster's current CA roots.
+	PeeringCARoots() (*structs.IndexedCARoots, error)
+
+	// PeeringRaftApply applies a protobuf message through raft.
+	PeeringRaftApply(t structs.MessageType, msg interface{}) (interface{}, error)
+
+	// PeeringLeaderRaftApply applies a message through raft on behalf of the
+	// named RPC method, as the leader does for its own writes.
+	PeeringLeaderRaftApply(method string, t structs.MessageType, msg interface{}) (interface{}, error)
+
+	// PeeringDeleteNodes deletes the nodes imported from peerName, at the rate
+	// allowed by limiter, and returns the number of catalog entries removed.
+	PeeringDeleteNodes(ctx context.Context, limiter *rate.Limiter, entMeta acl.EnterpriseMeta, peerName string) (int, error)
+
+	// PeeringWriteCASSupported reports whether every server in the datacenter
+	// checks the ExpectedModifyIndex of peering writes, so that a
+	// check-and-set write is applied the same way by all of them.
+	PeeringWriteCASSupported() bool
+
+	PeeringConfig() *Config
+	PeeringState() *state.Store
+	PeeringPublisher() PeeringEventPublisher
+	PeeringStreamTracker() PeeringStreamTracker
+	PeeringLogger() hclog.Logger
+	PeeringGRPCServerUseTLS() bool
 }
 
-// GetLeaderAddress provides the best hint for the current address of the
-// leader. There is no guarantee that this is the actual address of the
-// leader.
-func (b *PeeringBackend) GetLeaderAddress() string {
-	b.leaderAddrLock.RLock()
-	defer b.leaderAddrLock.RUnlock()
-	return b.leaderAddr
+// PeeringEventPublisher is the part of the server's event publisher used by
+// PeeringBackend.
+type PeeringEventPublisher interface {
+	Subscribe(req *stream.SubscribeRequest) (*stream.Subscription, error)
 }
 
-// GetTLSMaterials returns the TLS materials for the dialer to dial the acceptor using TLS.
-// It returns the server name to validate, and the CA certificate to validate with.
-func (b *PeeringBackend) GetTLSMaterials(generatingToken bool) (string, []string, error) {
-	if generatingToken {
-		if !b.srv.config.ConnectEnabled {
-			return "", nil, fmt.Errorf("connect.enabled must be set to true in the server's configuration when generating peering tokens")
-		}
-		if b.srv.config.GRPCTLSPort <= 0 && !b.srv.tlsConfigurator.GRPCServerUseTLS() {
-			return "", nil, fmt.Errorf("TLS for gRPC must be enabled when generating peering tokens")
-		}
+// PeeringStreamTracker is the part of the peer stream tracker used by
+// PeeringBackend.
+type PeeringStreamTracker interface {
+	StreamStatus(id string) (peerstream.Status, bool)
+	IsHealthy(s peerstream.Status) bool
+	Throughput(window time.Duration) (inBps, outBps float64)
+}
+
+// streamTracker returns the server's peer stream tracker. Until the server
+// has one it returns a tracker that knows of no streams, so that reads made
+// before setup finishes report peerings as disconnected rather than panic.
+func (b *PeeringBackend) streamTracker() PeeringStreamTracker {
+	if tracker := b.srv.PeeringStreamTracker(); tracker != nil {
+		return tracker
 	}
+	return noStreamTracker{}
+}
 
-	roots, err := b.srv.getCARoots(nil, b.srv.fsm.State())
-	if err != nil {
-		return "", nil, fmt.Errorf("failed to fetch roots: %w", err)
+// noStreamTracker is the PeeringStreamTracker used when the server has none.
+type noStreamTracker struct{}
+
+func (noStreamTracker) StreamStatus(string) (peerstream.Status, bool) {
+	return peerstream.Status{}, false
+}
+func (noStreamTracker) IsHealthy(peerstream.Status) bool            { return false }
+func (noStreamTracker) Throughput(time.Duration) (float64, float64) { return 0, 0 }
+
+var _ PeeringBackendServer = (*Server)(nil)
+
+func (s *Server) PeeringCARoots() (*structs.IndexedCARoots, error) {
+	return s.getCARoots(nil, s.PeeringState())
+}
+
+// minPeeringWriteCASVersion is the first version whose state store checks the
+// ExpectedModifyIndex of peering writes.
+var minPeeringWriteCASVersion = version.Must(version.NewVersion("1.14.0"))
+
+func (s *Server) PeeringWriteCASSupported() bool {
+	ok, _ := ServersInDCMeetMinimumVersion(s, s.config.Datacenter, minPeeringWriteCASVersion)
+	return ok
+}
+
+func (s *Server) PeeringRaftApply(t structs.MessageType, msg interface{}) (interface{}, error) {
+	return s.raftApplyProtobuf(t, msg)
+}
+
+func (s *Server) PeeringLeaderRaftApply(method string, t structs.MessageType, msg interface{}) (interface{}, error) {
+	return s.leaderRaftApply(method, t, msg)
+}
+
+func (s *Server) PeeringDeleteNodes(ctx context.Context, limiter *rate.Limiter, entMeta acl.EnterpriseMeta, peerName string) (int, error) {
+	return s.deleteAllNodes(ctx, limiter, entMeta, peerName)
+}
+
+func (s *Server) PeeringConfig() *Config {
+	return s.config
+}
+
+func (s *Server) PeeringState() *state.Store {
+	if s.fsm == nil {
+		return nil
 	}
-	if len(roots.Roots) == 0 || roots.TrustDomain == "" {
-		return "", nil, fmt.Errorf("CA has not finished initializing")
+	return s.fsm.State()
+}
+
+func (s *Server) PeeringPublisher() PeeringEventPublisher {
+	if s.publisher == nil {
+		return nil
 	}
+	return s.publisher
+}
 
-	serverName := connect.PeeringServerSAN(b.srv.config.Datacenter, roots.TrustDomain)
+func (s *Server) PeeringStreamTracker() PeeringStreamTracker {
+	if s.peerStreamServer == nil || s.peerStreamServer.Tracker == nil {
+		return nil
+	}
+	return s.peerStreamServer.Tracker
+}
+
+func (s *Server) PeeringLogger() hclog.Logger {
+	return s.loggers.Named(logging.Peering)
+}
 
-	var caPems []string
-	for _, r := range roots.Roots {
-		caPems = append(caPems, lib.EnsureTrailingNewline(r.RootCert))
+func (s *Server) PeeringGRPCServerUseTLS() bool {
+	return s.tlsConfigurator.GRPCServerUseTLS()
+}
+
+// NewPeeringBackend returns a peering.Backend implementation that is bound to the given server.
+func NewPeeringBackend(srv PeeringBackendServer) *PeeringBackend {
+	return &PeeringBackend{
+		srv:                 srv,
+		logger:              srv.PeeringLogger(),
+		tokenChecksum:       srv.PeeringConfig().PeeringTokenChecksum,
+		tokenCompression:    srv.PeeringConfig().PeeringTokenCompression,
+		tokenEncryptionKey:  srv.PeeringConfig().PeeringTokenEncryptionKey,
+		tokenVerify:         srv.PeeringConfig().PeeringTokenVerifyEncoding,
+		tokenTTL:            srv.PeeringConfig().PeeringTokenTTL,
+		tokenEnforceExpiry:  srv.PeeringConfig().PeeringTokenEnforceExpiry,
+		tokenLogFingerprint: srv.PeeringConfig().PeeringTokenLogFingerprint,
+		leaderAddrMaxWait:   srv.PeeringConfig().PeeringLeaderAddressMaxWait,
 	}
+}
 
-	return serverName, caPems, nil
+func (b *PeeringBackend) log() hclog.Logger {
+	if b.logger == nil {
+		return hclog.NewNullLogger()
+	}
+	return b.logger
 }
 
-// GetServerAddresses looks up server or mesh gateway addresses from the state store.
-func (b *PeeringBackend) GetServerAddresses() ([]string, error) {
-	_, rawEntry, err := b.srv.fsm.State().ConfigEntry(nil, structs.MeshConfig, structs.MeshConfigMesh, acl.DefaultEnterpriseMeta())
-	if err != nil {
-		return nil, fmt.Errorf("failed to read mesh config entry: %w", err)
+func (b *PeeringBackend) now() time.Time {
+	if b.timeNow == nil {
+		return time.Now()
 	}
+	return b.timeNow()
+}
 
-	meshConfig, ok := rawEntry.(*structs.MeshConfigEntry)
-	if ok && meshConfig.Peering != nil && meshConfig.Peering.PeerThroughMeshGateways {
-		return meshGatewayAdresses(b.srv.fsm.State())
+// SetLeaderAddress is called on a raft.LeaderObservation in a go routine
+// in the consul server; see trackLeaderChanges()
+// Malformed addresses are logged and ignored, while an empty address
+// records that the leader is unknown.
+func (b *PeeringBackend) SetLeaderAddress(addr string) {
+	if addr != "" {
+		if err := ValidateLeaderAddress(addr); err != nil {
+			b.log().Warn("ignoring malformed leader address", "address", addr, "error", err)
+			return
+		}
 	}
-	return serverAddresses(b.srv.fsm.State())
+
+	b.leaderAddrLock.Lock()
+	b.leaderAddr = addr
+	b.leaderAddrSetAt = time.Now()
+	b.leaderAddrLock.Unlock()
+}
+
+// ValidateLeaderAddress checks that addr is a host:port pair with a valid port.
+func ValidateLeaderAddress(addr string) error {
+	return validateHostPort(addr)
 }
 
-func meshGatewayAdresses(state *state.Store) ([]string, error) {
-	_, nodes, err := state.ServiceDump(nil, structs.ServiceKindMeshGateway, true, acl.DefaultEnterpriseMeta(), structs.DefaultPeerKeyword)
+// validateHostPort checks that addr is a host:port pair with a valid port.
+func validateHostPort(addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dump gateway addresses: %w", err)
+		return err
 	}
-
-	var addrs []string
-	for _, node := range nodes {
-		_, addr, port := node.BestAddress(true)
-		addrs = append(addrs, ipaddr.FormatAddressPort(addr, port))
+	if host == "" {
+		return fmt.Errorf("address %q is missing a host", addr)
 	}
-	if len(addrs) == 0 {
-		return nil, fmt.Errorf("servers are configured to PeerThroughMeshGateways, but no mesh gateway instances are registered")
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("address %q has an invalid port", addr)
 	}
-	return addrs, nil
+	return nil
 }
 
-func serverAddresses(state *state.Store) ([]string, error) {
-	_, nodes, err := state.ServiceNodes(nil, "consul", structs.DefaultEnterpriseMetaInDefaultPartition(), structs.DefaultPeerKeyword)
-	if err != nil {
-		return nil, err
+// GetLeaderAddress provides the best hint for the current address of the
+// leader. There is no guarantee that this is the actual address of the
+// leader.
+func (b *PeeringBackend) GetLeaderAddress() string {
+	b.leaderAddrLock.RLock()
+	defer b.leaderAddrLock.RUnlock()
+	return b.leaderAddr
+}
+
+// defaultLeaderAddrMaxWait is the longest WaitForLeaderAddress waits between
+// checks for a leader address when PeeringLeaderAddressMaxWait is unset.
+const defaultLeaderAddrMaxWait = time.Second
+
+// WaitForLeaderAddress returns the leader address hint as soon as one is
+// known. During leadership gaps it checks again with exponential backoff,
+// starting at 10ms and capped at PeeringLeaderAddressMaxWait, until an address
+// is set or ctx is done, in which case the context's error is returned.
+func (b *PeeringBackend) WaitForLeaderAddress(ctx context.Context) (string, error) {
+	maxWait := b.leaderAddrMaxWait
+	if maxWait <= 0 {
+		maxWait = defaultLeaderAddrMaxWait
 	}
-	var addrs []string
-	for _, node := range nodes {
-		// Prefer the TLS port if it is defined.
-		grpcPortStr := node.ServiceMeta["grpc_tls_port"]
-		if v, err := strconv.Atoi(grpcPortStr); err == nil && v > 0 {
-			addrs = append(addrs, node.Address+":"+grpcPortStr)
-			continue
+	waiter := &retry.Waiter{
+		MinWait: 10 * time.Millisecond,
+		MaxWait: maxWait,
+		Factor:  10 * time.Millisecond,
+		Jitter:  retry.NewJitter(10),
+	}
+	for {
+		if addr := b.GetLeaderAddress(); addr != "" {
+			return addr, nil
 		}
-		// Fallback to the standard port if TLS is not defined.
-		grpcPortStr = node.ServiceMeta["grpc_port"]
-		if v, err := strconv.Atoi(grpcPortStr); err == nil && v > 0 {
-			addrs = append(addrs, node.Address+":"+grpcPortStr)
-			continue
+		if err := waiter.Wait(ctx); err != nil {
+			return "", err
 		}
-		// Skip node if neither defined.
 	}
-	if len(addrs) == 0 {
-		return nil, fmt.Errorf("a grpc bind port must be specified in the configuration for all servers")
-	}
-	return addrs, nil
 }
 
-// EncodeToken encodes a peering token as a bas64-encoded representation of JSON (for now).
-func (b *PeeringBackend) EncodeToken(tok *structs.PeeringToken) ([]byte, error) {
-	jsonToken, err := json.Marshal(tok)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal token: %w", err)
+// GetLeaderAddressWithAge returns the same hint as GetLeaderAddress along
+// with how long ago it was set, so callers can decide whether it is fresh
+// enough to trust. The age is zero if the hint has never been set.
+func (b *PeeringBackend) GetLeaderAddressWithAge() (string, time.Duration) {
+	b.leaderAddrLock.RLock()
+	defer b.leaderAddrLock.RUnlock()
+	if b.leaderAddrSetAt.IsZero() {
+		return b.leaderAddr, 0
 	}
-	return []byte(base64.StdEncoding.EncodeToString(jsonToken)), nil
+	return b.leaderAddr, time.Since(b.leaderAddrSetAt)
+}
+
+func (s *PeeringBackend) Subscribe(req *stream.SubscribeRequest) (*stream.Subscription, error) {
+	return s.srv.PeeringPublisher().Subscribe(req)
+}
+
+// ResubscribeEvent is delivered by SubscribeWithResubscribe. Exactly one of
+// its fields is set.
+type ResubscribeEvent struct {
+	// Event is an event received from the subscription, including framing
+	// events such as the end of a snapshot.
+	Event stream.Event
+
+	// Reset is set when the server closed the subscription and it has been
+	// re-established. The consumer must discard any state built from earlier
+	// events, since a new snapshot follows.
+	Reset bool
+
+	// Err is set on the last event before the channel is closed when the
+	// subscription ends for any reason other than ctx being done.
+	Err error
 }
 
-// DecodeToken decodes a peering token from a base64-encoded JSON byte array (for now).
-func (b *PeeringBackend) DecodeToken(tokRaw []byte) (*structs.PeeringToken, error) {
-	tokJSONRaw, err := base64.StdEncoding.DecodeString(string(tokRaw))
+// SubscribeWithResubscribe subscribes like Subscribe but transparently
+// re-subscribes whenever the server force closes the subscription, such as
+// after a snapshot restore, sending a Reset event so the consumer can reload
+// its state. Events are delivered on the returned channel, which is closed
+// once ctx is done or the subscription fails for another reason.
+func (b *PeeringBackend) SubscribeWithResubscribe(ctx context.Context, req *stream.SubscribeRequest) (<-chan ResubscribeEvent, error) {
+	sub, err := b.Subscribe(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode token: %w", err)
-	}
-	var tok structs.PeeringToken
-	if err := json.Unmarshal(tokJSONRaw, &tok); err != nil {
 		return nil, err
 	}
-	return &tok, nil
+	events := make(chan ResubscribeEvent)
+	go b.resubscribeLoop(ctx, *req, sub, events)
+	return events, nil
 }
 
-func (s *PeeringBackend) Subscribe(req *stream.SubscribeRequest) (*stream.Subscription, error) {
-	return s.srv.publisher.Subscribe(req)
+func (b *PeeringBackend) resubscribeLoop(ctx context.Context, req stream.SubscribeRequest, sub *stream.Subscription, events chan<- ResubscribeEvent) {
+	defer close(events)
+
+	send := func(e ResubscribeEvent) bool {
+		select {
+		case events <- e:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		event, err := sub.Next(ctx)
+		switch {
+		case errors.Is(err, stream.ErrSubForceClosed):
+			sub.Unsubscribe()
+			b.log().Trace("subscription reset by server, resubscribing", "topic", req.Topic)
+
+			// The server closed the subscription because its view is no
+			// longer valid, so start over from a new snapshot.
+			req.Index = 0
+			sub, err = b.Subscribe(&req)
+			if err != nil {
+				send(ResubscribeEvent{Err: err})
+				return
+			}
+			if !send(ResubscribeEvent{Reset: true}) {
+				sub.Unsubscribe()
+				return
+			}
+			continue
+
+		case err != nil:
+			sub.Unsubscribe()
+			if ctx.Err() == nil {
+				send(ResubscribeEvent{Err: err})
+			}
+			return
+		}
+
+		if !send(ResubscribeEvent{Event: event}) {
+			sub.Unsubscribe()
+			return
+		}
+	}
 }
 
 func (b *PeeringBackend) Store() peering.Store {
-	return b.srv.fsm.State()
+	return b.srv.PeeringState()
 }
 
 func (b *PeeringBackend) EnterpriseCheckPartitions(partition string) error {
@@ -181,12 +521,18 @@ func (b *PeeringBackend) EnterpriseCheckNamespaces(namespace string) error {
 	return b.enterpriseCheckNamespaces(namespace)
 }
 
+// EnsureImportNamespace checks that the namespace that imported data is
+// routed to exists in the partition described by entMeta.
+func (b *PeeringBackend) EnsureImportNamespace(namespace string, entMeta *acl.EnterpriseMeta) error {
+	return b.enterpriseEnsureImportNamespace(namespace, entMeta)
+}
+
 func (b *PeeringBackend) IsLeader() bool {
 	return b.srv.IsLeader()
 }
 
 func (b *PeeringBackend) CheckPeeringUUID(id string) (bool, error) {
-	state := b.srv.fsm.State()
+	state := b.srv.PeeringState()
 	if _, existing, err := state.PeeringReadByID(nil, id); err != nil {
 		return false, err
 	} else if existing != nil {
@@ -196,39 +542,63 @@ func (b *PeeringBackend) CheckPeeringUUID(id string) (bool, error) {
 	return true, nil
 }
 
-func (b *PeeringBackend) ValidateProposedPeeringSecret(id string) (bool, error) {
-	return b.srv.fsm.State().ValidateProposedPeeringSecretUUID(id)
-}
-
-func (b *PeeringBackend) PeeringSecretsWrite(req *pbpeering.SecretsWriteRequest) error {
-	_, err := b.srv.raftApplyProtobuf(structs.PeeringSecretsWriteType, req)
-	return err
-}
-
-func (b *PeeringBackend) PeeringWrite(req *pbpeering.PeeringWriteRequest) error {
-	_, err := b.srv.raftApplyProtobuf(structs.PeeringWriteType, req)
-	return err
-}
-
-// TODO(peering): This needs RPC metrics interceptor since it's not triggered by an RPC.
-func (b *PeeringBackend) PeeringTerminateByID(req *pbpeering.PeeringTerminateByIDRequest) error {
-	_, err := b.srv.raftApplyProtobuf(structs.PeeringTerminateByIDType, req)
-	return err
+// maxPeeringIDAttempts bounds how many peering IDs GenerateUniquePeeringID
+// generates before giving up. A collision between random UUIDs is all but
+// impossible, so hitting the limit indicates a broken ID generator.
+const maxPeeringIDAttempts = 5
+
+// GenerateUniquePeeringID returns a new UUID that is not the ID of any
+// existing peering.
+func (b *PeeringBackend) GenerateUniquePeeringID() (string, error) {
+	generate := b.generatePeeringID
+	if generate == nil {
+		generate = uuid.GenerateUUID
+	}
+	return generateUniquePeeringID(generate, b.CheckPeeringUUID)
 }
 
-func (b *PeeringBackend) PeeringTrustBundleWrite(req *pbpeering.PeeringTrustBundleWriteRequest) error {
-	_, err := b.srv.raftApplyProtobuf(structs.PeeringTrustBundleWriteType, req)
-	return err
+func generateUniquePeeringID(generate func() (string, error), check lib.UUIDCheckFunc) (string, error) {
+	for i := 0; i < maxPeeringIDAttempts; i++ {
+		id, err := generate()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate peering ID: %w", err)
+		}
+		ok, err := check(id)
+		if err != nil {
+			return "", fmt.Errorf("failed to check peering ID: %w", err)
+		}
+		if ok {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate a unique peering ID after %d attempts", maxPeeringIDAttempts)
 }
 
-func (b *PeeringBackend) CatalogRegister(req *structs.RegisterRequest) error {
-	_, err := b.srv.leaderRaftApply("Catalog.Register", structs.RegisterRequestType, req)
-	return err
+// CheckPeeringReadPermission returns an error if the token is not allowed to
+// read peering data in the partition described by entMeta. Peering ACLs are not
+// scoped by peer name, so the same rule applies to every peering in the partition.
+func (b *PeeringBackend) CheckPeeringReadPermission(token string, entMeta *acl.EnterpriseMeta) error {
+	var authzCtx acl.AuthorizerContext
+	authz, err := b.ResolveTokenAndDefaultMeta(token, entMeta, &authzCtx)
+	if err != nil {
+		return err
+	}
+	return authz.ToAllowAuthorizer().PeeringReadAllowed(&authzCtx)
 }
 
-func (b *PeeringBackend) CatalogDeregister(req *structs.DeregisterRequest) error {
-	_, err := b.srv.leaderRaftApply("Catalog.Deregister", structs.DeregisterRequestType, req)
-	return err
+// peeringReadable reports whether the token may read the given peering. It
+// is used by reads that span partitions to leave out the peerings the token
+// cannot see.
+func (b *PeeringBackend) peeringReadable(token string, peering *pbpeering.Peering) (bool, error) {
+	err := b.CheckPeeringReadPermission(token, structs.DefaultEnterpriseMetaInPartition(peering.PartitionOrDefault()))
+	switch {
+	case err == nil:
+		return true, nil
+	case acl.IsErrPermissionDenied(err):
+		return false, nil
+	default:
+		return false, err
+	}
 }
 
 func (b *PeeringBackend) ResolveTokenAndDefaultMeta(token string, entMeta *acl.EnterpriseMeta, authzCtx *acl.AuthorizerContext) (resolver.Result, error) {
@@ -0,0 +1,701 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/ipaddr"
+)
+
+// GetServerAddresses looks up server or mesh gateway addresses from the state store.
+func (b *PeeringBackend) GetServerAddresses() ([]string, error) {
+	return b.GetServerAddressesCtx(context.Background())
+}
+
+// GetServerAddressesForPartition is like GetServerAddressesCtx but discovers
+// the servers visible to the given partition. Every partition goes through
+// the same address cache, ServerAddressDNSName handling and logging as
+// GetServerAddresses. When peering through mesh gateways, preferWAN selects
+// the gateways' WAN addresses over their LAN addresses, as for
+// GetMeshGatewayAddresses.
+func (b *PeeringBackend) GetServerAddressesForPartition(ctx context.Context, partition string, preferWAN bool) ([]string, error) {
+	entMeta, err := b.serverAddressesEnterpriseMeta(partition)
+	if err != nil {
+		return nil, err
+	}
+	return serverAddrs(b.serverAddressesWithTLSCtx(ctx, entMeta, preferWAN))
+}
+
+// GetServerAddressesCtx is like GetServerAddresses but stops early with the
+// context's error if ctx is canceled.
+func (b *PeeringBackend) GetServerAddressesCtx(ctx context.Context) ([]string, error) {
+	return serverAddrs(b.serverAddressesWithTLSCtx(ctx, structs.DefaultEnterpriseMetaInDefaultPartition(), true))
+}
+
+// serverAddrs returns the addresses of servers, passing through err.
+func serverAddrs(servers []ServerAddress, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(servers))
+	for _, s := range servers {
+		addrs = append(addrs, s.Addr)
+	}
+	return addrs, nil
+}
+
+// serverAddressesWithTLSCtx discovers the addresses of the servers visible to
+// the partition of entMeta for GetServerAddressesCtx,
+// GetServerAddressesForPartition and GetServerAddressesWithTLS, so that they
+// share the address cache and log why peering goes directly to servers.
+// preferWAN only applies when peering through mesh gateways.
+func (b *PeeringBackend) serverAddressesWithTLSCtx(ctx context.Context, entMeta *acl.EnterpriseMeta, preferWAN bool) ([]ServerAddress, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	directReason, err := b.directPeeringReason()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	throughGateways := directReason == ""
+	partition := entMeta.PartitionOrDefault()
+	if !throughGateways {
+		b.log().Debug("peering directly to servers rather than through mesh gateways", "reason", directReason, "partition", partition)
+	}
+	key := serverAddressCacheKey{
+		partition:       partition,
+		throughGateways: throughGateways,
+		lanGateways:     throughGateways && !preferWAN,
+	}
+	servers, err := b.serverAddrsCache.get(b.srv.PeeringConfig().PeeringServerAddressesCacheTTL, key, func() ([]ServerAddress, error) {
+		if throughGateways {
+			return b.meshGatewayServerAddresses(preferWAN)
+		}
+		return b.localServerAddressesWithTLS(entMeta)
+	})
+	if err != nil {
+		b.log().Error("failed to discover peering server addresses", "through_mesh_gateways", throughGateways, "partition", partition, "error", err)
+		return nil, err
+	}
+	b.log().Debug("discovered peering server addresses", "through_mesh_gateways", throughGateways, "partition", partition, "addresses", servers)
+	return servers, nil
+}
+
+// serverAddressCache reuses the addresses returned by GetServerAddresses for
+// a short time, so that bursts of token generation don't each query the
+// catalog. Results are kept separately per partition, for peering through
+// mesh gateways and peering directly to servers, and for the gateways' WAN
+// and LAN addresses, so changing the mesh config takes effect immediately.
+// Errors are never cached.
+type serverAddressCache struct {
+	lock    sync.Mutex
+	entries map[serverAddressCacheKey]serverAddressCacheEntry
+
+	// timeNow is a shim for testing.
+	timeNow func() time.Time
+}
+
+type serverAddressCacheKey struct {
+	partition       string
+	throughGateways bool
+	lanGateways     bool
+}
+
+type serverAddressCacheEntry struct {
+	addrs   []ServerAddress
+	fetched time.Time
+}
+
+func (c *serverAddressCache) now() time.Time {
+	if c.timeNow == nil {
+		return time.Now()
+	}
+	return c.timeNow()
+}
+
+// get returns the cached addresses for the given key if they were loaded less
+// than ttl ago, and otherwise calls load and caches its result. The lock is
+// held while loading so that concurrent callers share a single load.
+func (c *serverAddressCache) get(ttl time.Duration, key serverAddressCacheKey, load func() ([]ServerAddress, error)) ([]ServerAddress, error) {
+	if ttl <= 0 {
+		return load()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	if entry, ok := c.entries[key]; ok && now.Sub(entry.fetched) < ttl {
+		return append([]ServerAddress(nil), entry.addrs...), nil
+	}
+
+	addrs, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if c.entries == nil {
+		c.entries = make(map[serverAddressCacheKey]serverAddressCacheEntry)
+	}
+	c.entries[key] = serverAddressCacheEntry{addrs: addrs, fetched: now}
+	return append([]ServerAddress(nil), addrs...), nil
+}
+
+// PeerThroughMeshGateways reports whether the mesh config entry directs
+// peering traffic through mesh gateways rather than directly to servers.
+func (b *PeeringBackend) PeerThroughMeshGateways() (bool, error) {
+	reason, err := b.directPeeringReason()
+	if err != nil {
+		return false, err
+	}
+	return reason == "", nil
+}
+
+// directPeeringReason is like PeerThroughMeshGateways but explains why
+// peering traffic goes directly to servers. It returns an empty reason when
+// traffic goes through mesh gateways.
+func (b *PeeringBackend) directPeeringReason() (string, error) {
+	_, rawEntry, err := b.srv.PeeringState().ConfigEntry(nil, structs.MeshConfig, structs.MeshConfigMesh, acl.DefaultEnterpriseMeta())
+	if err != nil {
+		return "", fmt.Errorf("failed to read mesh config entry: %w", err)
+	}
+	return meshConfigDirectPeeringReason(rawEntry), nil
+}
+
+// Reasons returned by meshConfigDirectPeeringReason.
+const (
+	directPeeringNoMeshConfig    = "no mesh config entry"
+	directPeeringNoPeeringConfig = "mesh config entry has no Peering config"
+	directPeeringDisabled        = "mesh config entry sets PeerThroughMeshGateways=false"
+)
+
+func meshConfigPeersThroughGateways(rawEntry structs.ConfigEntry) bool {
+	return meshConfigDirectPeeringReason(rawEntry) == ""
+}
+
+func meshConfigDirectPeeringReason(rawEntry structs.ConfigEntry) string {
+	meshConfig, ok := rawEntry.(*structs.MeshConfigEntry)
+	switch {
+	case !ok || meshConfig == nil:
+		return directPeeringNoMeshConfig
+	case meshConfig.Peering == nil:
+		return directPeeringNoPeeringConfig
+	case !meshConfig.Peering.PeerThroughMeshGateways:
+		return directPeeringDisabled
+	}
+	return ""
+}
+
+// serverAddressDNSName returns the DNS name that the mesh config entry sets in
+// place of the servers' addresses, or an empty string if there is none.
+func (b *PeeringBackend) serverAddressDNSName() (string, error) {
+	_, rawEntry, err := b.srv.PeeringState().ConfigEntry(nil, structs.MeshConfig, structs.MeshConfigMesh, acl.DefaultEnterpriseMeta())
+	if err != nil {
+		return "", fmt.Errorf("failed to read mesh config entry: %w", err)
+	}
+	meshConfig, _ := rawEntry.(*structs.MeshConfigEntry)
+	return meshConfig.PeeringServerAddressDNSName(), nil
+}
+
+// localServerAddressesWithTLS returns the addresses peers use to dial this
+// cluster's servers directly, rather than through mesh gateways, and whether
+// each expects TLS. If the mesh config entry sets a DNS name for the servers,
+// it is returned with this server's gRPC port in place of the servers'
+// addresses from the catalog.
+func (b *PeeringBackend) localServerAddressesWithTLS(entMeta *acl.EnterpriseMeta) ([]ServerAddress, error) {
+	name, err := b.serverAddressDNSName()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		opts := b.serverAddressOptions()
+		opts.entMeta = entMeta
+		return serverAddressesWithTLS(b.srv.PeeringState(), opts)
+	}
+
+	keys, err := b.srv.PeeringConfig().PeeringServerPortPrecedence.metaKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		port, tls := b.srv.PeeringConfig().GRPCPort, false
+		if key == "grpc_tls_port" {
+			port, tls = b.srv.PeeringConfig().GRPCTLSPort, true
+		}
+		if validPort(port) {
+			return []ServerAddress{{Addr: ipaddr.FormatAddressPort(name, port), TLS: tls}}, nil
+		}
+	}
+	return nil, newPeeringTokenError(PeeringTokenErrorNoAddresses,
+		"the mesh config entry sets ServerAddressDNSName %q, but this server has no gRPC port to advertise with it", name)
+}
+
+// serverAddressOptions returns the options used to select server addresses
+// based on the server's configuration.
+func (b *PeeringBackend) serverAddressOptions() serverAddressOptions {
+	opts := serverAddressOptions{
+		portPrecedence: b.srv.PeeringConfig().PeeringServerPortPrecedence,
+		maxAddresses:   b.srv.PeeringConfig().PeeringMaxServerAddresses,
+		logger:         b.log(),
+	}
+	if b.srv.PeeringConfig().PeeringExcludeLocalServerAddress {
+		opts.excludeNode = b.srv.PeeringConfig().NodeName
+	}
+	return opts
+}
+
+// GetMeshGatewayAddresses returns the addresses of the local mesh gateways
+// that peers dial when PeerThroughMeshGateways is enabled. When preferWAN is
+// false the gateways' LAN addresses are returned instead of their WAN
+// addresses, for peers that share a network with this cluster. A configured
+// PeeringMeshGatewayTaggedAddress takes precedence over either.
+func (b *PeeringBackend) GetMeshGatewayAddresses(preferWAN bool) ([]string, error) {
+	return meshGatewayAdresses(b.srv.PeeringState(), b.meshGatewayAddressOptions(preferWAN))
+}
+
+// meshGatewayAddressOptions controls which mesh gateway addresses are
+// returned by meshGatewayAdresses.
+type meshGatewayAddressOptions struct {
+	// taggedAddrKey is the key of the service tagged address to use in
+	// preference to any other.
+	taggedAddrKey string
+
+	// preferWAN selects the gateways' WAN addresses over their LAN addresses.
+	preferWAN bool
+
+	// includeWarning includes gateways with warning health checks. Gateways
+	// with critical checks are always left out.
+	includeWarning bool
+}
+
+func (b *PeeringBackend) meshGatewayAddressOptions(preferWAN bool) meshGatewayAddressOptions {
+	return meshGatewayAddressOptions{
+		taggedAddrKey:  b.srv.PeeringConfig().PeeringMeshGatewayTaggedAddress,
+		preferWAN:      preferWAN,
+		includeWarning: b.srv.PeeringConfig().PeeringMeshGatewayIncludeWarning,
+	}
+}
+
+func meshGatewayAdresses(state *state.Store, opts meshGatewayAddressOptions) ([]string, error) {
+	gateways, err := meshGatewayAddressesDetailed(state, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(gateways))
+	for _, gw := range gateways {
+		addrs = append(addrs, gw.Address)
+	}
+	return addrs, nil
+}
+
+// MeshGatewayAddress is the address of a mesh gateway that peers can dial,
+// annotated with the datacenter it fronts.
+type MeshGatewayAddress struct {
+	Address string
+
+	// Datacenter is the datacenter of the gateway's node. It is empty when the
+	// registration does not record one.
+	Datacenter string
+}
+
+// MeshGatewayAddressesDetailed returns the addresses of the local mesh
+// gateways that peers dial when PeerThroughMeshGateways is enabled, along
+// with the datacenter each gateway fronts.
+func (b *PeeringBackend) MeshGatewayAddressesDetailed() ([]MeshGatewayAddress, error) {
+	return meshGatewayAddressesDetailed(b.srv.PeeringState(), b.meshGatewayAddressOptions(true))
+}
+
+func meshGatewayAddressesDetailed(state *state.Store, opts meshGatewayAddressOptions) ([]MeshGatewayAddress, error) {
+	_, nodes, err := state.ServiceDump(nil, structs.ServiceKindMeshGateway, true, acl.DefaultEnterpriseMeta(), structs.DefaultPeerKeyword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump gateway addresses: %w", err)
+	}
+
+	if len(nodes) == 0 {
+		return nil, newPeeringTokenError(PeeringTokenErrorNoAddresses,
+			"servers are configured to PeerThroughMeshGateways, but no mesh gateway instances are registered")
+	}
+	healthy := healthyForPeering(nodes, opts.includeWarning)
+	if len(healthy) == 0 {
+		return nil, newPeeringTokenError(PeeringTokenErrorNoAddresses,
+			fmt.Sprintf("servers are configured to PeerThroughMeshGateways, but none of the %d registered mesh gateway instances are healthy", len(nodes)))
+	}
+
+	var gateways []MeshGatewayAddress
+	seen := make(map[string]struct{})
+	for _, node := range healthy {
+		for _, addr := range meshGatewayNodeAddresses(node, opts.taggedAddrKey, opts.preferWAN) {
+			if _, ok := seen[addr]; ok {
+				continue
+			}
+			seen[addr] = struct{}{}
+			gateways = append(gateways, MeshGatewayAddress{Address: addr, Datacenter: node.Node.Datacenter})
+		}
+	}
+	sort.SliceStable(gateways, func(i, j int) bool {
+		return addressLess(gateways[i].Address, gateways[j].Address)
+	})
+	return gateways, nil
+}
+
+// healthyForPeering returns the instances whose addresses may be put in
+// peering tokens: instances with passing checks are kept, instances with
+// warning checks are kept only when includeWarning is set, and any other
+// status leaves the instance out. Mesh gateways are filtered by it alone.
+func healthyForPeering(nodes structs.CheckServiceNodes, includeWarning bool) structs.CheckServiceNodes {
+	var healthy structs.CheckServiceNodes
+	for _, node := range nodes {
+		if instanceHealthyForPeering(node.Checks, includeWarning) {
+			healthy = append(healthy, node)
+		}
+	}
+	return healthy
+}
+
+// serversForPeering is the health policy for servers. It keeps the servers
+// that healthyForPeering keeps, including those with warning checks, but if
+// that leaves nothing every server is returned: a dialer retries the servers
+// in a token, and a server that may be unreachable is more useful to it than
+// none.
+func serversForPeering(nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
+	if healthy := healthyForPeering(nodes, true); len(healthy) > 0 {
+		return healthy
+	}
+	return nodes
+}
+
+func instanceHealthyForPeering(checks structs.HealthChecks, includeWarning bool) bool {
+	for _, check := range checks {
+		switch check.Status {
+		case api.HealthPassing:
+		case api.HealthWarning:
+			if !includeWarning {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// meshGatewayNodeAddresses returns the dial candidates for a single mesh
+// gateway instance. If taggedAddrKey names one of the service's tagged
+// addresses, only that address is used. When WAN addresses are preferred,
+// only the gateway's WAN tagged addresses are used, falling back to its LAN
+// addresses if it has none. Otherwise the gateway's best LAN address is
+// followed by each of its other LAN tagged addresses, so that gateways
+// advertising several VIPs give peers more to fall back on.
+func meshGatewayNodeAddresses(node structs.CheckServiceNode, taggedAddrKey string, preferWAN bool) []string {
+	if tagged, ok := node.Service.TaggedAddresses[taggedAddrKey]; taggedAddrKey != "" && ok && tagged.Address != "" {
+		return []string{formatTaggedAddress(tagged, node.Service.Port)}
+	}
+
+	if preferWAN {
+		if addrs := meshGatewayTaggedAddresses(node, true); len(addrs) > 0 {
+			return addrs
+		}
+		if wan := node.Node.TaggedAddresses[structs.TaggedAddressWAN]; wan != "" {
+			return []string{ipaddr.FormatAddressPort(wan, node.Service.Port)}
+		}
+	}
+
+	_, addr, port := node.BestAddress(false)
+	return append([]string{ipaddr.FormatAddressPort(addr, port)}, meshGatewayTaggedAddresses(node, false)...)
+}
+
+// meshGatewayTaggedAddresses returns the WAN or the LAN tagged addresses of a
+// mesh gateway instance, ordered by key. Virtual IPs are never included.
+func meshGatewayTaggedAddresses(node structs.CheckServiceNode, wan bool) []string {
+	keys := make([]string, 0, len(node.Service.TaggedAddresses))
+	for key := range node.Service.TaggedAddresses {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var addrs []string
+	for _, key := range keys {
+		tagged := node.Service.TaggedAddresses[key]
+		if tagged.Address == "" || key == structs.TaggedAddressVirtualIP {
+			continue
+		}
+		if strings.HasPrefix(key, structs.TaggedAddressWAN) != wan {
+			continue
+		}
+		addrs = append(addrs, formatTaggedAddress(tagged, node.Service.Port))
+	}
+	return addrs
+}
+
+// formatTaggedAddress formats a service tagged address, using the service's
+// own port when the tagged address does not set one.
+func formatTaggedAddress(tagged structs.ServiceAddress, servicePort int) string {
+	port := tagged.Port
+	if port == 0 {
+		port = servicePort
+	}
+	return ipaddr.FormatAddressPort(tagged.Address, port)
+}
+
+// addressLess orders host:port addresses by host and then numerically by
+// port, so that generated peering tokens don't change between generations
+// just because the state store returned nodes in a different order.
+func addressLess(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	if hostA != hostB {
+		return hostA < hostB
+	}
+	numA, errA := strconv.Atoi(portA)
+	numB, errB := strconv.Atoi(portB)
+	if errA != nil || errB != nil {
+		return portA < portB
+	}
+	return numA < numB
+}
+
+// PeeringPortPrecedence controls which of a server's advertised gRPC ports
+// is embedded into peering tokens.
+type PeeringPortPrecedence string
+
+const (
+	// PeeringPortPrecedenceTLSFirst prefers the TLS port and falls back to the
+	// plain-text port. This is the default.
+	PeeringPortPrecedenceTLSFirst PeeringPortPrecedence = "tls-first"
+
+	// PeeringPortPrecedencePlainFirst prefers the plain-text port and falls
+	// back to the TLS port.
+	PeeringPortPrecedencePlainFirst PeeringPortPrecedence = "plain-first"
+
+	// PeeringPortPrecedenceTLSOnly only considers the TLS port.
+	PeeringPortPrecedenceTLSOnly PeeringPortPrecedence = "tls-only"
+
+	// PeeringPortPrecedencePlainOnly only considers the plain-text port.
+	PeeringPortPrecedencePlainOnly PeeringPortPrecedence = "plain-only"
+)
+
+// metaKeys returns the service meta keys holding the gRPC ports, in the
+// order they should be considered.
+func (p PeeringPortPrecedence) metaKeys() ([]string, error) {
+	switch p {
+	case "", PeeringPortPrecedenceTLSFirst:
+		return []string{"grpc_tls_port", "grpc_port"}, nil
+	case PeeringPortPrecedencePlainFirst:
+		return []string{"grpc_port", "grpc_tls_port"}, nil
+	case PeeringPortPrecedenceTLSOnly:
+		return []string{"grpc_tls_port"}, nil
+	case PeeringPortPrecedencePlainOnly:
+		return []string{"grpc_port"}, nil
+	default:
+		return nil, fmt.Errorf("unknown peering port precedence %q", p)
+	}
+}
+
+// maxPort is the largest valid TCP port.
+const maxPort = 65535
+
+// validPort reports whether port is a usable TCP port.
+func validPort(port int) bool {
+	return port >= 1 && port <= maxPort
+}
+
+// serverAddressOptions controls which server addresses are returned by serverAddresses.
+type serverAddressOptions struct {
+	// portPrecedence determines which gRPC port is used for each server.
+	portPrecedence PeeringPortPrecedence
+
+	// excludeNode is the name of a server node whose address is omitted.
+	excludeNode string
+
+	// maxAddresses limits the number of addresses returned. Zero means
+	// unlimited.
+	maxAddresses int
+
+	// logger records servers whose advertised ports are skipped. It may be
+	// nil.
+	logger hclog.Logger
+
+	// entMeta scopes the catalog lookup of the consul service. Nil means the
+	// default partition.
+	entMeta *acl.EnterpriseMeta
+}
+
+// serverAddressCandidate is a server address along with the properties used
+// to prefer it over others when the number of addresses is capped.
+type serverAddressCandidate struct {
+	addr  string
+	voter bool
+	tls   bool
+}
+
+// serverAddresses returns the gRPC addresses of the servers in the catalog.
+// Servers are filtered by serversForPeering, so that draining or unreachable
+// servers are left out.
+func serverAddresses(state *state.Store, opts serverAddressOptions) ([]string, error) {
+	servers, err := serverAddressesWithTLS(state, opts)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(servers))
+	for _, s := range servers {
+		addrs = append(addrs, s.Addr)
+	}
+	return addrs, nil
+}
+
+// ServerAddress is a gRPC address that peers can dial, along with whether
+// it expects TLS.
+type ServerAddress struct {
+	Addr string
+	TLS  bool
+}
+
+// GetServerAddressesWithTLS is like GetServerAddresses but reports whether
+// each address expects TLS. Mesh gateway addresses always expect TLS since
+// gateways route peering traffic by SNI.
+func (b *PeeringBackend) GetServerAddressesWithTLS() ([]ServerAddress, error) {
+	return b.serverAddressesWithTLSCtx(context.Background(), structs.DefaultEnterpriseMetaInDefaultPartition(), true)
+}
+
+// meshGatewayServerAddresses returns the WAN or, if preferWAN is false, the
+// LAN addresses of the local mesh gateways, each of which expects TLS.
+func (b *PeeringBackend) meshGatewayServerAddresses(preferWAN bool) ([]ServerAddress, error) {
+	addrs, err := b.GetMeshGatewayAddresses(preferWAN)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]ServerAddress, 0, len(addrs))
+	for _, addr := range addrs {
+		servers = append(servers, ServerAddress{Addr: addr, TLS: true})
+	}
+	return servers, nil
+}
+
+// serverAddressesWithTLS is like serverAddresses but reports whether each
+// address is a server's TLS port.
+func serverAddressesWithTLS(state *state.Store, opts serverAddressOptions) ([]ServerAddress, error) {
+	keys, err := opts.portPrecedence.metaKeys()
+	if err != nil {
+		return nil, err
+	}
+	logger := opts.logger
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
+
+	entMeta := opts.entMeta
+	if entMeta == nil {
+		entMeta = structs.DefaultEnterpriseMetaInDefaultPartition()
+	}
+	_, nodes, err := state.CheckServiceNodes(nil, "consul", entMeta, structs.DefaultPeerKeyword)
+	if err != nil {
+		return nil, err
+	}
+	// Only servers with a usable port are considered by the health policy, so
+	// that it falls back to unhealthy servers rather than to none.
+	var eligible structs.CheckServiceNodes
+	candidateByNode := make(map[string]serverAddressCandidate)
+	for _, node := range nodes {
+		if opts.excludeNode != "" && node.Node.Node == opts.excludeNode {
+			continue
+		}
+		// Use the first port defined, in order of precedence.
+		for _, key := range keys {
+			grpcPortStr := node.Service.Meta[key]
+			v, err := strconv.Atoi(grpcPortStr)
+			if err == nil && !validPort(v) {
+				logger.Debug("skipping out of range server gRPC port",
+					"node", node.Node.Node, "key", key, "port", grpcPortStr)
+				continue
+			}
+			if err == nil {
+				candidate := serverAddressCandidate{
+					addr:  ipaddr.FormatAddressPort(node.Node.Address, v),
+					voter: node.Service.Meta["non_voter"] != "true" && node.Service.Meta["read_replica"] != "true",
+					tls:   key == "grpc_tls_port",
+				}
+				eligible = append(eligible, node)
+				candidateByNode[node.Node.Node] = candidate
+				break
+			}
+		}
+		// Skip node if none are defined.
+	}
+	if len(eligible) == 0 {
+		return nil, newPeeringTokenError(PeeringTokenErrorNoAddresses,
+			"a grpc bind port must be specified in the configuration for all servers")
+	}
+	var candidates []serverAddressCandidate
+	for _, node := range serversForPeering(eligible) {
+		candidates = append(candidates, candidateByNode[node.Node.Node])
+	}
+
+	if opts.maxAddresses > 0 && len(candidates) > opts.maxAddresses {
+		// Prefer voters, then TLS-enabled servers, breaking ties by address
+		// so that the same servers are chosen every time.
+		sort.SliceStable(candidates, func(i, j int) bool {
+			a, b := candidates[i], candidates[j]
+			if a.voter != b.voter {
+				return a.voter
+			}
+			if a.tls != b.tls {
+				return a.tls
+			}
+			return addressLess(a.addr, b.addr)
+		})
+		candidates = candidates[:opts.maxAddresses]
+	}
+
+	servers := make([]ServerAddress, 0, len(candidates))
+	for _, c := range candidates {
+		servers = append(servers, ServerAddress{Addr: c.addr, TLS: c.tls})
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return addressLess(servers[i].Addr, servers[j].Addr)
+	})
+	return servers, nil
+}
+
+// DiscoveredGRPCPorts returns the distinct set of gRPC ports, both TLS and
+// plain-text, advertised by the servers in the catalog. Ports outside the
+// valid TCP range are ignored.
+func (b *PeeringBackend) DiscoveredGRPCPorts() ([]int, error) {
+	_, nodes, err := b.srv.PeeringState().ServiceNodes(nil, "consul", structs.DefaultEnterpriseMetaInDefaultPartition(), structs.DefaultPeerKeyword)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int]struct{})
+	for _, node := range nodes {
+		for _, key := range []string{"grpc_tls_port", "grpc_port"} {
+			if v, err := strconv.Atoi(node.ServiceMeta[key]); err == nil && validPort(v) {
+				seen[v] = struct{}{}
+			}
+		}
+	}
+
+	ports := make([]int, 0, len(seen))
+	for port := range seen {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
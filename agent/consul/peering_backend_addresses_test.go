@@ -0,0 +1,971 @@
+package consul
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/freeport"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/hashicorp/consul/testrpc"
+	"github.com/hashicorp/consul/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeeringBackend_DiscoveredGRPCPorts(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	register := func(idx uint64, node, addr string, meta map[string]string) {
+		require.NoError(t, srv.fsm.State().EnsureRegistration(idx, &structs.RegisterRequest{
+			Node:    node,
+			Address: addr,
+			Service: &structs.NodeService{
+				ID:      "consul",
+				Service: "consul",
+				Meta:    meta,
+			},
+		}))
+	}
+	register(1000, "server-1", "10.0.0.1", map[string]string{"grpc_tls_port": "8503", "grpc_port": "8502"})
+	register(1001, "server-2", "10.0.0.2", map[string]string{"grpc_tls_port": "8503"})
+	register(1002, "server-3", "10.0.0.3", map[string]string{"grpc_port": "not-a-port"})
+	register(1003, "server-4", "10.0.0.4", map[string]string{"grpc_tls_port": "70000", "grpc_port": "-1"})
+
+	ports, err := backend.DiscoveredGRPCPorts()
+	require.NoError(t, err)
+	require.NotContains(t, ports, 70000)
+
+	// The test server registers itself too, so only check the ports added here.
+	require.Subset(t, ports, []int{8502, 8503})
+	require.True(t, sort.IntsAreSorted(ports))
+	seen := make(map[int]bool)
+	for _, port := range ports {
+		require.False(t, seen[port], "duplicate port %d", port)
+		require.Positive(t, port)
+		seen[port] = true
+	}
+}
+
+func TestMeshGatewayAddresses_TaggedAddress(t *testing.T) {
+	store := state.NewStateStore(nil)
+	register := func(idx uint64, node string, tagged map[string]structs.ServiceAddress) {
+		require.NoError(t, store.EnsureRegistration(idx, &structs.RegisterRequest{
+			Node:    node,
+			Address: "10.0.0.1",
+			Service: &structs.NodeService{
+				Kind:            structs.ServiceKindMeshGateway,
+				ID:              "mesh-gateway",
+				Service:         "mesh-gateway",
+				Address:         "10.0.0.1",
+				Port:            443,
+				TaggedAddresses: tagged,
+			},
+		}))
+	}
+	register(1, "gw-1", map[string]structs.ServiceAddress{
+		structs.TaggedAddressWAN: {Address: "203.0.113.1", Port: 8443},
+		"peering":                {Address: "198.51.100.1", Port: 9443},
+	})
+	register(2, "gw-2", map[string]structs.ServiceAddress{
+		structs.TaggedAddressWAN: {Address: "203.0.113.2", Port: 8443},
+	})
+
+	testutil.RunStep(t, "default uses WAN addresses only", func(t *testing.T) {
+		addrs, err := meshGatewayAdresses(store, meshGatewayAddressOptions{preferWAN: true})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"203.0.113.1:8443", "203.0.113.2:8443"}, addrs)
+	})
+
+	testutil.RunStep(t, "configured tagged address with fallback", func(t *testing.T) {
+		addrs, err := meshGatewayAdresses(store, meshGatewayAddressOptions{taggedAddrKey: "peering", preferWAN: true})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"198.51.100.1:9443", "203.0.113.2:8443"}, addrs)
+	})
+}
+
+func TestMeshGatewayAddressesDetailed(t *testing.T) {
+	store := state.NewStateStore(nil)
+
+	testutil.RunStep(t, "no gateways", func(t *testing.T) {
+		_, err := meshGatewayAddressesDetailed(store, meshGatewayAddressOptions{preferWAN: true})
+		var tokenErr *PeeringTokenError
+		require.True(t, errors.As(err, &tokenErr))
+		require.Equal(t, PeeringTokenErrorNoAddresses, tokenErr.Code())
+	})
+
+	register := func(idx uint64, node, dc string, tagged map[string]structs.ServiceAddress) {
+		require.NoError(t, store.EnsureRegistration(idx, &structs.RegisterRequest{
+			Node:       node,
+			Datacenter: dc,
+			Address:    "10.0.0.1",
+			Service: &structs.NodeService{
+				Kind:            structs.ServiceKindMeshGateway,
+				ID:              "mesh-gateway",
+				Service:         "mesh-gateway",
+				Address:         "10.0.0.1",
+				Port:            443,
+				TaggedAddresses: tagged,
+			},
+		}))
+	}
+	register(1, "gw-1", "dc1", map[string]structs.ServiceAddress{
+		"peering": {Address: "198.51.100.1", Port: 9443},
+	})
+	register(2, "gw-2", "", map[string]structs.ServiceAddress{
+		structs.TaggedAddressWAN: {Address: "203.0.113.2", Port: 8443},
+	})
+
+	testutil.RunStep(t, "gateways annotated with datacenter", func(t *testing.T) {
+		gateways, err := meshGatewayAddressesDetailed(store, meshGatewayAddressOptions{taggedAddrKey: "peering", preferWAN: true})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []MeshGatewayAddress{
+			{Address: "198.51.100.1:9443", Datacenter: "dc1"},
+			{Address: "203.0.113.2:8443"},
+		}, gateways)
+	})
+}
+
+func TestPeeringBackend_GetServerAddresses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("too slow for testing.Short")
+	}
+
+	_, cfg := testServerConfig(t)
+	cfg.GRPCTLSPort = freeport.GetOne(t)
+
+	srv, err := newServer(t, cfg)
+	require.NoError(t, err)
+	testrpc.WaitForLeader(t, srv.RPC, "dc1")
+
+	backend := NewPeeringBackend(srv)
+
+	testutil.RunStep(t, "peer to servers", func(t *testing.T) {
+		throughGateways, err := backend.PeerThroughMeshGateways()
+		require.NoError(t, err)
+		require.False(t, throughGateways)
+
+		addrs, err := backend.GetServerAddresses()
+		require.NoError(t, err)
+
+		expect := fmt.Sprintf("127.0.0.1:%d", srv.config.GRPCTLSPort)
+		require.Equal(t, []string{expect}, addrs)
+	})
+
+	testutil.RunStep(t, "existence of mesh config entry is not enough to peer through gateways", func(t *testing.T) {
+		mesh := structs.MeshConfigEntry{
+			// Enable unrelated config.
+			TransparentProxy: structs.TransparentProxyMeshConfig{
+				MeshDestinationsOnly: true,
+			},
+		}
+
+		require.NoError(t, srv.fsm.State().EnsureConfigEntry(1, &mesh))
+		addrs, err := backend.GetServerAddresses()
+		require.NoError(t, err)
+
+		// Still expect server address because PeerThroughMeshGateways was not enabled.
+		expect := fmt.Sprintf("127.0.0.1:%d", srv.config.GRPCTLSPort)
+		require.Equal(t, []string{expect}, addrs)
+	})
+
+	testutil.RunStep(t, "cannot peer through gateways without registered gateways", func(t *testing.T) {
+		mesh := structs.MeshConfigEntry{
+			Peering: &structs.PeeringMeshConfig{PeerThroughMeshGateways: true},
+		}
+		require.NoError(t, srv.fsm.State().EnsureConfigEntry(1, &mesh))
+
+		throughGateways, err := backend.PeerThroughMeshGateways()
+		require.NoError(t, err)
+		require.True(t, throughGateways)
+
+		addrs, err := backend.GetServerAddresses()
+		require.Nil(t, addrs)
+		testutil.RequireErrorContains(t, err,
+			"servers are configured to PeerThroughMeshGateways, but no mesh gateway instances are registered")
+		require.Equal(t, PeeringTokenErrorNoAddresses, PeeringTokenErrorCodeOf(err))
+	})
+
+	testutil.RunStep(t, "peer through mesh gateways", func(t *testing.T) {
+		reg := structs.RegisterRequest{
+			ID:      types.NodeID("b5489ca9-f5e9-4dba-a779-61fec4e8e364"),
+			Node:    "gw-node",
+			Address: "1.2.3.4",
+			TaggedAddresses: map[string]string{
+				structs.TaggedAddressWAN: "172.217.22.14",
+			},
+			Service: &structs.NodeService{
+				ID:      "mesh-gateway",
+				Service: "mesh-gateway",
+				Kind:    structs.ServiceKindMeshGateway,
+				Port:    443,
+				TaggedAddresses: map[string]structs.ServiceAddress{
+					structs.TaggedAddressWAN: {Address: "154.238.12.252", Port: 8443},
+				},
+			},
+		}
+		require.NoError(t, srv.fsm.State().EnsureRegistration(2, &reg))
+
+		addrs, err := backend.GetServerAddresses()
+		require.NoError(t, err)
+		require.Equal(t, []string{"154.238.12.252:8443"}, addrs)
+	})
+
+	testutil.RunStep(t, "peer through mesh gateways on the LAN", func(t *testing.T) {
+		addrs, err := backend.GetServerAddressesForPartition(context.Background(), "", false)
+		require.NoError(t, err)
+		require.Equal(t, []string{"1.2.3.4:443"}, addrs)
+
+		// WAN addresses are still returned by default.
+		addrs, err = backend.GetServerAddressesForPartition(context.Background(), "", true)
+		require.NoError(t, err)
+		require.Equal(t, []string{"154.238.12.252:8443"}, addrs)
+	})
+}
+
+func TestMeshConfigPeersThroughGateways(t *testing.T) {
+	cases := map[string]struct {
+		entry        structs.ConfigEntry
+		expect       bool
+		expectReason string
+	}{
+		"entry absent": {
+			entry:        nil,
+			expect:       false,
+			expectReason: directPeeringNoMeshConfig,
+		},
+		"entry without peering config": {
+			entry:        &structs.MeshConfigEntry{},
+			expect:       false,
+			expectReason: directPeeringNoPeeringConfig,
+		},
+		"entry peering through gateways": {
+			entry: &structs.MeshConfigEntry{
+				Peering: &structs.PeeringMeshConfig{PeerThroughMeshGateways: true},
+			},
+			expect: true,
+		},
+		"entry peering directly": {
+			entry: &structs.MeshConfigEntry{
+				Peering: &structs.PeeringMeshConfig{PeerThroughMeshGateways: false},
+			},
+			expect:       false,
+			expectReason: directPeeringDisabled,
+		},
+		"wrong type": {
+			entry:        &structs.ProxyConfigEntry{Kind: structs.ProxyDefaults, Name: structs.ProxyConfigGlobal},
+			expect:       false,
+			expectReason: directPeeringNoMeshConfig,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expect, meshConfigPeersThroughGateways(tc.entry))
+			require.Equal(t, tc.expectReason, meshConfigDirectPeeringReason(tc.entry))
+		})
+	}
+}
+
+func TestPeeringBackend_GetServerAddressesLogsDirectPeeringReason(t *testing.T) {
+	srv, backend := newMockPeeringBackend()
+
+	var buf bytes.Buffer
+	backend.logger = hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Debug})
+
+	cases := []struct {
+		name   string
+		entry  *structs.MeshConfigEntry
+		expect string
+	}{
+		{
+			name:   "no mesh config entry",
+			expect: directPeeringNoMeshConfig,
+		},
+		{
+			name:   "mesh config entry without peering config",
+			entry:  &structs.MeshConfigEntry{},
+			expect: directPeeringNoPeeringConfig,
+		},
+		{
+			name:   "mesh config entry peering directly",
+			entry:  &structs.MeshConfigEntry{Peering: &structs.PeeringMeshConfig{}},
+			expect: directPeeringDisabled,
+		},
+	}
+	for i, tc := range cases {
+		testutil.RunStep(t, tc.name, func(t *testing.T) {
+			if tc.entry != nil {
+				require.NoError(t, srv.store.EnsureConfigEntry(uint64(i+1), tc.entry))
+			}
+			buf.Reset()
+
+			// There are no servers in the catalog, so only the log matters.
+			_, _ = backend.GetServerAddresses()
+			require.Contains(t, buf.String(), "[DEBUG] peering directly to servers rather than through mesh gateways")
+			require.Contains(t, buf.String(), fmt.Sprintf("reason=%q", tc.expect))
+		})
+	}
+
+	testutil.RunStep(t, "peering through mesh gateways", func(t *testing.T) {
+		require.NoError(t, srv.store.EnsureConfigEntry(10, &structs.MeshConfigEntry{
+			Peering: &structs.PeeringMeshConfig{PeerThroughMeshGateways: true},
+		}))
+		buf.Reset()
+
+		_, _ = backend.GetServerAddresses()
+		require.NotContains(t, buf.String(), "peering directly to servers")
+	})
+}
+
+func TestServerAddresses_PortPrecedence(t *testing.T) {
+	store := state.NewStateStore(nil)
+	require.NoError(t, store.EnsureRegistration(1, &structs.RegisterRequest{
+		Node:    "server-1",
+		Address: "10.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "consul",
+			Service: "consul",
+			Meta: map[string]string{
+				"grpc_port":     "8502",
+				"grpc_tls_port": "8503",
+			},
+		},
+	}))
+	require.NoError(t, store.EnsureRegistration(2, &structs.RegisterRequest{
+		Node:    "server-2",
+		Address: "10.0.0.2",
+		Service: &structs.NodeService{
+			ID:      "consul",
+			Service: "consul",
+			Meta:    map[string]string{"grpc_port": "8502"},
+		},
+	}))
+
+	cases := map[PeeringPortPrecedence][]string{
+		"":                              {"10.0.0.1:8503", "10.0.0.2:8502"},
+		PeeringPortPrecedenceTLSFirst:   {"10.0.0.1:8503", "10.0.0.2:8502"},
+		PeeringPortPrecedencePlainFirst: {"10.0.0.1:8502", "10.0.0.2:8502"},
+		PeeringPortPrecedenceTLSOnly:    {"10.0.0.1:8503"},
+		PeeringPortPrecedencePlainOnly:  {"10.0.0.1:8502", "10.0.0.2:8502"},
+	}
+	for precedence, expect := range cases {
+		addrs, err := serverAddresses(store, serverAddressOptions{portPrecedence: precedence})
+		require.NoError(t, err)
+		require.ElementsMatch(t, expect, addrs, "precedence %q", precedence)
+	}
+
+	_, err := serverAddresses(store, serverAddressOptions{portPrecedence: "tls-sometimes"})
+	testutil.RequireErrorContains(t, err, `unknown peering port precedence "tls-sometimes"`)
+
+	addrs, err := serverAddresses(store, serverAddressOptions{excludeNode: "server-1"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.2:8502"}, addrs)
+}
+
+func TestServerAddresses_Health(t *testing.T) {
+	register := func(t *testing.T, store *state.Store, idx uint64, node, addr string, status string) {
+		t.Helper()
+		require.NoError(t, store.EnsureRegistration(idx, &structs.RegisterRequest{
+			Node:    node,
+			Address: addr,
+			Service: &structs.NodeService{
+				ID:      "consul",
+				Service: "consul",
+				Meta:    map[string]string{"grpc_port": "8502"},
+			},
+			Check: &structs.HealthCheck{
+				Node:    node,
+				CheckID: structs.SerfCheckID,
+				Name:    structs.SerfCheckName,
+				Status:  status,
+			},
+		}))
+	}
+
+	t.Run("all healthy", func(t *testing.T) {
+		store := state.NewStateStore(nil)
+		register(t, store, 1, "server-1", "10.0.0.1", api.HealthPassing)
+		register(t, store, 2, "server-2", "10.0.0.2", api.HealthPassing)
+
+		addrs, err := serverAddresses(store, serverAddressOptions{})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"10.0.0.1:8502", "10.0.0.2:8502"}, addrs)
+	})
+
+	t.Run("some unhealthy", func(t *testing.T) {
+		store := state.NewStateStore(nil)
+		register(t, store, 1, "server-1", "10.0.0.1", api.HealthPassing)
+		register(t, store, 2, "server-2", "10.0.0.2", api.HealthCritical)
+		register(t, store, 3, "server-3", "10.0.0.3", api.HealthWarning)
+
+		addrs, err := serverAddresses(store, serverAddressOptions{})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"10.0.0.1:8502", "10.0.0.3:8502"}, addrs)
+	})
+
+	t.Run("all unhealthy", func(t *testing.T) {
+		store := state.NewStateStore(nil)
+		register(t, store, 1, "server-1", "10.0.0.1", api.HealthCritical)
+		register(t, store, 2, "server-2", "10.0.0.2", api.HealthCritical)
+
+		addrs, err := serverAddresses(store, serverAddressOptions{})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"10.0.0.1:8502", "10.0.0.2:8502"}, addrs)
+	})
+}
+
+func TestServerAddresses_StableOrder(t *testing.T) {
+	store := state.NewStateStore(nil)
+	servers := []struct {
+		node, addr, port string
+	}{
+		{"server-c", "10.0.0.2", "8502"},
+		{"server-a", "10.0.0.10", "8502"},
+		{"server-b", "10.0.0.2", "10502"},
+		{"server-d", "10.0.0.1", "9502"},
+	}
+	for i, srv := range servers {
+		require.NoError(t, store.EnsureRegistration(uint64(i+1), &structs.RegisterRequest{
+			Node:    srv.node,
+			Address: srv.addr,
+			Service: &structs.NodeService{
+				ID:      "consul",
+				Service: "consul",
+				Meta:    map[string]string{"grpc_port": srv.port},
+			},
+		}))
+	}
+	for i, gw := range []string{"10.0.1.2", "10.0.1.1", "10.0.1.3"} {
+		require.NoError(t, store.EnsureRegistration(uint64(10+i), &structs.RegisterRequest{
+			Node:    fmt.Sprintf("gateway-%d", i),
+			Address: gw,
+			Service: &structs.NodeService{
+				Kind:    structs.ServiceKindMeshGateway,
+				ID:      "mesh-gateway",
+				Service: "mesh-gateway",
+				Port:    8443,
+			},
+		}))
+	}
+
+	expect := []string{"10.0.0.1:9502", "10.0.0.10:8502", "10.0.0.2:8502", "10.0.0.2:10502"}
+	expectGateways := []string{"10.0.1.1:8443", "10.0.1.2:8443", "10.0.1.3:8443"}
+	for i := 0; i < 5; i++ {
+		addrs, err := serverAddresses(store, serverAddressOptions{})
+		require.NoError(t, err)
+		require.Equal(t, expect, addrs)
+
+		gateways, err := meshGatewayAdresses(store, meshGatewayAddressOptions{preferWAN: true})
+		require.NoError(t, err)
+		require.Equal(t, expectGateways, gateways)
+	}
+}
+
+func TestServerAddresses_AddressFormatting(t *testing.T) {
+	cases := map[string]struct {
+		address string
+		expect  string
+	}{
+		"ipv4":     {address: "10.0.0.1", expect: "10.0.0.1:8502"},
+		"ipv6":     {address: "fe80::1", expect: "[fe80::1]:8502"},
+		"hostname": {address: "server-1.example.com", expect: "server-1.example.com:8502"},
+	}
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			store := state.NewStateStore(nil)
+			require.NoError(t, store.EnsureRegistration(1, &structs.RegisterRequest{
+				Node:    "server-1",
+				Address: tc.address,
+				Service: &structs.NodeService{
+					ID:      "consul",
+					Service: "consul",
+					Meta:    map[string]string{"grpc_port": "8502"},
+				},
+			}))
+			require.NoError(t, store.EnsureRegistration(2, &structs.RegisterRequest{
+				Node:    "gateway-1",
+				Address: tc.address,
+				Service: &structs.NodeService{
+					Kind:    structs.ServiceKindMeshGateway,
+					ID:      "mesh-gateway",
+					Service: "mesh-gateway",
+					Port:    8502,
+				},
+			}))
+
+			addrs, err := serverAddresses(store, serverAddressOptions{})
+			require.NoError(t, err)
+			require.Equal(t, []string{tc.expect}, addrs)
+
+			gateways, err := meshGatewayAdresses(store, meshGatewayAddressOptions{preferWAN: true})
+			require.NoError(t, err)
+			require.Equal(t, addrs, gateways)
+		})
+	}
+}
+
+func TestMeshGatewayAddresses_WANPreference(t *testing.T) {
+	store := state.NewStateStore(nil)
+	require.NoError(t, store.EnsureRegistration(1, &structs.RegisterRequest{
+		Node:    "gateway-1",
+		Address: "10.0.1.1",
+		TaggedAddresses: map[string]string{
+			structs.TaggedAddressWAN: "198.18.0.1",
+		},
+		Service: &structs.NodeService{
+			Kind:    structs.ServiceKindMeshGateway,
+			ID:      "mesh-gateway",
+			Service: "mesh-gateway",
+			Port:    8443,
+		},
+	}))
+	require.NoError(t, store.EnsureRegistration(2, &structs.RegisterRequest{
+		Node:    "gateway-2",
+		Address: "10.0.1.2",
+		Service: &structs.NodeService{
+			Kind:    structs.ServiceKindMeshGateway,
+			ID:      "mesh-gateway",
+			Service: "mesh-gateway",
+			Address: "10.0.2.2",
+			Port:    8443,
+			TaggedAddresses: map[string]structs.ServiceAddress{
+				structs.TaggedAddressWAN: {Address: "198.18.0.2", Port: 443},
+				structs.TaggedAddressLAN: {Address: "10.0.3.2", Port: 8443},
+			},
+		},
+	}))
+	// A gateway without WAN addresses is dialed on its LAN address.
+	require.NoError(t, store.EnsureRegistration(3, &structs.RegisterRequest{
+		Node:    "gateway-3",
+		Address: "10.0.1.3",
+		Service: &structs.NodeService{
+			Kind:    structs.ServiceKindMeshGateway,
+			ID:      "mesh-gateway",
+			Service: "mesh-gateway",
+			Port:    8443,
+		},
+	}))
+
+	t.Run("prefer WAN", func(t *testing.T) {
+		addrs, err := meshGatewayAdresses(store, meshGatewayAddressOptions{preferWAN: true})
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.1.3:8443", "198.18.0.1:8443", "198.18.0.2:443"}, addrs)
+	})
+
+	t.Run("prefer LAN", func(t *testing.T) {
+		addrs, err := meshGatewayAdresses(store, meshGatewayAddressOptions{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.1.1:8443", "10.0.1.3:8443", "10.0.2.2:8443", "10.0.3.2:8443"}, addrs)
+	})
+}
+
+func TestMeshGatewayAddresses_Health(t *testing.T) {
+	store := state.NewStateStore(nil)
+	gateways := []struct {
+		node, addr string
+		status     string
+	}{
+		{"gateway-1", "10.0.1.1", api.HealthPassing},
+		{"gateway-2", "10.0.1.2", api.HealthWarning},
+		{"gateway-3", "10.0.1.3", api.HealthCritical},
+		{"gateway-4", "10.0.1.4", api.HealthMaint},
+	}
+	for i, gw := range gateways {
+		require.NoError(t, store.EnsureRegistration(uint64(i+1), &structs.RegisterRequest{
+			Node:    gw.node,
+			Address: gw.addr,
+			Service: &structs.NodeService{
+				Kind:    structs.ServiceKindMeshGateway,
+				ID:      "mesh-gateway",
+				Service: "mesh-gateway",
+				Port:    8443,
+			},
+			Checks: structs.HealthChecks{{
+				Node:      gw.node,
+				CheckID:   "mesh-gateway-alive",
+				ServiceID: "mesh-gateway",
+				Status:    gw.status,
+			}},
+		}))
+	}
+
+	t.Run("passing only", func(t *testing.T) {
+		addrs, err := meshGatewayAdresses(store, meshGatewayAddressOptions{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.1.1:8443"}, addrs)
+	})
+
+	t.Run("include warning", func(t *testing.T) {
+		addrs, err := meshGatewayAdresses(store, meshGatewayAddressOptions{includeWarning: true})
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.1.1:8443", "10.0.1.2:8443"}, addrs)
+	})
+
+	t.Run("none healthy", func(t *testing.T) {
+		require.NoError(t, store.DeleteNode(10, "gateway-1", nil, ""))
+		require.NoError(t, store.DeleteNode(11, "gateway-2", nil, ""))
+
+		// Unlike servers, unhealthy gateways are never put in tokens.
+		_, err := meshGatewayAdresses(store, meshGatewayAddressOptions{includeWarning: true})
+		require.Equal(t, PeeringTokenErrorNoAddresses, PeeringTokenErrorCodeOf(err))
+		testutil.RequireErrorContains(t, err, "none of the 2 registered mesh gateway instances are healthy")
+	})
+
+	t.Run("none registered", func(t *testing.T) {
+		require.NoError(t, store.DeleteNode(12, "gateway-3", nil, ""))
+		require.NoError(t, store.DeleteNode(13, "gateway-4", nil, ""))
+
+		_, err := meshGatewayAdresses(store, meshGatewayAddressOptions{})
+		require.Equal(t, PeeringTokenErrorNoAddresses, PeeringTokenErrorCodeOf(err))
+		testutil.RequireErrorContains(t, err, "no mesh gateway instances are registered")
+	})
+}
+
+func TestMeshGatewayAddresses_MultipleTaggedAddresses(t *testing.T) {
+	store := state.NewStateStore(nil)
+	require.NoError(t, store.EnsureRegistration(1, &structs.RegisterRequest{
+		Node:    "gateway-1",
+		Address: "10.0.1.1",
+		Service: &structs.NodeService{
+			Kind:    structs.ServiceKindMeshGateway,
+			ID:      "mesh-gateway",
+			Service: "mesh-gateway",
+			Port:    8443,
+			TaggedAddresses: map[string]structs.ServiceAddress{
+				structs.TaggedAddressWAN:     {Address: "198.18.0.1", Port: 443},
+				structs.TaggedAddressLANIPv4: {Address: "10.0.2.1"},
+			},
+		},
+	}))
+	// A second gateway sharing the public VIP should not duplicate it.
+	require.NoError(t, store.EnsureRegistration(2, &structs.RegisterRequest{
+		Node:    "gateway-2",
+		Address: "10.0.1.2",
+		Service: &structs.NodeService{
+			Kind:    structs.ServiceKindMeshGateway,
+			ID:      "mesh-gateway",
+			Service: "mesh-gateway",
+			Port:    8443,
+			TaggedAddresses: map[string]structs.ServiceAddress{
+				structs.TaggedAddressWAN: {Address: "198.18.0.1", Port: 443},
+			},
+		},
+	}))
+
+	t.Run("prefer WAN", func(t *testing.T) {
+		addrs, err := meshGatewayAdresses(store, meshGatewayAddressOptions{preferWAN: true})
+		require.NoError(t, err)
+		require.Equal(t, []string{"198.18.0.1:443"}, addrs)
+	})
+
+	t.Run("prefer LAN", func(t *testing.T) {
+		addrs, err := meshGatewayAdresses(store, meshGatewayAddressOptions{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.1.1:8443", "10.0.1.2:8443", "10.0.2.1:8443"}, addrs)
+	})
+
+	t.Run("configured tagged address", func(t *testing.T) {
+		addrs, err := meshGatewayAdresses(store, meshGatewayAddressOptions{taggedAddrKey: structs.TaggedAddressLANIPv4, preferWAN: true})
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.2.1:8443", "198.18.0.1:443"}, addrs)
+	})
+}
+
+func TestServerAddressCache(t *testing.T) {
+	now := time.Now()
+	cache := serverAddressCache{timeNow: func() time.Time { return now }}
+
+	direct := serverAddressCacheKey{partition: "default"}
+	gateways := serverAddressCacheKey{partition: "default", throughGateways: true}
+
+	var loads int
+	addrs := []ServerAddress{{Addr: "10.0.0.1:8502", TLS: true}}
+	load := func() ([]ServerAddress, error) {
+		loads++
+		return addrs, nil
+	}
+
+	got, err := cache.get(time.Second, direct, load)
+	require.NoError(t, err)
+	require.Equal(t, addrs, got)
+	require.Equal(t, 1, loads)
+
+	// A second call within the TTL reuses the result.
+	now = now.Add(500 * time.Millisecond)
+	got, err = cache.get(time.Second, direct, load)
+	require.NoError(t, err)
+	require.Equal(t, addrs, got)
+	require.Equal(t, 1, loads)
+
+	// Modifying a returned slice does not affect the cache.
+	got[0].Addr = "modified"
+	got, err = cache.get(time.Second, direct, load)
+	require.NoError(t, err)
+	require.Equal(t, addrs, got)
+	require.Equal(t, 1, loads)
+
+	// Mesh gateway addresses are cached separately.
+	_, err = cache.get(time.Second, gateways, load)
+	require.NoError(t, err)
+	require.Equal(t, 2, loads)
+
+	// So are the addresses of each partition.
+	_, err = cache.get(time.Second, serverAddressCacheKey{partition: "ap1"}, load)
+	require.NoError(t, err)
+	require.Equal(t, 3, loads)
+
+	// Expired entries are reloaded.
+	now = now.Add(time.Second)
+	_, err = cache.get(time.Second, direct, load)
+	require.NoError(t, err)
+	require.Equal(t, 4, loads)
+
+	// Errors are not cached.
+	failing := func() ([]ServerAddress, error) {
+		loads++
+		return nil, errors.New("no addresses")
+	}
+	now = now.Add(time.Second)
+	_, err = cache.get(time.Second, direct, failing)
+	require.Error(t, err)
+	_, err = cache.get(time.Second, direct, load)
+	require.NoError(t, err)
+	require.Equal(t, 6, loads)
+
+	// A zero TTL disables caching.
+	_, err = cache.get(0, direct, load)
+	require.NoError(t, err)
+	require.Equal(t, 7, loads)
+}
+
+func TestServerAddresses_PortRange(t *testing.T) {
+	store := state.NewStateStore(nil)
+	servers := []struct {
+		node, addr string
+		meta       map[string]string
+	}{
+		{"server-1", "10.0.0.1", map[string]string{"grpc_tls_port": "99999", "grpc_port": "8502"}},
+		{"server-2", "10.0.0.2", map[string]string{"grpc_tls_port": "70000", "grpc_port": "-1"}},
+		{"server-3", "10.0.0.3", map[string]string{"grpc_tls_port": "65535"}},
+	}
+	for i, srv := range servers {
+		require.NoError(t, store.EnsureRegistration(uint64(i+1), &structs.RegisterRequest{
+			Node:    srv.node,
+			Address: srv.addr,
+			Service: &structs.NodeService{
+				ID:      "consul",
+				Service: "consul",
+				Meta:    srv.meta,
+			},
+		}))
+	}
+
+	// server-1 falls back to its plain port and server-2 is skipped.
+	addrs, err := serverAddresses(store, serverAddressOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1:8502", "10.0.0.3:65535"}, addrs)
+
+	// With only invalid ports there is nothing to return.
+	_, err = serverAddresses(store, serverAddressOptions{excludeNode: "server-3", portPrecedence: PeeringPortPrecedenceTLSOnly})
+	require.Equal(t, PeeringTokenErrorNoAddresses, PeeringTokenErrorCodeOf(err))
+}
+
+func TestServerAddresses_MaxAddresses(t *testing.T) {
+	store := state.NewStateStore(nil)
+	servers := []struct {
+		node, addr string
+		meta       map[string]string
+	}{
+		{"server-1", "10.0.0.1", map[string]string{"grpc_port": "8502", "non_voter": "true"}},
+		{"server-2", "10.0.0.2", map[string]string{"grpc_port": "8502"}},
+		{"server-3", "10.0.0.3", map[string]string{"grpc_tls_port": "8503"}},
+		{"server-4", "10.0.0.4", map[string]string{"grpc_tls_port": "8503", "read_replica": "true"}},
+		{"server-5", "10.0.0.5", map[string]string{"grpc_port": "8502"}},
+	}
+	for i, srv := range servers {
+		require.NoError(t, store.EnsureRegistration(uint64(i+1), &structs.RegisterRequest{
+			Node:    srv.node,
+			Address: srv.addr,
+			Service: &structs.NodeService{
+				ID:      "consul",
+				Service: "consul",
+				Meta:    srv.meta,
+			},
+		}))
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			addrs, err := serverAddresses(store, serverAddressOptions{maxAddresses: 3})
+			require.NoError(t, err)
+			// Voters first, preferring TLS, then non-voters.
+			require.Equal(t, []string{"10.0.0.2:8502", "10.0.0.3:8503", "10.0.0.5:8502"}, addrs)
+		}
+
+		addrs, err := serverAddresses(store, serverAddressOptions{maxAddresses: 4})
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.2:8502", "10.0.0.3:8503", "10.0.0.4:8503", "10.0.0.5:8502"}, addrs)
+	})
+
+	t.Run("fewer servers than the limit", func(t *testing.T) {
+		addrs, err := serverAddresses(store, serverAddressOptions{maxAddresses: 10})
+		require.NoError(t, err)
+		require.Len(t, addrs, len(servers))
+	})
+
+	t.Run("unlimited by default", func(t *testing.T) {
+		backend := NewPeeringBackend(&mockPeeringBackendServer{config: DefaultConfig(), store: store})
+		addrs, err := serverAddresses(store, backend.serverAddressOptions())
+		require.NoError(t, err)
+		require.Len(t, addrs, len(servers))
+	})
+}
+
+func TestPeeringBackend_ServerAddressDNSName(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.GRPCPort = 8502
+	cfg.GRPCTLSPort = 8503
+	cfg.PeeringServerAddressesCacheTTL = 0
+	srv := &mockPeeringBackendServer{config: cfg, store: state.NewStateStore(nil)}
+	backend := NewPeeringBackend(srv)
+
+	require.NoError(t, srv.store.EnsureRegistration(1, &structs.RegisterRequest{
+		Node:    "server-1",
+		Address: "10.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "consul",
+			Service: "consul",
+			Meta:    map[string]string{"grpc_tls_port": "8503"},
+		},
+	}))
+
+	testutil.RunStep(t, "server addresses by default", func(t *testing.T) {
+		addrs, err := backend.GetServerAddresses()
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.1:8503"}, addrs)
+	})
+
+	require.NoError(t, srv.store.EnsureConfigEntry(2, &structs.MeshConfigEntry{
+		Peering: &structs.PeeringMeshConfig{ServerAddressDNSName: "servers.dc1.example.com"},
+	}))
+
+	testutil.RunStep(t, "DNS name", func(t *testing.T) {
+		addrs, err := backend.GetServerAddresses()
+		require.NoError(t, err)
+		require.Equal(t, []string{"servers.dc1.example.com:8503"}, addrs)
+
+		servers, err := backend.GetServerAddressesWithTLS()
+		require.NoError(t, err)
+		require.Equal(t, []ServerAddress{{Addr: "servers.dc1.example.com:8503", TLS: true}}, servers)
+	})
+
+	testutil.RunStep(t, "DNS name follows port precedence", func(t *testing.T) {
+		cfg.PeeringServerPortPrecedence = PeeringPortPrecedencePlainFirst
+		servers, err := backend.GetServerAddressesWithTLS()
+		require.NoError(t, err)
+		require.Equal(t, []ServerAddress{{Addr: "servers.dc1.example.com:8502", TLS: false}}, servers)
+
+		cfg.PeeringServerPortPrecedence = PeeringPortPrecedenceTLSOnly
+		cfg.GRPCTLSPort = 0
+		_, err = backend.GetServerAddresses()
+		require.Equal(t, PeeringTokenErrorNoAddresses, PeeringTokenErrorCodeOf(err))
+	})
+}
+
+func TestServerAddressesWithTLS(t *testing.T) {
+	store := state.NewStateStore(nil)
+	servers := []struct {
+		node, addr string
+		meta       map[string]string
+	}{
+		{"tls-only", "10.0.0.1", map[string]string{"grpc_tls_port": "8503"}},
+		{"plain-only", "10.0.0.2", map[string]string{"grpc_port": "8502"}},
+		{"both", "10.0.0.3", map[string]string{"grpc_tls_port": "8503", "grpc_port": "8502"}},
+	}
+	for i, srv := range servers {
+		require.NoError(t, store.EnsureRegistration(uint64(i+1), &structs.RegisterRequest{
+			Node:    srv.node,
+			Address: srv.addr,
+			Service: &structs.NodeService{
+				ID:      "consul",
+				Service: "consul",
+				Meta:    srv.meta,
+			},
+		}))
+	}
+
+	t.Run("default precedence", func(t *testing.T) {
+		addrs, err := serverAddressesWithTLS(store, serverAddressOptions{})
+		require.NoError(t, err)
+		require.Equal(t, []ServerAddress{
+			{Addr: "10.0.0.1:8503", TLS: true},
+			{Addr: "10.0.0.2:8502", TLS: false},
+			{Addr: "10.0.0.3:8503", TLS: true},
+		}, addrs)
+	})
+
+	t.Run("plain first", func(t *testing.T) {
+		addrs, err := serverAddressesWithTLS(store, serverAddressOptions{portPrecedence: PeeringPortPrecedencePlainFirst})
+		require.NoError(t, err)
+		require.Equal(t, []ServerAddress{
+			{Addr: "10.0.0.1:8503", TLS: true},
+			{Addr: "10.0.0.2:8502", TLS: false},
+			{Addr: "10.0.0.3:8502", TLS: false},
+		}, addrs)
+	})
+
+	t.Run("matches serverAddresses", func(t *testing.T) {
+		withTLS, err := serverAddressesWithTLS(store, serverAddressOptions{})
+		require.NoError(t, err)
+		plain, err := serverAddresses(store, serverAddressOptions{})
+		require.NoError(t, err)
+		require.Len(t, plain, len(withTLS))
+		for i, addr := range withTLS {
+			require.Equal(t, addr.Addr, plain[i])
+		}
+	})
+}
+
+func TestPeeringBackend_GetServerAddressesWithTLSCache(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PeeringServerAddressesCacheTTL = time.Hour
+	srv := &mockPeeringBackendServer{config: cfg, store: state.NewStateStore(nil)}
+	backend := NewPeeringBackend(srv)
+
+	register := func(idx uint64, node, addr string) {
+		require.NoError(t, srv.store.EnsureRegistration(idx, &structs.RegisterRequest{
+			Node:    node,
+			Address: addr,
+			Service: &structs.NodeService{
+				ID:      "consul",
+				Service: "consul",
+				Meta:    map[string]string{"grpc_tls_port": "8503"},
+			},
+		}))
+	}
+	register(1, "server-1", "10.0.0.1")
+
+	servers, err := backend.GetServerAddressesWithTLS()
+	require.NoError(t, err)
+	require.Equal(t, []ServerAddress{{Addr: "10.0.0.1:8503", TLS: true}}, servers)
+
+	// Both methods are served from the cache until it expires.
+	register(2, "server-2", "10.0.0.2")
+
+	servers, err = backend.GetServerAddressesWithTLS()
+	require.NoError(t, err)
+	require.Equal(t, []ServerAddress{{Addr: "10.0.0.1:8503", TLS: true}}, servers)
+
+	addrs, err := backend.GetServerAddresses()
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1:8503"}, addrs)
+}
@@ -0,0 +1,574 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"sigs.k8s.io/yaml"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/grpc-external/services/peerstream"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/proto/pbpeering"
+	"github.com/hashicorp/consul/proto/pbpeerstream"
+)
+
+// ExportedServicesConfig returns the exported-services config entry for the
+// partition of the named peering, as written by the operator. It returns nil
+// if no exported-services config entry exists. The peering is looked up in the
+// partition of entMeta, where the token must be allowed to read peering data.
+func (b *PeeringBackend) ExportedServicesConfig(token, peeringName string, entMeta *acl.EnterpriseMeta) (*structs.ExportedServicesConfigEntry, error) {
+	if err := b.CheckPeeringReadPermission(token, entMeta); err != nil {
+		return nil, err
+	}
+	peering, err := b.peeringByNameInPartition(peeringName, entMeta.PartitionOrDefault())
+	if err != nil {
+		return nil, err
+	}
+	return b.exportedServicesConfig(peering)
+}
+
+func (b *PeeringBackend) exportedServicesConfig(peering *pbpeering.Peering) (*structs.ExportedServicesConfigEntry, error) {
+	// Exported service config entries are scoped to partitions so they are in the default namespace.
+	partitionMeta := structs.DefaultEnterpriseMetaInPartition(peering.PartitionOrDefault())
+
+	_, rawEntry, err := b.srv.PeeringState().ConfigEntry(nil, structs.ExportedServices, partitionMeta.PartitionOrDefault(), partitionMeta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exported-services config entry: %w", err)
+	}
+	if rawEntry == nil {
+		return nil, nil
+	}
+
+	entry, ok := rawEntry.(*structs.ExportedServicesConfigEntry)
+	if !ok {
+		return nil, fmt.Errorf("unexpected type %T for exported-services config entry", rawEntry)
+	}
+	return entry, nil
+}
+
+// ImportedServicesByPartition returns the services imported from the named
+// peer grouped by the partition they were exported from. The source
+// partition is taken from the SPIFFE ID replicated with each instance; when
+// an instance has none, the partition that exported the peer's trust bundle
+// is used.
+func (b *PeeringBackend) ImportedServicesByPartition(token, peeringName string, entMeta *acl.EnterpriseMeta) (map[string][]structs.ServiceName, error) {
+	if err := b.CheckPeeringReadPermission(token, entMeta); err != nil {
+		return nil, err
+	}
+	peering, err := b.peeringByNameInPartition(peeringName, entMeta.PartitionOrDefault())
+	if err != nil {
+		return nil, err
+	}
+
+	store := b.srv.PeeringState()
+	_, bundle, err := store.PeeringTrustBundleRead(nil, state.Query{
+		Value:          peering.Name,
+		EnterpriseMeta: *structs.NodeEnterpriseMetaInPartition(peering.Partition),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust bundle for peering %q: %w", peering.Name, err)
+	}
+	fallback := acl.DefaultPartitionName
+	if bundle != nil && bundle.ExportedPartition != "" {
+		fallback = bundle.ExportedPartition
+	}
+
+	_, nodes, err := store.ServiceDump(nil, "", false, structs.WildcardEnterpriseMetaInPartition(peering.PartitionOrDefault()), peering.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read services imported from peering %q: %w", peering.Name, err)
+	}
+
+	seen := make(map[string]map[structs.ServiceName]struct{})
+	result := make(map[string][]structs.ServiceName)
+	for _, csn := range nodes {
+		partition := fallback
+		if svc := csn.Service; svc.Connect.PeerMeta != nil && len(svc.Connect.PeerMeta.SpiffeID) > 0 {
+			if uri, err := connect.ParseCertURIFromString(svc.Connect.PeerMeta.SpiffeID[0]); err == nil {
+				if id, ok := uri.(*connect.SpiffeIDService); ok {
+					partition = id.Partition
+				}
+			}
+		}
+
+		sn := csn.Service.CompoundServiceName()
+		if seen[partition] == nil {
+			seen[partition] = make(map[structs.ServiceName]struct{})
+		}
+		if _, ok := seen[partition][sn]; ok {
+			continue
+		}
+		seen[partition][sn] = struct{}{}
+		result[partition] = append(result[partition], sn)
+	}
+	return result, nil
+}
+
+// PeeringConfigExport is the non-secret configuration of a peering, in a
+// form suitable for consumption by external tools.
+type PeeringConfigExport struct {
+	Name                string            `json:"name"`
+	Partition           string            `json:"partition,omitempty"`
+	PeerID              string            `json:"peer_id,omitempty"`
+	PeerServerName      string            `json:"peer_server_name,omitempty"`
+	PeerServerAddresses []string          `json:"peer_server_addresses,omitempty"`
+	PeerTrustDomain     string            `json:"peer_trust_domain,omitempty"`
+	Meta                map[string]string `json:"meta,omitempty"`
+	ImportHealthyOnly   bool              `json:"import_healthy_only"`
+	ImportConflict      string            `json:"import_conflict_strategy,omitempty"`
+	ExportedServices    []string          `json:"exported_services,omitempty"`
+}
+
+// ExportPeeringConfig returns the non-secret configuration of the named
+// peering encoded as "json" or "yaml". Reserved meta keys are omitted since
+// the options they hold are exported as dedicated fields. The peering is
+// looked up in the partition of entMeta, where the token must be allowed to
+// read peering data.
+func (b *PeeringBackend) ExportPeeringConfig(token, peeringName string, entMeta *acl.EnterpriseMeta, format string) ([]byte, error) {
+	if err := b.CheckPeeringReadPermission(token, entMeta); err != nil {
+		return nil, err
+	}
+	peering, err := b.peeringByNameInPartition(peeringName, entMeta.PartitionOrDefault())
+	if err != nil {
+		return nil, err
+	}
+
+	export := PeeringConfigExport{
+		Name:                peering.Name,
+		Partition:           peering.Partition,
+		PeerID:              peering.PeerID,
+		PeerServerName:      peering.PeerServerName,
+		PeerServerAddresses: peering.PeerServerAddresses,
+		ImportHealthyOnly:   peering.Meta[peeringMetaImportHealthyOnly] == "true",
+		ImportConflict:      peering.Meta[peeringMetaImportConflictStrategy],
+	}
+	for k, v := range peering.Meta {
+		if strings.HasPrefix(k, structs.MetaKeyReservedPrefix) {
+			continue
+		}
+		if export.Meta == nil {
+			export.Meta = make(map[string]string)
+		}
+		export.Meta[k] = v
+	}
+
+	_, bundle, err := b.srv.PeeringState().PeeringTrustBundleRead(nil, state.Query{
+		Value:          peering.Name,
+		EnterpriseMeta: *structs.NodeEnterpriseMetaInPartition(peering.Partition),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust bundle for peering %q: %w", peering.Name, err)
+	}
+	if bundle != nil {
+		export.PeerTrustDomain = bundle.TrustDomain
+	}
+
+	entry, err := b.exportedServicesConfig(peering)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		for _, svc := range entry.Services {
+			for _, consumer := range svc.Consumers {
+				if consumer.Peer == peering.Name {
+					export.ExportedServices = append(export.ExportedServices, svc.Name)
+					break
+				}
+			}
+		}
+	}
+
+	out, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode peering config: %w", err)
+	}
+	switch strings.ToLower(format) {
+	case "json":
+		return out, nil
+	case "yaml":
+		out, err = yaml.JSONToYAML(out)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode peering config: %w", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported peering config format %q", format)
+	}
+}
+
+// PeeringHealth describes a peering that needs operator attention.
+type PeeringHealth struct {
+	Name      string
+	ID        string
+	Partition string
+	State     pbpeering.PeeringState
+
+	// Connected is true when there is an open stream for the peer.
+	Connected bool
+
+	// LastError is the most relevant error reported by the replication stream, if any.
+	LastError string
+
+	// TrustBundleExpired is true when every root in the peer's trust bundle has expired.
+	TrustBundleExpired bool
+}
+
+// UnhealthyPeerings returns the active peerings, across all partitions, that
+// are failing, have an unhealthy replication stream, or whose trust bundle has
+// expired. Peerings in partitions where the token is not allowed to read
+// peering data are left out.
+func (b *PeeringBackend) UnhealthyPeerings(token string) ([]PeeringHealth, error) {
+	store := b.srv.PeeringState()
+	_, peerings, err := store.PeeringList(nil, *structs.NodeEnterpriseMetaInPartition(structs.WildcardSpecifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peerings: %w", err)
+	}
+
+	now := time.Now()
+	var result []PeeringHealth
+	for _, peering := range peerings {
+		if !peering.IsActive() {
+			continue
+		}
+		readable, err := b.peeringReadable(token, peering)
+		if err != nil {
+			return nil, err
+		}
+		if !readable {
+			continue
+		}
+
+		status, found := b.streamTracker().StreamStatus(peering.ID)
+		health := PeeringHealth{
+			Name:      peering.Name,
+			ID:        peering.ID,
+			Partition: peering.Partition,
+			State:     peering.State,
+			Connected: status.Connected,
+			LastError: lastStreamError(status),
+		}
+
+		_, bundle, err := store.PeeringTrustBundleRead(nil, state.Query{
+			Value:          peering.Name,
+			EnterpriseMeta: *structs.NodeEnterpriseMetaInPartition(peering.Partition),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trust bundle for peering %q: %w", peering.Name, err)
+		}
+		if bundle != nil {
+			health.TrustBundleExpired = allRootsExpired(bundle.RootPEMs, now)
+		}
+
+		unhealthy := peering.State == pbpeering.PeeringState_FAILING ||
+			health.TrustBundleExpired ||
+			(found && !b.streamTracker().IsHealthy(status))
+		if unhealthy {
+			result = append(result, health)
+		}
+	}
+	return result, nil
+}
+
+// PeeringSummary is a description of a peering that is safe to show in
+// dashboards. It never includes secrets or the peer's CA roots.
+type PeeringSummary struct {
+	Name      string
+	ID        string
+	Partition string
+	PeerID    string
+	State     pbpeering.PeeringState
+
+	// Meta holds the peering's user-provided meta. Reserved keys, some of
+	// which are derived from secrets, are omitted.
+	Meta map[string]string
+
+	ImportedServicesCount uint64
+	ExportedServicesCount uint64
+}
+
+// ListPeerings returns a summary of each peering in the given partition,
+// with any secret material stripped.
+func (b *PeeringBackend) ListPeerings(token string, entMeta *acl.EnterpriseMeta) ([]PeeringSummary, error) {
+	if err := b.EnterpriseCheckPartitions(entMeta.PartitionOrDefault()); err != nil {
+		return nil, err
+	}
+	if err := b.EnterpriseCheckNamespaces(entMeta.NamespaceOrDefault()); err != nil {
+		return nil, err
+	}
+	if err := b.CheckPeeringReadPermission(token, entMeta); err != nil {
+		return nil, err
+	}
+
+	_, peerings, err := b.srv.PeeringState().PeeringList(nil, *entMeta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peerings: %w", err)
+	}
+
+	result := make([]PeeringSummary, 0, len(peerings))
+	for _, peering := range peerings {
+		summary := PeeringSummary{
+			Name:      peering.Name,
+			ID:        peering.ID,
+			Partition: peering.Partition,
+			PeerID:    peering.PeerID,
+			State:     peering.State,
+		}
+		for k, v := range peering.Meta {
+			if strings.HasPrefix(k, structs.MetaKeyReservedPrefix) {
+				continue
+			}
+			if summary.Meta == nil {
+				summary.Meta = make(map[string]string)
+			}
+			summary.Meta[k] = v
+		}
+		if status, found := b.streamTracker().StreamStatus(peering.ID); found {
+			summary.ImportedServicesCount = status.GetImportedServicesCount()
+			summary.ExportedServicesCount = status.GetExportedServicesCount()
+		}
+		result = append(result, summary)
+	}
+	return result, nil
+}
+
+// AsymmetricPeeringError is returned by DetectAsymmetricPeering when the peer
+// does not appear to have a corresponding peering with this cluster.
+type AsymmetricPeeringError struct {
+	PeeringName string
+	Reason      string
+}
+
+func (e *AsymmetricPeeringError) Error() string {
+	return fmt.Sprintf("peering %q appears to be one-sided: %s", e.PeeringName, e.Reason)
+}
+
+// DetectAsymmetricPeering reports whether the peer has a peering back to
+// this cluster. Replication streams are only accepted between two matching
+// peerings, so a peer that has connected at some point is known to have one;
+// a peer that never connected, or that terminated the peering on its side,
+// does not. When the peering is one-sided, false is returned along with an
+// *AsymmetricPeeringError describing why. The peering is looked up in the
+// partition of entMeta, where the token must be allowed to read peering data.
+func (b *PeeringBackend) DetectAsymmetricPeering(token, peeringName string, entMeta *acl.EnterpriseMeta) (bool, error) {
+	if err := b.CheckPeeringReadPermission(token, entMeta); err != nil {
+		return false, err
+	}
+	peering, err := b.peeringByNameInPartition(peeringName, entMeta.PartitionOrDefault())
+	if err != nil {
+		return false, err
+	}
+
+	asymmetric := func(reason string) (bool, error) {
+		return false, &AsymmetricPeeringError{PeeringName: peering.Name, Reason: reason}
+	}
+
+	switch peering.State {
+	case pbpeering.PeeringState_PENDING:
+		return asymmetric("the generated token has not been used to establish a peering")
+	case pbpeering.PeeringState_TERMINATED:
+		return asymmetric("the peer has deleted its side of the peering")
+	}
+
+	status, found := b.streamTracker().StreamStatus(peering.ID)
+	if !found || status.NeverConnected {
+		return asymmetric("the peer has never opened a replication stream")
+	}
+	return true, nil
+}
+
+// NegotiatedProtocolVersion returns the replication protocol version agreed
+// with the named peer. Both sides of a stream advertise the highest version
+// they support when they subscribe to resources, and the lower of the two is
+// used. It returns an error if no version has been agreed upon, such as when
+// the peer has never connected.
+func (b *PeeringBackend) NegotiatedProtocolVersion(token, peeringName string, entMeta *acl.EnterpriseMeta) (int, error) {
+	if err := b.CheckPeeringReadPermission(token, entMeta); err != nil {
+		return 0, err
+	}
+	peering, err := b.peeringByNameInPartition(peeringName, entMeta.PartitionOrDefault())
+	if err != nil {
+		return 0, err
+	}
+	status, found := b.streamTracker().StreamStatus(peering.ID)
+	if !found || status.ProtocolVersion == 0 {
+		return 0, fmt.Errorf("no protocol version has been negotiated with peering %q", peeringName)
+	}
+	return int(status.ProtocolVersion), nil
+}
+
+// PeeringLastDataExchange returns the last time a replicated resource was
+// sent to or received from the named peer. Heartbeats and acknowledgements
+// are not counted. The zero time is returned if no data has been exchanged.
+func (b *PeeringBackend) PeeringLastDataExchange(token, peeringName string, entMeta *acl.EnterpriseMeta) (time.Time, error) {
+	if err := b.CheckPeeringReadPermission(token, entMeta); err != nil {
+		return time.Time{}, err
+	}
+	peering, err := b.peeringByNameInPartition(peeringName, entMeta.PartitionOrDefault())
+	if err != nil {
+		return time.Time{}, err
+	}
+	status, _ := b.streamTracker().StreamStatus(peering.ID)
+
+	last := status.LastRecvResourceSuccess
+	if status.LastSendSuccess.After(last) {
+		last = status.LastSendSuccess
+	}
+	return last, nil
+}
+
+// PeeringThroughput returns the average rate in bytes per second at which
+// replication messages were received from and sent to all peers over the
+// given window. Windows of up to one hour are supported.
+func (b *PeeringBackend) PeeringThroughput(window time.Duration) (inBps, outBps float64, err error) {
+	if window < time.Second || window > time.Hour {
+		return 0, 0, fmt.Errorf("throughput window must be between 1s and 1h, got %s", window)
+	}
+	inBps, outBps = b.streamTracker().Throughput(window)
+	return inBps, outBps, nil
+}
+
+// MissingRootsForPeer returns the PEMs of the local CA roots that were not
+// part of the trust bundle last sent to the named peer. If no trust bundle has
+// been sent yet, all roots are returned. The peering is looked up in the
+// partition of entMeta, where the token must be allowed to read peering data.
+func (b *PeeringBackend) MissingRootsForPeer(token, peeringName string, entMeta *acl.EnterpriseMeta) ([]string, error) {
+	if err := b.CheckPeeringReadPermission(token, entMeta); err != nil {
+		return nil, err
+	}
+	peering, err := b.peeringByNameInPartition(peeringName, entMeta.PartitionOrDefault())
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := b.srv.PeeringCARoots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch roots: %w", err)
+	}
+
+	status, _ := b.streamTracker().StreamStatus(peering.ID)
+	sent := make(map[string]struct{}, len(status.SentCARootPEMs))
+	for _, pem := range status.SentCARootPEMs {
+		sent[lib.EnsureTrailingNewline(pem)] = struct{}{}
+	}
+
+	var missing []string
+	for _, r := range roots.Roots {
+		pem := lib.EnsureTrailingNewline(r.RootCert)
+		if _, ok := sent[pem]; !ok {
+			missing = append(missing, pem)
+		}
+	}
+	return missing, nil
+}
+
+// ErrNotPeeringEndpoint is returned by VerifyGRPCEndpoint when the address
+// accepts gRPC connections but does not serve the peering stream service.
+var ErrNotPeeringEndpoint = errors.New("address does not serve the peering gRPC service")
+
+// VerifyGRPCEndpoint dials addr and issues an empty ExchangeSecret call to
+// check that it is a peering gRPC endpoint. Peering servers reject the call
+// with a known status: InvalidArgument with
+// peerstream.MissingExchangeSecretFieldsMessage, or PermissionDenied with
+// peerstream.InvalidEstablishmentSecretMessage for servers that predate the
+// former. Any other response means the address serves something else. TLS is
+// used when caPems is non-empty, verifying the server against serverName.
+func (b *PeeringBackend) VerifyGRPCEndpoint(addr string, timeout time.Duration, serverName string, caPems []string) error {
+	tlsOption, err := (&pbpeering.Peering{
+		PeerServerName: serverName,
+		PeerCAPems:     caPems,
+	}).TLSDialOption()
+	if err != nil {
+		return fmt.Errorf("failed to build TLS dial option: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, addr, tlsOption, grpc.WithBlock())
+	if err != nil {
+		return fmt.Errorf("failed to dial %q: %w", addr, err)
+	}
+	defer conn.Close()
+
+	_, err = pbpeerstream.NewPeerStreamServiceClient(conn).ExchangeSecret(ctx, &pbpeerstream.ExchangeSecretRequest{})
+	if err == nil {
+		return fmt.Errorf("%q accepted an empty secret exchange: %w", addr, ErrNotPeeringEndpoint)
+	}
+	st, ok := grpcstatus.FromError(err)
+	if !ok {
+		return fmt.Errorf("failed to call %q: %w", addr, err)
+	}
+	switch {
+	case st.Code() == codes.InvalidArgument && st.Message() == peerstream.MissingExchangeSecretFieldsMessage:
+		return nil
+	case st.Code() == codes.PermissionDenied && st.Message() == peerstream.InvalidEstablishmentSecretMessage:
+		return nil
+	case st.Code() == codes.Unavailable, st.Code() == codes.DeadlineExceeded:
+		return fmt.Errorf("failed to call %q: %w", addr, err)
+	}
+	return fmt.Errorf("%q: %w: %s", addr, ErrNotPeeringEndpoint, st.Message())
+}
+
+// DiagnosePeerServerAddresses runs VerifyGRPCEndpoint against each of the
+// server addresses of the named dialing peering. The result maps each address
+// to its verification error, or nil if it is a peering endpoint. The peering is
+// looked up in the partition of entMeta, where the token must be allowed to
+// read peering data.
+func (b *PeeringBackend) DiagnosePeerServerAddresses(token, peeringName string, entMeta *acl.EnterpriseMeta, timeout time.Duration) (map[string]error, error) {
+	if err := b.CheckPeeringReadPermission(token, entMeta); err != nil {
+		return nil, err
+	}
+	peering, err := b.peeringByNameInPartition(peeringName, entMeta.PartitionOrDefault())
+	if err != nil {
+		return nil, err
+	}
+	if !peering.ShouldDial() {
+		return nil, fmt.Errorf("peering %q was not established by dialing", peeringName)
+	}
+
+	result := make(map[string]error, len(peering.PeerServerAddresses))
+	for _, addr := range peering.PeerServerAddresses {
+		result[addr] = b.VerifyGRPCEndpoint(addr, timeout, peering.PeerServerName, peering.PeerCAPems)
+	}
+	return result, nil
+}
+
+// lastStreamError returns the most relevant error message from a stream status.
+func lastStreamError(status peerstream.Status) string {
+	for _, msg := range []string{
+		status.DisconnectErrorMessage,
+		status.LastRecvErrorMessage,
+		status.LastSendErrorMessage,
+		status.LastNackMessage,
+	} {
+		if msg != "" {
+			return msg
+		}
+	}
+	return ""
+}
+
+// allRootsExpired returns true if there is at least one root and every root
+// has expired as of now. Roots that cannot be parsed are treated as expired.
+func allRootsExpired(rootPEMs []string, now time.Time) bool {
+	if len(rootPEMs) == 0 {
+		return false
+	}
+	for _, pem := range rootPEMs {
+		cert, err := connect.ParseCert(pem)
+		if err == nil && now.Before(cert.NotAfter) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,572 @@
+package consul
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	gogrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/grpc-external/services/peerstream"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/proto/pbpeering"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeeringBackend_ExportedServicesConfig(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	store := srv.fsm.State()
+	require.NoError(t, store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Name: "my-peer"},
+	}))
+
+	testutil.RunStep(t, "unknown peering", func(t *testing.T) {
+		_, err := backend.ExportedServicesConfig("", "other-peer", nil)
+		testutil.RequireErrorContains(t, err, `no peering found with name "other-peer"`)
+	})
+
+	testutil.RunStep(t, "no config entry", func(t *testing.T) {
+		entry, err := backend.ExportedServicesConfig("", "my-peer", nil)
+		require.NoError(t, err)
+		require.Nil(t, entry)
+	})
+
+	testutil.RunStep(t, "config entry", func(t *testing.T) {
+		require.NoError(t, store.EnsureConfigEntry(11, &structs.ExportedServicesConfigEntry{
+			Name: "default",
+			Services: []structs.ExportedService{
+				{
+					Name:      "web",
+					Consumers: []structs.ServiceConsumer{{Peer: "my-peer"}},
+				},
+			},
+		}))
+
+		entry, err := backend.ExportedServicesConfig("", "my-peer", nil)
+		require.NoError(t, err)
+		require.NotNil(t, entry)
+		require.Len(t, entry.Services, 1)
+		require.Equal(t, "web", entry.Services[0].Name)
+	})
+}
+
+func TestAllRootsExpired(t *testing.T) {
+	now := time.Now()
+	valid := connect.TestCA(t, nil).RootCert
+	expired := connect.TestCAWithTTL(t, nil, -time.Minute).RootCert
+
+	cases := map[string]struct {
+		roots  []string
+		expect bool
+	}{
+		"no roots":       {roots: nil, expect: false},
+		"all valid":      {roots: []string{valid}, expect: false},
+		"mixed":          {roots: []string{expired, valid}, expect: false},
+		"all expired":    {roots: []string{expired}, expect: true},
+		"unparseable":    {roots: []string{"not a cert"}, expect: true},
+		"valid and junk": {roots: []string{"not a cert", valid}, expect: false},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expect, allRootsExpired(tc.roots, now))
+		})
+	}
+}
+
+func TestLastStreamError(t *testing.T) {
+	require.Equal(t, "", lastStreamError(peerstream.Status{}))
+	require.Equal(t, "nack", lastStreamError(peerstream.Status{LastNackMessage: "nack"}))
+	require.Equal(t, "disconnected", lastStreamError(peerstream.Status{
+		DisconnectErrorMessage: "disconnected",
+		LastSendErrorMessage:   "send failed",
+		LastNackMessage:        "nack",
+	}))
+}
+
+func TestPeeringBackend_UnhealthyPeerings(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	store := srv.fsm.State()
+	write := func(idx uint64, id, name string, peeringState pbpeering.PeeringState, root string) {
+		require.NoError(t, store.PeeringWrite(idx, &pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{ID: id, Name: name, State: peeringState},
+		}))
+		require.NoError(t, store.PeeringTrustBundleWrite(idx+1, &pbpeering.PeeringTrustBundle{
+			TrustDomain: "11111111-2222-3333-4444-555555555555.consul",
+			PeerName:    name,
+			RootPEMs:    []string{root},
+		}))
+	}
+	valid := connect.TestCA(t, nil).RootCert
+	expired := connect.TestCAWithTTL(t, nil, -time.Minute).RootCert
+
+	write(10, "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", "healthy", pbpeering.PeeringState_ACTIVE, valid)
+	write(12, "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e", "failing", pbpeering.PeeringState_FAILING, valid)
+	write(14, "5a8f1e2b-3c4d-4e5f-8a9b-0c1d2e3f4a5b", "expired", pbpeering.PeeringState_ACTIVE, expired)
+
+	unhealthy, err := backend.UnhealthyPeerings("")
+	require.NoError(t, err)
+
+	byName := make(map[string]PeeringHealth)
+	for _, h := range unhealthy {
+		byName[h.Name] = h
+	}
+	require.Len(t, byName, 2)
+	require.Equal(t, pbpeering.PeeringState_FAILING, byName["failing"].State)
+	require.False(t, byName["failing"].TrustBundleExpired)
+	require.True(t, byName["expired"].TrustBundleExpired)
+	require.False(t, byName["expired"].Connected)
+}
+
+func TestPeeringBackend_PeeringLastDataExchange(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	const peerID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+	require.NoError(t, srv.fsm.State().PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: peerID, Name: "my-peer"},
+	}))
+
+	testutil.RunStep(t, "unknown peering", func(t *testing.T) {
+		_, err := backend.PeeringLastDataExchange("", "other-peer", nil)
+		testutil.RequireErrorContains(t, err, `no peering found with name "other-peer"`)
+	})
+
+	status, err := srv.peerStreamServer.Tracker.Connected(peerID)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.peerStreamServer.Tracker.DeleteStatus(peerID) })
+
+	testutil.RunStep(t, "heartbeats are not data", func(t *testing.T) {
+		status.TrackRecvHeartbeat()
+		status.TrackAck()
+
+		last, err := backend.PeeringLastDataExchange("", "my-peer", nil)
+		require.NoError(t, err)
+		require.True(t, last.IsZero())
+	})
+
+	testutil.RunStep(t, "latest of sent and received", func(t *testing.T) {
+		status.TrackRecvResourceSuccess()
+		last, err := backend.PeeringLastDataExchange("", "my-peer", nil)
+		require.NoError(t, err)
+		require.Equal(t, status.GetStatus().LastRecvResourceSuccess, last)
+
+		time.Sleep(time.Millisecond)
+		status.TrackSendSuccess()
+		last, err = backend.PeeringLastDataExchange("", "my-peer", nil)
+		require.NoError(t, err)
+		require.Equal(t, status.GetStatus().LastSendSuccess, last)
+	})
+}
+
+func TestPeeringBackend_NegotiatedProtocolVersion(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	const peerID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+	require.NoError(t, srv.fsm.State().PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: peerID, Name: "my-peer"},
+	}))
+
+	testutil.RunStep(t, "unknown peering", func(t *testing.T) {
+		_, err := backend.NegotiatedProtocolVersion("", "other-peer", nil)
+		testutil.RequireErrorContains(t, err, `no peering found with name "other-peer"`)
+	})
+
+	testutil.RunStep(t, "never connected", func(t *testing.T) {
+		_, err := backend.NegotiatedProtocolVersion("", "my-peer", nil)
+		testutil.RequireErrorContains(t, err, `no protocol version has been negotiated with peering "my-peer"`)
+	})
+
+	status, err := srv.peerStreamServer.Tracker.Connected(peerID)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.peerStreamServer.Tracker.DeleteStatus(peerID) })
+
+	testutil.RunStep(t, "connected without subscriptions", func(t *testing.T) {
+		_, err := backend.NegotiatedProtocolVersion("", "my-peer", nil)
+		testutil.RequireErrorContains(t, err, "no protocol version has been negotiated")
+	})
+
+	testutil.RunStep(t, "negotiated", func(t *testing.T) {
+		status.TrackProtocolVersion(peerstream.ProtocolVersion)
+		version, err := backend.NegotiatedProtocolVersion("", "my-peer", nil)
+		require.NoError(t, err)
+		require.Equal(t, peerstream.ProtocolVersion, version)
+	})
+}
+
+func TestPeeringBackend_MissingRootsForPeer(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	const peerID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+	require.NoError(t, srv.fsm.State().PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: peerID, Name: "my-peer"},
+	}))
+
+	roots, err := srv.PeeringCARoots()
+	require.NoError(t, err)
+	require.NotEmpty(t, roots.Roots)
+	var pems []string
+	for _, r := range roots.Roots {
+		pems = append(pems, lib.EnsureTrailingNewline(r.RootCert))
+	}
+
+	testutil.RunStep(t, "unknown peering", func(t *testing.T) {
+		_, err := backend.MissingRootsForPeer("", "other-peer", nil)
+		testutil.RequireErrorContains(t, err, `no peering found with name "other-peer"`)
+	})
+
+	testutil.RunStep(t, "nothing sent yet", func(t *testing.T) {
+		missing, err := backend.MissingRootsForPeer("", "my-peer", nil)
+		require.NoError(t, err)
+		require.Equal(t, pems, missing)
+	})
+
+	status, err := srv.peerStreamServer.Tracker.Connected(peerID)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.peerStreamServer.Tracker.DeleteStatus(peerID) })
+
+	testutil.RunStep(t, "all roots sent", func(t *testing.T) {
+		status.TrackSentCARoots(pems)
+		missing, err := backend.MissingRootsForPeer("", "my-peer", nil)
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+}
+
+func TestPeeringBackend_ExportPeeringConfig(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	store := srv.fsm.State()
+	require.NoError(t, store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:                  "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+			Name:                "my-peer",
+			PeerID:              "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e",
+			PeerServerName:      "server.dc2.peering.11111111-2222-3333-4444-555555555555.consul",
+			PeerServerAddresses: []string{"10.0.0.1:8502"},
+			Meta: map[string]string{
+				"env":                        "prod",
+				peeringMetaImportHealthyOnly: "true",
+			},
+		},
+	}))
+	require.NoError(t, store.PeeringTrustBundleWrite(11, &pbpeering.PeeringTrustBundle{
+		TrustDomain: "11111111-2222-3333-4444-555555555555.consul",
+		PeerName:    "my-peer",
+		RootPEMs:    []string{"root"},
+	}))
+	require.NoError(t, store.EnsureConfigEntry(12, &structs.ExportedServicesConfigEntry{
+		Name: "default",
+		Services: []structs.ExportedService{
+			{Name: "web", Consumers: []structs.ServiceConsumer{{Peer: "my-peer"}}},
+			{Name: "db", Consumers: []structs.ServiceConsumer{{Peer: "other-peer"}}},
+		},
+	}))
+
+	expect := PeeringConfigExport{
+		Name:                "my-peer",
+		PeerID:              "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e",
+		PeerServerName:      "server.dc2.peering.11111111-2222-3333-4444-555555555555.consul",
+		PeerServerAddresses: []string{"10.0.0.1:8502"},
+		PeerTrustDomain:     "11111111-2222-3333-4444-555555555555.consul",
+		Meta:                map[string]string{"env": "prod"},
+		ImportHealthyOnly:   true,
+		ExportedServices:    []string{"web"},
+	}
+
+	testutil.RunStep(t, "json", func(t *testing.T) {
+		out, err := backend.ExportPeeringConfig("", "my-peer", nil, "json")
+		require.NoError(t, err)
+
+		var got PeeringConfigExport
+		require.NoError(t, json.Unmarshal(out, &got))
+		require.Equal(t, expect, got)
+		require.NotContains(t, string(out), peeringMetaImportHealthyOnly)
+	})
+
+	testutil.RunStep(t, "yaml", func(t *testing.T) {
+		out, err := backend.ExportPeeringConfig("", "my-peer", nil, "YAML")
+		require.NoError(t, err)
+		require.Contains(t, string(out), "name: my-peer\n")
+		require.Contains(t, string(out), "import_healthy_only: true\n")
+	})
+
+	testutil.RunStep(t, "unsupported format", func(t *testing.T) {
+		_, err := backend.ExportPeeringConfig("", "my-peer", nil, "toml")
+		testutil.RequireErrorContains(t, err, `unsupported peering config format "toml"`)
+	})
+}
+
+func TestPeeringBackend_DetectAsymmetricPeering(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	store := srv.fsm.State()
+	peerings := []*pbpeering.Peering{
+		{ID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Name: "pending", State: pbpeering.PeeringState_PENDING},
+		{ID: "5ebcff30-5509-4858-8142-a8e580f1863f", Name: "active", State: pbpeering.PeeringState_ACTIVE},
+		{ID: "c1ea1ef1-b8b0-4b1b-8e1c-3c4a2b1d7f60", Name: "terminated", State: pbpeering.PeeringState_ACTIVE},
+	}
+	for i, p := range peerings {
+		require.NoError(t, store.PeeringWrite(uint64(10+i), &pbpeering.PeeringWriteRequest{Peering: p}))
+	}
+
+	// New peerings can't be written as terminated, so terminate an existing one.
+	require.NoError(t, store.PeeringWrite(20, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: "c1ea1ef1-b8b0-4b1b-8e1c-3c4a2b1d7f60", Name: "terminated", State: pbpeering.PeeringState_TERMINATED},
+	}))
+
+	type testcase struct {
+		name      string
+		expectErr string
+		symmetric bool
+	}
+	run := func(t *testing.T, tc testcase) {
+		symmetric, err := backend.DetectAsymmetricPeering("", tc.name, nil)
+		require.Equal(t, tc.symmetric, symmetric)
+		if tc.expectErr == "" {
+			require.NoError(t, err)
+			return
+		}
+		testutil.RequireErrorContains(t, err, tc.expectErr)
+
+		var asymErr *AsymmetricPeeringError
+		if errors.As(err, &asymErr) {
+			require.Equal(t, tc.name, asymErr.PeeringName)
+		}
+	}
+
+	testutil.RunStep(t, "one-sided peerings", func(t *testing.T) {
+		tcs := []testcase{
+			{name: "pending", expectErr: "has not been used to establish a peering"},
+			{name: "terminated", expectErr: "has deleted its side of the peering"},
+			{name: "active", expectErr: "has never opened a replication stream"},
+			{name: "unknown", expectErr: `no peering found with name "unknown"`},
+		}
+		for _, tc := range tcs {
+			t.Run(tc.name, func(t *testing.T) {
+				run(t, tc)
+			})
+		}
+	})
+
+	testutil.RunStep(t, "peer has connected", func(t *testing.T) {
+		_, err := srv.peerStreamServer.Tracker.Connected("5ebcff30-5509-4858-8142-a8e580f1863f")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			srv.peerStreamServer.Tracker.DeleteStatus("5ebcff30-5509-4858-8142-a8e580f1863f")
+		})
+
+		run(t, testcase{name: "active", symmetric: true})
+	})
+}
+
+func TestPeeringBackend_ImportedServicesByPartition(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	store := srv.fsm.State()
+	require.NoError(t, store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:   "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+			Name: "my-peer",
+		},
+	}))
+	require.NoError(t, store.PeeringTrustBundleWrite(11, &pbpeering.PeeringTrustBundle{
+		TrustDomain:       "11111111-2222-3333-4444-555555555555.consul",
+		PeerName:          "my-peer",
+		ExportedPartition: "ap1",
+		RootPEMs:          []string{"root"},
+	}))
+
+	register := func(idx uint64, node, service, spiffeID string) {
+		svc := &structs.NodeService{
+			ID:       service + "-" + node,
+			Service:  service,
+			Port:     8080,
+			PeerName: "my-peer",
+		}
+		if spiffeID != "" {
+			svc.Connect.PeerMeta = &structs.PeeringServiceMeta{SpiffeID: []string{spiffeID}}
+		}
+		require.NoError(t, store.EnsureRegistration(idx, &structs.RegisterRequest{
+			Node:     node,
+			Address:  "10.0.0.1",
+			PeerName: "my-peer",
+			Service:  svc,
+		}))
+	}
+	register(12, "node-1", "web", "spiffe://11111111-2222-3333-4444-555555555555.consul/ap/ap2/ns/default/dc/dc2/svc/web")
+	register(13, "node-2", "web", "spiffe://11111111-2222-3333-4444-555555555555.consul/ap/ap2/ns/default/dc/dc2/svc/web")
+	register(14, "node-1", "db", "")
+	register(15, "node-1", "api", "not-a-spiffe-id")
+
+	testutil.RunStep(t, "grouped by source partition", func(t *testing.T) {
+		got, err := backend.ImportedServicesByPartition("", "my-peer", nil)
+		require.NoError(t, err)
+
+		expect := map[string][]structs.ServiceName{
+			"ap1": {structs.NewServiceName("api", nil), structs.NewServiceName("db", nil)},
+			"ap2": {structs.NewServiceName("web", nil)},
+		}
+		require.Len(t, got, len(expect))
+		for partition, services := range expect {
+			require.ElementsMatch(t, services, got[partition])
+		}
+	})
+
+	testutil.RunStep(t, "unknown peering", func(t *testing.T) {
+		_, err := backend.ImportedServicesByPartition("", "unknown", nil)
+		testutil.RequireErrorContains(t, err, `no peering found with name "unknown"`)
+	})
+}
+
+func TestPeeringBackend_ListPeerings(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	const (
+		peerID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+		secret = "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84"
+	)
+	store := srv.fsm.State()
+	require.NoError(t, store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:         peerID,
+			Name:       "my-peer",
+			PeerID:     "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e",
+			PeerCAPems: []string{"ca-pem"},
+			Meta: map[string]string{
+				"team":                       "payments",
+				peeringMetaImportHealthyOnly: "true",
+			},
+		},
+	}))
+	require.NoError(t, store.PeeringSecretsWrite(11, &pbpeering.SecretsWriteRequest{
+		PeerID: peerID,
+		Request: &pbpeering.SecretsWriteRequest_GenerateToken{
+			GenerateToken: &pbpeering.SecretsWriteRequest_GenerateTokenRequest{
+				EstablishmentSecret: secret,
+			},
+		},
+	}))
+
+	summaries, err := backend.ListPeerings("", structs.DefaultEnterpriseMetaInDefaultPartition())
+	require.NoError(t, err)
+	require.Equal(t, []PeeringSummary{{
+		Name:   "my-peer",
+		ID:     peerID,
+		PeerID: "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e",
+		State:  pbpeering.PeeringState_PENDING,
+		Meta:   map[string]string{"team": "payments"},
+	}}, summaries)
+
+	out, err := json.Marshal(summaries)
+	require.NoError(t, err)
+	require.NotContains(t, string(out), secret)
+	require.NotContains(t, string(out), "ca-pem")
+}
+
+func TestPeeringBackend_VerifyGRPCEndpoint_WrongService(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// A gRPC server with no registered services rejects every call with Unimplemented.
+	srv := gogrpc.NewServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	backend := &PeeringBackend{}
+	err = backend.VerifyGRPCEndpoint(lis.Addr().String(), 5*time.Second, "", nil)
+	require.ErrorIs(t, err, ErrNotPeeringEndpoint)
+}
+
+// startStatusGRPCServer starts a gRPC server that answers every call with the
+// given status and returns its address.
+func startStatusGRPCServer(t *testing.T, code codes.Code, msg string) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := gogrpc.NewServer(gogrpc.UnknownServiceHandler(func(interface{}, gogrpc.ServerStream) error {
+		return grpcstatus.Error(code, msg)
+	}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	return lis.Addr().String()
+}
+
+func TestPeeringBackend_VerifyGRPCEndpoint_Status(t *testing.T) {
+	cases := map[string]struct {
+		code     codes.Code
+		msg      string
+		expectOK bool
+	}{
+		"missing fields": {
+			code:     codes.InvalidArgument,
+			msg:      peerstream.MissingExchangeSecretFieldsMessage,
+			expectOK: true,
+		},
+		"invalid secret from older servers": {
+			code:     codes.PermissionDenied,
+			msg:      peerstream.InvalidEstablishmentSecretMessage,
+			expectOK: true,
+		},
+		"other invalid argument": {
+			code: codes.InvalidArgument,
+			msg:  "malformed request",
+		},
+		"other permission denied": {
+			code: codes.PermissionDenied,
+			msg:  "permission denied",
+		},
+	}
+	backend := &PeeringBackend{}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			addr := startStatusGRPCServer(t, tc.code, tc.msg)
+			err := backend.VerifyGRPCEndpoint(addr, 5*time.Second, "", nil)
+			if tc.expectOK {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrNotPeeringEndpoint)
+			}
+		})
+	}
+}
+
+func TestPeeringBackend_DiagnosePeerServerAddresses(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	good := startStatusGRPCServer(t, codes.InvalidArgument, peerstream.MissingExchangeSecretFieldsMessage)
+	bad := startStatusGRPCServer(t, codes.Unimplemented, "unknown service")
+
+	store := srv.fsm.State()
+	require.NoError(t, store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:                  "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+			Name:                "dialer",
+			PeerServerAddresses: []string{good, bad},
+		},
+	}))
+	require.NoError(t, store.PeeringWrite(11, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e", Name: "acceptor"},
+	}))
+
+	testutil.RunStep(t, "accepting peering", func(t *testing.T) {
+		_, err := backend.DiagnosePeerServerAddresses("", "acceptor", nil, 5*time.Second)
+		testutil.RequireErrorContains(t, err, `peering "acceptor" was not established by dialing`)
+	})
+
+	testutil.RunStep(t, "verifies each address", func(t *testing.T) {
+		result, err := backend.DiagnosePeerServerAddresses("", "dialer", nil, 5*time.Second)
+		require.NoError(t, err)
+		require.Len(t, result, 2)
+		require.NoError(t, result[good])
+		require.ErrorIs(t, result[bad], ErrNotPeeringEndpoint)
+	})
+}
@@ -0,0 +1,725 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	hashstructure_v2 "github.com/mitchellh/hashstructure/v2"
+	"golang.org/x/time/rate"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/proto/pbpeering"
+)
+
+func (b *PeeringBackend) CatalogRegister(req *structs.RegisterRequest) error {
+	if err := b.checkRegistrationTenancy(req); err != nil {
+		return err
+	}
+	var peering *pbpeering.Peering
+	if req.PeerName != "" {
+		var err error
+		peering, err = b.peeringRead(req.PeerName, req.PartitionOrDefault())
+		if err != nil {
+			return err
+		}
+	}
+	return b.catalogRegister(req, peering)
+}
+
+// catalogRegister registers req, whose tenancy has been checked. For imported
+// registrations, peering is the peering that req was imported from, or nil if
+// it does not exist.
+func (b *PeeringBackend) catalogRegister(req *structs.RegisterRequest, peering *pbpeering.Peering) error {
+	if req.PeerName != "" {
+		prepared, err := b.prepareImportedRegistration(req, peering)
+		if err != nil {
+			return err
+		}
+		if prepared == nil {
+			return nil
+		}
+		req = prepared
+	}
+	return b.applyCatalogRegister(req)
+}
+
+// prepareImportedRegistration runs the checks and import policies of the
+// peering that req was imported from. It returns the registration to apply,
+// which may have had services or checks filtered out, or nil if nothing
+// should be applied.
+func (b *PeeringBackend) prepareImportedRegistration(req *structs.RegisterRequest, peering *pbpeering.Peering) (*structs.RegisterRequest, error) {
+	if peering.GetState() == pbpeering.PeeringState_QUARANTINED {
+		return nil, fmt.Errorf("skipped registration of node %q imported from peer %q: %w", req.Node, req.PeerName, ErrPeeringQuarantined)
+	}
+	if err := b.checkImportedRegistration(req); err != nil {
+		return nil, err
+	}
+	req, err := b.filterImportKinds(req, peering)
+	if err != nil {
+		return nil, err
+	}
+	if req.Service != nil {
+		skip, err := b.resolveImportConflict(req, peering)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return nil, nil
+		}
+	}
+	if len(req.Checks) > 0 {
+		req, err = b.dropCriticalImports(req, peering)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// applyCatalogRegister applies req through raft, unless it is an imported
+// registration identical to the last one applied and deduplication is
+// enabled.
+func (b *PeeringBackend) applyCatalogRegister(req *structs.RegisterRequest) error {
+	var (
+		dedupeKey  string
+		dedupeHash uint64
+	)
+	if req.PeerName != "" && b.srv.PeeringConfig().PeeringDedupeCatalogRegister {
+		var unchanged bool
+		dedupeKey, dedupeHash, unchanged = b.registrationUnchanged(req)
+		if unchanged {
+			return nil
+		}
+	}
+	_, err := b.srv.PeeringLeaderRaftApply("Catalog.Register", structs.RegisterRequestType, req)
+	if err != nil {
+		b.log().Error("failed to register imported node", "peering_name", req.PeerName, "node", req.Node, "error", err)
+		b.forgetRegistrations(req.PeerName, req.PartitionOrDefault(), req.Node)
+		return err
+	}
+	if dedupeKey != "" {
+		b.registrationHashesLock.Lock()
+		if b.registrationHashes == nil {
+			b.registrationHashes = make(map[string]uint64)
+		}
+		b.registrationHashes[dedupeKey] = dedupeHash
+		b.registrationHashesLock.Unlock()
+	}
+	return nil
+}
+
+// registrationKeyPrefix returns the prefix of the registrationHashes keys for
+// the instances on an imported node.
+func registrationKeyPrefix(peerName, partition, node string) string {
+	return strings.Join([]string{partition, peerName, node}, "\x00") + "\x00"
+}
+
+// registrationKey returns the registrationHashes key for req. Besides the
+// node and service it includes the shape of the registration, so that
+// registering a node alone and registering the checks on it do not overwrite
+// each other's hash.
+func registrationKey(req *structs.RegisterRequest) string {
+	shape := "node"
+	if req.Service != nil {
+		shape = "service/" + req.Service.ID
+	}
+	if len(req.Checks) > 0 || req.Check != nil {
+		shape += "+checks"
+	}
+	return registrationKeyPrefix(req.PeerName, req.PartitionOrDefault(), req.Node) + shape
+}
+
+// registrationUnchanged reports whether req is identical to the last
+// registration of the same shape applied for the same imported node, and
+// what it registered is still in the catalog. It also returns the key and
+// hash to record once req is applied. The key is empty if req cannot be
+// hashed.
+func (b *PeeringBackend) registrationUnchanged(req *structs.RegisterRequest) (string, uint64, bool) {
+	hash, err := hashstructure_v2.Hash(req, hashstructure_v2.FormatV2, nil)
+	if err != nil {
+		return "", 0, false
+	}
+	key := registrationKey(req)
+
+	b.registrationHashesLock.Lock()
+	last, ok := b.registrationHashes[key]
+	b.registrationHashesLock.Unlock()
+	if !ok || last != hash {
+		return key, hash, false
+	}
+
+	// What was registered may have been removed by something other than this
+	// backend, such as the cleanup of a deleted peering, in which case it
+	// must be registered again.
+	store := b.srv.PeeringState()
+	if req.Service != nil {
+		_, svc, err := store.NodeService(nil, req.Node, req.Service.ID, &req.Service.EnterpriseMeta, req.PeerName)
+		if err != nil || svc == nil {
+			return key, hash, false
+		}
+	} else {
+		_, node, err := store.GetNode(req.Node, &req.EnterpriseMeta, req.PeerName)
+		if err != nil || node == nil {
+			return key, hash, false
+		}
+	}
+	checks := req.Checks
+	if req.Check != nil {
+		checks = append(structs.HealthChecks{req.Check}, checks...)
+	}
+	for _, chk := range checks {
+		_, existing, err := store.NodeCheck(req.Node, chk.CheckID, &chk.EnterpriseMeta, req.PeerName)
+		if err != nil || existing == nil {
+			return key, hash, false
+		}
+	}
+	return key, hash, true
+}
+
+// forgetRegistrations discards the registration hashes recorded for an
+// imported node, so that its next registration is always applied.
+func (b *PeeringBackend) forgetRegistrations(peerName, partition, node string) {
+	b.forgetRegistrationsWithPrefix(registrationKeyPrefix(peerName, partition, node))
+}
+
+// forgetPeerRegistrations discards the registration hashes recorded for every
+// node imported from a peer.
+func (b *PeeringBackend) forgetPeerRegistrations(peerName, partition string) {
+	b.forgetRegistrationsWithPrefix(strings.Join([]string{partition, peerName}, "\x00") + "\x00")
+}
+
+func (b *PeeringBackend) forgetRegistrationsWithPrefix(prefix string) {
+	b.registrationHashesLock.Lock()
+	defer b.registrationHashesLock.Unlock()
+	for key := range b.registrationHashes {
+		if strings.HasPrefix(key, prefix) {
+			delete(b.registrationHashes, key)
+		}
+	}
+}
+
+// checkRegistrationTenancy checks that the partition and namespaces of a
+// registration exist before it is applied, so that a malformed request fails
+// with a clear error rather than in raft.
+func (b *PeeringBackend) checkRegistrationTenancy(req *structs.RegisterRequest) error {
+	if err := b.checkTenancy(&req.EnterpriseMeta); err != nil {
+		return fmt.Errorf("cannot register node %q: %w", req.Node, err)
+	}
+	if req.Service != nil {
+		if err := b.checkTenancy(&req.Service.EnterpriseMeta); err != nil {
+			return fmt.Errorf("cannot register service %q on node %q: %w", req.Service.ID, req.Node, err)
+		}
+	}
+	for _, check := range req.Checks {
+		if err := b.checkTenancy(&check.EnterpriseMeta); err != nil {
+			return fmt.Errorf("cannot register check %q on node %q: %w", check.CheckID, req.Node, err)
+		}
+	}
+	if req.Check != nil {
+		if err := b.checkTenancy(&req.Check.EnterpriseMeta); err != nil {
+			return fmt.Errorf("cannot register check %q on node %q: %w", req.Check.CheckID, req.Node, err)
+		}
+	}
+	return nil
+}
+
+func (b *PeeringBackend) checkTenancy(entMeta *acl.EnterpriseMeta) error {
+	if err := b.EnterpriseCheckPartitions(entMeta.PartitionOrEmpty()); err != nil {
+		return err
+	}
+	return b.EnterpriseCheckNamespaces(entMeta.NamespaceOrEmpty())
+}
+
+// checkImportedRegistration performs the checks on a registration imported
+// from a peer that depend only on the registration itself.
+func (b *PeeringBackend) checkImportedRegistration(req *structs.RegisterRequest) error {
+	if req.Service != nil {
+		if err := b.EnsureImportNamespace(req.Service.NamespaceOrEmpty(), &req.Service.EnterpriseMeta); err != nil {
+			return fmt.Errorf("cannot import service %q from peer %q: %w", req.Service.Service, req.PeerName, err)
+		}
+	}
+	if err := b.srv.PeeringConfig().PeeringImportLimits.check(req); err != nil {
+		return fmt.Errorf("rejected registration imported from peer %q: %w", req.PeerName, err)
+	}
+	return nil
+}
+
+// CatalogRegisterBatchError reports which registrations in a call to
+// CatalogRegisterBatch failed. Registrations not listed were applied.
+type CatalogRegisterBatchError struct {
+	// Failures maps the index of each failed registration to its error.
+	Failures map[int]error
+}
+
+func (e *CatalogRegisterBatchError) Error() string {
+	indexes := make([]int, 0, len(e.Failures))
+	for i := range e.Failures {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	msgs := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		msgs = append(msgs, fmt.Sprintf("registration %d: %v", i, e.Failures[i]))
+	}
+	return fmt.Sprintf("%d of the catalog registrations failed: %s", len(indexes), strings.Join(msgs, "; "))
+}
+
+// CatalogRegisterBatch registers each of the given requests, in order, like
+// CatalogRegister. Consecutive registrations for the same node are coalesced
+// into a single raft apply, which greatly reduces raft load when the peer
+// stream imports a peer's catalog, and coalesced registrations that are
+// unchanged are skipped like in CatalogRegister. Registrations from peers with
+// import policies that inspect the catalog, or that are quarantined, are
+// applied one at a time through CatalogRegister since their outcome depends on
+// the preceding registrations.
+// For peerings that import healthy instances only, service registrations whose
+// checks elsewhere in reqs are critical are left out.
+// The peerings that reqs were imported from are read once for the whole batch.
+//
+// If any registration fails the others are still attempted, and a
+// *CatalogRegisterBatchError is returned.
+func (b *PeeringBackend) CatalogRegisterBatch(reqs []*structs.RegisterRequest) error {
+	failures := make(map[int]error)
+
+	var pending []registerBatch
+	flush := func() {
+		for _, batch := range pending {
+			if err := b.applyCatalogRegister(batch.req); err != nil {
+				for _, i := range batch.indexes {
+					failures[i] = err
+				}
+			}
+		}
+		pending = nil
+	}
+
+	peerings, err := b.importPeerings(reqs)
+	if err != nil {
+		return err
+	}
+	skip := skipCriticalImports(reqs, peerings)
+
+	for i, req := range reqs {
+		if err := b.checkRegistrationTenancy(req); err != nil {
+			failures[i] = err
+			continue
+		}
+		if _, ok := skip[i]; ok {
+			continue
+		}
+		peering := peerings[importPeeringKeyFor(req)]
+		if !registrationBatchable(req, peering) {
+			flush()
+			if err := b.catalogRegister(req, peering); err != nil {
+				failures[i] = err
+			}
+			continue
+		}
+		if req.PeerName != "" {
+			if err := b.checkImportedRegistration(req); err != nil {
+				failures[i] = err
+				continue
+			}
+		}
+		pending = appendRegisterBatch(pending, i, req)
+	}
+	flush()
+
+	if len(failures) > 0 {
+		return &CatalogRegisterBatchError{Failures: failures}
+	}
+	return nil
+}
+
+// importPeeringKey identifies the peering that a registration was imported
+// from.
+type importPeeringKey struct {
+	peer, partition string
+}
+
+func importPeeringKeyFor(req *structs.RegisterRequest) importPeeringKey {
+	return importPeeringKey{peer: req.PeerName, partition: req.PartitionOrDefault()}
+}
+
+// importPeerings reads each peering that the registrations in reqs were
+// imported from once, so that the import policies of a batch do not read the
+// same peering for every registration. Peerings that do not exist map to nil.
+func (b *PeeringBackend) importPeerings(reqs []*structs.RegisterRequest) (map[importPeeringKey]*pbpeering.Peering, error) {
+	peerings := make(map[importPeeringKey]*pbpeering.Peering)
+	for _, req := range reqs {
+		if req.PeerName == "" {
+			continue
+		}
+		key := importPeeringKeyFor(req)
+		if _, ok := peerings[key]; ok {
+			continue
+		}
+		peering, err := b.peeringRead(key.peer, key.partition)
+		if err != nil {
+			return nil, err
+		}
+		peerings[key] = peering
+	}
+	return peerings, nil
+}
+
+// registrationBatchable reports whether req can be coalesced with other
+// registrations. Registrations imported from a peer cannot be if the peering
+// has options that make CatalogRegister consult or modify the catalog.
+func registrationBatchable(req *structs.RegisterRequest, peering *pbpeering.Peering) bool {
+	if req.PeerName == "" {
+		return true
+	}
+	if peering.GetState() == pbpeering.PeeringState_QUARANTINED {
+		return false
+	}
+	meta := peering.GetMeta()
+	for _, key := range []string{
+		peeringMetaImportServiceKinds,
+		peeringMetaImportConflictStrategy,
+		peeringMetaImportHealthyOnly,
+	} {
+		if meta[key] != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// registerBatch is a registration coalesced from one or more requests, along
+// with the indexes of those requests.
+type registerBatch struct {
+	req     *structs.RegisterRequest
+	indexes []int
+}
+
+// appendRegisterBatch merges req into the last batch if possible, or starts a
+// new batch with a copy of req otherwise.
+func appendRegisterBatch(batches []registerBatch, index int, req *structs.RegisterRequest) []registerBatch {
+	if n := len(batches); n > 0 && canMergeRegisterRequests(batches[n-1].req, req) {
+		last := &batches[n-1]
+		if last.req.Service == nil {
+			last.req.Service = req.Service
+		}
+		last.req.Checks = append(last.req.Checks, req.Checks...)
+		last.indexes = append(last.indexes, index)
+		return batches
+	}
+
+	merged := *req
+	merged.Checks = append(structs.HealthChecks(nil), req.Checks...)
+	return append(batches, registerBatch{req: &merged, indexes: []int{index}})
+}
+
+// canMergeRegisterRequests reports whether b can be applied as part of a.
+// Both must describe the same node identically, and between them register at
+// most one service, since a RegisterRequest holds only one.
+func canMergeRegisterRequests(a, b *structs.RegisterRequest) bool {
+	switch {
+	case a.Service != nil && b.Service != nil:
+		return false
+	case a.Check != nil || b.Check != nil:
+		return false
+	case a.Datacenter != b.Datacenter,
+		a.Node != b.Node,
+		a.ID != b.ID,
+		a.Address != b.Address,
+		a.PeerName != b.PeerName,
+		a.SkipNodeUpdate != b.SkipNodeUpdate:
+		return false
+	}
+	return reflect.DeepEqual(a.TaggedAddresses, b.TaggedAddresses) &&
+		reflect.DeepEqual(a.NodeMeta, b.NodeMeta) &&
+		reflect.DeepEqual(a.EnterpriseMeta, b.EnterpriseMeta)
+}
+
+// PeeringImportLimits bounds the size of catalog registrations imported from
+// peers, protecting the state store from a misbehaving peer. A zero value for
+// any limit means that it is not enforced.
+type PeeringImportLimits struct {
+	// MaxServiceTags is the maximum number of tags on an imported service.
+	MaxServiceTags int
+
+	// MaxServiceMetaBytes is the maximum combined size of the keys and values
+	// of an imported service's meta.
+	MaxServiceMetaBytes int
+
+	// MaxChecks is the maximum number of checks in a single registration.
+	MaxChecks int
+}
+
+func (l PeeringImportLimits) check(req *structs.RegisterRequest) error {
+	if svc := req.Service; svc != nil {
+		if l.MaxServiceTags > 0 && len(svc.Tags) > l.MaxServiceTags {
+			return fmt.Errorf("service %q has %d tags, exceeding the limit of %d", svc.Service, len(svc.Tags), l.MaxServiceTags)
+		}
+		if l.MaxServiceMetaBytes > 0 {
+			var size int
+			for k, v := range svc.Meta {
+				size += len(k) + len(v)
+			}
+			if size > l.MaxServiceMetaBytes {
+				return fmt.Errorf("service %q has %d bytes of meta, exceeding the limit of %d", svc.Service, size, l.MaxServiceMetaBytes)
+			}
+		}
+	}
+
+	numChecks := len(req.Checks)
+	if req.Check != nil {
+		numChecks++
+	}
+	if l.MaxChecks > 0 && numChecks > l.MaxChecks {
+		return fmt.Errorf("node %q has %d checks, exceeding the limit of %d", req.Node, numChecks, l.MaxChecks)
+	}
+	return nil
+}
+
+// filterImportKinds applies the import service kind allowlist of the peering
+// that req was imported from. A disallowed service is removed from the
+// request and deregistered if it was imported earlier, along with its checks.
+// Checks for other services that are not in the catalog are dropped, since
+// their service was filtered.
+func (b *PeeringBackend) filterImportKinds(req *structs.RegisterRequest, peering *pbpeering.Peering) (*structs.RegisterRequest, error) {
+	allowlist := peering.GetMeta()[peeringMetaImportServiceKinds]
+	if allowlist == "" {
+		return req, nil
+	}
+
+	filtered := *req
+	if svc := req.Service; svc != nil && !importServiceKindAllowed(allowlist, svc.Kind) {
+		filtered.Service = nil
+
+		// Only deregister services that were imported before the allowlist
+		// changed, to avoid a raft write for every filtered message.
+		_, existing, err := b.srv.PeeringState().NodeService(nil, req.Node, svc.ID, &svc.EnterpriseMeta, req.PeerName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service %q: %w", svc.ID, err)
+		}
+		if existing != nil {
+			err := b.CatalogDeregister(&structs.DeregisterRequest{
+				Node:           req.Node,
+				ServiceID:      svc.ID,
+				EnterpriseMeta: svc.EnterpriseMeta,
+				PeerName:       req.PeerName,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to deregister service %q imported from peer %q: %w", svc.ID, req.PeerName, err)
+			}
+		}
+	}
+
+	if len(req.Checks) > 0 {
+		filtered.Checks = nil
+		for _, chk := range req.Checks {
+			if req.Service != nil && chk.ServiceID == req.Service.ID {
+				if filtered.Service == nil {
+					continue
+				}
+			} else if chk.ServiceID != "" {
+				_, svc, err := b.srv.PeeringState().NodeService(nil, req.Node, chk.ServiceID, &chk.EnterpriseMeta, req.PeerName)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read service %q: %w", chk.ServiceID, err)
+				}
+				if svc == nil {
+					continue
+				}
+			}
+			filtered.Checks = append(filtered.Checks, chk)
+		}
+	}
+	return &filtered, nil
+}
+
+// resolveImportConflict applies the import conflict strategy of the peering
+// that req was imported from. It returns true if the registration should be
+// skipped because the existing catalog entry takes precedence.
+func (b *PeeringBackend) resolveImportConflict(req *structs.RegisterRequest, peering *pbpeering.Peering) (bool, error) {
+	if peering == nil {
+		return false, nil
+	}
+	strategy := PeeringImportConflictStrategy(peering.Meta[peeringMetaImportConflictStrategy])
+	if strategy == "" || strategy == PeeringImportConflictPeerWins {
+		return false, nil
+	}
+
+	_, existing, err := b.srv.PeeringState().NodeService(nil, req.Node, req.Service.ID, &req.Service.EnterpriseMeta, req.PeerName)
+	if err != nil {
+		return false, fmt.Errorf("failed to read imported service %q: %w", req.Service.ID, err)
+	}
+	if existing == nil || existing.IsSame(req.Service) {
+		return false, nil
+	}
+
+	switch strategy {
+	case PeeringImportConflictLocalWins:
+		return true, nil
+	case PeeringImportConflictReject:
+		return false, fmt.Errorf("service %q on node %q from peer %q: %w", req.Service.ID, req.Node, req.PeerName, ErrPeeringImportConflict)
+	}
+	return false, nil
+}
+
+// dropCriticalImports enforces the import-healthy-only option of a peering.
+// Instances with a critical check in req are removed from it along with their
+// checks, and deregistered if they were imported earlier. The instances are
+// imported again once the peer reports them as healthy.
+func (b *PeeringBackend) dropCriticalImports(req *structs.RegisterRequest, peering *pbpeering.Peering) (*structs.RegisterRequest, error) {
+	if peering == nil || peering.Meta[peeringMetaImportHealthyOnly] != "true" {
+		return req, nil
+	}
+
+	critical, nodeCritical := criticalImportedServices(req.Checks)
+	if nodeCritical && req.Service != nil {
+		critical[req.Service.ID] = req.Service.EnterpriseMeta
+	}
+	if len(critical) == 0 {
+		return req, nil
+	}
+
+	filtered := *req
+	if req.Service != nil {
+		if _, ok := critical[req.Service.ID]; ok {
+			filtered.Service = nil
+		}
+	}
+	filtered.Checks = nil
+	for _, chk := range req.Checks {
+		if _, ok := critical[chk.ServiceID]; !ok {
+			filtered.Checks = append(filtered.Checks, chk)
+		}
+	}
+
+	for serviceID, entMeta := range critical {
+		entMeta := entMeta
+		_, svc, err := b.srv.PeeringState().NodeService(nil, req.Node, serviceID, &entMeta, req.PeerName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service %q: %w", serviceID, err)
+		}
+		if svc == nil {
+			continue
+		}
+		err = b.CatalogDeregister(&structs.DeregisterRequest{
+			Node:           req.Node,
+			ServiceID:      serviceID,
+			EnterpriseMeta: svc.EnterpriseMeta,
+			PeerName:       req.PeerName,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to deregister critical service %q imported from peer %q: %w", serviceID, req.PeerName, err)
+		}
+	}
+	return &filtered, nil
+}
+
+// criticalImportedServices returns the IDs of the services with a critical
+// check in checks, along with the tenancy of those checks. A critical node
+// check makes every service with a check in checks critical, and is reported
+// by the returned bool.
+func criticalImportedServices(checks structs.HealthChecks) (map[string]acl.EnterpriseMeta, bool) {
+	var nodeCritical bool
+	critical := make(map[string]acl.EnterpriseMeta)
+	for _, chk := range checks {
+		if chk.Status != api.HealthCritical {
+			continue
+		}
+		if chk.ServiceID == "" {
+			nodeCritical = true
+		} else {
+			critical[chk.ServiceID] = chk.EnterpriseMeta
+		}
+	}
+	if nodeCritical {
+		for _, chk := range checks {
+			if chk.ServiceID != "" {
+				critical[chk.ServiceID] = chk.EnterpriseMeta
+			}
+		}
+	}
+	return critical, nodeCritical
+}
+
+// skipCriticalImports returns the indexes of the service registrations in reqs
+// that checks elsewhere in reqs report as critical, for peerings with the
+// import-healthy-only option. Imported services are registered before their
+// checks, so these are left out of the batch rather than registered and then
+// removed once their checks are applied.
+func skipCriticalImports(reqs []*structs.RegisterRequest, peerings map[importPeeringKey]*pbpeering.Peering) map[int]struct{} {
+	type nodeKey struct {
+		importPeeringKey
+		node string
+	}
+
+	critical := make(map[nodeKey]map[string]acl.EnterpriseMeta)
+	nodeCritical := make(map[nodeKey]bool)
+	for _, req := range reqs {
+		if req.PeerName == "" || len(req.Checks) == 0 {
+			continue
+		}
+		pk := importPeeringKeyFor(req)
+		if peerings[pk].GetMeta()[peeringMetaImportHealthyOnly] != "true" {
+			continue
+		}
+
+		nk := nodeKey{importPeeringKey: pk, node: req.Node}
+		services, anyNode := criticalImportedServices(req.Checks)
+		if critical[nk] == nil {
+			critical[nk] = make(map[string]acl.EnterpriseMeta)
+		}
+		for id, entMeta := range services {
+			critical[nk][id] = entMeta
+		}
+		nodeCritical[nk] = nodeCritical[nk] || anyNode
+	}
+
+	skip := make(map[int]struct{})
+	for i, req := range reqs {
+		if req.PeerName == "" || req.Service == nil || len(req.Checks) > 0 {
+			continue
+		}
+		nk := nodeKey{importPeeringKey: importPeeringKeyFor(req), node: req.Node}
+		if _, ok := critical[nk][req.Service.ID]; ok || nodeCritical[nk] {
+			skip[i] = struct{}{}
+		}
+	}
+	return skip
+}
+
+func (b *PeeringBackend) CatalogDeregister(req *structs.DeregisterRequest) error {
+	if err := b.checkTenancy(&req.EnterpriseMeta); err != nil {
+		return fmt.Errorf("cannot deregister node %q: %w", req.Node, err)
+	}
+	b.forgetRegistrations(req.PeerName, req.PartitionOrDefault(), req.Node)
+	_, err := b.srv.PeeringLeaderRaftApply("Catalog.Deregister", structs.DeregisterRequestType, req)
+	if err != nil {
+		b.log().Error("failed to deregister imported node", "peering_name", req.PeerName, "node", req.Node, "error", err)
+	}
+	return err
+}
+
+// DeregisterPeeredCatalog removes every node imported from the named peer in
+// the given partition, along with their services and checks, so that no
+// imported instances linger once a peering is terminated. Nodes are deleted
+// the same way as when a peering is deleted: in bounded, rate limited batches
+// through raft. It returns the number of catalog entries removed, and is safe
+// to call again, for example after a partial failure.
+func (b *PeeringBackend) DeregisterPeeredCatalog(ctx context.Context, peerName, partition string) (int, error) {
+	if peerName == "" {
+		return 0, fmt.Errorf("peer name is required")
+	}
+	entMeta := *structs.NodeEnterpriseMetaInPartition(partition)
+	limiter := rate.NewLimiter(defaultDeletionApplyRate, int(defaultDeletionApplyRate))
+
+	removed, err := b.srv.PeeringDeleteNodes(ctx, limiter, entMeta, peerName)
+	b.forgetPeerRegistrations(peerName, entMeta.PartitionOrDefault())
+	if err != nil {
+		b.log().Error("failed to deregister nodes imported from peer", "peering_name", peerName, "removed", removed, "error", err)
+		return removed, fmt.Errorf("failed to deregister nodes imported from peer %q: %w", peerName, err)
+	}
+	return removed, nil
+}
@@ -0,0 +1,708 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/proto/pbpeering"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/hashicorp/consul/testrpc"
+	"github.com/hashicorp/consul/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportServiceKindAllowed(t *testing.T) {
+	type testcase struct {
+		allowlist string
+		kind      structs.ServiceKind
+		expect    bool
+	}
+	tcs := map[string]testcase{
+		"empty allowlist": {
+			allowlist: "",
+			kind:      structs.ServiceKindMeshGateway,
+			expect:    true,
+		},
+		"typical allowed": {
+			allowlist: "mesh-gateway,typical",
+			kind:      structs.ServiceKindTypical,
+			expect:    true,
+		},
+		"typical not allowed": {
+			allowlist: "mesh-gateway",
+			kind:      structs.ServiceKindTypical,
+			expect:    false,
+		},
+		"kind allowed": {
+			allowlist: "mesh-gateway,typical",
+			kind:      structs.ServiceKindMeshGateway,
+			expect:    true,
+		},
+		"kind not allowed": {
+			allowlist: "typical",
+			kind:      structs.ServiceKindConnectProxy,
+			expect:    false,
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expect, importServiceKindAllowed(tc.allowlist, tc.kind))
+		})
+	}
+}
+
+func TestPeeringBackend_ImportServiceKinds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("too slow for testing.Short")
+	}
+
+	_, srv := testServer(t)
+	testrpc.WaitForLeader(t, srv.RPC, "dc1")
+	counting := &registerCountingServer{Server: srv}
+	backend := NewPeeringBackend(counting)
+
+	store := srv.fsm.State()
+	require.NoError(t, store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:   "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+			Name: "my-peer",
+		},
+	}))
+
+	register := func(t *testing.T, id string, kind structs.ServiceKind) {
+		require.NoError(t, backend.CatalogRegister(&structs.RegisterRequest{
+			Node:     "node-1",
+			Address:  "10.0.0.1",
+			PeerName: "my-peer",
+			Service: &structs.NodeService{
+				Kind:     kind,
+				ID:       id,
+				Service:  id,
+				Port:     8080,
+				PeerName: "my-peer",
+			},
+			Checks: structs.HealthChecks{{
+				Node:      "node-1",
+				CheckID:   types.CheckID(id + "-check"),
+				ServiceID: id,
+				Status:    api.HealthPassing,
+				PeerName:  "my-peer",
+			}},
+		}))
+	}
+	imported := func(t *testing.T, id string) bool {
+		_, svc, err := store.NodeService(nil, "node-1", id, nil, "my-peer")
+		require.NoError(t, err)
+		return svc != nil
+	}
+
+	testutil.RunStep(t, "all kinds imported by default", func(t *testing.T) {
+		register(t, "gateway", structs.ServiceKindMeshGateway)
+		require.True(t, imported(t, "gateway"))
+	})
+
+	testutil.RunStep(t, "allowlist filters and removes earlier imports", func(t *testing.T) {
+		require.NoError(t, backend.SetPeeringImportServiceKinds("my-peer", "", []structs.ServiceKind{structs.ServiceKindTypical}))
+
+		register(t, "web", structs.ServiceKindTypical)
+		require.True(t, imported(t, "web"))
+
+		register(t, "gateway", structs.ServiceKindMeshGateway)
+		require.False(t, imported(t, "gateway"))
+		require.Equal(t, 1, counting.deregisters)
+
+		_, checks, err := store.NodeChecks(nil, "node-1", nil, "my-peer")
+		require.NoError(t, err)
+		require.Len(t, checks, 1)
+		require.Equal(t, "web", checks[0].ServiceID)
+	})
+
+	testutil.RunStep(t, "filtered services that were never imported are not deregistered", func(t *testing.T) {
+		register(t, "ingress", structs.ServiceKindIngressGateway)
+		require.False(t, imported(t, "ingress"))
+		require.Equal(t, 1, counting.deregisters)
+	})
+}
+
+// peerSyncRegistrations returns registrations in the order the peer stream
+// replicates them: each node, then each of its services, then its checks.
+func peerSyncRegistrations(nodes, servicesPerNode int) []*structs.RegisterRequest {
+	var reqs []*structs.RegisterRequest
+	for n := 0; n < nodes; n++ {
+		node := structs.RegisterRequest{
+			Node:     fmt.Sprintf("node-%d", n),
+			Address:  fmt.Sprintf("10.0.0.%d", n),
+			PeerName: "my-peer",
+		}
+		reqs = append(reqs, &node)
+
+		var checks structs.HealthChecks
+		for s := 0; s < servicesPerNode; s++ {
+			svc := node
+			svc.Service = &structs.NodeService{
+				ID:       fmt.Sprintf("svc-%d", s),
+				Service:  fmt.Sprintf("svc-%d", s),
+				PeerName: "my-peer",
+			}
+			reqs = append(reqs, &svc)
+			checks = append(checks, &structs.HealthCheck{
+				Node:      node.Node,
+				CheckID:   types.CheckID(fmt.Sprintf("check-%d", s)),
+				ServiceID: svc.Service.ID,
+				Status:    api.HealthPassing,
+				PeerName:  "my-peer",
+			})
+		}
+		chk := node
+		chk.Checks = checks
+		reqs = append(reqs, &chk)
+	}
+	return reqs
+}
+
+func TestAppendRegisterBatch(t *testing.T) {
+	reqs := peerSyncRegistrations(2, 3)
+
+	var batches []registerBatch
+	for i, req := range reqs {
+		batches = appendRegisterBatch(batches, i, req)
+	}
+
+	// For each node, the node registration merges into the first service and
+	// the checks merge into the last service.
+	require.Len(t, batches, 6)
+	require.Equal(t, []int{0, 1}, batches[0].indexes)
+	require.Equal(t, []int{2}, batches[1].indexes)
+	require.Equal(t, []int{3, 4}, batches[2].indexes)
+	require.Equal(t, []int{5, 6}, batches[3].indexes)
+	require.Equal(t, "svc-0", batches[0].req.Service.ID)
+	require.Equal(t, "svc-2", batches[2].req.Service.ID)
+	require.Len(t, batches[2].req.Checks, 3)
+	require.Equal(t, "node-1", batches[3].req.Node)
+
+	// The input requests are not modified.
+	require.Nil(t, reqs[0].Service)
+	require.Empty(t, reqs[3].Checks)
+}
+
+func BenchmarkCatalogRegisterBatch_Applies(b *testing.B) {
+	reqs := peerSyncRegistrations(20, 5)
+
+	run := func(b *testing.B, register func(*PeeringBackend) error) {
+		for n := 0; n < b.N; n++ {
+			srv := &mockPeeringBackendServer{config: DefaultConfig(), store: state.NewStateStore(nil)}
+			require.NoError(b, register(NewPeeringBackend(srv)))
+			b.ReportMetric(float64(len(srv.applied)), "applies/op")
+		}
+	}
+
+	b.Run("per-request", func(b *testing.B) {
+		run(b, func(backend *PeeringBackend) error {
+			for _, req := range reqs {
+				if err := backend.CatalogRegister(req); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		run(b, func(backend *PeeringBackend) error {
+			return backend.CatalogRegisterBatch(reqs)
+		})
+	})
+}
+
+func TestPeeringBackend_CatalogRegisterBatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("too slow for testing.Short")
+	}
+
+	_, srv := testServerWithConfig(t, func(c *Config) {
+		c.PeeringDedupeCatalogRegister = true
+	})
+	testrpc.WaitForLeader(t, srv.RPC, "dc1")
+	counting := &registerCountingServer{Server: srv}
+	backend := NewPeeringBackend(counting)
+
+	reqs := peerSyncRegistrations(2, 3)
+	require.NoError(t, backend.CatalogRegisterBatch(reqs))
+	require.Equal(t, 6, counting.registers)
+
+	store := srv.fsm.State()
+	for _, node := range []string{"node-0", "node-1"} {
+		_, services, err := store.NodeServices(nil, node, nil, "my-peer")
+		require.NoError(t, err)
+		require.Len(t, services.Services, 3)
+		_, checks, err := store.NodeChecks(nil, node, nil, "my-peer")
+		require.NoError(t, err)
+		require.Len(t, checks, 3)
+	}
+
+	testutil.RunStep(t, "unchanged registrations are skipped", func(t *testing.T) {
+		require.NoError(t, backend.CatalogRegisterBatch(reqs))
+		require.Equal(t, 6, counting.registers)
+	})
+}
+
+func TestPeeringBackend_CatalogRegisterBatch_ImportHealthyOnly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("too slow for testing.Short")
+	}
+
+	_, srv := testServer(t)
+	testrpc.WaitForLeader(t, srv.RPC, "dc1")
+	counting := &registerCountingServer{Server: srv}
+	backend := NewPeeringBackend(counting)
+
+	require.NoError(t, backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Name: "my-peer"},
+	}))
+	require.NoError(t, backend.SetPeeringImportHealthyOnly("my-peer", "", true))
+
+	// sync imports svc-0 and svc-1 on node-0 with the given check statuses.
+	sync := func(t *testing.T, statuses ...string) {
+		reqs := peerSyncRegistrations(1, 2)
+		for i, chk := range reqs[len(reqs)-1].Checks {
+			chk.Status = statuses[i]
+		}
+		require.NoError(t, backend.CatalogRegisterBatch(reqs))
+	}
+	imported := func(t *testing.T) []string {
+		_, services, err := srv.fsm.State().NodeServices(nil, "node-0", nil, "my-peer")
+		require.NoError(t, err)
+		var ids []string
+		for id := range services.Services {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	testutil.RunStep(t, "critical instances are never registered", func(t *testing.T) {
+		sync(t, api.HealthPassing, api.HealthCritical)
+		require.Equal(t, []string{"svc-0"}, imported(t))
+		require.Zero(t, counting.deregisters)
+
+		_, checks, err := srv.fsm.State().NodeChecks(nil, "node-0", nil, "my-peer")
+		require.NoError(t, err)
+		require.Len(t, checks, 1)
+		require.Equal(t, "svc-0", checks[0].ServiceID)
+	})
+
+	testutil.RunStep(t, "instances that turn critical are deregistered", func(t *testing.T) {
+		sync(t, api.HealthCritical, api.HealthCritical)
+		require.Empty(t, imported(t))
+		require.Equal(t, 1, counting.deregisters)
+	})
+
+	testutil.RunStep(t, "healthy instances are imported again", func(t *testing.T) {
+		sync(t, api.HealthPassing, api.HealthWarning)
+		require.Equal(t, []string{"svc-0", "svc-1"}, imported(t))
+	})
+}
+
+// registerCountingServer counts the catalog registrations and deregistrations
+// applied through raft by a real server.
+type registerCountingServer struct {
+	*Server
+	registers   int
+	deregisters int
+}
+
+func (s *registerCountingServer) PeeringLeaderRaftApply(method string, t structs.MessageType, msg interface{}) (interface{}, error) {
+	switch t {
+	case structs.RegisterRequestType:
+		s.registers++
+	case structs.DeregisterRequestType:
+		s.deregisters++
+	}
+	return s.Server.PeeringLeaderRaftApply(method, t, msg)
+}
+
+func TestPeeringBackend_CatalogRegisterDedupe(t *testing.T) {
+	if testing.Short() {
+		t.Skip("too slow for testing.Short")
+	}
+
+	_, srv := testServerWithConfig(t, func(c *Config) {
+		c.PeeringDedupeCatalogRegister = true
+	})
+	testrpc.WaitForLeader(t, srv.RPC, "dc1")
+	counting := &registerCountingServer{Server: srv}
+	backend := NewPeeringBackend(counting)
+
+	newReq := func(port int) *structs.RegisterRequest {
+		return &structs.RegisterRequest{
+			Node:     "node-1",
+			Address:  "10.0.0.1",
+			PeerName: "my-peer",
+			Service: &structs.NodeService{
+				ID:       "web-1",
+				Service:  "web",
+				Port:     port,
+				PeerName: "my-peer",
+			},
+		}
+	}
+
+	require.NoError(t, backend.CatalogRegister(newReq(8080)))
+	require.Equal(t, 1, counting.registers)
+
+	testutil.RunStep(t, "unchanged registration is skipped", func(t *testing.T) {
+		require.NoError(t, backend.CatalogRegister(newReq(8080)))
+		require.Equal(t, 1, counting.registers)
+	})
+
+	testutil.RunStep(t, "changed registration is applied", func(t *testing.T) {
+		require.NoError(t, backend.CatalogRegister(newReq(9090)))
+		require.Equal(t, 2, counting.registers)
+
+		_, svc, err := srv.fsm.State().NodeService(nil, "node-1", "web-1", nil, "my-peer")
+		require.NoError(t, err)
+		require.Equal(t, 9090, svc.Port)
+	})
+
+	testutil.RunStep(t, "registration is applied again after deregistration", func(t *testing.T) {
+		require.NoError(t, backend.CatalogDeregister(&structs.DeregisterRequest{Node: "node-1", PeerName: "my-peer"}))
+		require.NoError(t, backend.CatalogRegister(newReq(9090)))
+		require.Equal(t, 3, counting.registers)
+
+		_, svc, err := srv.fsm.State().NodeService(nil, "node-1", "web-1", nil, "my-peer")
+		require.NoError(t, err)
+		require.NotNil(t, svc)
+	})
+}
+
+func TestPeeringBackend_DeregisterPeeredCatalog(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	store := srv.fsm.State()
+	var idx uint64 = 100
+	register := func(node, peerName string) {
+		idx++
+		require.NoError(t, store.EnsureRegistration(idx, &structs.RegisterRequest{
+			Node:     node,
+			Address:  "10.0.0.1",
+			PeerName: peerName,
+			Service: &structs.NodeService{
+				ID:       "web-1",
+				Service:  "web",
+				PeerName: peerName,
+			},
+			Checks: structs.HealthChecks{{
+				Node:      node,
+				CheckID:   "web-alive",
+				ServiceID: "web-1",
+				Status:    api.HealthPassing,
+				PeerName:  peerName,
+			}},
+		}))
+	}
+	const imported = 5
+	for i := 0; i < imported; i++ {
+		register(fmt.Sprintf("node-%d", i), "my-peer")
+	}
+	register("node-0", "other-peer")
+	register("local-node", "")
+
+	// Each imported node has one service and one check.
+	removed, err := backend.DeregisterPeeredCatalog(context.Background(), "my-peer", "")
+	require.NoError(t, err)
+	require.Equal(t, 3*imported, removed)
+
+	_, nodes, err := store.Nodes(nil, nil, "my-peer")
+	require.NoError(t, err)
+	require.Empty(t, nodes)
+	_, services, err := store.ServiceNodes(nil, "web", nil, "my-peer")
+	require.NoError(t, err)
+	require.Empty(t, services)
+	_, checks, err := store.ChecksInState(nil, api.HealthAny, nil, "my-peer")
+	require.NoError(t, err)
+	require.Empty(t, checks)
+
+	// Other peers and local nodes are untouched.
+	_, nodes, err = store.Nodes(nil, nil, "other-peer")
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	_, node, err := store.GetNode("local-node", nil, "")
+	require.NoError(t, err)
+	require.NotNil(t, node)
+
+	// Calling it again is a no-op.
+	removed, err = backend.DeregisterPeeredCatalog(context.Background(), "my-peer", "")
+	require.NoError(t, err)
+	require.Zero(t, removed)
+}
+
+func BenchmarkCatalogRegister_Dedupe(b *testing.B) {
+	reqs := peerSyncRegistrations(20, 5)
+
+	run := func(b *testing.B, dedupe bool) {
+		cfg := DefaultConfig()
+		cfg.PeeringDedupeCatalogRegister = dedupe
+		srv := &mockPeeringBackendServer{config: cfg, store: state.NewStateStore(nil)}
+		for i, req := range reqs {
+			require.NoError(b, srv.store.EnsureRegistration(uint64(i+1), req))
+		}
+		backend := NewPeeringBackend(srv)
+
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			// Each iteration replays the whole catalog, as after a reconnect.
+			for _, req := range reqs {
+				require.NoError(b, backend.CatalogRegister(req))
+			}
+		}
+		b.ReportMetric(float64(len(srv.applied))/float64(b.N), "applies/op")
+	}
+
+	b.Run("disabled", func(b *testing.B) { run(b, false) })
+	b.Run("enabled", func(b *testing.B) { run(b, true) })
+}
+
+func TestPeeringImportLimits(t *testing.T) {
+	limits := PeeringImportLimits{
+		MaxServiceTags:      2,
+		MaxServiceMetaBytes: 10,
+		MaxChecks:           1,
+	}
+
+	newReq := func() *structs.RegisterRequest {
+		return &structs.RegisterRequest{
+			Node: "node-1",
+			Service: &structs.NodeService{
+				Service: "api",
+				Tags:    []string{"a", "b"},
+				Meta:    map[string]string{"key": "value"},
+			},
+			Checks: structs.HealthChecks{{CheckID: "check-1"}},
+		}
+	}
+	require.NoError(t, limits.check(newReq()))
+	require.NoError(t, PeeringImportLimits{}.check(newReq()))
+
+	req := newReq()
+	req.Service.Tags = append(req.Service.Tags, "c")
+	testutil.RequireErrorContains(t, limits.check(req), `service "api" has 3 tags, exceeding the limit of 2`)
+
+	req = newReq()
+	req.Service.Meta["more"] = "data"
+	testutil.RequireErrorContains(t, limits.check(req), `service "api" has 16 bytes of meta, exceeding the limit of 10`)
+
+	req = newReq()
+	req.Check = &structs.HealthCheck{CheckID: "check-2"}
+	testutil.RequireErrorContains(t, limits.check(req), `node "node-1" has 2 checks, exceeding the limit of 1`)
+}
+
+func TestPeeringBackend_ImportConflictStrategy(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	store := srv.fsm.State()
+	require.NoError(t, store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Name: "my-peer"},
+	}))
+
+	registration := func(node, peerName string, port int) *structs.RegisterRequest {
+		return &structs.RegisterRequest{
+			Node:     node,
+			Address:  "10.0.0.1",
+			PeerName: peerName,
+			Service: &structs.NodeService{
+				ID:       "api",
+				Service:  "api",
+				Port:     port,
+				PeerName: peerName,
+			},
+		}
+	}
+	port := func(t *testing.T, node, peerName string) int {
+		_, svc, err := store.NodeService(nil, node, "api", nil, peerName)
+		require.NoError(t, err)
+		if svc == nil {
+			return 0
+		}
+		return svc.Port
+	}
+
+	type testcase struct {
+		strategy PeeringImportConflictStrategy
+		node     string
+		// expectPort is the imported port after the peer re-sends the
+		// instance with a different port.
+		expectPort int
+		expectErr  error
+	}
+	run := func(t *testing.T, tc testcase) {
+		require.NoError(t, backend.SetPeeringImportConflictStrategy("my-peer", "", tc.strategy))
+
+		// A local instance with the same node and ID never conflicts, since
+		// imported instances are stored under the peer's name.
+		require.NoError(t, store.EnsureRegistration(20, registration(tc.node, "", 7070)))
+		require.NoError(t, backend.CatalogRegister(registration(tc.node, "my-peer", 8080)))
+		require.Equal(t, 8080, port(t, tc.node, "my-peer"))
+
+		// Re-sending the same definition is not a conflict either.
+		require.NoError(t, backend.CatalogRegister(registration(tc.node, "my-peer", 8080)))
+
+		err := backend.CatalogRegister(registration(tc.node, "my-peer", 9090))
+		if tc.expectErr != nil {
+			require.ErrorIs(t, err, tc.expectErr)
+		} else {
+			require.NoError(t, err)
+		}
+		require.Equal(t, tc.expectPort, port(t, tc.node, "my-peer"))
+		require.Equal(t, 7070, port(t, tc.node, ""))
+	}
+
+	tcs := map[string]testcase{
+		"peer wins": {
+			strategy:   PeeringImportConflictPeerWins,
+			node:       "node-peer-wins",
+			expectPort: 9090,
+		},
+		"local wins": {
+			strategy:   PeeringImportConflictLocalWins,
+			node:       "node-local-wins",
+			expectPort: 8080,
+		},
+		"reject": {
+			strategy:   PeeringImportConflictReject,
+			node:       "node-reject",
+			expectPort: 8080,
+			expectErr:  ErrPeeringImportConflict,
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+func TestPeeringBackend_QuarantinePeering(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	store := srv.fsm.State()
+	require.NoError(t, store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Name: "my-peer"},
+	}))
+
+	register := func(id string, port int) error {
+		return backend.CatalogRegister(&structs.RegisterRequest{
+			Node:     "node-1",
+			Address:  "10.0.0.1",
+			PeerName: "my-peer",
+			Service: &structs.NodeService{
+				ID:       id,
+				Service:  id,
+				Port:     port,
+				PeerName: "my-peer",
+			},
+		})
+	}
+	importedPort := func(t *testing.T, id string) int {
+		_, svc, err := store.NodeService(nil, "node-1", id, nil, "my-peer")
+		require.NoError(t, err)
+		if svc == nil {
+			return 0
+		}
+		return svc.Port
+	}
+
+	require.NoError(t, register("web", 8080))
+	require.NoError(t, register("api", 8080))
+
+	readState := func(t *testing.T) pbpeering.PeeringState {
+		_, p, err := store.PeeringReadByID(nil, "9e650110-ac74-4c5a-a6a8-9348b2bed4e9")
+		require.NoError(t, err)
+		return p.State
+	}
+
+	testutil.RunStep(t, "registrations are rejected", func(t *testing.T) {
+		require.NoError(t, backend.QuarantinePeering("my-peer", ""))
+		require.Equal(t, pbpeering.PeeringState_QUARANTINED, readState(t))
+
+		require.ErrorIs(t, register("web", 9090), ErrPeeringQuarantined)
+		require.Equal(t, 8080, importedPort(t, "web"))
+
+		require.ErrorIs(t, register("db", 8080), ErrPeeringQuarantined)
+		require.Zero(t, importedPort(t, "db"))
+	})
+
+	testutil.RunStep(t, "deregistrations still apply", func(t *testing.T) {
+		require.NoError(t, backend.CatalogDeregister(&structs.DeregisterRequest{
+			Node:      "node-1",
+			ServiceID: "api",
+			PeerName:  "my-peer",
+		}))
+		require.Zero(t, importedPort(t, "api"))
+	})
+
+	testutil.RunStep(t, "registrations resume", func(t *testing.T) {
+		require.NoError(t, backend.UnquarantinePeering("my-peer", ""))
+		require.Equal(t, pbpeering.PeeringState_PENDING, readState(t))
+
+		require.NoError(t, register("web", 9090))
+		require.Equal(t, 9090, importedPort(t, "web"))
+	})
+}
+
+func TestPeeringBackend_CatalogRegisterDedupeByShape(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PeeringDedupeCatalogRegister = true
+	srv := &mockPeeringBackendServer{config: cfg, store: state.NewStateStore(nil)}
+	backend := NewPeeringBackend(srv)
+
+	nodeReq := &structs.RegisterRequest{Node: "node-1", Address: "10.0.0.1", PeerName: "my-peer"}
+	checksReq := &structs.RegisterRequest{
+		Node:     "node-1",
+		Address:  "10.0.0.1",
+		PeerName: "my-peer",
+		Checks: structs.HealthChecks{{
+			Node:     "node-1",
+			CheckID:  "serf",
+			Status:   api.HealthPassing,
+			PeerName: "my-peer",
+		}},
+	}
+	otherPeerReq := &structs.RegisterRequest{Node: "node-1", Address: "10.0.0.1", PeerName: "other-peer"}
+	require.NotEqual(t, registrationKey(nodeReq), registrationKey(checksReq))
+
+	// The mock does not apply registrations, so the catalog is populated
+	// directly.
+	require.NoError(t, srv.store.EnsureRegistration(1, checksReq))
+	require.NoError(t, srv.store.EnsureRegistration(2, otherPeerReq))
+
+	sync := func() {
+		require.NoError(t, backend.CatalogRegister(nodeReq))
+		require.NoError(t, backend.CatalogRegister(checksReq))
+		require.NoError(t, backend.CatalogRegister(otherPeerReq))
+	}
+
+	sync()
+	require.Len(t, srv.applied, 3)
+
+	testutil.RunStep(t, "node and checks registrations are both skipped", func(t *testing.T) {
+		sync()
+		require.Len(t, srv.applied, 3)
+	})
+
+	testutil.RunStep(t, "removed checks are registered again", func(t *testing.T) {
+		require.NoError(t, srv.store.DeleteCheck(3, "node-1", "serf", nil, "my-peer"))
+		sync()
+		require.Len(t, srv.applied, 4)
+	})
+
+	testutil.RunStep(t, "forgetting a peer keeps other peers", func(t *testing.T) {
+		backend.forgetPeerRegistrations("my-peer", "default")
+		sync()
+		require.Len(t, srv.applied, 6)
+	})
+}
@@ -6,6 +6,9 @@ package consul
 import (
 	"fmt"
 	"strings"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/agent/structs"
 )
 
 func (b *PeeringBackend) enterpriseCheckPartitions(partition string) error {
@@ -15,9 +18,23 @@ func (b *PeeringBackend) enterpriseCheckPartitions(partition string) error {
 	return fmt.Errorf("Partitions are a Consul Enterprise feature")
 }
 
+// serverAddressesEnterpriseMeta returns the enterprise meta used to discover
+// server addresses for the given partition. Only the default partition exists
+// in OSS.
+func (b *PeeringBackend) serverAddressesEnterpriseMeta(partition string) (*acl.EnterpriseMeta, error) {
+	if err := b.enterpriseCheckPartitions(partition); err != nil {
+		return nil, err
+	}
+	return structs.DefaultEnterpriseMetaInDefaultPartition(), nil
+}
+
 func (b *PeeringBackend) enterpriseCheckNamespaces(namespace string) error {
 	if namespace == "" || strings.EqualFold(namespace, "default") {
 		return nil
 	}
 	return fmt.Errorf("Namespaces are a Consul Enterprise feature")
 }
+
+func (b *PeeringBackend) enterpriseEnsureImportNamespace(namespace string, _ *acl.EnterpriseMeta) error {
+	return b.enterpriseCheckNamespaces(namespace)
+}
@@ -8,13 +8,17 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/require"
 	gogrpc "google.golang.org/grpc"
 
+	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/consul/state"
 	"github.com/hashicorp/consul/agent/structs"
 	"github.com/hashicorp/consul/proto/pbpeering"
 	"github.com/hashicorp/consul/sdk/freeport"
+	"github.com/hashicorp/consul/sdk/testutil"
 	"github.com/hashicorp/consul/testrpc"
 )
 
@@ -61,6 +65,16 @@ func TestPeeringBackend_RejectsPartition(t *testing.T) {
 	require.Contains(t, err.Error(), "Partitions are a Consul Enterprise feature")
 }
 
+func TestPeeringBackend_EnsureImportNamespace(t *testing.T) {
+	backend := &PeeringBackend{}
+
+	require.NoError(t, backend.EnsureImportNamespace("", nil))
+	require.NoError(t, backend.EnsureImportNamespace("default", nil))
+
+	err := backend.EnsureImportNamespace("ns1", nil)
+	testutil.RequireErrorContains(t, err, "Namespaces are a Consul Enterprise feature")
+}
+
 func TestPeeringBackend_IgnoresDefaultPartition(t *testing.T) {
 	if testing.Short() {
 		t.Skip("too slow for testing.Short")
@@ -102,3 +116,119 @@ func TestPeeringBackend_IgnoresDefaultPartition(t *testing.T) {
 	_, err = peeringClient.GenerateToken(ctx, &req)
 	require.NoError(t, err)
 }
+
+func TestPeeringBackend_GetServerAddressesForPartition(t *testing.T) {
+	srv := &mockPeeringBackendServer{config: DefaultConfig(), store: state.NewStateStore(nil)}
+	backend := NewPeeringBackend(srv)
+
+	require.NoError(t, srv.store.EnsureRegistration(1, &structs.RegisterRequest{
+		Node:    "server-1",
+		Address: "10.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "consul",
+			Service: "consul",
+			Meta:    map[string]string{"grpc_tls_port": "8503"},
+		},
+	}))
+
+	t.Run("default partition", func(t *testing.T) {
+		for _, partition := range []string{"", "default", "DeFaUlT"} {
+			addrs, err := backend.GetServerAddressesForPartition(context.Background(), partition, true)
+			require.NoError(t, err)
+			require.Equal(t, []string{"10.0.0.1:8503"}, addrs)
+		}
+	})
+
+	t.Run("addresses are cached per partition", func(t *testing.T) {
+		_, ok := backend.serverAddrsCache.entries[serverAddressCacheKey{partition: "default"}]
+		require.True(t, ok)
+	})
+
+	t.Run("non-default partition", func(t *testing.T) {
+		_, err := backend.GetServerAddressesForPartition(context.Background(), "test", true)
+		testutil.RequireErrorContains(t, err, "Partitions are a Consul Enterprise feature")
+	})
+
+	t.Run("enterprise meta is passed through", func(t *testing.T) {
+		entMeta, err := backend.serverAddressesEnterpriseMeta("default")
+		require.NoError(t, err)
+		require.Equal(t, structs.DefaultEnterpriseMetaInDefaultPartition(), entMeta)
+
+		addrs, err := serverAddresses(srv.store, serverAddressOptions{entMeta: entMeta})
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.1:8503"}, addrs)
+	})
+}
+
+func TestPeeringBackend_CatalogRegisterTenancy(t *testing.T) {
+	srv := &mockPeeringBackendServer{config: DefaultConfig(), store: state.NewStateStore(nil)}
+	backend := NewPeeringBackend(srv)
+
+	// Only the default partition and namespace exist in OSS, so every
+	// registration passes the tenancy checks and reaches raft.
+	require.NoError(t, backend.CatalogRegister(&structs.RegisterRequest{
+		Node:           "node-1",
+		Address:        "10.0.0.1",
+		EnterpriseMeta: *structs.DefaultEnterpriseMetaInDefaultPartition(),
+		Service: &structs.NodeService{
+			ID:             "web-1",
+			Service:        "web",
+			EnterpriseMeta: *structs.DefaultEnterpriseMetaInDefaultPartition(),
+		},
+		Checks: structs.HealthChecks{{
+			Node:           "node-1",
+			CheckID:        "web-alive",
+			ServiceID:      "web-1",
+			EnterpriseMeta: *structs.DefaultEnterpriseMetaInDefaultPartition(),
+		}},
+	}))
+	require.NoError(t, backend.CatalogDeregister(&structs.DeregisterRequest{
+		Node:           "node-1",
+		EnterpriseMeta: *structs.DefaultEnterpriseMetaInDefaultPartition(),
+	}))
+	require.Equal(t, []structs.MessageType{structs.RegisterRequestType, structs.DeregisterRequestType}, srv.applied)
+}
+
+func TestPeeringBackend_ValidatePeeringEstablishment(t *testing.T) {
+	const existingID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+
+	srv := &mockPeeringBackendServer{config: DefaultConfig(), store: state.NewStateStore(nil)}
+	require.NoError(t, srv.store.PeeringWrite(1, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: existingID, Name: "my-peer"},
+	}))
+	backend := NewPeeringBackend(srv)
+
+	testutil.RunStep(t, "valid", func(t *testing.T) {
+		req := &pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{ID: "0d5e9e53-8a3b-4e38-8a0c-0e4f2c1b3f0a", Name: "other-peer"},
+		}
+		require.NoError(t, backend.ValidatePeeringEstablishment(req, acl.DefaultEnterpriseMeta()))
+	})
+
+	testutil.RunStep(t, "re-establishing keeps the existing ID", func(t *testing.T) {
+		req := &pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{ID: existingID, Name: "my-peer"},
+		}
+		require.NoError(t, backend.ValidatePeeringEstablishment(req, nil))
+	})
+
+	testutil.RunStep(t, "every failure is reported", func(t *testing.T) {
+		req := &pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{ID: existingID, Name: "Not_A_Label", Partition: "ap1"},
+		}
+		err := backend.ValidatePeeringEstablishment(req, acl.DefaultEnterpriseMeta())
+		require.Error(t, err)
+
+		var merr *multierror.Error
+		require.ErrorAs(t, err, &merr)
+		require.Len(t, merr.Errors, 3)
+		testutil.RequireErrorContains(t, err, "Not_A_Label is not a valid peer name")
+		testutil.RequireErrorContains(t, err, `invalid partition "ap1": Partitions are a Consul Enterprise feature`)
+		testutil.RequireErrorContains(t, err, `peering ID "9e650110-ac74-4c5a-a6a8-9348b2bed4e9" is already used by peering "my-peer"`)
+	})
+
+	testutil.RunStep(t, "missing peering", func(t *testing.T) {
+		err := backend.ValidatePeeringEstablishment(&pbpeering.PeeringWriteRequest{}, nil)
+		testutil.RequireErrorContains(t, err, "missing peering")
+	})
+}
@@ -0,0 +1,918 @@
+package consul
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/prometheus"
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/go-multierror"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/dns"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/proto/pbpeering"
+)
+
+// PeeringsByTrustDomain returns the peerings, across all partitions, whose
+// peer presented a trust bundle for the given trust domain. Peerings in
+// partitions where the token is not allowed to read peering data are left out.
+func (b *PeeringBackend) PeeringsByTrustDomain(token, trustDomain string) ([]*pbpeering.Peering, error) {
+	store := b.srv.PeeringState()
+	_, bundles, err := store.PeeringTrustBundleList(nil, *structs.NodeEnterpriseMetaInPartition(structs.WildcardSpecifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peering trust bundles: %w", err)
+	}
+
+	var result []*pbpeering.Peering
+	for _, bundle := range bundles {
+		if !strings.EqualFold(bundle.TrustDomain, trustDomain) {
+			continue
+		}
+		_, peering, err := store.PeeringRead(nil, state.Query{
+			Value:          bundle.PeerName,
+			EnterpriseMeta: *structs.NodeEnterpriseMetaInPartition(bundle.Partition),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read peering %q: %w", bundle.PeerName, err)
+		}
+		if peering == nil {
+			continue
+		}
+		readable, err := b.peeringReadable(token, peering)
+		if err != nil {
+			return nil, err
+		}
+		if readable {
+			result = append(result, peering)
+		}
+	}
+	return result, nil
+}
+
+// peeringByNameInPartition reads the named peering from the given partition,
+// returning an error if it does not exist.
+func (b *PeeringBackend) peeringByNameInPartition(name, partition string) (*pbpeering.Peering, error) {
+	peering, err := b.peeringRead(name, partition)
+	if err != nil {
+		return nil, err
+	}
+	if peering == nil {
+		return nil, fmt.Errorf("no peering found with name %q", name)
+	}
+	return peering, nil
+}
+
+// peeringRead reads the named peering from the given partition. It returns
+// nil if the peering does not exist.
+func (b *PeeringBackend) peeringRead(name, partition string) (*pbpeering.Peering, error) {
+	_, peering, err := b.srv.PeeringState().PeeringRead(nil, state.Query{
+		Value:          name,
+		EnterpriseMeta: *structs.NodeEnterpriseMetaInPartition(partition),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peering %q: %w", name, err)
+	}
+	return peering, nil
+}
+
+// Peering options that are set through the backend are stored in the
+// peering's meta under reserved keys. Users cannot set these keys themselves
+// since meta keys with the reserved prefix are rejected when establishing
+// peerings, and PeeringWriteCtx carries them over when a peering is written
+// with user meta only.
+const (
+	peeringMetaImportHealthyOnly      = structs.MetaKeyReservedPrefix + "import-healthy-only"
+	peeringMetaImportConflictStrategy = structs.MetaKeyReservedPrefix + "import-conflict-strategy"
+	peeringMetaImportServiceKinds     = structs.MetaKeyReservedPrefix + "import-service-kinds"
+)
+
+// setPeeringMeta sets (or, for an empty value, removes) a meta key on the
+// named peering in the given partition.
+func (b *PeeringBackend) setPeeringMeta(peeringName, partition, key, value string) error {
+	return b.updatePeering(peeringName, partition, func(peering *pbpeering.Peering) error {
+		if peering.Meta == nil {
+			peering.Meta = make(map[string]string)
+		}
+		if value == "" {
+			delete(peering.Meta, key)
+		} else {
+			peering.Meta[key] = value
+		}
+		return nil
+	})
+}
+
+// peeringWriteCASAttempts is how many times updatePeering writes a peering
+// before giving up on concurrent writes to it.
+const peeringWriteCASAttempts = 5
+
+// updatePeering applies update to a copy of the named peering in the given
+// partition and writes it back. The write is a check-and-set on the
+// peering's ModifyIndex, and is retried with a fresh copy if the peering was
+// written in between, so that concurrent updates do not undo each other.
+// Check-and-set is skipped until every server supports it.
+func (b *PeeringBackend) updatePeering(peeringName, partition string, update func(*pbpeering.Peering) error) error {
+	cas := b.srv.PeeringWriteCASSupported()
+	for attempt := 1; ; attempt++ {
+		existing, err := b.peeringByNameInPartition(peeringName, partition)
+		if err != nil {
+			return err
+		}
+
+		peering, ok := proto.Clone(existing).(*pbpeering.Peering)
+		if !ok {
+			return fmt.Errorf("invalid type %T, expected *pbpeering.Peering", existing)
+		}
+		if err := update(peering); err != nil {
+			return err
+		}
+
+		req := &pbpeering.PeeringWriteRequest{Peering: peering}
+		if cas {
+			req.ExpectedModifyIndex = existing.ModifyIndex
+		}
+		err = b.peeringWrite(context.Background(), req)
+		if !errors.Is(err, state.ErrPeeringCASConflict) || attempt == peeringWriteCASAttempts {
+			return err
+		}
+	}
+}
+
+// SetPeeringImportHealthyOnly controls whether service instances imported
+// from the named peer are dropped while they are critical.
+func (b *PeeringBackend) SetPeeringImportHealthyOnly(peeringName, partition string, healthyOnly bool) error {
+	var value string
+	if healthyOnly {
+		value = "true"
+	}
+	return b.setPeeringMeta(peeringName, partition, peeringMetaImportHealthyOnly, value)
+}
+
+// SetPeeringOneTimeTokens controls whether tokens generated for the named
+// peering can only be used once. When enabled, the establishment secret of a
+// token is burned in the state store when it is exchanged: it is never handed
+// out again, and presenting the token again fails with
+// peerstream.ErrTokenAlreadyUsed.
+func (b *PeeringBackend) SetPeeringOneTimeTokens(peeringName, partition string, enabled bool) error {
+	var value string
+	if enabled {
+		value = "true"
+	}
+	return b.setPeeringMeta(peeringName, partition, pbpeering.MetaKeyOneTimeTokens, value)
+}
+
+// PeeringImportConflictStrategy controls what happens when a peer re-sends a
+// service instance that was already imported from it with a different
+// definition. Imported instances are stored under the peer's name, so they
+// never collide with local instances or with those of other peers.
+type PeeringImportConflictStrategy string
+
+const (
+	// PeeringImportConflictPeerWins overwrites the imported instance with
+	// the peer's new version. This is the default.
+	PeeringImportConflictPeerWins PeeringImportConflictStrategy = "peer-wins"
+
+	// PeeringImportConflictLocalWins keeps the instance in the catalog and
+	// discards the peer's new version. New instances are still imported.
+	PeeringImportConflictLocalWins PeeringImportConflictStrategy = "local-wins"
+
+	// PeeringImportConflictReject fails the registration.
+	PeeringImportConflictReject PeeringImportConflictStrategy = "reject"
+)
+
+// ErrPeeringImportConflict is returned when a registration imported from a
+// peer is rejected because it conflicts with the existing catalog entry.
+var ErrPeeringImportConflict = errors.New("imported service conflicts with existing catalog entry")
+
+func (s PeeringImportConflictStrategy) validate() error {
+	switch s {
+	case "", PeeringImportConflictPeerWins, PeeringImportConflictLocalWins, PeeringImportConflictReject:
+		return nil
+	}
+	return fmt.Errorf("unknown import conflict strategy %q", s)
+}
+
+// SetPeeringImportConflictStrategy sets how registrations imported from the
+// named peer are handled when they conflict with existing catalog entries.
+func (b *PeeringBackend) SetPeeringImportConflictStrategy(peeringName, partition string, strategy PeeringImportConflictStrategy) error {
+	if err := strategy.validate(); err != nil {
+		return err
+	}
+	if strategy == PeeringImportConflictPeerWins {
+		strategy = ""
+	}
+	return b.setPeeringMeta(peeringName, partition, peeringMetaImportConflictStrategy, string(strategy))
+}
+
+// ErrPeeringQuarantined is returned when a registration imported from a
+// quarantined peer is not applied.
+var ErrPeeringQuarantined = errors.New("peering is quarantined")
+
+// QuarantinePeering isolates the named peering without terminating it, by
+// moving it to the QUARANTINED state. New and changed registrations
+// replicated from a quarantined peer are rejected with ErrPeeringQuarantined,
+// so the services already imported from it are kept as they are for
+// investigation. Deregistrations still apply so that instances the peer has
+// removed do not linger. Re-establishing the peering releases it.
+func (b *PeeringBackend) QuarantinePeering(peeringName, partition string) error {
+	return b.updatePeering(peeringName, partition, func(peering *pbpeering.Peering) error {
+		if !peering.IsActive() {
+			return fmt.Errorf("cannot quarantine peering %q: it is being deleted or was terminated", peeringName)
+		}
+		peering.State = pbpeering.PeeringState_QUARANTINED
+		return nil
+	})
+}
+
+// UnquarantinePeering resumes imports from a peering that was quarantined
+// with QuarantinePeering. The peering goes back to the state it is stored in
+// before it connects, ESTABLISHING for dialers and PENDING otherwise; its
+// connection status is reported on read as usual.
+func (b *PeeringBackend) UnquarantinePeering(peeringName, partition string) error {
+	return b.updatePeering(peeringName, partition, func(peering *pbpeering.Peering) error {
+		if peering.State != pbpeering.PeeringState_QUARANTINED {
+			return nil
+		}
+		if peering.ShouldDial() {
+			peering.State = pbpeering.PeeringState_ESTABLISHING
+		} else {
+			peering.State = pbpeering.PeeringState_PENDING
+		}
+		return nil
+	})
+}
+
+// peeringImportKindTypical stands for structs.ServiceKindTypical, whose value
+// is the empty string, in the import service kind allowlist.
+const peeringImportKindTypical = "typical"
+
+// SetPeeringImportServiceKinds limits the services imported from the named
+// peer to the given kinds. Use structs.ServiceKindTypical for plain
+// services. An empty list allows all kinds.
+func (b *PeeringBackend) SetPeeringImportServiceKinds(peeringName, partition string, kinds []structs.ServiceKind) error {
+	values := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		if kind == structs.ServiceKindTypical {
+			values = append(values, peeringImportKindTypical)
+			continue
+		}
+		values = append(values, string(kind))
+	}
+	sort.Strings(values)
+	return b.setPeeringMeta(peeringName, partition, peeringMetaImportServiceKinds, strings.Join(values, ","))
+}
+
+// importServiceKindAllowed reports whether a service of the given kind may be
+// imported under the allowlist stored in a peering's meta.
+func importServiceKindAllowed(allowlist string, kind structs.ServiceKind) bool {
+	if allowlist == "" {
+		return true
+	}
+	want := string(kind)
+	if kind == structs.ServiceKindTypical {
+		want = peeringImportKindTypical
+	}
+	for _, allowed := range strings.Split(allowlist, ",") {
+		if allowed == want {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdatePeeringServerAddresses replaces the server addresses that the named
+// dialing peering in the given partition uses when it reconnects. The active
+// stream is unaffected.
+func (b *PeeringBackend) UpdatePeeringServerAddresses(peeringName, partition string, addrs []string) error {
+	if len(addrs) == 0 {
+		return fmt.Errorf("at least one server address is required")
+	}
+	for _, addr := range addrs {
+		if err := validateHostPort(addr); err != nil {
+			return fmt.Errorf("invalid server address %q: %w", addr, err)
+		}
+	}
+
+	return b.updatePeering(peeringName, partition, func(peering *pbpeering.Peering) error {
+		if !peering.ShouldDial() {
+			return fmt.Errorf("peering %q does not dial its peer, so it has no server addresses to update", peeringName)
+		}
+		peering.PeerServerAddresses = addrs
+		return nil
+	})
+}
+
+// raftApplyProtobufCtx applies msg through raft, returning the context's error
+// if ctx is canceled before the apply finishes. Raft applies cannot be
+// withdrawn once submitted, so a write that returns the context's error may
+// still be committed; callers that need to know must read the state back.
+// If finished is not nil it is called once the apply has returned, even if
+// ctx was canceled before then.
+func (b *PeeringBackend) raftApplyProtobufCtx(ctx context.Context, t structs.MessageType, msg interface{}, finished func()) error {
+	if err := ctx.Err(); err != nil {
+		if finished != nil {
+			finished()
+		}
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := b.srv.PeeringRaftApply(t, msg)
+		if finished != nil {
+			finished()
+		}
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ErrPeeringQuotaExceeded is returned when writing a new peering would exceed
+// the configured maximum number of peerings in a partition.
+var ErrPeeringQuotaExceeded = errors.New("peering quota exceeded for partition")
+
+func (b *PeeringBackend) PeeringWrite(req *pbpeering.PeeringWriteRequest) error {
+	return b.PeeringWriteCtx(context.Background(), req)
+}
+
+// PeeringWriteCtx is like PeeringWrite but returns the context's error if ctx
+// is canceled before the write is applied, in which case the write may still
+// be committed. Reserved meta keys of the stored peering that req does not
+// set are carried over. If req has an IdempotencyKey, a write repeating a
+// successful write with the same key made within PeeringIdempotencyKeyTTL is
+// not applied again, and a different write with the same key fails with
+// ErrIdempotencyKeyReused.
+func (b *PeeringBackend) PeeringWriteCtx(ctx context.Context, req *pbpeering.PeeringWriteRequest) error {
+	var requestHash string
+	if req.IdempotencyKey != "" {
+		var err error
+		if requestHash, err = peeringWriteRequestHash(req); err != nil {
+			return fmt.Errorf("failed to hash peering write request: %w", err)
+		}
+	}
+	return b.withIdempotencyKey(req.IdempotencyKey, requestHash, func() error {
+		if err := b.keepReservedMeta(req.Peering); err != nil {
+			return err
+		}
+		return b.peeringWrite(ctx, req)
+	})
+}
+
+// keepReservedMeta carries the reserved meta keys of the stored peering over
+// to peering, which is about to be written. Peering options set through the
+// backend live under these keys, and callers such as the Establish endpoint
+// write the peering with the user's meta only, which would otherwise drop
+// them.
+func (b *PeeringBackend) keepReservedMeta(peering *pbpeering.Peering) error {
+	if peering == nil {
+		return nil
+	}
+	existing, err := b.peeringRead(peering.Name, peering.PartitionOrDefault())
+	if err != nil {
+		return err
+	}
+	if existing == nil || existing.ID != peering.ID {
+		return nil
+	}
+
+	var meta map[string]string
+	for k, v := range existing.Meta {
+		if !strings.HasPrefix(k, structs.MetaKeyReservedPrefix) {
+			continue
+		}
+		if _, ok := peering.Meta[k]; ok {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string, len(peering.Meta)+len(existing.Meta))
+			for mk, mv := range peering.Meta {
+				meta[mk] = mv
+			}
+		}
+		meta[k] = v
+	}
+	if meta != nil {
+		peering.Meta = meta
+	}
+	return nil
+}
+
+// peeringWrite writes req as given. Unlike PeeringWriteCtx it does not carry
+// over reserved meta keys, so that it can be used to clear them.
+func (b *PeeringBackend) peeringWrite(ctx context.Context, req *pbpeering.PeeringWriteRequest) error {
+	if err := b.checkPeeringName(req.Peering); err != nil {
+		return err
+	}
+	var unlockQuota func()
+	if b.srv.PeeringConfig().PeeringMaxPerPartition > 0 {
+		// Peering writes are only applied by the leader, so holding the lock
+		// until the write is applied keeps the count and the write atomic.
+		// The lock is released once the apply returns, which may be after
+		// this call returns if ctx is canceled.
+		b.quotaLock.Lock()
+		if err := b.checkPeeringQuota(req.Peering); err != nil {
+			b.quotaLock.Unlock()
+			return err
+		}
+		unlockQuota = b.quotaLock.Unlock
+	}
+	if req.IdempotencyKey != "" {
+		// Keys are only checked by the leader, not by the state store, so
+		// keep them out of the raft log.
+		req = proto.Clone(req).(*pbpeering.PeeringWriteRequest)
+		req.IdempotencyKey = ""
+	}
+	if err := b.raftApplyProtobufCtx(ctx, structs.PeeringWriteType, req, unlockQuota); err != nil {
+		b.log().Error("peering write failed", "peering_name", req.Peering.GetName(), "peering_id", req.Peering.GetID(), "error", err)
+		return fmt.Errorf("peering write failed: %w", err)
+	}
+	b.log().Debug("wrote peering", "peering_name", req.Peering.GetName(), "peering_id", req.Peering.GetID())
+	if req.Peering != nil {
+		b.trackEstablishment(req.Peering)
+	}
+	return nil
+}
+
+// checkPeeringQuota rejects writes that would create a new peering in a
+// partition that already holds PeeringMaxPerPartition active peerings.
+// Updates to existing peerings are always allowed.
+func (b *PeeringBackend) checkPeeringQuota(peering *pbpeering.Peering) error {
+	limit := b.srv.PeeringConfig().PeeringMaxPerPartition
+	if limit <= 0 || peering == nil {
+		return nil
+	}
+
+	partition := peering.PartitionOrDefault()
+	if err := b.EnterpriseCheckPartitions(partition); err != nil {
+		return err
+	}
+
+	_, peerings, err := b.srv.PeeringState().PeeringList(nil, *structs.NodeEnterpriseMetaInPartition(partition))
+	if err != nil {
+		return fmt.Errorf("failed to list peerings: %w", err)
+	}
+
+	var active int
+	for _, p := range peerings {
+		if p.ID == peering.ID {
+			return nil
+		}
+		if p.IsActive() {
+			active++
+		}
+	}
+	if active >= limit {
+		return fmt.Errorf("%w: partition %q is limited to %d peerings", ErrPeeringQuotaExceeded, acl.PartitionOrDefault(partition), limit)
+	}
+	return nil
+}
+
+// checkPeeringName rejects peerings whose names are not valid DNS labels,
+// matching the validation of the GenerateToken and Establish endpoints.
+// Existing peerings keep their names so that they can still be updated and
+// deleted even if they were created before names were validated here.
+func (b *PeeringBackend) checkPeeringName(peering *pbpeering.Peering) error {
+	if peering == nil {
+		return nil
+	}
+	_, existing, err := b.srv.PeeringState().PeeringReadByID(nil, peering.ID)
+	if err != nil {
+		return fmt.Errorf("failed to read peering %q: %w", peering.ID, err)
+	}
+	if existing != nil && existing.Name == peering.Name {
+		return nil
+	}
+	return validatePeerName(peering.Name)
+}
+
+// ValidatePeeringEstablishment runs the checks that establishing the peering
+// in req would be subject to, and reports every problem found rather than
+// only the first. entMeta is the tenancy the request was made in; it may be
+// nil. A nil error means the request is valid as far as can be told without
+// writing it, not that PeeringWrite will succeed.
+func (b *PeeringBackend) ValidatePeeringEstablishment(req *pbpeering.PeeringWriteRequest, entMeta *acl.EnterpriseMeta) error {
+	peering := req.GetPeering()
+	if peering == nil {
+		return errors.New("missing peering")
+	}
+
+	var merr *multierror.Error
+	if err := b.checkPeeringName(peering); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	if err := b.EnterpriseCheckPartitions(peering.Partition); err != nil {
+		merr = multierror.Append(merr, fmt.Errorf("invalid partition %q: %w", peering.Partition, err))
+	}
+	if entMeta != nil {
+		if err := b.EnterpriseCheckNamespaces(entMeta.NamespaceOrEmpty()); err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("invalid namespace %q: %w", entMeta.NamespaceOrEmpty(), err))
+		}
+	}
+	if err := b.checkEstablishmentPeeringID(peering); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	return merr.ErrorOrNil()
+}
+
+// checkEstablishmentPeeringID rejects a peering ID that is already used by a
+// different peering. Re-establishing a peering keeps its existing ID, and
+// peerings without an ID are given a unique one when they are written.
+func (b *PeeringBackend) checkEstablishmentPeeringID(peering *pbpeering.Peering) error {
+	if peering.ID == "" {
+		return nil
+	}
+	unique, err := b.CheckPeeringUUID(peering.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check peering ID %q: %w", peering.ID, err)
+	}
+	if unique {
+		return nil
+	}
+	_, existing, err := b.srv.PeeringState().PeeringReadByID(nil, peering.ID)
+	if err != nil {
+		return fmt.Errorf("failed to read peering %q: %w", peering.ID, err)
+	}
+	if existing != nil && (existing.Name != peering.Name || existing.PartitionOrDefault() != peering.PartitionOrDefault()) {
+		return fmt.Errorf("peering ID %q is already used by peering %q", peering.ID, existing.Name)
+	}
+	return nil
+}
+
+func validatePeerName(name string) error {
+	if err := dns.ValidateLabel(name); err != nil {
+		return fmt.Errorf("%s is not a valid peer name: %w", name, err)
+	}
+	return nil
+}
+
+// trackEstablishment records when the given peering, which was just written,
+// started establishing, the first time it is written. A peering that is
+// marked for deletion or terminated is forgotten.
+func (b *PeeringBackend) trackEstablishment(peering *pbpeering.Peering) {
+	b.establishmentsLock.Lock()
+	defer b.establishmentsLock.Unlock()
+
+	if !peering.IsActive() {
+		delete(b.establishmentStarts, peering.ID)
+		delete(b.establishmentDurations, peering.ID)
+		return
+	}
+	if _, ok := b.establishmentDurations[peering.ID]; ok {
+		return
+	}
+	if b.establishmentStarts == nil {
+		b.establishmentStarts = make(map[string]time.Time)
+	}
+	if _, ok := b.establishmentStarts[peering.ID]; !ok {
+		b.establishmentStarts[peering.ID] = b.now()
+	}
+}
+
+// establishmentDurationLocked returns how long the peering with the given ID
+// took to connect, or has been establishing so far, and whether it has
+// connected. Once it has connected, its start time is replaced by the final
+// duration. The last result is false if the start time is unknown. It must be
+// called with establishmentsLock held.
+func (b *PeeringBackend) establishmentDurationLocked(peeringID string) (time.Duration, bool, bool) {
+	if d, ok := b.establishmentDurations[peeringID]; ok {
+		return d, true, true
+	}
+	start, ok := b.establishmentStarts[peeringID]
+	if !ok {
+		return 0, false, false
+	}
+
+	status, found := b.streamTracker().StreamStatus(peeringID)
+	if !found || status.FirstConnected.IsZero() {
+		return b.now().Sub(start), false, true
+	}
+	d := status.FirstConnected.Sub(start)
+	if b.establishmentDurations == nil {
+		b.establishmentDurations = make(map[string]time.Duration)
+	}
+	b.establishmentDurations[peeringID] = d
+	delete(b.establishmentStarts, peeringID)
+	return d, true, true
+}
+
+// PeeringEstablishmentDuration returns how long it took from the first write
+// of the named peering to its first successful stream connection. The bool
+// is false while the peering has not connected yet, in which case the time
+// elapsed so far is returned. Start times are tracked in memory, so peerings
+// written before this server became leader have no known duration.
+func (b *PeeringBackend) PeeringEstablishmentDuration(token, peeringName string, entMeta *acl.EnterpriseMeta) (time.Duration, bool, error) {
+	if err := b.CheckPeeringReadPermission(token, entMeta); err != nil {
+		return 0, false, err
+	}
+	peering, err := b.peeringByNameInPartition(peeringName, entMeta.PartitionOrDefault())
+	if err != nil {
+		return 0, false, err
+	}
+
+	b.establishmentsLock.Lock()
+	d, established, ok := b.establishmentDurationLocked(peering.ID)
+	b.establishmentsLock.Unlock()
+	if !ok {
+		return 0, false, fmt.Errorf("establishment start time of peering %q is unknown", peeringName)
+	}
+	return d, established, nil
+}
+
+// evictEstablishments settles the establishment of peerings that have
+// connected and forgets peerings that no longer exist or are no longer
+// active, such as those deleted without a write through this backend.
+func (b *PeeringBackend) evictEstablishments() {
+	b.establishmentsLock.Lock()
+	defer b.establishmentsLock.Unlock()
+
+	store := b.srv.PeeringState()
+	evict := func(id string) bool {
+		_, peering, err := store.PeeringReadByID(nil, id)
+		if err != nil {
+			// Keep the entry and try again later.
+			return false
+		}
+		return !peering.IsActive()
+	}
+	for id := range b.establishmentStarts {
+		if evict(id) {
+			delete(b.establishmentStarts, id)
+			continue
+		}
+		b.establishmentDurationLocked(id)
+	}
+	for id := range b.establishmentDurations {
+		if evict(id) {
+			delete(b.establishmentDurations, id)
+		}
+	}
+}
+
+// ErrIdempotencyKeyReused is returned when a peering write reuses the
+// idempotency key of a different write. It is a gRPC FailedPrecondition error
+// so that it reaches clients as one.
+var ErrIdempotencyKeyReused = grpcstatus.Error(codes.FailedPrecondition, "idempotency key was already used by a different peering write")
+
+// peeringWriteRequestHash returns a hash of req without its IdempotencyKey,
+// which identifies the write that a key was first used for.
+func peeringWriteRequestHash(req *pbpeering.PeeringWriteRequest) (string, error) {
+	clone, ok := proto.Clone(req).(*pbpeering.PeeringWriteRequest)
+	if !ok {
+		return "", fmt.Errorf("invalid type %T, expected *pbpeering.PeeringWriteRequest", req)
+	}
+	clone.IdempotencyKey = ""
+
+	buffer := proto.NewBuffer(nil)
+	buffer.SetDeterministic(true)
+	if err := buffer.Marshal(clone); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buffer.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type idempotentWrite struct {
+	// requestHash identifies the write the key was used for.
+	requestHash string
+
+	// done is closed once the write completes.
+	done chan struct{}
+
+	// err is the result of the write. It must only be read after done is closed.
+	err error
+
+	// expires is zero while the write is in flight.
+	expires time.Time
+}
+
+// withIdempotencyKey calls write, unless a previous call with the same key
+// succeeded within PeeringIdempotencyKeyTTL, in which case nil is returned
+// without calling it again. Concurrent calls with the same key wait for the
+// first one to complete. Failed writes are forgotten so that they can be
+// retried. An empty key or a zero TTL disables the check.
+//
+// A key is bound to the requestHash of the write it was first used for; a
+// call with the same key and a different hash fails with
+// ErrIdempotencyKeyReused instead of reporting the earlier write's result.
+//
+// Keys are tracked in memory on the server handling the write, which is the
+// leader, and are not replicated. The guarantee therefore only holds while
+// the same server stays leader: a retry after a leadership change is applied
+// again.
+func (b *PeeringBackend) withIdempotencyKey(key, requestHash string, write func() error) error {
+	ttl := b.srv.PeeringConfig().PeeringIdempotencyKeyTTL
+	if key == "" || ttl <= 0 {
+		return write()
+	}
+
+	b.idempotentWritesLock.Lock()
+	now := b.now()
+	for k, w := range b.idempotentWrites {
+		if !w.expires.IsZero() && now.After(w.expires) {
+			delete(b.idempotentWrites, k)
+		}
+	}
+	if existing, ok := b.idempotentWrites[key]; ok {
+		b.idempotentWritesLock.Unlock()
+		if existing.requestHash != requestHash {
+			return ErrIdempotencyKeyReused
+		}
+		<-existing.done
+		if existing.err == nil {
+			return nil
+		}
+		// The first write failed and was forgotten, so try again.
+		return b.withIdempotencyKey(key, requestHash, write)
+	}
+	if b.idempotentWrites == nil {
+		b.idempotentWrites = make(map[string]*idempotentWrite)
+	}
+	w := &idempotentWrite{requestHash: requestHash, done: make(chan struct{})}
+	b.idempotentWrites[key] = w
+	b.idempotentWritesLock.Unlock()
+
+	err := write()
+
+	b.idempotentWritesLock.Lock()
+	w.err = err
+	if err != nil {
+		delete(b.idempotentWrites, key)
+	} else {
+		w.expires = b.now().Add(ttl)
+	}
+	b.idempotentWritesLock.Unlock()
+	close(w.done)
+
+	return err
+}
+
+// ErrPeeringWriteRateLimited is returned when a peering is written more often
+// than PeeringWriteRate allows. It wraps structs.ErrRPCRateExceeded so that
+// clients retry the write later.
+var ErrPeeringWriteRateLimited = fmt.Errorf("too many writes for peering: %w", structs.ErrRPCRateExceeded)
+
+// peeringWriteLimiter is the token bucket limiting writes to one peering.
+type peeringWriteLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// CheckPeeringWriteRate takes a token from the named peering's write limiter,
+// returning ErrPeeringWriteRateLimited if there are none left. It is only
+// called for writes requested by clients; writes made by the server itself,
+// such as marking a peering for deletion or recording the addresses sent by a
+// peer, are never throttled.
+func (b *PeeringBackend) CheckPeeringWriteRate(peering *pbpeering.Peering) error {
+	limit, burst := b.peeringWriteLimits()
+	if limit <= 0 || peering == nil {
+		return nil
+	}
+	now := b.now()
+	key := peering.PartitionOrDefault() + "/" + peering.Name
+
+	b.writeLimitersLock.Lock()
+	defer b.writeLimitersLock.Unlock()
+
+	if b.writeLimiters == nil {
+		b.writeLimiters = make(map[string]*peeringWriteLimiter)
+	}
+	l, ok := b.writeLimiters[key]
+	if !ok {
+		l = &peeringWriteLimiter{limiter: rate.NewLimiter(limit, burst)}
+		b.writeLimiters[key] = l
+	}
+	l.lastUsed = now
+	if !l.limiter.AllowN(now, 1) {
+		return fmt.Errorf("%w %q", ErrPeeringWriteRateLimited, peering.Name)
+	}
+	return nil
+}
+
+// peeringWriteLimits returns the configured PeeringWriteRate and
+// PeeringWriteBurst, with the burst raised to at least one.
+func (b *PeeringBackend) peeringWriteLimits() (rate.Limit, int) {
+	limit, burst := b.srv.PeeringConfig().PeeringWriteRate, b.srv.PeeringConfig().PeeringWriteBurst
+	if burst < 1 {
+		burst = 1
+	}
+	return limit, burst
+}
+
+// peeringWriteLimiterGCInterval is how often Run discards idle write
+// limiters.
+const peeringWriteLimiterGCInterval = time.Minute
+
+// Run watches the CA roots for the CA roots change hooks until ctx is done.
+// Every peeringWriteLimiterGCInterval it also discards idle peering write
+// limiters and the establishment times of peerings that are gone, so that
+// the request path never has to scan them.
+func (b *PeeringBackend) Run(ctx context.Context) {
+	go b.watchCARoots(ctx)
+
+	ticker := time.NewTicker(peeringWriteLimiterGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.evictIdleWriteLimiters()
+			b.evictEstablishments()
+		}
+	}
+}
+
+// evictIdleWriteLimiters discards the write limiters that have been idle long
+// enough to refill, since a new limiter would behave the same. All limiters
+// are discarded once PeeringWriteRate is disabled.
+func (b *PeeringBackend) evictIdleWriteLimiters() {
+	limit, burst := b.peeringWriteLimits()
+
+	b.writeLimitersLock.Lock()
+	defer b.writeLimitersLock.Unlock()
+
+	if limit <= 0 {
+		b.writeLimiters = nil
+		return
+	}
+	refill := time.Duration(float64(burst) / float64(limit) * float64(time.Second))
+	now := b.now()
+	for k, l := range b.writeLimiters {
+		if now.Sub(l.lastUsed) > refill {
+			delete(b.writeLimiters, k)
+		}
+	}
+}
+
+var PeeringTerminateCounters = []prometheus.CounterDefinition{
+	{
+		Name: []string{"peering", "terminate_by_id", "failure"},
+		Help: "Increments for each failed attempt to terminate a peering by ID.",
+	},
+}
+
+var PeeringTerminateSummaries = []prometheus.SummaryDefinition{
+	{
+		Name: []string{"peering", "terminate_by_id"},
+		Help: "Measures the time it takes to terminate a peering by ID.",
+	},
+}
+
+// PeeringTerminateByID marks a peering as terminated. It is not triggered by
+// an RPC, so it emits its own metrics in place of the RPC interceptor.
+func (b *PeeringBackend) PeeringTerminateByID(req *pbpeering.PeeringTerminateByIDRequest) error {
+	defer metrics.MeasureSince([]string{"peering", "terminate_by_id"}, time.Now())
+
+	if _, err := b.srv.PeeringRaftApply(structs.PeeringTerminateByIDType, req); err != nil {
+		metrics.IncrCounter([]string{"peering", "terminate_by_id", "failure"}, 1)
+		b.log().Error("peering terminate by ID failed", "peering_id", req.ID, "error", err)
+		return fmt.Errorf("peering terminate by ID failed: %w", err)
+	}
+	return nil
+}
+
+// ForceTerminatePeering marks the peering with the given ID as terminated
+// without going through the usual PeeringWrite validation. It is a last-resort
+// recovery tool for peerings whose records are wedged and must only be called
+// on the leader. The peering is terminated through PeeringTerminateByID, the
+// same path used when a peer terminates the peering, so the leader's deferred
+// deletion routine then removes the data imported from the peer.
+func (b *PeeringBackend) ForceTerminatePeering(peeringID string) error {
+	if !b.srv.IsLeader() {
+		return fmt.Errorf("peerings can only be force-terminated by the leader")
+	}
+
+	_, existing, err := b.srv.PeeringState().PeeringReadByID(nil, peeringID)
+	if err != nil {
+		return fmt.Errorf("failed to read peering %q: %w", peeringID, err)
+	}
+	if existing == nil {
+		return fmt.Errorf("no peering found with ID %q", peeringID)
+	}
+
+	b.log().Warn("force-terminating peering, bypassing normal validation",
+		"peer_name", existing.Name,
+		"peer_id", existing.ID,
+		"state", existing.State.String(),
+	)
+	return b.PeeringTerminateByID(&pbpeering.PeeringTerminateByIDRequest{ID: peeringID})
+}
@@ -0,0 +1,722 @@
+package consul
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/raft"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/proto/pbpeering"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeeringBackend_ForceTerminatePeering(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	const peerID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+	store := srv.fsm.State()
+	require.NoError(t, store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: peerID, Name: "my-peer", State: pbpeering.PeeringState_FAILING},
+	}))
+	insertTestPeeringData(t, store, "my-peer", 10)
+
+	testutil.RunStep(t, "unknown peering", func(t *testing.T) {
+		err := backend.ForceTerminatePeering("0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e")
+		testutil.RequireErrorContains(t, err, `no peering found with ID "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e"`)
+	})
+
+	testutil.RunStep(t, "terminates the peering", func(t *testing.T) {
+		require.NoError(t, backend.ForceTerminatePeering(peerID))
+
+		_, peering, err := store.PeeringReadByID(nil, peerID)
+		require.NoError(t, err)
+		require.Equal(t, pbpeering.PeeringState_TERMINATED, peering.State)
+	})
+
+	testutil.RunStep(t, "imported data is removed", func(t *testing.T) {
+		defaultMeta := structs.DefaultEnterpriseMetaInDefaultPartition()
+		retry.Run(t, func(r *retry.R) {
+			_, nodes, err := store.NodeDump(nil, defaultMeta, "my-peer")
+			require.NoError(r, err)
+			require.Len(r, nodes, 0)
+
+			_, tb, err := store.PeeringTrustBundleRead(nil, state.Query{Value: "my-peer"})
+			require.NoError(r, err)
+			require.Nil(r, tb)
+		})
+
+		// Like a peering terminated by the peer, the record itself is kept.
+		_, peering, err := store.PeeringReadByID(nil, peerID)
+		require.NoError(t, err)
+		require.NotNil(t, peering)
+	})
+}
+
+func TestPeeringBackend_PeeringsByTrustDomain(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	store := srv.fsm.State()
+	peerings := []struct {
+		id, name, trustDomain string
+	}{
+		{"9e650110-ac74-4c5a-a6a8-9348b2bed4e9", "peer-1", "11111111-2222-3333-4444-555555555555.consul"},
+		{"0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e", "peer-2", "11111111-2222-3333-4444-555555555555.consul"},
+		{"5a8f1e2b-3c4d-4e5f-8a9b-0c1d2e3f4a5b", "peer-3", "66666666-7777-8888-9999-000000000000.consul"},
+	}
+	for i, p := range peerings {
+		idx := uint64(10 + 2*i)
+		require.NoError(t, store.PeeringWrite(idx, &pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{ID: p.id, Name: p.name},
+		}))
+		require.NoError(t, store.PeeringTrustBundleWrite(idx+1, &pbpeering.PeeringTrustBundle{
+			TrustDomain: p.trustDomain,
+			PeerName:    p.name,
+			RootPEMs:    []string{"root"},
+		}))
+	}
+
+	names := func(peerings []*pbpeering.Peering) []string {
+		var out []string
+		for _, p := range peerings {
+			out = append(out, p.Name)
+		}
+		return out
+	}
+
+	testutil.RunStep(t, "matches case-insensitively", func(t *testing.T) {
+		got, err := backend.PeeringsByTrustDomain("", "11111111-2222-3333-4444-555555555555.CONSUL")
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"peer-1", "peer-2"}, names(got))
+	})
+
+	testutil.RunStep(t, "no match", func(t *testing.T) {
+		got, err := backend.PeeringsByTrustDomain("", "unknown.consul")
+		require.NoError(t, err)
+		require.Empty(t, got)
+	})
+}
+
+func TestPeeringBackend_PeeringQuota(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t, func(c *Config) {
+		c.PeeringMaxPerPartition = 2
+	})
+
+	write := func(id, name string) error {
+		return backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{ID: id, Name: name, State: pbpeering.PeeringState_PENDING},
+		})
+	}
+	require.NoError(t, write("9e650110-ac74-4c5a-a6a8-9348b2bed4e9", "peer-1"))
+	require.NoError(t, write("0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e", "peer-2"))
+
+	testutil.RunStep(t, "new peering over the limit", func(t *testing.T) {
+		err := write("5a8f1e2b-3c4d-4e5f-8a9b-0c1d2e3f4a5b", "peer-3")
+		require.ErrorIs(t, err, ErrPeeringQuotaExceeded)
+		testutil.RequireErrorContains(t, err, `partition "default" is limited to 2 peerings`)
+	})
+
+	testutil.RunStep(t, "updates to existing peerings are allowed", func(t *testing.T) {
+		require.NoError(t, write("0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e", "peer-2"))
+	})
+
+	testutil.RunStep(t, "concurrent writes cannot exceed the limit", func(t *testing.T) {
+		srv.config.PeeringMaxPerPartition = 4
+
+		var (
+			wg        sync.WaitGroup
+			succeeded int32
+		)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				id, err := uuid.GenerateUUID()
+				require.NoError(t, err)
+				if write(id, fmt.Sprintf("concurrent-%d", i)) == nil {
+					atomic.AddInt32(&succeeded, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		require.Equal(t, int32(2), succeeded)
+
+		_, peerings, err := srv.fsm.State().PeeringList(nil, *structs.DefaultEnterpriseMetaInDefaultPartition())
+		require.NoError(t, err)
+		require.Len(t, peerings, 4)
+	})
+
+	testutil.RunStep(t, "unlimited when zero", func(t *testing.T) {
+		srv.config.PeeringMaxPerPartition = 0
+		require.NoError(t, write("5a8f1e2b-3c4d-4e5f-8a9b-0c1d2e3f4a5b", "peer-3"))
+	})
+}
+
+func TestPeeringBackend_PeeringEstablishmentDuration(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	const peerID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+	require.NoError(t, srv.fsm.State().PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: "0ba06390-bd77-4c52-8397-f88c0867157d", Name: "unrecorded"},
+	}))
+	require.NoError(t, backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: peerID, Name: "my-peer"},
+	}))
+
+	testutil.RunStep(t, "unknown peering", func(t *testing.T) {
+		_, _, err := backend.PeeringEstablishmentDuration("", "other-peer", nil)
+		testutil.RequireErrorContains(t, err, `no peering found with name "other-peer"`)
+	})
+
+	testutil.RunStep(t, "start time written before this server", func(t *testing.T) {
+		_, _, err := backend.PeeringEstablishmentDuration("", "unrecorded", nil)
+		testutil.RequireErrorContains(t, err, "establishment start time of peering \"unrecorded\" is unknown")
+	})
+
+	testutil.RunStep(t, "not connected yet", func(t *testing.T) {
+		elapsed, established, err := backend.PeeringEstablishmentDuration("", "my-peer", nil)
+		require.NoError(t, err)
+		require.False(t, established)
+		require.Positive(t, elapsed)
+	})
+
+	testutil.RunStep(t, "connected", func(t *testing.T) {
+		_, err := srv.peerStreamServer.Tracker.Connected(peerID)
+		require.NoError(t, err)
+		t.Cleanup(func() { srv.peerStreamServer.Tracker.DeleteStatus(peerID) })
+
+		first, established, err := backend.PeeringEstablishmentDuration("", "my-peer", nil)
+		require.NoError(t, err)
+		require.True(t, established)
+
+		// The duration stops growing once the peering has connected.
+		time.Sleep(time.Millisecond)
+		second, _, err := backend.PeeringEstablishmentDuration("", "my-peer", nil)
+		require.NoError(t, err)
+		require.Equal(t, first, second)
+		require.NotContains(t, backend.establishmentStarts, peerID)
+	})
+
+	testutil.RunStep(t, "deleted peerings are forgotten", func(t *testing.T) {
+		const otherID = "5a8f1e2b-3c4d-4e5f-8a9b-0c1d2e3f4a5b"
+		require.NoError(t, backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{ID: otherID, Name: "other-peer"},
+		}))
+		require.Contains(t, backend.establishmentStarts, otherID)
+
+		// Marking a peering for deletion through the backend forgets it.
+		require.NoError(t, backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{
+				ID:        otherID,
+				Name:      "other-peer",
+				State:     pbpeering.PeeringState_DELETING,
+				DeletedAt: structs.TimeToProto(time.Now()),
+			},
+		}))
+		require.NotContains(t, backend.establishmentStarts, otherID)
+
+		// Peerings terminated by other writes are forgotten by the next eviction.
+		require.NoError(t, srv.fsm.State().PeeringTerminateByID(20, peerID))
+		backend.evictEstablishments()
+		require.Empty(t, backend.establishmentDurations)
+	})
+}
+
+func TestPeeringBackend_UpdatePeeringServerAddresses(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	store := srv.fsm.State()
+	require.NoError(t, store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:                  "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+			Name:                "dialer",
+			PeerServerAddresses: []string{"10.0.0.1:8502"},
+		},
+	}))
+	require.NoError(t, store.PeeringWrite(11, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e", Name: "acceptor"},
+	}))
+
+	cases := map[string]struct {
+		peering   string
+		addrs     []string
+		expectErr string
+	}{
+		"no addresses":      {peering: "dialer", expectErr: "at least one server address is required"},
+		"missing port":      {peering: "dialer", addrs: []string{"10.0.0.2"}, expectErr: `invalid server address "10.0.0.2"`},
+		"missing host":      {peering: "dialer", addrs: []string{":8502"}, expectErr: "is missing a host"},
+		"invalid port":      {peering: "dialer", addrs: []string{"10.0.0.2:0"}, expectErr: "has an invalid port"},
+		"unknown peering":   {peering: "other", addrs: []string{"10.0.0.2:8502"}, expectErr: `no peering found with name "other"`},
+		"accepting peering": {peering: "acceptor", addrs: []string{"10.0.0.2:8502"}, expectErr: "does not dial its peer"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := backend.UpdatePeeringServerAddresses(tc.peering, "", tc.addrs)
+			testutil.RequireErrorContains(t, err, tc.expectErr)
+		})
+	}
+
+	testutil.RunStep(t, "updates the addresses", func(t *testing.T) {
+		addrs := []string{"10.0.0.2:8502", "[2001:db8::1]:8502"}
+		require.NoError(t, backend.UpdatePeeringServerAddresses("dialer", "", addrs))
+
+		peering, err := backend.peeringByNameInPartition("dialer", "")
+		require.NoError(t, err)
+		require.Equal(t, addrs, peering.PeerServerAddresses)
+	})
+}
+
+func TestPeeringBackend_UpdatePeeringCAS(t *testing.T) {
+	srv, backend := newMockPeeringBackend()
+	require.NoError(t, srv.store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:                  "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+			Name:                "dialer",
+			PeerServerAddresses: []string{"10.0.0.1:8502"},
+		},
+	}))
+
+	testutil.RunStep(t, "writes are checked against the read peering", func(t *testing.T) {
+		require.NoError(t, backend.UpdatePeeringServerAddresses("dialer", "", []string{"10.0.0.2:8502"}))
+
+		req, ok := srv.lastApplied.(*pbpeering.PeeringWriteRequest)
+		require.True(t, ok)
+		require.Equal(t, uint64(10), req.ExpectedModifyIndex)
+		require.Equal(t, []string{"10.0.0.2:8502"}, req.Peering.PeerServerAddresses)
+	})
+
+	testutil.RunStep(t, "conflicting writes are retried", func(t *testing.T) {
+		srv.applied = nil
+		srv.applyErr = state.ErrPeeringCASConflict
+
+		err := backend.SetPeeringImportHealthyOnly("dialer", "", true)
+		require.ErrorIs(t, err, state.ErrPeeringCASConflict)
+		require.Len(t, srv.applied, peeringWriteCASAttempts)
+	})
+}
+
+func TestPeeringBackend_PeeringWriteRateLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PeeringWriteRate = 1
+	cfg.PeeringWriteBurst = 2
+	srv := &mockPeeringBackendServer{config: cfg, store: state.NewStateStore(nil)}
+	backend := NewPeeringBackend(srv)
+
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	backend.timeNow = func() time.Time { return now }
+
+	write := func(id, name string) error {
+		peering := &pbpeering.Peering{ID: id, Name: name}
+		if err := backend.CheckPeeringWriteRate(peering); err != nil {
+			return err
+		}
+		return backend.PeeringWrite(&pbpeering.PeeringWriteRequest{Peering: peering})
+	}
+	const (
+		peer1ID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+		peer2ID = "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e"
+	)
+
+	testutil.RunStep(t, "rapid writes are throttled", func(t *testing.T) {
+		require.NoError(t, write(peer1ID, "peer-1"))
+		require.NoError(t, write(peer1ID, "peer-1"))
+
+		err := write(peer1ID, "peer-1")
+		require.ErrorIs(t, err, ErrPeeringWriteRateLimited)
+		require.True(t, structs.IsErrRPCRateExceeded(err))
+		require.Len(t, srv.applied, 2)
+	})
+
+	testutil.RunStep(t, "other peerings are unaffected", func(t *testing.T) {
+		require.NoError(t, write(peer2ID, "peer-2"))
+		require.Len(t, srv.applied, 3)
+	})
+
+	testutil.RunStep(t, "writes are allowed again after refilling", func(t *testing.T) {
+		now = now.Add(time.Second)
+		require.NoError(t, write(peer1ID, "peer-1"))
+		require.ErrorIs(t, write(peer1ID, "peer-1"), ErrPeeringWriteRateLimited)
+	})
+
+	testutil.RunStep(t, "idle limiters are evicted", func(t *testing.T) {
+		backend.evictIdleWriteLimiters()
+		require.Len(t, backend.writeLimiters, 2)
+
+		// Both limiters refill in two seconds, and only peer-2 has been idle
+		// for longer than that.
+		now = now.Add(2 * time.Second)
+		backend.evictIdleWriteLimiters()
+		require.Len(t, backend.writeLimiters, 1)
+		require.Contains(t, backend.writeLimiters, "default/peer-1")
+	})
+
+	testutil.RunStep(t, "internal writes are not throttled", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			require.NoError(t, backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+				Peering: &pbpeering.Peering{ID: peer1ID, Name: "peer-1"},
+			}))
+		}
+	})
+
+	testutil.RunStep(t, "disabled", func(t *testing.T) {
+		cfg.PeeringWriteRate = 0
+		for i := 0; i < 5; i++ {
+			require.NoError(t, write(peer1ID, "peer-1"))
+		}
+		backend.evictIdleWriteLimiters()
+		require.Empty(t, backend.writeLimiters)
+	})
+}
+
+func TestPeeringBackend_LogsFailedPeeringWrite(t *testing.T) {
+	srv := &mockPeeringBackendServer{
+		config:   DefaultConfig(),
+		store:    state.NewStateStore(nil),
+		applyErr: errors.New("leadership lost"),
+	}
+	backend := NewPeeringBackend(srv)
+
+	var buf bytes.Buffer
+	backend.logger = hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Debug})
+
+	err := backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Name: "my-peer"},
+	})
+	require.Error(t, err)
+
+	logs := buf.String()
+	require.Contains(t, logs, "[ERROR] peering write failed")
+	require.Contains(t, logs, "peering_name=my-peer")
+	require.Contains(t, logs, "peering_id=9e650110-ac74-4c5a-a6a8-9348b2bed4e9")
+	require.Contains(t, logs, "error=\"leadership lost\"")
+	require.NotContains(t, logs, "wrote peering")
+}
+
+func TestPeeringBackend_PeeringTerminateByID_Metrics(t *testing.T) {
+	if testing.Short() {
+		t.Skip("too slow for testing.Short")
+	}
+
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	cfg := metrics.DefaultConfig("consul")
+	cfg.EnableHostname = false
+	metrics.NewGlobal(cfg, sink)
+	t.Cleanup(func() {
+		metrics.NewGlobal(cfg, &metrics.BlackholeSink{})
+	})
+
+	srv, backend := newTestPeeringBackend(t)
+
+	const peerID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+	require.NoError(t, srv.fsm.State().PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: peerID, Name: "my-peer"},
+	}))
+
+	require.NoError(t, backend.PeeringTerminateByID(&pbpeering.PeeringTerminateByIDRequest{ID: peerID}))
+
+	intv := sink.Data()[0]
+	require.Equal(t, 1, intv.Samples["consul.peering.terminate_by_id"].Count)
+	require.NotContains(t, intv.Counters, "consul.peering.terminate_by_id.failure")
+
+	// Applies fail once raft has shut down.
+	require.NoError(t, srv.Shutdown())
+	require.Error(t, backend.PeeringTerminateByID(&pbpeering.PeeringTerminateByIDRequest{ID: peerID}))
+
+	intv = sink.Data()[0]
+	require.Equal(t, 2, intv.Samples["consul.peering.terminate_by_id"].Count)
+	require.Equal(t, 1, intv.Counters["consul.peering.terminate_by_id.failure"].Count)
+}
+
+func TestPeeringBackend_RaftApplyErrorsHaveContext(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	// Applies fail once raft has shut down.
+	require.NoError(t, srv.Shutdown())
+
+	const peerID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+	cases := map[string]struct {
+		apply  func() error
+		prefix string
+	}{
+		"PeeringWrite": {
+			apply: func() error {
+				return backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+					Peering: &pbpeering.Peering{ID: peerID, Name: "my-peer"},
+				})
+			},
+			prefix: "peering write failed: ",
+		},
+		"PeeringSecretsWrite": {
+			apply: func() error {
+				return backend.PeeringSecretsWrite(&pbpeering.SecretsWriteRequest{
+					PeerID: peerID,
+					Request: &pbpeering.SecretsWriteRequest_GenerateToken{
+						GenerateToken: &pbpeering.SecretsWriteRequest_GenerateTokenRequest{
+							EstablishmentSecret: "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84",
+						},
+					},
+				})
+			},
+			prefix: "peering secrets write failed: ",
+		},
+		"PeeringTrustBundleWrite": {
+			apply: func() error {
+				return backend.PeeringTrustBundleWrite(&pbpeering.PeeringTrustBundleWriteRequest{
+					PeeringTrustBundle: &pbpeering.PeeringTrustBundle{PeerName: "my-peer", TrustDomain: "peer.consul"},
+				})
+			},
+			prefix: "peering trust bundle write failed: ",
+		},
+		"PeeringTerminateByID": {
+			apply: func() error {
+				return backend.PeeringTerminateByID(&pbpeering.PeeringTerminateByIDRequest{ID: peerID})
+			},
+			prefix: "peering terminate by ID failed: ",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.apply()
+			require.Error(t, err)
+			require.True(t, strings.HasPrefix(err.Error(), tc.prefix), err.Error())
+			require.ErrorIs(t, err, raft.ErrRaftShutdown)
+		})
+	}
+}
+
+func TestValidatePeerName(t *testing.T) {
+	cases := map[string]bool{
+		"my-peer":               true,
+		"peer1":                 true,
+		"1peer":                 true,
+		"MyPeer":                true,
+		"":                      false,
+		"-peer":                 false,
+		"peer-":                 false,
+		"my/peer":               false,
+		"my peer":               false,
+		"my_peer":               false,
+		"my.peer":               false,
+		" peer":                 false,
+		"peer\n":                false,
+		strings.Repeat("a", 63): true,
+		strings.Repeat("a", 64): false,
+	}
+	for name, valid := range cases {
+		err := validatePeerName(name)
+		if valid {
+			require.NoError(t, err, "name %q", name)
+		} else {
+			testutil.RequireErrorContains(t, err, "is not a valid peer name")
+		}
+	}
+}
+
+func TestPeeringBackend_SetPeeringOneTimeTokens(t *testing.T) {
+	store := state.NewStateStore(nil)
+	srv := &mockPeeringBackendServer{config: DefaultConfig(), store: store}
+	backend := NewPeeringBackend(srv)
+
+	require.NoError(t, store.PeeringWrite(1, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Name: "my-peer"},
+	}))
+
+	require.NoError(t, backend.SetPeeringOneTimeTokens("my-peer", "", true))
+	req, ok := srv.lastApplied.(*pbpeering.PeeringWriteRequest)
+	require.True(t, ok)
+	require.True(t, req.Peering.OneTimeTokens())
+
+	err := backend.SetPeeringOneTimeTokens("unknown", "", true)
+	testutil.RequireErrorContains(t, err, "no peering")
+}
+
+func TestPeeringBackend_ReservedMetaSurvivesReestablish(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	const peeringID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+	require.NoError(t, backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:                  peeringID,
+			Name:                "my-peer",
+			PeerServerAddresses: []string{"10.0.0.1:8502"},
+			Meta:                map[string]string{"env": "prod"},
+		},
+	}))
+	require.NoError(t, backend.SetPeeringImportHealthyOnly("my-peer", "", true))
+	require.NoError(t, backend.SetPeeringOneTimeTokens("my-peer", acl.DefaultPartitionName, true))
+
+	readMeta := func(t *testing.T) map[string]string {
+		_, p, err := srv.fsm.State().PeeringReadByID(nil, peeringID)
+		require.NoError(t, err)
+		require.NotNil(t, p)
+		return p.Meta
+	}
+
+	testutil.RunStep(t, "re-establishing keeps reserved keys", func(t *testing.T) {
+		userMeta := map[string]string{"env": "staging"}
+		require.NoError(t, backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{
+				ID:                  peeringID,
+				Name:                "my-peer",
+				PeerServerAddresses: []string{"10.0.0.1:8502"},
+				Meta:                userMeta,
+			},
+		}))
+
+		require.Equal(t, map[string]string{
+			"env":                          "staging",
+			peeringMetaImportHealthyOnly:   "true",
+			pbpeering.MetaKeyOneTimeTokens: "true",
+		}, readMeta(t))
+		// The caller's meta is not modified.
+		require.Equal(t, map[string]string{"env": "staging"}, userMeta)
+	})
+
+	testutil.RunStep(t, "options can still be cleared", func(t *testing.T) {
+		require.NoError(t, backend.SetPeeringOneTimeTokens("my-peer", "", false))
+		require.Equal(t, map[string]string{
+			"env":                        "staging",
+			peeringMetaImportHealthyOnly: "true",
+		}, readMeta(t))
+	})
+
+	testutil.RunStep(t, "new peerings start without options", func(t *testing.T) {
+		require.NoError(t, backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{
+				ID:   "5ebcff30-5509-4858-8142-a8e580f1863f",
+				Name: "other-peer",
+			},
+		}))
+		_, p, err := srv.fsm.State().PeeringReadByID(nil, "5ebcff30-5509-4858-8142-a8e580f1863f")
+		require.NoError(t, err)
+		require.Empty(t, p.Meta)
+	})
+}
+
+// blockingApplyServer holds raft applies until release is closed.
+type blockingApplyServer struct {
+	*mockPeeringBackendServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingApplyServer) PeeringRaftApply(t structs.MessageType, msg interface{}) (interface{}, error) {
+	close(s.started)
+	<-s.release
+	return s.mockPeeringBackendServer.PeeringRaftApply(t, msg)
+}
+
+func TestPeeringBackend_RaftApplyReturnsOnCancel(t *testing.T) {
+	srv := &blockingApplyServer{
+		mockPeeringBackendServer: &mockPeeringBackendServer{config: DefaultConfig(), store: state.NewStateStore(nil)},
+		started:                  make(chan struct{}),
+		release:                  make(chan struct{}),
+	}
+	backend := NewPeeringBackend(srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- backend.raftApplyProtobufCtx(ctx, structs.PeeringWriteType, &pbpeering.PeeringWriteRequest{}, func() {
+			close(finished)
+		})
+	}()
+
+	<-srv.started
+	cancel()
+	select {
+	case err := <-errCh:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not return when the context was canceled")
+	}
+
+	// The submitted apply still finishes after the caller has given up.
+	select {
+	case <-finished:
+		t.Fatal("finished before the apply returned")
+	default:
+	}
+	close(srv.release)
+	<-finished
+	require.Equal(t, []structs.MessageType{structs.PeeringWriteType}, srv.applied)
+}
+
+func TestPeeringBackend_PeeringWriteIdempotencyKey(t *testing.T) {
+	srv, backend := newMockPeeringBackend()
+
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	backend.timeNow = func() time.Time { return now }
+
+	write := func(key string) error {
+		return backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+			Peering:        &pbpeering.Peering{ID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Name: "my-peer"},
+			IdempotencyKey: key,
+		})
+	}
+
+	testutil.RunStep(t, "repeated key is applied once", func(t *testing.T) {
+		require.NoError(t, write("key-1"))
+		require.NoError(t, write("key-1"))
+		require.Len(t, srv.applied, 1)
+	})
+
+	testutil.RunStep(t, "keys are kept out of raft", func(t *testing.T) {
+		applied, ok := srv.lastApplied.(*pbpeering.PeeringWriteRequest)
+		require.True(t, ok)
+		require.Empty(t, applied.IdempotencyKey)
+	})
+
+	testutil.RunStep(t, "other keys and no key are applied", func(t *testing.T) {
+		require.NoError(t, write("key-2"))
+		require.NoError(t, write(""))
+		require.NoError(t, write(""))
+		require.Len(t, srv.applied, 4)
+	})
+
+	testutil.RunStep(t, "failed writes can be retried", func(t *testing.T) {
+		srv.applyErr = errors.New("leadership lost")
+		require.Error(t, write("key-3"))
+		srv.applyErr = nil
+		require.NoError(t, write("key-3"))
+		require.NoError(t, write("key-3"))
+		require.Len(t, srv.applied, 6)
+	})
+
+	testutil.RunStep(t, "keys cannot be reused for a different write", func(t *testing.T) {
+		err := backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+			Peering:        &pbpeering.Peering{ID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Name: "my-peer", Meta: map[string]string{"k": "v"}},
+			IdempotencyKey: "key-1",
+		})
+		require.ErrorIs(t, err, ErrIdempotencyKeyReused)
+		require.Len(t, srv.applied, 6)
+	})
+
+	testutil.RunStep(t, "keys expire", func(t *testing.T) {
+		now = now.Add(srv.config.PeeringIdempotencyKeyTTL + time.Second)
+		require.NoError(t, write("key-1"))
+		require.Len(t, srv.applied, 7)
+	})
+
+	testutil.RunStep(t, "zero TTL disables keys", func(t *testing.T) {
+		srv.config.PeeringIdempotencyKeyTTL = 0
+		require.NoError(t, write("key-4"))
+		require.NoError(t, write("key-4"))
+		require.Len(t, srv.applied, 9)
+	})
+}
@@ -0,0 +1,176 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/go-uuid"
+
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/proto/pbpeering"
+)
+
+// GenerateEstablishmentSecret returns a new establishment secret that is not
+// in use by any peering.
+func (b *PeeringBackend) GenerateEstablishmentSecret() (string, error) {
+	if b.generateSecret != nil {
+		return b.generateSecret()
+	}
+	return lib.GenerateUUID(b.ValidateProposedPeeringSecret)
+}
+
+func (b *PeeringBackend) ValidateProposedPeeringSecret(id string) (bool, error) {
+	rejection, err := b.ExplainProposedPeeringSecret(id)
+	if err != nil {
+		return false, err
+	}
+	return rejection == nil, nil
+}
+
+// PeeringSecretRejectionReason is why a proposed peering secret cannot be used.
+type PeeringSecretRejectionReason string
+
+const (
+	// PeeringSecretMalformed means the secret is not a UUID.
+	PeeringSecretMalformed PeeringSecretRejectionReason = "MALFORMED"
+
+	// PeeringSecretInUse means the secret is currently held by a peering.
+	PeeringSecretInUse PeeringSecretRejectionReason = "IN_USE"
+
+	// PeeringSecretAlreadyUsed means the secret was burned by a one-time
+	// token and is never handed out again.
+	PeeringSecretAlreadyUsed PeeringSecretRejectionReason = "ALREADY_USED"
+)
+
+// PeeringSecretRejection explains why ValidateProposedPeeringSecret rejected
+// a secret.
+type PeeringSecretRejection struct {
+	Reason PeeringSecretRejectionReason
+
+	// PeerID is the ID of the peering that holds or used the secret, if known.
+	PeerID string
+}
+
+func (r *PeeringSecretRejection) Error() string {
+	switch r.Reason {
+	case PeeringSecretMalformed:
+		return "peering secret is not a valid UUID"
+	case PeeringSecretInUse:
+		if r.PeerID != "" {
+			return fmt.Sprintf("peering secret is in use by peering %q", r.PeerID)
+		}
+		return "peering secret is in use by another peering"
+	case PeeringSecretAlreadyUsed:
+		return fmt.Sprintf("peering secret was already used to establish peering %q", r.PeerID)
+	default:
+		return fmt.Sprintf("peering secret was rejected: %s", r.Reason)
+	}
+}
+
+// ExplainProposedPeeringSecret returns why the given secret cannot be used as
+// a peering secret, or nil if it can.
+func (b *PeeringBackend) ExplainProposedPeeringSecret(id string) (*PeeringSecretRejection, error) {
+	if _, err := uuid.ParseUUID(id); err != nil {
+		return &PeeringSecretRejection{Reason: PeeringSecretMalformed}, nil
+	}
+
+	store := b.srv.PeeringState()
+	ok, err := store.ValidateProposedPeeringSecretUUID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		owner, err := store.PeeringSecretOwner(id)
+		if err != nil {
+			return nil, err
+		}
+		secrets, err := store.PeeringSecretsRead(nil, owner)
+		if err != nil {
+			return nil, err
+		}
+		for _, used := range secrets.GetUsedEstablishmentSecretIDs() {
+			if used == id {
+				return &PeeringSecretRejection{Reason: PeeringSecretAlreadyUsed, PeerID: owner}, nil
+			}
+		}
+		return &PeeringSecretRejection{Reason: PeeringSecretInUse, PeerID: owner}, nil
+	}
+	return nil, nil
+}
+
+func (b *PeeringBackend) PeeringSecretsWrite(req *pbpeering.SecretsWriteRequest) error {
+	return b.PeeringSecretsWriteCtx(context.Background(), req)
+}
+
+// PeeringSecretsWriteCtx is like PeeringSecretsWrite but returns the
+// context's error if ctx is canceled before the write is applied, in which
+// case the write may still be committed.
+func (b *PeeringBackend) PeeringSecretsWriteCtx(ctx context.Context, req *pbpeering.SecretsWriteRequest) error {
+	if err := b.raftApplyProtobufCtx(ctx, structs.PeeringSecretsWriteType, req, nil); err != nil {
+		b.log().Error("peering secrets write failed", "peering_id", req.PeerID, "error", err)
+		return fmt.Errorf("peering secrets write failed: %w", err)
+	}
+	return nil
+}
+
+// ErrPeeringSecretConflict is returned by RotatePeeringSecret when the secret
+// was changed by a concurrent write or the generated secret cannot be used.
+// The rotation can be retried.
+var ErrPeeringSecretConflict = errors.New("peering secret rotation conflict")
+
+// RotatePeeringSecret replaces the establishment secret of the peering with
+// the given ID with a newly generated one and returns it. Tokens carrying the
+// previous secret can no longer be used to establish the peering.
+func (b *PeeringBackend) RotatePeeringSecret(peeringID string) (string, error) {
+	_, existing, err := b.srv.PeeringState().PeeringReadByID(nil, peeringID)
+	if err != nil {
+		return "", fmt.Errorf("failed to read peering: %w", err)
+	}
+	if existing == nil || !existing.IsActive() {
+		return "", fmt.Errorf("no active peering with ID %q", peeringID)
+	}
+	if existing.ShouldDial() {
+		return "", fmt.Errorf("peering %q was established from a token; only the peer that generated the token can rotate its secret", existing.Name)
+	}
+	previous, err := b.srv.PeeringState().PeeringSecretsRead(nil, peeringID)
+	if err != nil {
+		return "", fmt.Errorf("failed to read peering secrets: %w", err)
+	}
+
+	generate := b.generateSecret
+	if generate == nil {
+		generate = uuid.GenerateUUID
+	}
+	secret, err := generate()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate peering secret: %w", err)
+	}
+	rejection, err := b.ExplainProposedPeeringSecret(secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to validate peering secret: %w", err)
+	}
+	if rejection != nil {
+		return "", fmt.Errorf("%w: %v", ErrPeeringSecretConflict, rejection)
+	}
+
+	err = b.PeeringSecretsWrite(&pbpeering.SecretsWriteRequest{
+		PeerID: peeringID,
+		Request: &pbpeering.SecretsWriteRequest_GenerateToken{
+			GenerateToken: &pbpeering.SecretsWriteRequest_GenerateTokenRequest{
+				EstablishmentSecret:         secret,
+				Cas:                         true,
+				PreviousEstablishmentSecret: previous.GetEstablishment().GetSecretID(),
+			},
+		},
+	})
+	if errors.Is(err, state.ErrPeeringSecretsCASConflict) {
+		return "", fmt.Errorf("%w: the secret of peering %q was changed by another write", ErrPeeringSecretConflict, existing.Name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
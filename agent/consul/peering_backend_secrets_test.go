@@ -0,0 +1,167 @@
+package consul
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/go-uuid"
+
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/proto/pbpeering"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeeringBackend_GenerateEstablishmentSecret(t *testing.T) {
+	testutil.RunStep(t, "shim", func(t *testing.T) {
+		backend := &PeeringBackend{generateSecret: func() (string, error) {
+			return "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84", nil
+		}}
+		secret, err := backend.GenerateEstablishmentSecret()
+		require.NoError(t, err)
+		require.Equal(t, "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84", secret)
+
+		backend.generateSecret = func() (string, error) { return "", errors.New("exhausted") }
+		_, err = backend.GenerateEstablishmentSecret()
+		testutil.RequireErrorContains(t, err, "exhausted")
+	})
+
+	testutil.RunStep(t, "random by default", func(t *testing.T) {
+		_, backend := newTestPeeringBackend(t)
+
+		first, err := backend.GenerateEstablishmentSecret()
+		require.NoError(t, err)
+		_, err = uuid.ParseUUID(first)
+		require.NoError(t, err)
+
+		second, err := backend.GenerateEstablishmentSecret()
+		require.NoError(t, err)
+		require.NotEqual(t, first, second)
+	})
+}
+
+func TestPeeringBackend_ExplainProposedPeeringSecret(t *testing.T) {
+	store := state.NewStateStore(nil)
+	backend := NewPeeringBackend(&mockPeeringBackendServer{config: DefaultConfig(), store: store})
+
+	const (
+		holderID  = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+		heldID    = "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84"
+		unusedID  = "0ba06390-bd77-4c52-8397-f88c0867157d"
+		usedID    = "5c4e2ba4-3f6d-4ab3-9f0e-51c1dbd9a6b2"
+		oneTimeID = "7a1d46b5-0c7f-4a39-9a9e-2f6b1c8a3d10"
+		malformed = "not-a-uuid"
+	)
+	require.NoError(t, store.PeeringWrite(1, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: holderID, Name: "holder"},
+		SecretsRequest: &pbpeering.SecretsWriteRequest{
+			PeerID: holderID,
+			Request: &pbpeering.SecretsWriteRequest_GenerateToken{
+				GenerateToken: &pbpeering.SecretsWriteRequest_GenerateTokenRequest{EstablishmentSecret: heldID},
+			},
+		},
+	}))
+	require.NoError(t, store.PeeringWrite(2, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:   oneTimeID,
+			Name: "one-time",
+			Meta: map[string]string{pbpeering.MetaKeyOneTimeTokens: "true"},
+		},
+		SecretsRequest: &pbpeering.SecretsWriteRequest{
+			PeerID: oneTimeID,
+			Request: &pbpeering.SecretsWriteRequest_GenerateToken{
+				GenerateToken: &pbpeering.SecretsWriteRequest_GenerateTokenRequest{EstablishmentSecret: usedID},
+			},
+		},
+	}))
+	require.NoError(t, store.PeeringSecretsWrite(3, &pbpeering.SecretsWriteRequest{
+		PeerID: oneTimeID,
+		Request: &pbpeering.SecretsWriteRequest_ExchangeSecret{
+			ExchangeSecret: &pbpeering.SecretsWriteRequest_ExchangeSecretRequest{
+				EstablishmentSecret: usedID,
+				PendingStreamSecret: "1e0b9c4f-8d2a-4f6e-b3c7-5a9d0e2f4b61",
+			},
+		},
+	}))
+
+	cases := map[string]struct {
+		secret string
+		expect *PeeringSecretRejection
+	}{
+		"malformed": {secret: malformed, expect: &PeeringSecretRejection{Reason: PeeringSecretMalformed}},
+		"in use":    {secret: heldID, expect: &PeeringSecretRejection{Reason: PeeringSecretInUse, PeerID: holderID}},
+		"used":      {secret: usedID, expect: &PeeringSecretRejection{Reason: PeeringSecretAlreadyUsed, PeerID: oneTimeID}},
+		"unused":    {secret: unusedID},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rejection, err := backend.ExplainProposedPeeringSecret(tc.secret)
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, rejection)
+
+			ok, err := backend.ValidateProposedPeeringSecret(tc.secret)
+			require.NoError(t, err)
+			require.Equal(t, tc.expect == nil, ok)
+		})
+	}
+}
+
+func TestPeeringBackend_RotatePeeringSecret(t *testing.T) {
+	store := state.NewStateStore(nil)
+	srv := &mockPeeringBackendServer{config: DefaultConfig(), store: store}
+	backend := NewPeeringBackend(srv)
+
+	const (
+		peerID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+		heldID = "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84"
+	)
+	require.NoError(t, store.PeeringWrite(1, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: peerID, Name: "my-peer"},
+		SecretsRequest: &pbpeering.SecretsWriteRequest{
+			PeerID: peerID,
+			Request: &pbpeering.SecretsWriteRequest_GenerateToken{
+				GenerateToken: &pbpeering.SecretsWriteRequest_GenerateTokenRequest{EstablishmentSecret: heldID},
+			},
+		},
+	}))
+
+	testutil.RunStep(t, "clean rotation", func(t *testing.T) {
+		secret, err := backend.RotatePeeringSecret(peerID)
+		require.NoError(t, err)
+		require.NotEqual(t, heldID, secret)
+		_, err = uuid.ParseUUID(secret)
+		require.NoError(t, err)
+		require.Equal(t, []structs.MessageType{structs.PeeringSecretsWriteType}, srv.applied)
+
+		// The write only applies if no one else replaced the secret first.
+		req, ok := srv.lastApplied.(*pbpeering.SecretsWriteRequest)
+		require.True(t, ok)
+		require.True(t, req.GetGenerateToken().GetCas())
+		require.Equal(t, heldID, req.GetGenerateToken().GetPreviousEstablishmentSecret())
+	})
+
+	testutil.RunStep(t, "generated secret collides", func(t *testing.T) {
+		backend.generateSecret = func() (string, error) { return heldID, nil }
+		t.Cleanup(func() { backend.generateSecret = nil })
+
+		_, err := backend.RotatePeeringSecret(peerID)
+		require.ErrorIs(t, err, ErrPeeringSecretConflict)
+		testutil.RequireErrorContains(t, err, "in use by peering")
+		require.Len(t, srv.applied, 1)
+	})
+
+	testutil.RunStep(t, "concurrent rotation", func(t *testing.T) {
+		srv.applyErr = state.ErrPeeringSecretsCASConflict
+		t.Cleanup(func() { srv.applyErr = nil })
+
+		_, err := backend.RotatePeeringSecret(peerID)
+		require.ErrorIs(t, err, ErrPeeringSecretConflict)
+		testutil.RequireErrorContains(t, err, "changed by another write")
+	})
+
+	testutil.RunStep(t, "unknown peering", func(t *testing.T) {
+		_, err := backend.RotatePeeringSecret("0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e")
+		testutil.RequireErrorContains(t, err, "no active peering")
+	})
+}
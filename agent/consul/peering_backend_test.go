@@ -2,22 +2,33 @@ package consul
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/time/rate"
 	gogrpc "google.golang.org/grpc"
 
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/acl/resolver"
 	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/consul/stream"
+	"github.com/hashicorp/consul/agent/grpc-external/services/peerstream"
 	"github.com/hashicorp/consul/agent/pool"
 	"github.com/hashicorp/consul/agent/structs"
 	"github.com/hashicorp/consul/proto/pbpeering"
 	"github.com/hashicorp/consul/proto/pbpeerstream"
+	"github.com/hashicorp/consul/proto/pbsubscribe"
 	"github.com/hashicorp/consul/sdk/freeport"
 	"github.com/hashicorp/consul/sdk/testutil"
 	"github.com/hashicorp/consul/testrpc"
-	"github.com/hashicorp/consul/types"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -76,80 +87,402 @@ func TestPeeringBackend_ForwardToLeader(t *testing.T) {
 	})
 }
 
-func TestPeeringBackend_GetServerAddresses(t *testing.T) {
+// mockPeeringBackendServer implements PeeringBackendServer on top of a bare
+// state store, recording raft applies instead of performing them.
+type mockPeeringBackendServer struct {
+	config  *Config
+	store   *state.Store
+	roots   *structs.IndexedCARoots
+	applied []structs.MessageType
+
+	// lastApplied is the message of the last PeeringRaftApply.
+	lastApplied interface{}
+
+	// applyErr is returned by every raft apply.
+	applyErr error
+
+	// publisher is returned by PeeringPublisher. It may be nil.
+	publisher PeeringEventPublisher
+
+	// tracker is returned by PeeringStreamTracker. It may be nil.
+	tracker PeeringStreamTracker
+}
+
+func TestPeeringBackend_NoStreamTracker(t *testing.T) {
+	srv, backend := newMockPeeringBackend()
+
+	require.NoError(t, srv.store.PeeringWrite(1, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Name: "my-peer"},
+	}))
+
+	_, err := backend.UnhealthyPeerings("")
+	require.NoError(t, err)
+
+	inBps, outBps, err := backend.PeeringThroughput(time.Minute)
+	require.NoError(t, err)
+	require.Zero(t, inBps)
+	require.Zero(t, outBps)
+}
+
+// newTestPeeringBackend starts a server configured by configOpts and returns
+// it, once it is the leader, with a new PeeringBackend for it. Running a
+// server is slow, so the test is skipped in short mode.
+func newTestPeeringBackend(t *testing.T, configOpts ...func(*Config)) (*Server, *PeeringBackend) {
+	t.Helper()
 	if testing.Short() {
 		t.Skip("too slow for testing.Short")
 	}
 
-	_, cfg := testServerConfig(t)
-	cfg.GRPCTLSPort = freeport.GetOne(t)
-
-	srv, err := newServer(t, cfg)
-	require.NoError(t, err)
+	_, srv := testServerWithConfig(t, configOpts...)
 	testrpc.WaitForLeader(t, srv.RPC, "dc1")
+	return srv, NewPeeringBackend(srv)
+}
+
+// newMockPeeringBackend returns a PeeringBackend for a mock server with the
+// default config and an empty state store.
+func newMockPeeringBackend() (*mockPeeringBackendServer, *PeeringBackend) {
+	srv := &mockPeeringBackendServer{config: DefaultConfig(), store: state.NewStateStore(nil)}
+	return srv, NewPeeringBackend(srv)
+}
+
+var _ PeeringBackendServer = (*mockPeeringBackendServer)(nil)
+
+func (m *mockPeeringBackendServer) IsLeader() bool            { return true }
+func (m *mockPeeringBackendServer) InPrimaryDatacenter() bool { return true }
+
+func (m *mockPeeringBackendServer) ResolveTokenAndDefaultMeta(string, *acl.EnterpriseMeta, *acl.AuthorizerContext) (resolver.Result, error) {
+	return resolver.Result{Authorizer: acl.ManageAll()}, nil
+}
+
+func (m *mockPeeringBackendServer) PeeringCARoots() (*structs.IndexedCARoots, error) {
+	if m.roots == nil {
+		return &structs.IndexedCARoots{}, nil
+	}
+	return m.roots, nil
+}
+
+func (m *mockPeeringBackendServer) PeeringRaftApply(t structs.MessageType, msg interface{}) (interface{}, error) {
+	m.applied = append(m.applied, t)
+	m.lastApplied = msg
+	return nil, m.applyErr
+}
+
+func (m *mockPeeringBackendServer) PeeringLeaderRaftApply(_ string, t structs.MessageType, _ interface{}) (interface{}, error) {
+	m.applied = append(m.applied, t)
+	return nil, m.applyErr
+}
+
+func (m *mockPeeringBackendServer) PeeringDeleteNodes(context.Context, *rate.Limiter, acl.EnterpriseMeta, string) (int, error) {
+	m.applied = append(m.applied, structs.TxnRequestType)
+	return 0, m.applyErr
+}
+
+func (m *mockPeeringBackendServer) PeeringWriteCASSupported() bool { return true }
+
+func (m *mockPeeringBackendServer) PeeringConfig() *Config                     { return m.config }
+func (m *mockPeeringBackendServer) PeeringState() *state.Store                 { return m.store }
+func (m *mockPeeringBackendServer) PeeringPublisher() PeeringEventPublisher    { return m.publisher }
+func (m *mockPeeringBackendServer) PeeringStreamTracker() PeeringStreamTracker { return m.tracker }
+func (m *mockPeeringBackendServer) PeeringLogger() hclog.Logger                { return hclog.NewNullLogger() }
+func (m *mockPeeringBackendServer) PeeringGRPCServerUseTLS() bool              { return true }
 
+func TestPeeringBackend_MockServer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ConnectEnabled = true
+	srv := &mockPeeringBackendServer{config: cfg, store: state.NewStateStore(nil)}
 	backend := NewPeeringBackend(srv)
 
-	testutil.RunStep(t, "peer to servers", func(t *testing.T) {
-		addrs, err := backend.GetServerAddresses()
-		require.NoError(t, err)
+	testutil.RunStep(t, "self check", func(t *testing.T) {
+		testutil.RequireErrorContains(t, backend.SelfCheck(), "peering backend server has no event publisher")
+	})
+
+	testutil.RunStep(t, "peering writes are applied through raft", func(t *testing.T) {
+		require.NoError(t, backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{ID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Name: "my-peer"},
+		}))
+		require.Equal(t, []structs.MessageType{structs.PeeringWriteType}, srv.applied)
 
-		expect := fmt.Sprintf("127.0.0.1:%d", srv.config.GRPCTLSPort)
-		require.Equal(t, []string{expect}, addrs)
+		err := backend.PeeringWrite(&pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{ID: "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e", Name: "Not A Valid Name"},
+		})
+		testutil.RequireErrorContains(t, err, "is not a valid peer name")
+		require.Len(t, srv.applied, 1)
 	})
 
-	testutil.RunStep(t, "existence of mesh config entry is not enough to peer through gateways", func(t *testing.T) {
-		mesh := structs.MeshConfigEntry{
-			// Enable unrelated config.
-			TransparentProxy: structs.TransparentProxyMeshConfig{
-				MeshDestinationsOnly: true,
+	testutil.RunStep(t, "server addresses are read from the store", func(t *testing.T) {
+		require.NoError(t, srv.store.EnsureRegistration(1, &structs.RegisterRequest{
+			Node:    "server-1",
+			Address: "10.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "consul",
+				Service: "consul",
+				Meta:    map[string]string{"grpc_tls_port": "8503"},
 			},
-		}
+		}))
 
-		require.NoError(t, srv.fsm.State().EnsureConfigEntry(1, &mesh))
 		addrs, err := backend.GetServerAddresses()
 		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.1:8503"}, addrs)
+	})
+
+	testutil.RunStep(t, "readiness", func(t *testing.T) {
+		testutil.RequireErrorContains(t, backend.Ready(), "peering backend server has no event publisher")
+
+		srv.publisher = stream.NewEventPublisher(0)
+		srv.tracker = peerstream.NewTracker(time.Minute)
+		cfg.PeeringEnabled = true
+		cfg.GRPCTLSPort = 8503
+		require.True(t, errors.Is(backend.Ready(), ErrCANotInitialized))
+
+		ca := connect.TestCA(t, nil)
+		srv.roots = &structs.IndexedCARoots{TrustDomain: connect.TestTrustDomain, Roots: []*structs.CARoot{ca}}
+		require.NoError(t, backend.Ready())
+
+		cfg.ConnectEnabled = false
+		require.Equal(t, PeeringTokenErrorConnectDisabled, PeeringTokenErrorCodeOf(backend.Ready()))
+	})
+}
+
+// resubscribeTestTopic is the topic used to test SubscribeWithResubscribe.
+type resubscribeTestTopic struct{}
 
-		// Still expect server address because PeerThroughMeshGateways was not enabled.
-		expect := fmt.Sprintf("127.0.0.1:%d", srv.config.GRPCTLSPort)
-		require.Equal(t, []string{expect}, addrs)
+func (resubscribeTestTopic) String() string { return "resubscribe-test" }
+
+type resubscribeTestPayload struct{}
+
+func (resubscribeTestPayload) HasReadPermission(acl.Authorizer) bool { return true }
+func (resubscribeTestPayload) Subject() stream.Subject               { return stream.SubjectNone }
+func (resubscribeTestPayload) ToSubscriptionEvent(uint64) *pbsubscribe.Event {
+	return &pbsubscribe.Event{}
+}
+
+func TestPeeringBackend_SubscribeWithResubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	publisher := stream.NewEventPublisher(0)
+	var snapshots int32
+	require.NoError(t, publisher.RegisterHandler(resubscribeTestTopic{}, func(_ stream.SubscribeRequest, buf stream.SnapshotAppender) (uint64, error) {
+		atomic.AddInt32(&snapshots, 1)
+		buf.Append([]stream.Event{{Topic: resubscribeTestTopic{}, Index: 1, Payload: resubscribeTestPayload{}}})
+		return 1, nil
+	}, false))
+	go publisher.Run(ctx)
+
+	srv := &mockPeeringBackendServer{config: DefaultConfig(), store: state.NewStateStore(nil), publisher: publisher}
+	backend := NewPeeringBackend(srv)
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	events, err := backend.SubscribeWithResubscribe(subCtx, &stream.SubscribeRequest{
+		Topic:   resubscribeTestTopic{},
+		Subject: stream.SubjectNone,
 	})
+	require.NoError(t, err)
 
-	testutil.RunStep(t, "cannot peer through gateways without registered gateways", func(t *testing.T) {
-		mesh := structs.MeshConfigEntry{
-			Peering: &structs.PeeringMeshConfig{PeerThroughMeshGateways: true},
+	next := func(t *testing.T) ResubscribeEvent {
+		t.Helper()
+		select {
+		case e, ok := <-events:
+			require.True(t, ok, "events channel closed")
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return ResubscribeEvent{}
 		}
-		require.NoError(t, srv.fsm.State().EnsureConfigEntry(1, &mesh))
+	}
+	requireSnapshot := func(t *testing.T) {
+		t.Helper()
+		e := next(t)
+		require.False(t, e.Reset)
+		require.Equal(t, uint64(1), e.Event.Index)
+		require.False(t, e.Event.IsEndOfSnapshot())
+		require.True(t, next(t).Event.IsEndOfSnapshot())
+	}
 
-		addrs, err := backend.GetServerAddresses()
-		require.Nil(t, addrs)
-		testutil.RequireErrorContains(t, err,
-			"servers are configured to PeerThroughMeshGateways, but no mesh gateway instances are registered")
-	})
-
-	testutil.RunStep(t, "peer through mesh gateways", func(t *testing.T) {
-		reg := structs.RegisterRequest{
-			ID:      types.NodeID("b5489ca9-f5e9-4dba-a779-61fec4e8e364"),
-			Node:    "gw-node",
-			Address: "1.2.3.4",
-			TaggedAddresses: map[string]string{
-				structs.TaggedAddressWAN: "172.217.22.14",
-			},
-			Service: &structs.NodeService{
-				ID:      "mesh-gateway",
-				Service: "mesh-gateway",
-				Kind:    structs.ServiceKindMeshGateway,
-				Port:    443,
-				TaggedAddresses: map[string]structs.ServiceAddress{
-					structs.TaggedAddressWAN: {Address: "154.238.12.252", Port: 8443},
-				},
-			},
+	testutil.RunStep(t, "initial snapshot", func(t *testing.T) {
+		requireSnapshot(t)
+	})
+
+	testutil.RunStep(t, "resubscribes after force close", func(t *testing.T) {
+		require.NoError(t, publisher.RefreshTopic(resubscribeTestTopic{}))
+
+		e := next(t)
+		require.True(t, e.Reset)
+		require.NoError(t, e.Err)
+		requireSnapshot(t)
+		require.Equal(t, int32(2), atomic.LoadInt32(&snapshots))
+	})
+
+	testutil.RunStep(t, "closed when the context is done", func(t *testing.T) {
+		subCancel()
+		select {
+		case _, ok := <-events:
+			require.False(t, ok)
+		case <-time.After(5 * time.Second):
+			t.Fatal("events channel was not closed")
+		}
+	})
+}
+
+func TestGenerateUniquePeeringID(t *testing.T) {
+	const (
+		existingID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+		freeID     = "0d5e9e53-8a3b-4e38-8a0c-0e4f2c1b3f0a"
+	)
+
+	store := state.NewStateStore(nil)
+	require.NoError(t, store.PeeringWrite(1, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: existingID, Name: "my-peer"},
+	}))
+	check := func(id string) (bool, error) {
+		_, existing, err := store.PeeringReadByID(nil, id)
+		return existing == nil, err
+	}
+
+	t.Run("collision then success", func(t *testing.T) {
+		ids := []string{existingID, freeID}
+		var calls int
+		generate := func() (string, error) {
+			id := ids[calls]
+			calls++
+			return id, nil
 		}
-		require.NoError(t, srv.fsm.State().EnsureRegistration(2, &reg))
 
-		addrs, err := backend.GetServerAddresses()
+		id, err := generateUniquePeeringID(generate, check)
+		require.NoError(t, err)
+		require.Equal(t, freeID, id)
+		require.Equal(t, 2, calls)
+	})
+
+	t.Run("gives up after repeated collisions", func(t *testing.T) {
+		var calls int
+		generate := func() (string, error) {
+			calls++
+			return existingID, nil
+		}
+
+		_, err := generateUniquePeeringID(generate, check)
+		testutil.RequireErrorContains(t, err, "failed to generate a unique peering ID")
+		require.Equal(t, maxPeeringIDAttempts, calls)
+	})
+}
+
+func TestPeeringBackend_CanceledContext(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := backend.GetServerAddressesCtx(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+
+	const peerID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+	err = backend.PeeringWriteCtx(ctx, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: peerID, Name: "my-peer"},
+	})
+	require.ErrorIs(t, err, context.Canceled)
+
+	err = backend.PeeringSecretsWriteCtx(ctx, &pbpeering.SecretsWriteRequest{
+		PeerID: peerID,
+		Request: &pbpeering.SecretsWriteRequest_GenerateToken{
+			GenerateToken: &pbpeering.SecretsWriteRequest_GenerateTokenRequest{
+				EstablishmentSecret: "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84",
+			},
+		},
+	})
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Nothing was submitted to raft.
+	_, peering, err := srv.fsm.State().PeeringReadByID(nil, peerID)
+	require.NoError(t, err)
+	require.Nil(t, peering)
+}
+
+func TestPeeringBackend_SelfCheck(t *testing.T) {
+	require.EqualError(t, (&PeeringBackend{}).SelfCheck(), "peering backend has no server")
+	require.EqualError(t, NewPeeringBackend(&Server{config: DefaultConfig(), loggers: newLoggerStore(hclog.NewNullLogger())}).SelfCheck(), "peering backend server has no FSM")
+}
+
+func TestValidateLeaderAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:8300", "[::1]:8300", "server-1.example.com:8300"} {
+		require.NoError(t, ValidateLeaderAddress(addr), addr)
+	}
+	for _, addr := range []string{"", "127.0.0.1", ":8300", "127.0.0.1:0", "127.0.0.1:99999", "127.0.0.1:port", "::1:8300"} {
+		require.Error(t, ValidateLeaderAddress(addr), addr)
+	}
+}
+
+func TestPeeringBackend_WaitForLeaderAddress(t *testing.T) {
+	t.Run("already known", func(t *testing.T) {
+		backend := &PeeringBackend{}
+		backend.SetLeaderAddress("10.0.0.1:8300")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		addr, err := backend.WaitForLeaderAddress(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.1:8300", addr)
+	})
+
+	t.Run("available after a delay", func(t *testing.T) {
+		backend := &PeeringBackend{leaderAddrMaxWait: 20 * time.Millisecond}
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			backend.SetLeaderAddress("10.0.0.1:8300")
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		addr, err := backend.WaitForLeaderAddress(ctx)
 		require.NoError(t, err)
-		require.Equal(t, []string{"154.238.12.252:8443"}, addrs)
+		require.Equal(t, "10.0.0.1:8300", addr)
+	})
+
+	t.Run("context canceled first", func(t *testing.T) {
+		backend := &PeeringBackend{}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		addr, err := backend.WaitForLeaderAddress(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Empty(t, addr)
+	})
+}
+
+func TestPeeringBackend_GetLeaderAddressWithAge(t *testing.T) {
+	backend := &PeeringBackend{}
+
+	addr, age := backend.GetLeaderAddressWithAge()
+	require.Empty(t, addr)
+	require.Zero(t, age)
+
+	backend.SetLeaderAddress("10.0.0.1:8300")
+	time.Sleep(10 * time.Millisecond)
+	addr, age = backend.GetLeaderAddressWithAge()
+	require.Equal(t, "10.0.0.1:8300", addr)
+	require.GreaterOrEqual(t, age, 10*time.Millisecond)
+	require.Equal(t, addr, backend.GetLeaderAddress())
+
+	t.Run("concurrent access", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					backend.SetLeaderAddress(fmt.Sprintf("10.0.0.%d:8300", i+1))
+				}
+			}(i)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					addr, age := backend.GetLeaderAddressWithAge()
+					assert.NotEmpty(t, addr)
+					assert.GreaterOrEqual(t, age, time.Duration(0))
+				}
+			}()
+		}
+		wg.Wait()
 	})
 }
 
@@ -240,3 +573,86 @@ func TestPeerStreamService_ForwardToLeader(t *testing.T) {
 		require.NoError(t, err)
 	})
 }
+
+func TestPeeringBackend_CheckPeeringReadPermission(t *testing.T) {
+	if testing.Short() {
+		t.Skip("too slow for testing.Short")
+	}
+
+	_, srv := testServerWithConfig(t, func(c *Config) {
+		c.PrimaryDatacenter = "dc1"
+		c.ACLsEnabled = true
+		c.ACLInitialManagementToken = "root"
+		c.ACLResolverSettings.ACLDefaultPolicy = "deny"
+	})
+	testrpc.WaitForLeader(t, srv.RPC, "dc1", testrpc.WithToken("root"))
+	codec := rpcClient(t, srv)
+	backend := NewPeeringBackend(srv)
+
+	readToken, err := upsertTestTokenWithPolicyRules(codec, "root", "dc1", `peering = "read"`)
+	require.NoError(t, err)
+	serviceToken, err := upsertTestTokenWithPolicyRules(codec, "root", "dc1", `service "web" { policy = "read" }`)
+	require.NoError(t, err)
+
+	require.NoError(t, srv.fsm.State().PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:    "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+			Name:  "my-peer",
+			State: pbpeering.PeeringState_FAILING,
+		},
+	}))
+	require.NoError(t, srv.fsm.State().PeeringTrustBundleWrite(11, &pbpeering.PeeringTrustBundle{
+		TrustDomain: "peer.consul",
+		PeerName:    "my-peer",
+	}))
+
+	cases := map[string]struct {
+		token   string
+		allowed bool
+	}{
+		"management":   {token: "root", allowed: true},
+		"peering read": {token: readToken.SecretID, allowed: true},
+		"no peering":   {token: serviceToken.SecretID},
+		"anonymous":    {token: ""},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			checkErr := func(t *testing.T, err error) {
+				if tc.allowed {
+					require.NoError(t, err)
+				} else {
+					require.True(t, acl.IsErrPermissionDenied(err), err)
+				}
+			}
+
+			checkErr(t, backend.CheckPeeringReadPermission(tc.token, nil))
+
+			_, err := backend.ExportedServicesConfig(tc.token, "my-peer", nil)
+			checkErr(t, err)
+			_, err = backend.PeeringLastDataExchange(tc.token, "my-peer", nil)
+			checkErr(t, err)
+			_, err = backend.MissingRootsForPeer(tc.token, "my-peer", nil)
+			checkErr(t, err)
+			_, err = backend.ExportPeeringConfig(tc.token, "my-peer", nil, "json")
+			checkErr(t, err)
+			_, err = backend.ImportedServicesByPartition(tc.token, "my-peer", nil)
+			checkErr(t, err)
+			_, err = backend.ListPeerings(tc.token, structs.DefaultEnterpriseMetaInDefaultPartition())
+			checkErr(t, err)
+
+			// Reads spanning partitions leave out the peerings the token
+			// cannot see.
+			unhealthy, err := backend.UnhealthyPeerings(tc.token)
+			require.NoError(t, err)
+			byTrustDomain, err := backend.PeeringsByTrustDomain(tc.token, "peer.consul")
+			require.NoError(t, err)
+			if tc.allowed {
+				require.Len(t, unhealthy, 1)
+				require.Len(t, byTrustDomain, 1)
+			} else {
+				require.Empty(t, unhealthy)
+				require.Empty(t, byTrustDomain)
+			}
+		})
+	}
+}
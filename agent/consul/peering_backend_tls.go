@@ -0,0 +1,447 @@
+package consul
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/lib"
+)
+
+// ErrCANotInitialized is matched by errors returned while the Connect CA has
+// not yet produced its roots. It is usually transient during server startup,
+// so callers may retry with backoff.
+var ErrCANotInitialized = errors.New("CA has not finished initializing")
+
+// checkCARootsInitialized returns an error matching ErrCANotInitialized if
+// the CA has no active roots or trust domain yet.
+func checkCARootsInitialized(roots *structs.IndexedCARoots) error {
+	if len(roots.Roots) == 0 || roots.TrustDomain == "" {
+		return newPeeringTokenError(PeeringTokenErrorCAUninitialized, "%v", ErrCANotInitialized)
+	}
+	return nil
+}
+
+// GetTLSMaterials returns the TLS materials for the dialer to dial the acceptor using TLS.
+// It returns the server name to validate, and the CA certificate to validate with.
+func (b *PeeringBackend) GetTLSMaterials(generatingToken bool) (string, []string, error) {
+	return b.GetTLSMaterialsMissing(generatingToken, nil)
+}
+
+// ErrCARootsAllKnown is returned by GetTLSMaterialsMissing when the caller
+// already knows every CA root. A token for such a dialer must be encoded with
+// EncodeThinToken, which sets CAOmitted, rather than carry an empty CA list.
+var ErrCARootsAllKnown = errors.New("the caller already holds every CA root; generate a token without CA roots instead")
+
+// GetTLSMaterialsMissing is like GetTLSMaterials but leaves out the roots
+// whose serial numbers are in knownSerials. Serials are
+// formatted like CARootInfo.SerialNumber. It lets a dialer that already
+// trusts some of the roots during a CA rotation fetch only the new ones. If
+// the caller knows every root, ErrCARootsAllKnown is returned.
+func (b *PeeringBackend) GetTLSMaterialsMissing(generatingToken bool, knownSerials []string) (string, []string, error) {
+	if generatingToken {
+		if err := b.checkTokenGenerationConfig(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	roots, pems, err := b.fetchCARootsWithPEMs()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch roots: %w", err)
+	}
+	if err := checkCARootsInitialized(roots); err != nil {
+		return "", nil, err
+	}
+
+	datacenter := b.srv.PeeringConfig().Datacenter
+	if len(knownSerials) == 0 {
+		return connect.PeeringServerSAN(datacenter, roots.TrustDomain), pems, nil
+	}
+
+	missing, err := rootsMissingFrom(roots.Roots, knownSerials)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(missing) == 0 {
+		return "", nil, ErrCARootsAllKnown
+	}
+	return connect.PeeringServerSAN(datacenter, roots.TrustDomain), caPEMs(missing), nil
+}
+
+// rootsMissingFrom returns the roots whose serial numbers are not in
+// knownSerials.
+func rootsMissingFrom(roots structs.CARoots, knownSerials []string) (structs.CARoots, error) {
+	if len(knownSerials) == 0 {
+		return roots, nil
+	}
+	known := make(map[string]struct{}, len(knownSerials))
+	for _, serial := range knownSerials {
+		known[strings.ToLower(serial)] = struct{}{}
+	}
+
+	var missing structs.CARoots
+	for _, r := range roots {
+		cert, err := connect.ParseCert(r.RootCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA root %q: %w", r.ID, err)
+		}
+		if _, ok := known[connect.EncodeSerialNumber(cert.SerialNumber)]; !ok {
+			missing = append(missing, r)
+		}
+	}
+	return missing, nil
+}
+
+// checkTokenGenerationConfig checks that the server's configuration allows
+// it to generate peering tokens.
+func (b *PeeringBackend) checkTokenGenerationConfig() error {
+	if !b.srv.PeeringConfig().ConnectEnabled {
+		return newPeeringTokenError(PeeringTokenErrorConnectDisabled,
+			"connect.enabled must be set to true in the server's configuration when generating peering tokens")
+	}
+	if b.srv.PeeringConfig().GRPCTLSPort <= 0 && !b.srv.PeeringGRPCServerUseTLS() {
+		return newPeeringTokenError(PeeringTokenErrorTLSDisabled,
+			"TLS for gRPC must be enabled when generating peering tokens")
+	}
+	return nil
+}
+
+// Ready reports whether the backend is able to generate peering tokens. It
+// runs SelfCheck, then CanAcceptPeering, then checks that gRPC TLS is
+// available and that at least one server or mesh gateway address can be put
+// in a token. The first failing precondition is returned, or nil if a token
+// could be generated.
+func (b *PeeringBackend) Ready() error {
+	if err := b.SelfCheck(); err != nil {
+		return err
+	}
+	if err := b.CanAcceptPeering(); err != nil {
+		return err
+	}
+	if err := b.checkTokenGenerationConfig(); err != nil {
+		return err
+	}
+
+	// GetServerAddresses fails with PeeringTokenErrorNoAddresses when there
+	// is nothing to put in a token.
+	_, err := b.GetServerAddresses()
+	return err
+}
+
+// GetTLSServerNames returns every server name that peers may validate this
+// cluster's servers against. The first is the one returned by
+// GetTLSMaterials; the rest are derived from PeeringLegacyTrustDomains so that
+// peers which still expect a previous trust domain keep working during a CA
+// migration.
+func (b *PeeringBackend) GetTLSServerNames() ([]string, error) {
+	roots, err := b.fetchCARoots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch roots: %w", err)
+	}
+	if err := checkCARootsInitialized(roots); err != nil {
+		return nil, err
+	}
+	return peeringServerNames(b.srv.PeeringConfig().Datacenter, roots.TrustDomain, b.srv.PeeringConfig().PeeringLegacyTrustDomains), nil
+}
+
+func peeringServerNames(datacenter, trustDomain string, legacyTrustDomains []string) []string {
+	names := []string{connect.PeeringServerSAN(datacenter, trustDomain)}
+	seen := map[string]struct{}{strings.ToLower(trustDomain): {}}
+	for _, legacy := range legacyTrustDomains {
+		if _, ok := seen[strings.ToLower(legacy)]; ok || legacy == "" {
+			continue
+		}
+		seen[strings.ToLower(legacy)] = struct{}{}
+		names = append(names, connect.PeeringServerSAN(datacenter, legacy))
+	}
+	return names
+}
+
+// caPEMs returns the PEM-encoded root certificates of the given roots.
+func caPEMs(roots structs.CARoots) []string {
+	var pems []string
+	for _, r := range roots {
+		pems = append(pems, lib.EnsureTrailingNewline(r.RootCert))
+	}
+	return pems
+}
+
+// caIntermediatePEMs returns the PEM-encoded intermediate certificates of the
+// given roots. They are sent to dialers apart from the roots, so that
+// dialers can chain leaves issued by an intermediate without trusting the
+// intermediate as a root.
+func caIntermediatePEMs(roots structs.CARoots) []string {
+	var pems []string
+	for _, r := range roots {
+		for _, intermediate := range r.IntermediateCerts {
+			pems = append(pems, lib.EnsureTrailingNewline(intermediate))
+		}
+	}
+	return pems
+}
+
+// GetTLSIntermediates returns the intermediate CA certificates that chain
+// this cluster's server certificates to the roots returned by
+// GetTLSMaterials. They are embedded in peering tokens apart from the roots.
+func (b *PeeringBackend) GetTLSIntermediates() ([]string, error) {
+	roots, err := b.fetchCARoots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch roots: %w", err)
+	}
+	return caIntermediatePEMs(roots.Roots), nil
+}
+
+// RegisterCARootsChangeHook adds a hook that is run whenever the CA roots
+// change while the backend is running. See Run.
+func (b *PeeringBackend) RegisterCARootsChangeHook(fn CARootsChangeHook) {
+	b.caRootsLock.Lock()
+	b.caRootsHooks = append(b.caRootsHooks, fn)
+	b.caRootsLock.Unlock()
+}
+
+// CanAcceptPeering checks the prerequisites for establishing a peering from a
+// token generated by another cluster, so that operators get a clear error
+// before attempting establishment.
+func (b *PeeringBackend) CanAcceptPeering() error {
+	if !b.srv.PeeringConfig().PeeringEnabled {
+		return fmt.Errorf("peering must be enabled in the server's configuration to accept peerings")
+	}
+	if !b.srv.PeeringConfig().ConnectEnabled {
+		return newPeeringTokenError(PeeringTokenErrorConnectDisabled,
+			"connect.enabled must be set to true in the server's configuration to accept peerings")
+	}
+	if b.srv.PeeringConfig().GRPCPort <= 0 && b.srv.PeeringConfig().GRPCTLSPort <= 0 {
+		return fmt.Errorf("a gRPC port must be configured to exchange data with peers")
+	}
+
+	roots, err := b.srv.PeeringCARoots()
+	if err != nil {
+		return newPeeringTokenError(PeeringTokenErrorCAUninitialized, "CA has not finished initializing: %v", err)
+	}
+	if err := checkCARootsInitialized(roots); err != nil {
+		return err
+	}
+
+	// Only the primary datacenter tracks whether ACLs were bootstrapped.
+	if b.srv.PeeringConfig().ACLsEnabled && b.srv.InPrimaryDatacenter() {
+		canBootstrap, _, err := b.srv.PeeringState().CanBootstrapACLToken()
+		if err != nil {
+			return fmt.Errorf("failed to check ACL bootstrap status: %w", err)
+		}
+		if canBootstrap {
+			return fmt.Errorf("ACLs are enabled but have not been bootstrapped")
+		}
+	}
+	return nil
+}
+
+// CertSummary describes a certificate, along with its PEM encoding, without
+// including its key material.
+type CertSummary struct {
+	PEM          string
+	Subject      string
+	SerialNumber string
+	NotBefore    time.Time
+	NotAfter     time.Time
+}
+
+// AdvertisedCARoots summarizes the CA roots that GetTLSMaterials currently
+// returns, which are embedded in newly generated peering tokens.
+func (b *PeeringBackend) AdvertisedCARoots() ([]CertSummary, error) {
+	_, caPems, err := b.GetTLSMaterials(false)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]CertSummary, 0, len(caPems))
+	for _, pem := range caPems {
+		cert, err := connect.ParseCert(pem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA root: %w", err)
+		}
+		if !bytes.Equal(cert.RawSubject, cert.RawIssuer) || cert.CheckSignatureFrom(cert) != nil {
+			continue
+		}
+		summaries = append(summaries, CertSummary{
+			PEM:          pem,
+			Subject:      cert.Subject.String(),
+			SerialNumber: connect.EncodeSerialNumber(cert.SerialNumber),
+			NotBefore:    cert.NotBefore,
+			NotAfter:     cert.NotAfter,
+		})
+	}
+	return summaries, nil
+}
+
+// CARootInfo is a CA root certificate embedded in peering tokens along with
+// the details needed to warn about its expiry.
+type CARootInfo struct {
+	PEM          string
+	SerialNumber string
+	NotAfter     time.Time
+}
+
+// GetCARootInfo returns the CA roots that GetTLSMaterials returns for peering
+// tokens, with each root's serial number and expiry.
+func (b *PeeringBackend) GetCARootInfo() ([]CARootInfo, error) {
+	roots, err := b.fetchCARoots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch roots: %w", err)
+	}
+	if err := checkCARootsInitialized(roots); err != nil {
+		return nil, err
+	}
+	return caRootInfos(roots.Roots)
+}
+
+func caRootInfos(roots structs.CARoots) ([]CARootInfo, error) {
+	infos := make([]CARootInfo, 0, len(roots))
+	for _, r := range roots {
+		cert, err := connect.ParseCert(r.RootCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA root %q: %w", r.ID, err)
+		}
+		infos = append(infos, CARootInfo{
+			PEM:          lib.EnsureTrailingNewline(r.RootCert),
+			SerialNumber: connect.EncodeSerialNumber(cert.SerialNumber),
+			NotAfter:     cert.NotAfter,
+		})
+	}
+	return infos, nil
+}
+
+// fetchCARoots returns the current CA roots. When PeeringCARootsMaxStale is
+// set, a previously fetched root set that is younger than the limit is
+// returned immediately while a refresh runs in the background, so that slow
+// CA reads do not block token generation.
+func (b *PeeringBackend) fetchCARoots() (*structs.IndexedCARoots, error) {
+	maxStale := b.srv.PeeringConfig().PeeringCARootsMaxStale
+	if maxStale <= 0 {
+		return b.refreshCARoots()
+	}
+
+	b.rootsCacheLock.Lock()
+	if b.rootsCache != nil && time.Since(b.rootsCacheFetched) <= maxStale {
+		roots := b.rootsCache
+		if !b.rootsCacheRefreshing {
+			b.rootsCacheRefreshing = true
+			go func() {
+				_, _ = b.refreshCARoots()
+			}()
+		}
+		b.rootsCacheLock.Unlock()
+		return roots, nil
+	}
+	b.rootsCacheLock.Unlock()
+
+	return b.refreshCARoots()
+}
+
+// refreshCARoots reads the CA roots and stores them for stale reads.
+func (b *PeeringBackend) refreshCARoots() (*structs.IndexedCARoots, error) {
+	roots, err := b.srv.PeeringCARoots()
+
+	b.rootsCacheLock.Lock()
+	defer b.rootsCacheLock.Unlock()
+	b.rootsCacheRefreshing = false
+	if err != nil {
+		return nil, err
+	}
+	// Roots without an index cannot be told apart, so their PEMs are never
+	// reused.
+	if roots.Index == 0 || roots.Index != b.rootsCacheIndex || roots.TrustDomain != b.rootsCacheTrustDomain {
+		b.rootsCachePEMs = nil
+	}
+	b.rootsCache = roots
+	b.rootsCacheIndex = roots.Index
+	b.rootsCacheTrustDomain = roots.TrustDomain
+	b.rootsCacheFetched = time.Now()
+	return roots, nil
+}
+
+// fetchCARootsWithPEMs is like fetchCARoots but also returns the PEMs of the
+// roots. The PEMs are built once for each set of roots and kept alongside the
+// cached roots, so that bursts of token generation don't each rebuild them.
+func (b *PeeringBackend) fetchCARootsWithPEMs() (*structs.IndexedCARoots, []string, error) {
+	roots, err := b.fetchCARoots()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b.rootsCacheLock.Lock()
+	defer b.rootsCacheLock.Unlock()
+	if roots != b.rootsCache {
+		// A concurrent refresh replaced the cached roots.
+		return roots, caPEMs(roots.Roots), nil
+	}
+	if b.rootsCachePEMs == nil {
+		b.rootsCachePEMs = caPEMs(roots.Roots)
+	}
+	return roots, append([]string(nil), b.rootsCachePEMs...), nil
+}
+
+// watchCARoots observes the CA roots every time they change until ctx is
+// done, so that the CA roots change hooks run when the CA rotates rather than
+// when the roots happen to be read.
+func (b *PeeringBackend) watchCARoots(ctx context.Context) {
+	for {
+		store := b.srv.PeeringState()
+		ws := memdb.NewWatchSet()
+		ws.Add(store.AbandonCh())
+
+		if _, _, _, err := store.CARootsAndConfig(ws); err != nil {
+			b.srv.PeeringLogger().Warn("failed to watch the CA roots", "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(caRootsWatchRetryWait):
+			}
+			continue
+		}
+
+		// The CA has no roots while it is initializing; the watch fires once
+		// it does.
+		if roots, err := b.srv.PeeringCARoots(); err == nil && checkCARootsInitialized(roots) == nil {
+			b.observeCARoots(roots)
+		}
+
+		if err := ws.WatchCtx(ctx); err != nil {
+			return
+		}
+	}
+}
+
+// caRootsWatchRetryWait is how long watchCARoots waits after failing to read
+// the CA roots before trying again.
+const caRootsWatchRetryWait = 5 * time.Second
+
+// observeCARoots records the given roots and, if they differ from the last
+// observed roots, runs the registered hooks. Hooks run in their own
+// goroutines so that a slow hook cannot block the caller.
+func (b *PeeringBackend) observeCARoots(roots *structs.IndexedCARoots) {
+	b.caRootsLock.Lock()
+	defer b.caRootsLock.Unlock()
+
+	if b.caRootsObserved && roots.Index == b.caRootsIndex && roots.TrustDomain == b.caRootsTrustDomain {
+		return
+	}
+	initial := !b.caRootsObserved
+	b.caRootsObserved = true
+	b.caRootsIndex = roots.Index
+	b.caRootsTrustDomain = roots.TrustDomain
+
+	// The first observation establishes a baseline rather than a change.
+	if initial {
+		return
+	}
+	for _, fn := range b.caRootsHooks {
+		go fn(roots.TrustDomain, len(roots.Roots))
+	}
+}
@@ -0,0 +1,483 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/sdk/freeport"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+	"github.com/hashicorp/consul/testrpc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeeringBackend_FetchCARootsStale(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t, func(c *Config) {
+		c.PeeringCARootsMaxStale = time.Minute
+	})
+
+	current, err := srv.getCARoots(nil, srv.fsm.State())
+	require.NoError(t, err)
+	stale := &structs.IndexedCARoots{TrustDomain: "stale.consul"}
+
+	testutil.RunStep(t, "fresh roots are served from the cache", func(t *testing.T) {
+		backend.rootsCacheLock.Lock()
+		backend.rootsCache = stale
+		backend.rootsCacheFetched = time.Now()
+		backend.rootsCacheLock.Unlock()
+
+		roots, err := backend.fetchCARoots()
+		require.NoError(t, err)
+		require.Same(t, stale, roots)
+
+		// The background refresh replaces the cached roots.
+		retry.Run(t, func(r *retry.R) {
+			roots, err := backend.fetchCARoots()
+			require.NoError(r, err)
+			require.Equal(r, current.TrustDomain, roots.TrustDomain)
+		})
+	})
+
+	testutil.RunStep(t, "roots older than the limit are refetched", func(t *testing.T) {
+		backend.rootsCacheLock.Lock()
+		backend.rootsCache = stale
+		backend.rootsCacheFetched = time.Now().Add(-2 * time.Minute)
+		backend.rootsCacheLock.Unlock()
+
+		roots, err := backend.fetchCARoots()
+		require.NoError(t, err)
+		require.Equal(t, current.TrustDomain, roots.TrustDomain)
+	})
+
+	testutil.RunStep(t, "stale reads disabled", func(t *testing.T) {
+		srv.config.PeeringCARootsMaxStale = 0
+		backend.rootsCacheLock.Lock()
+		backend.rootsCache = stale
+		backend.rootsCacheFetched = time.Now()
+		backend.rootsCacheLock.Unlock()
+
+		roots, err := backend.fetchCARoots()
+		require.NoError(t, err)
+		require.Equal(t, current.TrustDomain, roots.TrustDomain)
+	})
+}
+
+func TestPeeringBackend_AdvertisedCARoots(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	var roots *structs.IndexedCARoots
+	retry.Run(t, func(r *retry.R) {
+		var err error
+		roots, err = srv.getCARoots(nil, srv.fsm.State())
+		require.NoError(r, err)
+		require.NotEmpty(r, roots.Roots)
+	})
+
+	summaries, err := backend.AdvertisedCARoots()
+	require.NoError(t, err)
+	require.Len(t, summaries, len(roots.Roots))
+
+	for i, root := range roots.Roots {
+		cert, err := connect.ParseCert(root.RootCert)
+		require.NoError(t, err)
+		require.Equal(t, CertSummary{
+			PEM:          lib.EnsureTrailingNewline(root.RootCert),
+			Subject:      cert.Subject.String(),
+			SerialNumber: connect.EncodeSerialNumber(cert.SerialNumber),
+			NotBefore:    cert.NotBefore,
+			NotAfter:     cert.NotAfter,
+		}, summaries[i])
+	}
+}
+
+func TestPeeringBackend_AdvertisedCARoots_SkipsIntermediates(t *testing.T) {
+	srv, backend := newMockPeeringBackend()
+
+	root := connect.TestCA(t, nil)
+	root.IntermediateCerts = []string{connect.TestCA(t, root).SigningCert}
+	srv.roots = &structs.IndexedCARoots{TrustDomain: connect.TestTrustDomain, Roots: []*structs.CARoot{root}}
+
+	_, pems, err := backend.GetTLSMaterials(false)
+	require.NoError(t, err)
+	require.Len(t, pems, 2)
+
+	summaries, err := backend.AdvertisedCARoots()
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	require.Equal(t, lib.EnsureTrailingNewline(root.RootCert), summaries[0].PEM)
+}
+
+func TestPeeringBackend_GetCARootInfo(t *testing.T) {
+	srv, backend := newMockPeeringBackend()
+
+	testutil.RunStep(t, "CA not initialized", func(t *testing.T) {
+		_, err := backend.GetCARootInfo()
+		require.ErrorIs(t, err, ErrCANotInitialized)
+	})
+
+	testutil.RunStep(t, "roots without their intermediates", func(t *testing.T) {
+		root := connect.TestCA(t, nil)
+		root.IntermediateCerts = []string{connect.TestCA(t, root).SigningCert}
+		srv.roots = &structs.IndexedCARoots{TrustDomain: connect.TestTrustDomain, Roots: []*structs.CARoot{root}}
+
+		infos, err := backend.GetCARootInfo()
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		require.Equal(t, lib.EnsureTrailingNewline(root.RootCert), infos[0].PEM)
+	})
+}
+
+func TestCARootInfos(t *testing.T) {
+	ca := connect.TestCA(t, nil)
+	cert, err := connect.ParseCert(ca.RootCert)
+	require.NoError(t, err)
+
+	infos, err := caRootInfos(structs.CARoots{ca})
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, lib.EnsureTrailingNewline(ca.RootCert), infos[0].PEM)
+	require.Equal(t, connect.EncodeSerialNumber(cert.SerialNumber), infos[0].SerialNumber)
+	require.True(t, cert.NotAfter.Equal(infos[0].NotAfter))
+	require.WithinDuration(t, ca.NotAfter, infos[0].NotAfter, time.Second)
+
+	_, err = caRootInfos(structs.CARoots{{ID: "bad", RootCert: "not a cert"}})
+	testutil.RequireErrorContains(t, err, `failed to parse CA root "bad"`)
+}
+
+func TestPeeringBackend_CanAcceptPeering(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	retry.Run(t, func(r *retry.R) {
+		require.NoError(r, backend.CanAcceptPeering())
+	})
+
+	type testcase struct {
+		name      string
+		modify    func(c *Config)
+		expectErr string
+	}
+	tcs := []testcase{
+		{
+			name:      "peering disabled",
+			modify:    func(c *Config) { c.PeeringEnabled = false },
+			expectErr: "peering must be enabled",
+		},
+		{
+			name:      "connect disabled",
+			modify:    func(c *Config) { c.ConnectEnabled = false },
+			expectErr: "connect.enabled must be set to true",
+		},
+		{
+			name: "no gRPC port",
+			modify: func(c *Config) {
+				c.GRPCPort = 0
+				c.GRPCTLSPort = 0
+			},
+			expectErr: "a gRPC port must be configured",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			orig := *srv.config
+			t.Cleanup(func() { *srv.config = orig })
+
+			tc.modify(srv.config)
+			testutil.RequireErrorContains(t, backend.CanAcceptPeering(), tc.expectErr)
+		})
+	}
+}
+
+func TestPeeringBackend_Ready(t *testing.T) {
+	if testing.Short() {
+		t.Skip("too slow for testing.Short")
+	}
+
+	t.Run("connect disabled", func(t *testing.T) {
+		_, srv := testServerWithConfig(t, func(c *Config) {
+			c.ConnectEnabled = false
+			c.GRPCTLSPort = freeport.GetOne(t)
+		})
+		testrpc.WaitForLeader(t, srv.RPC, "dc1")
+
+		err := NewPeeringBackend(srv).Ready()
+		require.Equal(t, PeeringTokenErrorConnectDisabled, PeeringTokenErrorCodeOf(err))
+	})
+
+	t.Run("gRPC TLS disabled", func(t *testing.T) {
+		_, srv := testServer(t)
+		testrpc.WaitForLeader(t, srv.RPC, "dc1")
+
+		err := NewPeeringBackend(srv).Ready()
+		require.Equal(t, PeeringTokenErrorTLSDisabled, PeeringTokenErrorCodeOf(err))
+	})
+
+	t.Run("CA uninitialized", func(t *testing.T) {
+		// Without a leader the CA is never initialized.
+		_, srv := testServerWithConfig(t, func(c *Config) {
+			c.Bootstrap = false
+			c.GRPCTLSPort = freeport.GetOne(t)
+		})
+
+		err := NewPeeringBackend(srv).Ready()
+		require.True(t, errors.Is(err, ErrCANotInitialized))
+	})
+
+	srv, backend := newTestPeeringBackend(t, func(c *Config) {
+		c.GRPCTLSPort = freeport.GetOne(t)
+	})
+
+	testutil.RunStep(t, "ready", func(t *testing.T) {
+		retry.Run(t, func(r *retry.R) {
+			require.NoError(r, backend.Ready())
+		})
+	})
+
+	testutil.RunStep(t, "no addresses", func(t *testing.T) {
+		require.NoError(t, srv.fsm.State().EnsureConfigEntry(1, &structs.MeshConfigEntry{
+			Peering: &structs.PeeringMeshConfig{PeerThroughMeshGateways: true},
+		}))
+
+		err := backend.Ready()
+		require.Equal(t, PeeringTokenErrorNoAddresses, PeeringTokenErrorCodeOf(err))
+	})
+}
+
+func TestPeeringServerNames(t *testing.T) {
+	const (
+		current = "11111111-2222-3333-4444-555555555555.consul"
+		legacy  = "66666666-7777-8888-9999-000000000000.consul"
+	)
+
+	t.Run("single trust domain", func(t *testing.T) {
+		require.Equal(t,
+			[]string{"server.dc1.peering." + current},
+			peeringServerNames("dc1", current, nil))
+	})
+
+	t.Run("legacy trust domain", func(t *testing.T) {
+		require.Equal(t,
+			[]string{"server.dc1.peering." + current, "server.dc1.peering." + legacy},
+			peeringServerNames("dc1", current, []string{legacy, "", strings.ToUpper(current), legacy}))
+	})
+}
+
+func TestPeeringBackend_GetTLSMaterialsMissing(t *testing.T) {
+	cfg := DefaultConfig()
+	srv := &mockPeeringBackendServer{config: cfg, store: state.NewStateStore(nil)}
+	backend := NewPeeringBackend(srv)
+
+	oldCA, newCA := connect.TestCA(t, nil), connect.TestCA(t, nil)
+	srv.roots = &structs.IndexedCARoots{TrustDomain: connect.TestTrustDomain, Roots: []*structs.CARoot{oldCA, newCA}}
+
+	serial := func(ca *structs.CARoot) string {
+		cert, err := connect.ParseCert(ca.RootCert)
+		require.NoError(t, err)
+		return connect.EncodeSerialNumber(cert.SerialNumber)
+	}
+	expectName := connect.PeeringServerSAN(cfg.Datacenter, connect.TestTrustDomain)
+
+	testutil.RunStep(t, "caller knows none", func(t *testing.T) {
+		name, pems, err := backend.GetTLSMaterialsMissing(false, nil)
+		require.NoError(t, err)
+		require.Equal(t, expectName, name)
+
+		_, all, err := backend.GetTLSMaterials(false)
+		require.NoError(t, err)
+		require.Equal(t, all, pems)
+		require.Len(t, pems, 2)
+	})
+
+	testutil.RunStep(t, "caller knows some", func(t *testing.T) {
+		name, pems, err := backend.GetTLSMaterialsMissing(false, []string{strings.ToUpper(serial(oldCA))})
+		require.NoError(t, err)
+		require.Equal(t, expectName, name)
+		require.Equal(t, []string{lib.EnsureTrailingNewline(newCA.RootCert)}, pems)
+	})
+
+	testutil.RunStep(t, "caller knows all", func(t *testing.T) {
+		_, pems, err := backend.GetTLSMaterialsMissing(false, []string{serial(oldCA), serial(newCA)})
+		require.ErrorIs(t, err, ErrCARootsAllKnown)
+		require.Empty(t, pems)
+	})
+}
+
+func TestPeeringBackend_GetTLSMaterialsCache(t *testing.T) {
+	srv, backend := newMockPeeringBackend()
+
+	ca := connect.TestCA(t, nil)
+	original := ca.RootCert
+	srv.roots = &structs.IndexedCARoots{
+		TrustDomain: connect.TestTrustDomain,
+		Roots:       []*structs.CARoot{ca},
+		QueryMeta:   structs.QueryMeta{Index: 5},
+	}
+
+	_, pems, err := backend.GetTLSMaterials(false)
+	require.NoError(t, err)
+	require.Equal(t, []string{lib.EnsureTrailingNewline(original)}, pems)
+
+	// Changing a root without changing the index shows whether the cached
+	// result was reused.
+	ca.RootCert = connect.TestCA(t, nil).RootCert
+
+	testutil.RunStep(t, "reused while the roots are unchanged", func(t *testing.T) {
+		_, pems, err := backend.GetTLSMaterials(false)
+		require.NoError(t, err)
+		require.Equal(t, []string{lib.EnsureTrailingNewline(original)}, pems)
+
+		// Callers get their own copy.
+		pems[0] = "modified"
+		_, pems, err = backend.GetTLSMaterials(false)
+		require.NoError(t, err)
+		require.Equal(t, []string{lib.EnsureTrailingNewline(original)}, pems)
+	})
+
+	testutil.RunStep(t, "invalidated when the roots change", func(t *testing.T) {
+		srv.roots.Index = 6
+		_, pems, err := backend.GetTLSMaterials(false)
+		require.NoError(t, err)
+		require.Equal(t, []string{lib.EnsureTrailingNewline(ca.RootCert)}, pems)
+	})
+
+	testutil.RunStep(t, "safe for concurrent use", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, pems, err := backend.GetTLSMaterials(false)
+				require.NoError(t, err)
+				require.Len(t, pems, 1)
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestCheckCARootsInitialized(t *testing.T) {
+	ca := connect.TestCA(t, nil)
+
+	cases := map[string]*structs.IndexedCARoots{
+		"no roots":        {TrustDomain: connect.TestTrustDomain},
+		"no trust domain": {Roots: structs.CARoots{ca}},
+	}
+	for name, roots := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := checkCARootsInitialized(roots)
+			require.ErrorIs(t, err, ErrCANotInitialized)
+			require.Equal(t, PeeringTokenErrorCAUninitialized, PeeringTokenErrorCodeOf(err))
+			require.EqualError(t, err, "CA has not finished initializing")
+		})
+	}
+
+	require.NoError(t, checkCARootsInitialized(&structs.IndexedCARoots{
+		TrustDomain: connect.TestTrustDomain,
+		Roots:       structs.CARoots{ca},
+	}))
+
+	// Other token errors do not match the sentinel.
+	require.False(t, errors.Is(newPeeringTokenError(PeeringTokenErrorNoAddresses, "no addresses"), ErrCANotInitialized))
+}
+
+func TestCAPEMs(t *testing.T) {
+	root1 := connect.TestCA(t, nil)
+	root2 := connect.TestCA(t, nil)
+
+	// A CA cross-signed by root1 stands in for an intermediate issued by it.
+	intermediate := connect.TestCA(t, root1).SigningCert
+	root1.IntermediateCerts = []string{strings.TrimSuffix(intermediate, "\n")}
+
+	// Intermediates are kept apart from the roots so that dialers do not
+	// trust them as roots.
+	pems := caPEMs(structs.CARoots{root1, root2})
+	require.Equal(t, []string{
+		lib.EnsureTrailingNewline(root1.RootCert),
+		lib.EnsureTrailingNewline(root2.RootCert),
+	}, pems)
+	for _, pem := range pems {
+		require.True(t, strings.HasSuffix(pem, "\n"))
+	}
+
+	require.Equal(t, []string{intermediate}, caIntermediatePEMs(structs.CARoots{root1, root2}))
+	require.Empty(t, caIntermediatePEMs(structs.CARoots{root2}))
+}
+
+func TestPeeringBackend_CARootsChangeHook(t *testing.T) {
+	backend := &PeeringBackend{}
+
+	type change struct {
+		trustDomain string
+		rootCount   int
+	}
+	changes := make(chan change, 10)
+	backend.RegisterCARootsChangeHook(func(trustDomain string, rootCount int) {
+		changes <- change{trustDomain, rootCount}
+	})
+
+	roots := &structs.IndexedCARoots{
+		TrustDomain: "11111111-2222-3333-4444-555555555555.consul",
+		Roots:       structs.CARoots{{ID: "root-1"}},
+		QueryMeta:   structs.QueryMeta{Index: 5},
+	}
+
+	// The initial observation and repeated observations are not changes.
+	backend.observeCARoots(roots)
+	backend.observeCARoots(roots)
+
+	roots.Index = 6
+	roots.Roots = append(roots.Roots, &structs.CARoot{ID: "root-2"})
+	backend.observeCARoots(roots)
+
+	select {
+	case got := <-changes:
+		require.Equal(t, change{"11111111-2222-3333-4444-555555555555.consul", 2}, got)
+	case <-time.After(time.Second):
+		t.Fatal("hook was not called")
+	}
+	require.Empty(t, changes)
+}
+
+func TestPeeringBackend_CARootsChangeHook_Watch(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	rootCounts := make(chan int, 10)
+	backend.RegisterCARootsChangeHook(func(_ string, rootCount int) {
+		rootCounts <- rootCount
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go backend.watchCARoots(ctx)
+
+	retry.Run(t, func(r *retry.R) {
+		backend.caRootsLock.Lock()
+		defer backend.caRootsLock.Unlock()
+		require.True(r, backend.caRootsObserved)
+	})
+	require.Empty(t, rootCounts)
+
+	// Rotate the CA without reading the roots through the backend.
+	store := srv.fsm.State()
+	idx, roots, err := store.CARoots(nil)
+	require.NoError(t, err)
+	newRoot := connect.TestCA(t, nil)
+	newRoot.Active = false
+	ok, err := store.CARootSetCAS(idx+1, idx, append(roots, newRoot))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	select {
+	case got := <-rootCounts:
+		require.Equal(t, len(roots)+1, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook was not called")
+	}
+}
@@ -0,0 +1,618 @@
+package consul
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/prometheus"
+
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/rpc/peering"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/lib/file"
+	"github.com/hashicorp/consul/proto/pbpeering"
+)
+
+// PeeringTokenErrorCode is a stable, machine-readable reason for why a
+// peering token could not be generated.
+type PeeringTokenErrorCode string
+
+const (
+	PeeringTokenErrorConnectDisabled PeeringTokenErrorCode = "CONNECT_DISABLED"
+	PeeringTokenErrorTLSDisabled     PeeringTokenErrorCode = "TLS_DISABLED"
+	PeeringTokenErrorCAUninitialized PeeringTokenErrorCode = "CA_UNINITIALIZED"
+	PeeringTokenErrorNoAddresses     PeeringTokenErrorCode = "NO_ADDRESSES"
+)
+
+// PeeringTokenError is returned when a precondition for generating a peering
+// token is not met. The message is intended for humans, the Code for automation.
+type PeeringTokenError struct {
+	code    PeeringTokenErrorCode
+	message string
+}
+
+func newPeeringTokenError(code PeeringTokenErrorCode, format string, args ...interface{}) *PeeringTokenError {
+	return &PeeringTokenError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func (e *PeeringTokenError) Error() string {
+	return e.message
+}
+
+// Is reports whether the error matches target. Errors with the
+// PeeringTokenErrorCAUninitialized code match ErrCANotInitialized.
+func (e *PeeringTokenError) Is(target error) bool {
+	return target == ErrCANotInitialized && e.code == PeeringTokenErrorCAUninitialized
+}
+
+// Code returns the machine-readable reason for the error.
+func (e *PeeringTokenError) Code() PeeringTokenErrorCode {
+	return e.code
+}
+
+// PeeringTokenErrorCodeOf returns the code of the PeeringTokenError in err's
+// chain, or an empty code if there is none.
+func PeeringTokenErrorCodeOf(err error) PeeringTokenErrorCode {
+	var tokErr *PeeringTokenError
+	if errors.As(err, &tokErr) {
+		return tokErr.Code()
+	}
+	return ""
+}
+
+// tokenChecksumSeparator separates an encoded token from its checksum. It is
+// not part of the base64 alphabet so it can never appear in tokens encoded by
+// the default codec, which are the only ones that get a checksum.
+const tokenChecksumSeparator = "."
+
+// ErrTokenChecksumMismatch is returned when a peering token's checksum does
+// not match its contents, usually because it was truncated or altered.
+var ErrTokenChecksumMismatch = errors.New("peering token checksum mismatch; the token may have been truncated or altered")
+
+// tokenChecksum returns a short, human-verifiable checksum of an encoded token.
+func tokenChecksum(encoded []byte) string {
+	sum := sha256.Sum256(encoded)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:5])
+}
+
+// splitTokenChecksum removes the checksum from a token encoded with one. It
+// reports false, and leaves tokRaw alone, if the token has no valid checksum
+// suffix, so tokens from codecs whose output contains tokenChecksumSeparator
+// are not mistaken for checksummed ones.
+func splitTokenChecksum(tokRaw []byte) ([]byte, bool) {
+	idx := bytes.LastIndex(tokRaw, []byte(tokenChecksumSeparator))
+	if idx < 0 {
+		return tokRaw, false
+	}
+	payload, checksum := tokRaw[:idx], string(tokRaw[idx+len(tokenChecksumSeparator):])
+	if checksum != tokenChecksum(payload) {
+		return tokRaw, false
+	}
+	return payload, true
+}
+
+// peeringTokenCompressThreshold is the size of a token's JSON encoding, in
+// bytes, above which the token is gzipped when compression is enabled. Smaller
+// tokens gain little and would only become harder to inspect by hand.
+const peeringTokenCompressThreshold = 2048
+
+// maxDecompressedTokenSize bounds how much a compressed token may inflate to,
+// so that a malicious token cannot exhaust memory on decode.
+const maxDecompressedTokenSize = 1 << 20
+
+// gzipMagic is the header that prefixes every gzip stream. JSON tokens always
+// begin with '{', so the two can never be confused.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func compressToken(jsonToken []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(jsonToken); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressToken(compressed []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(zr, maxDecompressedTokenSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressedTokenSize {
+		return nil, fmt.Errorf("decompressed token exceeds %d bytes", maxDecompressedTokenSize)
+	}
+	return out, nil
+}
+
+// ErrTokenNotBase64 is returned when a peering token is not valid base64,
+// which usually means the input is not a peering token at all.
+var ErrTokenNotBase64 = errors.New("peering token is not base64-encoded")
+
+// ErrTokenNotJSON is returned when a peering token is valid base64 but does
+// not contain a JSON-encoded token, which usually means it was corrupted.
+var ErrTokenNotJSON = errors.New("peering token does not contain valid JSON")
+
+// tokenFormatError classifies a token decoding failure as one of the
+// ErrTokenNot* sentinels while keeping the underlying error's message.
+type tokenFormatError struct {
+	kind error
+	err  error
+}
+
+func (e *tokenFormatError) Error() string        { return e.err.Error() }
+func (e *tokenFormatError) Unwrap() error        { return e.err }
+func (e *tokenFormatError) Is(target error) bool { return target == e.kind }
+
+// ErrTokenEncrypted is returned when decoding an encrypted peering token
+// without a token encryption key configured.
+var ErrTokenEncrypted = errors.New("peering token is encrypted but no token encryption key is configured")
+
+// ErrTokenDecryptionFailed is returned when an encrypted peering token cannot
+// be decrypted, usually because it was encrypted with a different key.
+var ErrTokenDecryptionFailed = errors.New("failed to decrypt peering token; it may have been encrypted with a different key")
+
+// ErrUnsupportedTokenVersion is returned when decoding a peering token whose
+// format version is newer than this server understands.
+var ErrUnsupportedTokenVersion = errors.New("unsupported peering token version")
+
+// ErrTokenVerificationFailed is returned by EncodeToken when token
+// verification is enabled and the encoded token does not decode back to the
+// token that was encoded.
+var ErrTokenVerificationFailed = errors.New("encoded peering token does not decode to the original token")
+
+// ErrTokenExpired is returned when decoding a peering token whose expiry has
+// passed, if expiry is enforced.
+var ErrTokenExpired = errors.New("peering token has expired")
+
+// codec returns the TokenCodec used to serialize peering tokens.
+func (b *PeeringBackend) codec() TokenCodec {
+	if b.tokenCodec != nil {
+		return b.tokenCodec
+	}
+	return base64JSONTokenCodec{compress: b.tokenCompression, key: b.tokenEncryptionKey}
+}
+
+// EncodeToken encodes a peering token with the backend's TokenCodec, which by
+// default produces base64-encoded JSON.
+// The token is stamped with the current format version if it has none. When a
+// token TTL is configured it is also stamped with its issue time and expiry;
+// otherwise it is left without timestamps, so that encoding the same token
+// twice produces the same bytes for token diffs and fingerprints.
+// If token checksums are enabled a short checksum is appended to the encoded token.
+// If token verification is enabled the encoded token is decoded again and
+// must match the stamped token.
+func (b *PeeringBackend) EncodeToken(tok *structs.PeeringToken) ([]byte, error) {
+	versioned := *tok
+	if versioned.Version == 0 {
+		versioned.Version = structs.PeeringTokenVersion
+	}
+	if b.tokenTTL > 0 {
+		if versioned.IssuedAt == nil {
+			issuedAt := b.now().UTC().Truncate(time.Second)
+			versioned.IssuedAt = &issuedAt
+		}
+		if versioned.ExpiresAt == nil {
+			expiresAt := versioned.IssuedAt.Add(b.tokenTTL)
+			versioned.ExpiresAt = &expiresAt
+		}
+	}
+	encoded, err := b.codec().Encode(&versioned)
+	if err != nil {
+		b.log().Error("failed to encode peering token", "peer_id", tok.PeerID, "error", err)
+		return nil, err
+	}
+	if b.tokenVerify {
+		if err := b.verifyEncodedToken(&versioned, encoded); err != nil {
+			b.log().Error("failed to verify encoded peering token", "peer_id", tok.PeerID, "error", err)
+			return nil, err
+		}
+	}
+	if b.tokenChecksum && b.tokenCodec == nil {
+		encoded = append(encoded, []byte(tokenChecksumSeparator+tokenChecksum(encoded))...)
+	}
+	if b.tokenLogFingerprint {
+		b.log().Info("generated peering token", "peer_id", tok.PeerID, "fingerprint", TokenFingerprint(encoded))
+	}
+	labels := b.tokenMetricLabels()
+	metrics.IncrCounterWithLabels([]string{"peering", "token", "encode"}, 1, labels)
+	metrics.AddSampleWithLabels([]string{"peering", "token", "encode", "size"}, float32(len(encoded)), labels)
+	return encoded, nil
+}
+
+var PeeringTokenCounters = []prometheus.CounterDefinition{
+	{
+		Name: []string{"peering", "token", "encode"},
+		Help: "Increments for each peering token generated.",
+	},
+	{
+		Name: []string{"peering", "token", "decode"},
+		Help: "Increments for each peering token decoded.",
+	},
+	{
+		Name: []string{"peering", "token", "decode", "failure"},
+		Help: "Increments for each peering token that failed to decode, labeled with the reason.",
+	},
+}
+
+var PeeringTokenSummaries = []prometheus.SummaryDefinition{
+	{
+		Name: []string{"peering", "token", "encode", "size"},
+		Help: "Measures the size in bytes of generated peering tokens.",
+	},
+}
+
+// tokenMetricLabels returns the labels attached to peering token metrics.
+func (b *PeeringBackend) tokenMetricLabels() []metrics.Label {
+	if b.srv == nil {
+		return nil
+	}
+	return []metrics.Label{{Name: "datacenter", Value: b.srv.PeeringConfig().Datacenter}}
+}
+
+// tokenDecodeFailureReason classifies a DecodeToken error for metrics.
+func tokenDecodeFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrTokenChecksumMismatch):
+		return "checksum_mismatch"
+	case errors.Is(err, ErrTokenNotBase64):
+		return "not_base64"
+	case errors.Is(err, ErrTokenNotJSON):
+		return "not_json"
+	case errors.Is(err, ErrTokenEncrypted), errors.Is(err, ErrTokenDecryptionFailed):
+		return "decryption_failed"
+	case errors.Is(err, ErrUnsupportedTokenVersion):
+		return "unsupported_version"
+	case errors.Is(err, ErrTokenExpired):
+		return "expired"
+	}
+	return "invalid"
+}
+
+// tokenFingerprintLength is the number of hex characters in a token
+// fingerprint.
+const tokenFingerprintLength = 16
+
+// TokenFingerprint returns a short identifier for an encoded peering token
+// that is safe to log. It is a truncated SHA-256 of the token, so it is the
+// same for identical tokens but cannot be used to recover the establishment
+// secret. A token's checksum, if any, is not part of its fingerprint.
+func TokenFingerprint(tokRaw []byte) string {
+	if payload, ok := splitTokenChecksum(tokRaw); ok {
+		tokRaw = payload
+	}
+	sum := sha256.Sum256(tokRaw)
+	return hex.EncodeToString(sum[:])[:tokenFingerprintLength]
+}
+
+// TokensEquivalent reports whether two peering tokens describe the same peer
+// and the same way of reaching it. CA roots and server addresses are compared
+// as sets, so ordering is ignored, as are the timestamps and secrets that
+// differ each time a token is generated.
+func TokensEquivalent(a, b *structs.PeeringToken) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.PeerID != b.PeerID || a.ServerName != b.ServerName {
+		return false
+	}
+	return stringSetsEqual(a.CA, b.CA, normalizeRootPEM) &&
+		stringSetsEqual(a.ServerAddresses, b.ServerAddresses, strings.TrimSpace)
+}
+
+// stringSetsEqual reports whether a and b contain the same elements, ignoring
+// order and duplicates, after applying key to each.
+func stringSetsEqual(a, b []string, key func(string) string) bool {
+	set := make(map[string]bool, len(a))
+	for _, s := range a {
+		set[key(s)] = false
+	}
+	for _, s := range b {
+		k := key(s)
+		if _, ok := set[k]; !ok {
+			return false
+		}
+		set[k] = true
+	}
+	for _, seen := range set {
+		if !seen {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrTokenFilePermissive is returned by WriteTokenFile when the file it would
+// replace is readable or writable by users other than its owner.
+var ErrTokenFilePermissive = errors.New("existing peering token file is accessible to other users")
+
+// WriteTokenFile encodes tok like EncodeToken and atomically writes it to
+// path, readable and writable only by the current user. An existing file at
+// path that grants any access to other users is only replaced if
+// replacePermissive is set, so that a world-readable token file is not
+// silently reused for a new secret.
+func (b *PeeringBackend) WriteTokenFile(path string, tok *structs.PeeringToken, replacePermissive bool) error {
+	info, err := os.Stat(path)
+	switch {
+	case err == nil:
+		if info.IsDir() {
+			return fmt.Errorf("cannot write peering token to %q: is a directory", path)
+		}
+		if info.Mode().Perm()&0077 != 0 && !replacePermissive {
+			return fmt.Errorf("cannot write peering token to %q with mode %s: %w", path, info.Mode().Perm(), ErrTokenFilePermissive)
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("failed to check peering token file: %w", err)
+	}
+
+	encoded, err := b.EncodeToken(tok)
+	if err != nil {
+		return err
+	}
+	if err := file.WriteAtomicWithPerms(path, encoded, 0700, 0600); err != nil {
+		return fmt.Errorf("failed to write peering token file: %w", err)
+	}
+	return nil
+}
+
+// ErrThinTokenUntrustedPeer is returned by EncodeThinToken when the peer has
+// never established the peering, and so cannot hold this cluster's CA roots.
+var ErrThinTokenUntrustedPeer = errors.New("peering tokens without CA roots can only be generated for peerings that have been established")
+
+// EncodeThinToken encodes a peering token like EncodeToken but leaves out its
+// CA roots, for re-establishing a peering whose dialer already holds this
+// cluster's CA bundle. The token's PeerID must identify a peering that has
+// been established, so that first-time tokens always include the roots.
+func (b *PeeringBackend) EncodeThinToken(tok *structs.PeeringToken) ([]byte, error) {
+	_, existing, err := b.srv.PeeringState().PeeringReadByID(nil, tok.PeerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peering: %w", err)
+	}
+	if existing == nil || !existing.IsActive() || existing.State == pbpeering.PeeringState_PENDING {
+		return nil, ErrThinTokenUntrustedPeer
+	}
+
+	thin := *tok
+	thin.CA = nil
+	thin.CAOmitted = true
+	return b.EncodeToken(&thin)
+}
+
+// verifyEncodedToken checks that encoded decodes back to tok. Tokens are
+// compared field by field in their JSON form, so that equal times in
+// different locations are not reported as differences. Only the names of
+// mismatched fields are reported, since tokens hold secrets.
+func (b *PeeringBackend) verifyEncodedToken(tok *structs.PeeringToken, encoded []byte) error {
+	decoded, err := b.codec().Decode(encoded)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTokenVerificationFailed, err)
+	}
+	want, err := tokenJSONFields(tok)
+	if err != nil {
+		return err
+	}
+	got, err := tokenJSONFields(decoded)
+	if err != nil {
+		return err
+	}
+
+	var mismatched []string
+	for field, value := range want {
+		if !bytes.Equal(value, got[field]) {
+			mismatched = append(mismatched, field)
+		}
+	}
+	for field := range got {
+		if _, ok := want[field]; !ok {
+			mismatched = append(mismatched, field)
+		}
+	}
+	if len(mismatched) > 0 {
+		sort.Strings(mismatched)
+		return fmt.Errorf("%w: fields %s differ", ErrTokenVerificationFailed, strings.Join(mismatched, ", "))
+	}
+	return nil
+}
+
+func tokenJSONFields(tok *structs.PeeringToken) (map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(tok)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// DecodeToken decodes a peering token with the backend's TokenCodec.
+// Tokens with a checksum suffix are verified regardless of whether this server
+// appends checksums to the tokens it generates. With the default codec,
+// compressed tokens are detected automatically and malformed tokens produce
+// errors matching ErrTokenNotBase64 or ErrTokenNotJSON. Thin tokens from
+// EncodeThinToken decode with no CA roots. If expiry is enforced,
+// tokens past their expiry are rejected with ErrTokenExpired.
+func (b *PeeringBackend) DecodeToken(tokRaw []byte) (*structs.PeeringToken, error) {
+	tok, err := b.decodeToken(tokRaw)
+
+	labels := b.tokenMetricLabels()
+	metrics.IncrCounterWithLabels([]string{"peering", "token", "decode"}, 1, labels)
+	if err != nil {
+		labels = append(labels, metrics.Label{Name: "reason", Value: tokenDecodeFailureReason(err)})
+		metrics.IncrCounterWithLabels([]string{"peering", "token", "decode", "failure"}, 1, labels)
+	}
+	return tok, err
+}
+
+func (b *PeeringBackend) decodeToken(tokRaw []byte) (*structs.PeeringToken, error) {
+	// Only the default codec's tokens carry a checksum, and its payloads
+	// never contain the separator.
+	if b.tokenCodec == nil && bytes.Contains(tokRaw, []byte(tokenChecksumSeparator)) {
+		payload, ok := splitTokenChecksum(tokRaw)
+		if !ok {
+			b.log().Warn("failed to decode peering token", "error", ErrTokenChecksumMismatch)
+			return nil, ErrTokenChecksumMismatch
+		}
+		tokRaw = payload
+	}
+
+	tok, err := b.codec().Decode(tokRaw)
+	if err != nil {
+		b.log().Warn("failed to decode peering token", "error", err)
+		return nil, err
+	}
+	switch {
+	case tok.Version == 0:
+		tok.Version = 1
+	case tok.Version < 0 || tok.Version > structs.PeeringTokenVersion:
+		return nil, fmt.Errorf("%w: token is version %d but this server supports up to version %d",
+			ErrUnsupportedTokenVersion, tok.Version, structs.PeeringTokenVersion)
+	}
+	if err := structs.ValidatePeeringTokenOperatorContact(tok.OperatorContact); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if err := structs.ValidatePeeringTokenClusterName(tok.ClusterName); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if b.tokenEnforceExpiry && tok.ExpiresAt != nil && !b.now().Before(*tok.ExpiresAt) {
+		return nil, fmt.Errorf("%w at %s", ErrTokenExpired, tok.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	return tok, nil
+}
+
+// ErrTokenCARootsExpired is returned by DecodeAndValidateToken when every CA
+// root embedded in a peering token has expired, which usually means the token
+// was generated long ago and must be regenerated.
+var ErrTokenCARootsExpired = errors.New("all CA roots in the peering token have expired; generate a new token")
+
+// DecodeAndValidateToken decodes a peering token like DecodeToken and also
+// checks that at least one of its CA roots is still valid, so that stale
+// tokens fail up front rather than during the TLS handshake. Roots that cannot
+// be parsed are treated as expired, as they are for trust bundle health.
+func (b *PeeringBackend) DecodeAndValidateToken(tokRaw []byte) (*structs.PeeringToken, error) {
+	tok, err := b.DecodeToken(tokRaw)
+	if err != nil {
+		return nil, err
+	}
+	if allRootsExpired(tok.CA, b.now()) {
+		return nil, ErrTokenCARootsExpired
+	}
+	return tok, nil
+}
+
+// UpgradeToken decodes a token produced by any supported token format and
+// re-encodes it in the current format, preserving all fields.
+func (b *PeeringBackend) UpgradeToken(oldRaw []byte) ([]byte, error) {
+	tok, err := b.DecodeToken(oldRaw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode token for upgrade: %w", err)
+	}
+	return b.EncodeToken(tok)
+}
+
+// TokenInspection is a read-only summary of a peering token. It never
+// includes the establishment secret.
+type TokenInspection struct {
+	PeerID                 string
+	ServerName             string
+	ServerAddresses        []string
+	CARootCount            int
+	HasEstablishmentSecret bool
+	OperatorContact        string
+	ClusterName            string
+
+	// CARootFingerprints holds the SHA-1 fingerprint of each CA root, in
+	// token order. Roots that cannot be parsed have an empty fingerprint.
+	CARootFingerprints []string
+}
+
+// InspectToken decodes a peering token and summarizes what it would
+// configure, without establishing a peering. Decoding failures can be
+// classified with errors.Is against ErrTokenNotBase64 and ErrTokenNotJSON.
+func (b *PeeringBackend) InspectToken(tokRaw []byte) (*TokenInspection, error) {
+	tok, err := b.DecodeToken(tokRaw)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenInspection{
+		PeerID:                 tok.PeerID,
+		ServerName:             tok.ServerName,
+		ServerAddresses:        tok.ServerAddresses,
+		CARootCount:            len(tok.CA),
+		HasEstablishmentSecret: tok.EstablishmentSecret != "",
+		OperatorContact:        tok.OperatorContact,
+		ClusterName:            tok.ClusterName,
+		CARootFingerprints:     caRootFingerprints(tok.CA),
+	}, nil
+}
+
+func caRootFingerprints(roots []string) []string {
+	if len(roots) == 0 {
+		return nil
+	}
+	fingerprints := make([]string, len(roots))
+	for i, root := range roots {
+		if cert, err := connect.ParseCert(root); err == nil {
+			fingerprints[i] = connect.CalculateCertFingerprint(cert.Raw)
+		}
+	}
+	return fingerprints
+}
+
+// TokenValidation is the result of validating one peering token.
+type TokenValidation struct {
+	// PeerID is the peer ID from the token, if it could be decoded.
+	PeerID string
+
+	Valid bool
+
+	// Reason explains why the token is invalid. It is empty for valid tokens.
+	Reason string
+}
+
+// ValidateTokens decodes and structurally validates each of the given
+// peering tokens without establishing any peerings. A result is returned for
+// every token, in the same order, so that all problems can be reported at
+// once.
+func (b *PeeringBackend) ValidateTokens(raws [][]byte) ([]TokenValidation, error) {
+	if len(raws) == 0 {
+		return nil, fmt.Errorf("no peering tokens to validate")
+	}
+
+	results := make([]TokenValidation, len(raws))
+	for i, raw := range raws {
+		tok, err := b.DecodeToken(raw)
+		if err != nil {
+			results[i].Reason = err.Error()
+			continue
+		}
+		results[i].PeerID = tok.PeerID
+		if err := peering.ValidatePeeringToken(tok); err != nil {
+			results[i].Reason = err.Error()
+			continue
+		}
+		results[i].Valid = true
+	}
+	return results, nil
+}
@@ -0,0 +1,849 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/rpc/peering"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/proto/pbpeering"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeeringBackend_UpgradeToken(t *testing.T) {
+	tok := &structs.PeeringToken{
+		CA:                  []string{"ca"},
+		ServerAddresses:     []string{"10.0.0.1:8502"},
+		ServerName:          "server.dc1.peering.11111111-2222-3333-4444-555555555555.consul",
+		PeerID:              "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+		EstablishmentSecret: "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84",
+	}
+	jsonToken, err := json.Marshal(tok)
+	require.NoError(t, err)
+	legacy := []byte(base64.StdEncoding.EncodeToString(jsonToken))
+
+	backend := &PeeringBackend{tokenChecksum: true}
+
+	testutil.RunStep(t, "legacy token", func(t *testing.T) {
+		upgraded, err := backend.UpgradeToken(legacy)
+		require.NoError(t, err)
+		require.Contains(t, string(upgraded), tokenChecksumSeparator)
+
+		decoded, err := backend.DecodeToken(upgraded)
+		require.NoError(t, err)
+
+		expect := *tok
+		expect.Version = structs.PeeringTokenVersion
+		require.Equal(t, &expect, decoded)
+	})
+
+	testutil.RunStep(t, "invalid token", func(t *testing.T) {
+		_, err := backend.UpgradeToken([]byte("not a token"))
+		testutil.RequireErrorContains(t, err, "failed to decode token for upgrade")
+	})
+}
+
+func TestTokenFingerprint(t *testing.T) {
+	tok := &structs.PeeringToken{
+		CA:                  []string{"ca-1"},
+		ServerAddresses:     []string{"1.2.3.4:8502"},
+		PeerID:              "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+		EstablishmentSecret: "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84",
+		IssuedAt:            testTokenIssuedAt(),
+	}
+	backend := &PeeringBackend{}
+
+	raw, err := backend.EncodeToken(tok)
+	require.NoError(t, err)
+	fingerprint := TokenFingerprint(raw)
+	require.Len(t, fingerprint, tokenFingerprintLength)
+	require.NotContains(t, fingerprint, tok.EstablishmentSecret)
+
+	testutil.RunStep(t, "identical tokens", func(t *testing.T) {
+		again, err := backend.EncodeToken(tok)
+		require.NoError(t, err)
+		require.Equal(t, fingerprint, TokenFingerprint(again))
+	})
+
+	testutil.RunStep(t, "different tokens", func(t *testing.T) {
+		other := *tok
+		other.EstablishmentSecret = "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e"
+		raw, err := backend.EncodeToken(&other)
+		require.NoError(t, err)
+		require.NotEqual(t, fingerprint, TokenFingerprint(raw))
+	})
+
+	testutil.RunStep(t, "checksum is ignored", func(t *testing.T) {
+		raw, err := (&PeeringBackend{tokenChecksum: true}).EncodeToken(tok)
+		require.NoError(t, err)
+		require.Equal(t, fingerprint, TokenFingerprint(raw))
+	})
+
+	testutil.RunStep(t, "logged at generation", func(t *testing.T) {
+		var buf bytes.Buffer
+		logging := &PeeringBackend{
+			tokenLogFingerprint: true,
+			logger:              hclog.New(&hclog.LoggerOptions{Output: &buf}),
+		}
+		_, err := logging.EncodeToken(tok)
+		require.NoError(t, err)
+
+		logs := buf.String()
+		require.Contains(t, logs, "[INFO]  generated peering token")
+		require.Contains(t, logs, "fingerprint="+fingerprint)
+		require.NotContains(t, logs, tok.EstablishmentSecret)
+	})
+}
+
+func TestPeeringBackend_TokenMetrics(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	cfg := metrics.DefaultConfig("consul")
+	cfg.EnableHostname = false
+	metrics.NewGlobal(cfg, sink)
+	t.Cleanup(func() {
+		metrics.NewGlobal(cfg, &metrics.BlackholeSink{})
+	})
+
+	srv := &mockPeeringBackendServer{config: DefaultConfig(), store: state.NewStateStore(nil)}
+	srv.config.Datacenter = "dc1"
+	backend := NewPeeringBackend(srv)
+
+	encoded, err := backend.EncodeToken(&structs.PeeringToken{PeerID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"})
+	require.NoError(t, err)
+	_, err = backend.DecodeToken(encoded)
+	require.NoError(t, err)
+	_, err = backend.DecodeToken([]byte("not a token"))
+	require.Error(t, err)
+
+	intv := sink.Data()[0]
+	require.Equal(t, 1, intv.Counters["consul.peering.token.encode;datacenter=dc1"].Count)
+
+	size := intv.Samples["consul.peering.token.encode.size;datacenter=dc1"]
+	require.Equal(t, 1, size.Count)
+	require.Equal(t, float64(len(encoded)), size.Sum)
+
+	require.Equal(t, 2, intv.Counters["consul.peering.token.decode;datacenter=dc1"].Count)
+	require.Equal(t, 1, intv.Counters["consul.peering.token.decode.failure;datacenter=dc1;reason=not_base64"].Count)
+}
+
+func TestPeeringBackend_InspectToken(t *testing.T) {
+	backend := &PeeringBackend{}
+	ca := connect.TestCA(t, nil)
+
+	raw, err := backend.EncodeToken(&structs.PeeringToken{
+		CA:                  []string{ca.RootCert, "ca-2"},
+		ServerAddresses:     []string{"1.2.3.4:8502"},
+		ServerName:          "server.dc1.peering.11111111-2222-3333-4444-555555555555.consul",
+		PeerID:              "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+		EstablishmentSecret: "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84",
+		OperatorContact:     "platform-team@example.com",
+		ClusterName:         "prod-us-east",
+	})
+	require.NoError(t, err)
+
+	inspection, err := backend.InspectToken(raw)
+	require.NoError(t, err)
+	require.Equal(t, &TokenInspection{
+		PeerID:                 "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+		ServerName:             "server.dc1.peering.11111111-2222-3333-4444-555555555555.consul",
+		ServerAddresses:        []string{"1.2.3.4:8502"},
+		CARootCount:            2,
+		HasEstablishmentSecret: true,
+		OperatorContact:        "platform-team@example.com",
+		ClusterName:            "prod-us-east",
+		CARootFingerprints:     []string{ca.ID, ""},
+	}, inspection)
+
+	t.Run("not base64", func(t *testing.T) {
+		_, err := backend.InspectToken([]byte("not a token!"))
+		require.ErrorIs(t, err, ErrTokenNotBase64)
+		require.NotErrorIs(t, err, ErrTokenNotJSON)
+	})
+
+	t.Run("not json", func(t *testing.T) {
+		_, err := backend.InspectToken([]byte(base64.StdEncoding.EncodeToString([]byte("{corrupt"))))
+		require.ErrorIs(t, err, ErrTokenNotJSON)
+		require.NotErrorIs(t, err, ErrTokenNotBase64)
+	})
+
+	t.Run("operator contact too long", func(t *testing.T) {
+		raw, err := backend.EncodeToken(&structs.PeeringToken{
+			PeerID:          "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+			OperatorContact: strings.Repeat("a", structs.PeeringTokenMaxOperatorContactLength+1),
+		})
+		require.NoError(t, err)
+
+		_, err = backend.InspectToken(raw)
+		testutil.RequireErrorContains(t, err, "operator contact must be at most")
+	})
+}
+
+func TestPeeringBackend_ValidateTokens(t *testing.T) {
+	backend := &PeeringBackend{}
+
+	valid, err := backend.EncodeToken(&structs.PeeringToken{
+		ServerAddresses: []string{"1.2.3.4:8502"},
+		PeerID:          "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+	})
+	require.NoError(t, err)
+
+	noAddrs, err := backend.EncodeToken(&structs.PeeringToken{
+		PeerID: "0d5e9e53-8a3b-4e38-8a0c-0e4f2c1b3f0a",
+	})
+	require.NoError(t, err)
+
+	results, err := backend.ValidateTokens([][]byte{valid, []byte("not a token"), noAddrs})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	require.Equal(t, TokenValidation{PeerID: "9e650110-ac74-4c5a-a6a8-9348b2bed4e9", Valid: true}, results[0])
+
+	require.False(t, results[1].Valid)
+	require.Contains(t, results[1].Reason, "failed to decode token")
+
+	require.False(t, results[2].Valid)
+	require.Equal(t, "0d5e9e53-8a3b-4e38-8a0c-0e4f2c1b3f0a", results[2].PeerID)
+	require.Contains(t, results[2].Reason, "server addresses")
+
+	_, err = backend.ValidateTokens(nil)
+	require.Error(t, err)
+}
+
+func TestPeeringBackend_TokenVersion(t *testing.T) {
+	backend := &PeeringBackend{}
+
+	tok := &structs.PeeringToken{
+		ServerAddresses: []string{"1.2.3.4:8502"},
+		PeerID:          "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		raw, err := backend.EncodeToken(tok)
+		require.NoError(t, err)
+		require.Zero(t, tok.Version, "encoding must not modify the token")
+
+		decoded, err := backend.DecodeToken(raw)
+		require.NoError(t, err)
+		require.Equal(t, structs.PeeringTokenVersion, decoded.Version)
+		require.Equal(t, tok.PeerID, decoded.PeerID)
+	})
+
+	t.Run("legacy token without version", func(t *testing.T) {
+		raw := base64.StdEncoding.EncodeToString([]byte(`{"ServerAddresses":["1.2.3.4:8502"],"PeerID":"9e650110-ac74-4c5a-a6a8-9348b2bed4e9"}`))
+
+		decoded, err := backend.DecodeToken([]byte(raw))
+		require.NoError(t, err)
+		require.Equal(t, 1, decoded.Version)
+		require.Equal(t, tok.ServerAddresses, decoded.ServerAddresses)
+	})
+
+	t.Run("unknown future version", func(t *testing.T) {
+		raw, err := backend.EncodeToken(&structs.PeeringToken{
+			PeerID:  "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+			Version: structs.PeeringTokenVersion + 1,
+		})
+		require.NoError(t, err)
+
+		decoded, err := backend.DecodeToken(raw)
+		require.ErrorIs(t, err, ErrUnsupportedTokenVersion)
+		require.Nil(t, decoded)
+	})
+}
+
+func TestPeeringBackend_TokenTimestamps(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	tok := &structs.PeeringToken{
+		ServerAddresses: []string{"1.2.3.4:8502"},
+		PeerID:          "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+	}
+
+	t.Run("no TTL", func(t *testing.T) {
+		backend := &PeeringBackend{timeNow: clock}
+		raw, err := backend.EncodeToken(tok)
+		require.NoError(t, err)
+
+		decoded, err := backend.DecodeToken(raw)
+		require.NoError(t, err)
+		require.Nil(t, decoded.IssuedAt)
+		require.Nil(t, decoded.ExpiresAt)
+
+		// Without timestamps the encoding is stable over time.
+		later := &PeeringBackend{timeNow: func() time.Time { return now.Add(time.Minute) }}
+		again, err := later.EncodeToken(tok)
+		require.NoError(t, err)
+		require.Equal(t, raw, again)
+		require.Equal(t, TokenFingerprint(raw), TokenFingerprint(again))
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		backend := &PeeringBackend{timeNow: clock, tokenTTL: time.Hour}
+		raw, err := backend.EncodeToken(tok)
+		require.NoError(t, err)
+		require.Nil(t, tok.IssuedAt, "encoding must not modify the token")
+
+		decoded, err := backend.DecodeToken(raw)
+		require.NoError(t, err)
+		require.Equal(t, &now, decoded.IssuedAt)
+		expiresAt := now.Add(time.Hour)
+		require.Equal(t, &expiresAt, decoded.ExpiresAt)
+	})
+
+	t.Run("legacy token without timestamps", func(t *testing.T) {
+		raw := base64.StdEncoding.EncodeToString([]byte(`{"ServerAddresses":["1.2.3.4:8502"],"PeerID":"9e650110-ac74-4c5a-a6a8-9348b2bed4e9"}`))
+
+		decoded, err := (&PeeringBackend{timeNow: clock, tokenEnforceExpiry: true}).DecodeToken([]byte(raw))
+		require.NoError(t, err)
+		require.Nil(t, decoded.IssuedAt)
+		require.Nil(t, decoded.ExpiresAt)
+	})
+}
+
+func TestPeeringBackend_TokenExpiry(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	backend := &PeeringBackend{
+		timeNow:            func() time.Time { return now },
+		tokenTTL:           time.Hour,
+		tokenEnforceExpiry: true,
+	}
+
+	raw, err := backend.EncodeToken(&structs.PeeringToken{
+		ServerAddresses: []string{"1.2.3.4:8502"},
+		PeerID:          "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+	})
+	require.NoError(t, err)
+
+	now = now.Add(59 * time.Minute)
+	_, err = backend.DecodeToken(raw)
+	require.NoError(t, err)
+
+	now = now.Add(time.Minute)
+	decoded, err := backend.DecodeToken(raw)
+	require.ErrorIs(t, err, ErrTokenExpired)
+	require.Nil(t, decoded)
+
+	// Expiry is only checked when enforced.
+	backend.tokenEnforceExpiry = false
+	_, err = backend.DecodeToken(raw)
+	require.NoError(t, err)
+}
+
+func TestPeeringBackend_EncodeThinToken(t *testing.T) {
+	store := state.NewStateStore(nil)
+	backend := NewPeeringBackend(&mockPeeringBackendServer{config: DefaultConfig(), store: store})
+
+	const (
+		pendingID = "9e650110-ac74-4c5a-a6a8-9348b2bed4e9"
+		activeID  = "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e"
+	)
+	require.NoError(t, store.PeeringWrite(1, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: pendingID, Name: "pending", State: pbpeering.PeeringState_PENDING},
+	}))
+	require.NoError(t, store.PeeringWrite(2, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{ID: activeID, Name: "active", State: pbpeering.PeeringState_ACTIVE},
+	}))
+
+	tok := &structs.PeeringToken{
+		CA:              []string{connect.TestCA(t, nil).RootCert},
+		ServerAddresses: []string{"1.2.3.4:8502"},
+		ServerName:      "server.dc1.peering.11111111-2222-3333-4444-555555555555.consul",
+	}
+
+	t.Run("established peering", func(t *testing.T) {
+		tok := *tok
+		tok.PeerID = activeID
+
+		raw, err := backend.EncodeThinToken(&tok)
+		require.NoError(t, err)
+		require.Len(t, tok.CA, 1, "encoding must not modify the token")
+
+		decoded, err := backend.DecodeToken(raw)
+		require.NoError(t, err)
+		require.Empty(t, decoded.CA)
+		require.True(t, decoded.CAOmitted)
+		require.Equal(t, tok.ServerName, decoded.ServerName)
+		require.NoError(t, peering.ValidatePeeringToken(decoded))
+	})
+
+	t.Run("first-time tokens need roots", func(t *testing.T) {
+		for _, peerID := range []string{pendingID, "5e4d8c5a-0b3f-4c3d-8f5e-6a7b8c9d0e1f"} {
+			tok := *tok
+			tok.PeerID = peerID
+
+			_, err := backend.EncodeThinToken(&tok)
+			require.ErrorIs(t, err, ErrThinTokenUntrustedPeer)
+		}
+	})
+}
+
+func TestPeeringBackend_TokenChecksum(t *testing.T) {
+	tok := &structs.PeeringToken{
+		CA:                  []string{"ca-1"},
+		ServerAddresses:     []string{"1.2.3.4:8502"},
+		PeerID:              "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+		EstablishmentSecret: "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84",
+		Version:             structs.PeeringTokenVersion,
+		IssuedAt:            testTokenIssuedAt(),
+	}
+
+	backend := &PeeringBackend{tokenChecksum: true}
+	raw, err := backend.EncodeToken(tok)
+	require.NoError(t, err)
+	require.Contains(t, string(raw), tokenChecksumSeparator)
+
+	decoded, err := backend.DecodeToken(raw)
+	require.NoError(t, err)
+	require.Equal(t, tok, decoded)
+
+	// Backends that do not generate checksums must still verify them.
+	decoded, err = (&PeeringBackend{}).DecodeToken(raw)
+	require.NoError(t, err)
+	require.Equal(t, tok, decoded)
+
+	truncated := append([]byte{}, raw[:10]...)
+	truncated = append(truncated, raw[bytes.LastIndex(raw, []byte(tokenChecksumSeparator)):]...)
+	_, err = backend.DecodeToken(truncated)
+	require.ErrorIs(t, err, ErrTokenChecksumMismatch)
+
+	// Tokens without a checksum still decode.
+	legacy, err := (&PeeringBackend{}).EncodeToken(tok)
+	require.NoError(t, err)
+	decoded, err = backend.DecodeToken(legacy)
+	require.NoError(t, err)
+	require.Equal(t, tok, decoded)
+}
+
+// testTokenIssuedAt returns a fixed issue time for tokens that are compared
+// after a round trip, so that EncodeToken does not stamp the current time.
+func testTokenIssuedAt() *time.Time {
+	issuedAt := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	return &issuedAt
+}
+
+// largePeeringToken returns a token with enough CA roots and server addresses
+// to exceed peeringTokenCompressThreshold.
+func largePeeringToken(t *testing.T) *structs.PeeringToken {
+	tok := &structs.PeeringToken{
+		PeerID:              "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+		EstablishmentSecret: "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84",
+		ServerName:          "server.dc1.peering.11111111-2222-3333-4444-555555555555.consul",
+		Version:             structs.PeeringTokenVersion,
+		IssuedAt:            testTokenIssuedAt(),
+	}
+	for i := 0; i < 5; i++ {
+		tok.CA = append(tok.CA, connect.TestCA(t, nil).RootCert)
+	}
+	for i := 0; i < 20; i++ {
+		tok.ServerAddresses = append(tok.ServerAddresses, fmt.Sprintf("10.0.%d.%d:8502", i/10, i))
+	}
+	return tok
+}
+
+// hexJSONTokenCodec is a trivial TokenCodec used to test swapping codecs.
+type hexJSONTokenCodec struct{}
+
+func (hexJSONTokenCodec) Encode(tok *structs.PeeringToken) ([]byte, error) {
+	raw, err := json.Marshal(tok)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(raw)), nil
+}
+
+func (hexJSONTokenCodec) Decode(raw []byte) (*structs.PeeringToken, error) {
+	jsonRaw, err := hex.DecodeString(string(raw))
+	if err != nil {
+		return nil, err
+	}
+	var tok structs.PeeringToken
+	if err := json.Unmarshal(jsonRaw, &tok); err != nil {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+func TestPeeringBackend_TokenCodec(t *testing.T) {
+	tok := &structs.PeeringToken{
+		CA:                  []string{"ca-1"},
+		ServerAddresses:     []string{"1.2.3.4:8502"},
+		PeerID:              "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+		EstablishmentSecret: "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84",
+		Version:             structs.PeeringTokenVersion,
+		IssuedAt:            testTokenIssuedAt(),
+	}
+
+	backend := &PeeringBackend{tokenCodec: hexJSONTokenCodec{}, tokenChecksum: true}
+	raw, err := backend.EncodeToken(tok)
+	require.NoError(t, err)
+
+	// The checksum is only added to tokens of the default codec.
+	expect, err := hexJSONTokenCodec{}.Encode(tok)
+	require.NoError(t, err)
+	require.Equal(t, expect, raw)
+
+	decoded, err := backend.DecodeToken(raw)
+	require.NoError(t, err)
+	require.Equal(t, tok, decoded)
+
+	// The default codec cannot decode tokens from the alternate codec.
+	_, err = (&PeeringBackend{}).DecodeToken(raw)
+	require.Error(t, err)
+}
+
+// dottedTokenCodec is a TokenCodec whose output contains
+// tokenChecksumSeparator, like compact binary encodings can.
+type dottedTokenCodec struct{}
+
+func (dottedTokenCodec) Encode(tok *structs.PeeringToken) ([]byte, error) {
+	raw, err := hexJSONTokenCodec{}.Encode(tok)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("v1."), raw...), nil
+}
+
+func (dottedTokenCodec) Decode(raw []byte) (*structs.PeeringToken, error) {
+	return hexJSONTokenCodec{}.Decode(bytes.TrimPrefix(raw, []byte("v1.")))
+}
+
+func TestPeeringBackend_TokenCodecWithSeparator(t *testing.T) {
+	tok := &structs.PeeringToken{
+		CA:                  []string{"ca-1"},
+		ServerAddresses:     []string{"1.2.3.4:8502"},
+		PeerID:              "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+		EstablishmentSecret: "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84",
+		Version:             structs.PeeringTokenVersion,
+		IssuedAt:            testTokenIssuedAt(),
+	}
+
+	backend := &PeeringBackend{tokenCodec: dottedTokenCodec{}, tokenChecksum: true}
+	raw, err := backend.EncodeToken(tok)
+	require.NoError(t, err)
+	require.Contains(t, string(raw), tokenChecksumSeparator)
+
+	decoded, err := backend.DecodeToken(raw)
+	require.NoError(t, err)
+	require.Equal(t, tok, decoded)
+
+	testutil.RunStep(t, "fingerprint covers the whole token", func(t *testing.T) {
+		other := *tok
+		other.EstablishmentSecret = "0d7f2a9c-2c3d-4f3e-9b0a-3c0f4f1c5f8e"
+		otherRaw, err := backend.EncodeToken(&other)
+		require.NoError(t, err)
+		require.NotEqual(t, TokenFingerprint(raw), TokenFingerprint(otherRaw))
+	})
+}
+
+// lossyTokenCodec drops the cluster name when decoding, simulating a codec
+// that is missing a field.
+type lossyTokenCodec struct {
+	base64JSONTokenCodec
+}
+
+func (c lossyTokenCodec) Decode(raw []byte) (*structs.PeeringToken, error) {
+	tok, err := c.base64JSONTokenCodec.Decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	tok.ClusterName = ""
+	return tok, nil
+}
+
+func TestPeeringBackend_TokenVerification(t *testing.T) {
+	tok := &structs.PeeringToken{
+		ServerAddresses:     []string{"1.2.3.4:8502"},
+		PeerID:              "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+		EstablishmentSecret: "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84",
+		ClusterName:         "cluster-1",
+	}
+
+	_, err := (&PeeringBackend{tokenVerify: true, tokenChecksum: true}).EncodeToken(tok)
+	require.NoError(t, err)
+
+	// Unverified tokens are returned even if they lose fields.
+	lossy := &PeeringBackend{tokenCodec: lossyTokenCodec{}}
+	_, err = lossy.EncodeToken(tok)
+	require.NoError(t, err)
+
+	lossy.tokenVerify = true
+	raw, err := lossy.EncodeToken(tok)
+	require.ErrorIs(t, err, ErrTokenVerificationFailed)
+	testutil.RequireErrorContains(t, err, "fields ClusterName differ")
+	require.NotContains(t, err.Error(), tok.EstablishmentSecret)
+	require.Nil(t, raw)
+}
+
+func TestTokensEquivalent(t *testing.T) {
+	tok := largePeeringToken(t)
+
+	reordered := *tok
+	reordered.CA = []string{tok.CA[2], tok.CA[0], tok.CA[1], tok.CA[4], tok.CA[3]}
+	reordered.ServerAddresses = make([]string, len(tok.ServerAddresses))
+	for i, addr := range tok.ServerAddresses {
+		reordered.ServerAddresses[len(tok.ServerAddresses)-1-i] = addr
+	}
+	issuedAt := tok.IssuedAt.Add(time.Hour)
+	reordered.IssuedAt = &issuedAt
+	reordered.EstablishmentSecret = "3e3f2ba9-6a1c-4a54-a48e-5d9c1d2a0f1b"
+	require.True(t, TokensEquivalent(tok, &reordered))
+	require.True(t, TokensEquivalent(&reordered, tok))
+
+	rotated := *tok
+	rotated.CA = append(append([]string{}, tok.CA[:4]...), connect.TestCA(t, nil).RootCert)
+	require.False(t, TokensEquivalent(tok, &rotated))
+
+	fewer := *tok
+	fewer.ServerAddresses = tok.ServerAddresses[1:]
+	require.False(t, TokensEquivalent(tok, &fewer))
+
+	renamed := *tok
+	renamed.ServerName = "server.dc2.peering.11111111-2222-3333-4444-555555555555.consul"
+	require.False(t, TokensEquivalent(tok, &renamed))
+
+	require.True(t, TokensEquivalent(nil, nil))
+	require.False(t, TokensEquivalent(tok, nil))
+}
+
+func TestPeeringBackend_WriteTokenFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not enforced on windows")
+	}
+
+	tok := &structs.PeeringToken{
+		CA:                  []string{"ca-1"},
+		ServerAddresses:     []string{"1.2.3.4:8502"},
+		PeerID:              "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+		EstablishmentSecret: "389bbcdf-1c31-47d6-ae96-f2a3f4c45f84",
+		IssuedAt:            testTokenIssuedAt(),
+	}
+	backend := &PeeringBackend{}
+
+	requireTokenFile := func(t *testing.T, path string) {
+		t.Helper()
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		raw, err := os.ReadFile(path)
+		require.NoError(t, err)
+		decoded, err := backend.DecodeToken(raw)
+		require.NoError(t, err)
+		require.Equal(t, tok.EstablishmentSecret, decoded.EstablishmentSecret)
+
+		// The temporary file is renamed into place, so nothing is left behind.
+		entries, err := os.ReadDir(filepath.Dir(path))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	}
+
+	t.Run("new file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, backend.WriteTokenFile(path, tok, false))
+		requireTokenFile(t, path)
+	})
+
+	t.Run("replaces private file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(path, []byte("old token"), 0600))
+
+		require.NoError(t, backend.WriteTokenFile(path, tok, false))
+		requireTokenFile(t, path)
+	})
+
+	t.Run("refuses permissive file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(path, []byte("old token"), 0600))
+		require.NoError(t, os.Chmod(path, 0644))
+
+		err := backend.WriteTokenFile(path, tok, false)
+		require.ErrorIs(t, err, ErrTokenFilePermissive)
+
+		raw, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "old token", string(raw))
+
+		require.NoError(t, backend.WriteTokenFile(path, tok, true))
+		requireTokenFile(t, path)
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		err := backend.WriteTokenFile(t.TempDir(), tok, true)
+		testutil.RequireErrorContains(t, err, "is a directory")
+	})
+}
+
+func TestPeeringBackend_DecodeTokenErrors(t *testing.T) {
+	backend := &PeeringBackend{}
+
+	t.Run("not base64", func(t *testing.T) {
+		_, err := backend.DecodeToken([]byte("not a token!"))
+		require.ErrorIs(t, err, ErrTokenNotBase64)
+		require.NotErrorIs(t, err, ErrTokenNotJSON)
+		require.EqualError(t, err, "failed to decode token: illegal base64 data at input byte 3")
+
+		var corrupt base64.CorruptInputError
+		require.ErrorAs(t, err, &corrupt)
+	})
+
+	t.Run("not json", func(t *testing.T) {
+		_, err := backend.DecodeToken([]byte(base64.StdEncoding.EncodeToString([]byte("{corrupt"))))
+		require.ErrorIs(t, err, ErrTokenNotJSON)
+		require.NotErrorIs(t, err, ErrTokenNotBase64)
+		require.EqualError(t, err, "invalid character 'c' looking for beginning of object key string")
+
+		var syntax *json.SyntaxError
+		require.ErrorAs(t, err, &syntax)
+	})
+}
+
+func TestPeeringBackend_DecodeAndValidateToken(t *testing.T) {
+	valid := connect.TestCA(t, nil)
+	expired := connect.TestCAWithTTL(t, nil, -time.Hour)
+
+	cases := map[string]struct {
+		roots     []string
+		expectErr bool
+	}{
+		"all valid":   {roots: []string{valid.RootCert, connect.TestCA(t, nil).RootCert}},
+		"mixed":       {roots: []string{expired.RootCert, valid.RootCert}},
+		"all expired": {roots: []string{expired.RootCert, connect.TestCAWithTTL(t, nil, -time.Minute).RootCert}, expectErr: true},
+		"unparseable": {roots: []string{expired.RootCert, "not a cert"}, expectErr: true},
+		"no roots":    {},
+	}
+
+	backend := &PeeringBackend{}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			raw, err := backend.EncodeToken(&structs.PeeringToken{
+				CA:              tc.roots,
+				ServerAddresses: []string{"1.2.3.4:8502"},
+				PeerID:          "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+			})
+			require.NoError(t, err)
+
+			// Decoding alone never checks expiry.
+			_, err = backend.DecodeToken(raw)
+			require.NoError(t, err)
+
+			tok, err := backend.DecodeAndValidateToken(raw)
+			if tc.expectErr {
+				require.ErrorIs(t, err, ErrTokenCARootsExpired)
+				require.Nil(t, tok)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.roots, tok.CA)
+		})
+	}
+}
+
+func TestPeeringBackend_TokenCompression(t *testing.T) {
+	tok := largePeeringToken(t)
+
+	backend := &PeeringBackend{tokenCompression: true, tokenChecksum: true}
+	compressed, err := backend.EncodeToken(tok)
+	require.NoError(t, err)
+
+	plain, err := (&PeeringBackend{}).EncodeToken(tok)
+	require.NoError(t, err)
+	require.Less(t, len(compressed), len(plain))
+
+	// Backends that do not compress must still decode compressed tokens.
+	decoded, err := (&PeeringBackend{}).DecodeToken(compressed)
+	require.NoError(t, err)
+	require.Equal(t, tok, decoded)
+
+	// Uncompressed tokens still decode.
+	decoded, err = backend.DecodeToken(plain)
+	require.NoError(t, err)
+	require.Equal(t, tok, decoded)
+
+	// Small tokens are left uncompressed.
+	small := &structs.PeeringToken{PeerID: "peer", Version: structs.PeeringTokenVersion}
+	raw, err := (&PeeringBackend{tokenCompression: true}).EncodeToken(small)
+	require.NoError(t, err)
+	jsonRaw, err := base64.StdEncoding.DecodeString(string(raw))
+	require.NoError(t, err)
+	require.True(t, json.Valid(jsonRaw))
+}
+
+func BenchmarkPeeringBackend_EncodeToken_Compression(b *testing.B) {
+	tok := largePeeringToken(&testing.T{})
+
+	for _, compress := range []bool{false, true} {
+		backend := &PeeringBackend{tokenCompression: compress}
+		b.Run(fmt.Sprintf("compress=%t", compress), func(b *testing.B) {
+			var raw []byte
+			for n := 0; n < b.N; n++ {
+				var err error
+				raw, err = backend.EncodeToken(tok)
+				if err != nil {
+					b.Fatalf("err: %v", err)
+				}
+			}
+			b.ReportMetric(float64(len(raw)), "token-bytes")
+		})
+	}
+}
+
+func TestPeeringBackend_TokenEncryption(t *testing.T) {
+	tok := largePeeringToken(t)
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	backend := &PeeringBackend{tokenEncryptionKey: key, tokenCompression: true, tokenChecksum: true, tokenVerify: true}
+	encrypted, err := backend.EncodeToken(tok)
+	require.NoError(t, err)
+
+	testutil.RunStep(t, "round trip with the correct key", func(t *testing.T) {
+		decoded, err := backend.DecodeToken(encrypted)
+		require.NoError(t, err)
+		require.Equal(t, tok, decoded)
+
+		// The CA roots are not readable without the key.
+		payload, err := base64.StdEncoding.DecodeString(strings.SplitN(string(encrypted), tokenChecksumSeparator, 2)[0])
+		require.NoError(t, err)
+		require.Equal(t, encryptedTokenHeader, payload[0])
+		require.NotContains(t, string(payload), tok.CA[0])
+	})
+
+	testutil.RunStep(t, "wrong key", func(t *testing.T) {
+		other := &PeeringBackend{tokenEncryptionKey: []byte("fedcba9876543210fedcba9876543210")}
+		_, err := other.DecodeToken(encrypted)
+		require.ErrorIs(t, err, ErrTokenDecryptionFailed)
+	})
+
+	testutil.RunStep(t, "no key", func(t *testing.T) {
+		_, err := (&PeeringBackend{}).DecodeToken(encrypted)
+		require.ErrorIs(t, err, ErrTokenEncrypted)
+	})
+
+	testutil.RunStep(t, "plaintext tokens still decode", func(t *testing.T) {
+		plain, err := (&PeeringBackend{}).EncodeToken(tok)
+		require.NoError(t, err)
+
+		decoded, err := backend.DecodeToken(plain)
+		require.NoError(t, err)
+		require.Equal(t, tok, decoded)
+	})
+
+	testutil.RunStep(t, "invalid key size", func(t *testing.T) {
+		_, err := (&PeeringBackend{tokenEncryptionKey: []byte("short")}).EncodeToken(tok)
+		testutil.RequireErrorContains(t, err, "invalid token encryption key")
+	})
+}
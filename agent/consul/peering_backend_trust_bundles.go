@@ -0,0 +1,173 @@
+package consul
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/proto/pbpeering"
+)
+
+// RegisterTrustBundleValidator adds a validator that every trust bundle must
+// pass before PeeringTrustBundleWrite commits it.
+func (b *PeeringBackend) RegisterTrustBundleValidator(fn TrustBundleValidator) {
+	b.trustBundleValidatorsLock.Lock()
+	b.trustBundleValidators = append(b.trustBundleValidators, fn)
+	b.trustBundleValidatorsLock.Unlock()
+}
+
+func (b *PeeringBackend) validateTrustBundle(bundle *pbpeering.PeeringTrustBundle) error {
+	b.trustBundleValidatorsLock.RLock()
+	defer b.trustBundleValidatorsLock.RUnlock()
+
+	for _, fn := range b.trustBundleValidators {
+		if err := fn(bundle); err != nil {
+			return fmt.Errorf("trust bundle for peer %q failed validation: %w", bundle.GetPeerName(), err)
+		}
+	}
+	return nil
+}
+
+// PeeringTrustDomainMismatchPolicy controls what happens when a peer sends a
+// trust bundle whose trust domain differs from the one we expect for it.
+type PeeringTrustDomainMismatchPolicy string
+
+const (
+	// PeeringTrustDomainMismatchReject rejects the trust bundle. This is the
+	// default.
+	PeeringTrustDomainMismatchReject PeeringTrustDomainMismatchPolicy = "strict-reject"
+
+	// PeeringTrustDomainMismatchWarn logs a warning and stores the trust
+	// bundle with the new trust domain.
+	PeeringTrustDomainMismatchWarn PeeringTrustDomainMismatchPolicy = "warn-and-update"
+)
+
+// ErrPeeringTrustDomainMismatch is returned when a peer's trust bundle is
+// rejected because its trust domain is not the one expected for the peer.
+var ErrPeeringTrustDomainMismatch = errors.New("peer presented an unexpected trust domain")
+
+// expectedPeerTrustDomain returns the trust domain we expect the named peer
+// to present, or "" if there is nothing to compare against. For dialing
+// peerings it is taken from the server name in the peering token, otherwise
+// from the last trust bundle stored for the peer.
+func (b *PeeringBackend) expectedPeerTrustDomain(peerName, partition string) (string, error) {
+	peering, err := b.peeringRead(peerName, acl.PartitionOrDefault(partition))
+	if err != nil {
+		return "", err
+	}
+	const sanInfix = ".peering."
+	if idx := strings.Index(peering.GetPeerServerName(), sanInfix); idx >= 0 {
+		return peering.PeerServerName[idx+len(sanInfix):], nil
+	}
+
+	_, bundle, err := b.srv.PeeringState().PeeringTrustBundleRead(nil, state.Query{
+		Value:          peerName,
+		EnterpriseMeta: *structs.NodeEnterpriseMetaInPartition(partition),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read trust bundle for peering %q: %w", peerName, err)
+	}
+	return bundle.GetTrustDomain(), nil
+}
+
+// checkTrustDomain applies the configured PeeringTrustDomainMismatchPolicy
+// to a trust bundle received from a peer.
+func (b *PeeringBackend) checkTrustDomain(bundle *pbpeering.PeeringTrustBundle) error {
+	expected, err := b.expectedPeerTrustDomain(bundle.GetPeerName(), bundle.GetPartition())
+	if err != nil {
+		return err
+	}
+	if expected == "" || strings.EqualFold(expected, bundle.GetTrustDomain()) {
+		return nil
+	}
+
+	if b.srv.PeeringConfig().PeeringTrustDomainMismatchPolicy == PeeringTrustDomainMismatchWarn {
+		b.log().Warn("peer presented an unexpected trust domain, updating trust bundle",
+			"peer_name", bundle.GetPeerName(),
+			"expected", expected,
+			"presented", bundle.GetTrustDomain(),
+		)
+		return nil
+	}
+	return fmt.Errorf("%w: expected %q for peer %q, got %q",
+		ErrPeeringTrustDomainMismatch, expected, bundle.GetPeerName(), bundle.GetTrustDomain())
+}
+
+func (b *PeeringBackend) PeeringTrustBundleWrite(req *pbpeering.PeeringTrustBundleWriteRequest) error {
+	if err := b.validateTrustBundle(req.PeeringTrustBundle); err != nil {
+		return err
+	}
+	if err := b.checkTrustDomain(req.PeeringTrustBundle); err != nil {
+		return err
+	}
+	req, err := b.mergeTrustBundle(req)
+	if err != nil {
+		return err
+	}
+	if _, err := b.srv.PeeringRaftApply(structs.PeeringTrustBundleWriteType, req); err != nil {
+		b.log().Error("peering trust bundle write failed", "peering_name", req.PeeringTrustBundle.GetPeerName(), "error", err)
+		return fmt.Errorf("peering trust bundle write failed: %w", err)
+	}
+	return nil
+}
+
+// mergeTrustBundle returns a copy of req whose CA roots are deduplicated by
+// their normalized PEM content. Roots that match one already stored for the
+// peer keep the stored encoding, so that re-sending the same roots with
+// different whitespace does not change the stored bundle. Stored roots that
+// are missing from req are not kept, since the peer has rotated them out.
+func (b *PeeringBackend) mergeTrustBundle(req *pbpeering.PeeringTrustBundleWriteRequest) (*pbpeering.PeeringTrustBundleWriteRequest, error) {
+	bundle := req.GetPeeringTrustBundle()
+	if bundle == nil {
+		return req, nil
+	}
+	_, stored, err := b.srv.PeeringState().PeeringTrustBundleRead(nil, state.Query{
+		Value:          bundle.PeerName,
+		EnterpriseMeta: *structs.NodeEnterpriseMetaInPartition(bundle.Partition),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust bundle for peer %q: %w", bundle.PeerName, err)
+	}
+
+	storedPEMs := make(map[string]string)
+	for _, root := range stored.GetRootPEMs() {
+		storedPEMs[normalizeRootPEM(root)] = root
+	}
+
+	roots := make([]string, 0, len(bundle.RootPEMs))
+	seen := make(map[string]struct{})
+	for _, root := range bundle.RootPEMs {
+		key := normalizeRootPEM(root)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if existing, ok := storedPEMs[key]; ok {
+			root = existing
+		}
+		roots = append(roots, root)
+	}
+
+	merged, ok := proto.Clone(req).(*pbpeering.PeeringTrustBundleWriteRequest)
+	if !ok {
+		return nil, fmt.Errorf("invalid type %T, expected *pbpeering.PeeringTrustBundleWriteRequest", req)
+	}
+	merged.PeeringTrustBundle.RootPEMs = roots
+	return merged, nil
+}
+
+// normalizeRootPEM returns a key that is equal for PEM encodings of the same
+// certificate. PEMs that cannot be decoded are compared by their trimmed text.
+func normalizeRootPEM(rootPEM string) string {
+	block, _ := pem.Decode([]byte(rootPEM))
+	if block == nil {
+		return strings.TrimSpace(rootPEM)
+	}
+	return string(block.Bytes)
+}
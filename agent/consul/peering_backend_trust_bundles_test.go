@@ -0,0 +1,135 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/proto/pbpeering"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeeringBackend_TrustBundleValidators(t *testing.T) {
+	// The validators run before the raft apply, so a backend without a server
+	// is enough to exercise the rejection path.
+	backend := &PeeringBackend{}
+
+	var seen []string
+	backend.RegisterTrustBundleValidator(func(bundle *pbpeering.PeeringTrustBundle) error {
+		seen = append(seen, bundle.PeerName)
+		return nil
+	})
+	backend.RegisterTrustBundleValidator(func(bundle *pbpeering.PeeringTrustBundle) error {
+		return fmt.Errorf("issuer not approved")
+	})
+
+	err := backend.PeeringTrustBundleWrite(&pbpeering.PeeringTrustBundleWriteRequest{
+		PeeringTrustBundle: &pbpeering.PeeringTrustBundle{PeerName: "my-peer"},
+	})
+	testutil.RequireErrorContains(t, err, `trust bundle for peer "my-peer" failed validation: issuer not approved`)
+	require.Equal(t, []string{"my-peer"}, seen)
+}
+
+func TestPeeringBackend_TrustBundleWriteDedupes(t *testing.T) {
+	srv, backend := newTestPeeringBackend(t)
+
+	rootA := connect.TestCA(t, nil).RootCert
+	rootB := connect.TestCA(t, nil).RootCert
+	rootC := connect.TestCA(t, nil).RootCert
+	// The same certificate as rootA, re-encoded with different line endings.
+	rootAReencoded := strings.ReplaceAll(rootA, "\n", "\r\n") + "\n"
+
+	write := func(roots ...string) {
+		require.NoError(t, backend.PeeringTrustBundleWrite(&pbpeering.PeeringTrustBundleWriteRequest{
+			PeeringTrustBundle: &pbpeering.PeeringTrustBundle{
+				PeerName:    "my-peer",
+				TrustDomain: "peer.consul",
+				RootPEMs:    roots,
+			},
+		}))
+	}
+	storedRoots := func() []string {
+		_, bundle, err := srv.fsm.State().PeeringTrustBundleRead(nil, state.Query{Value: "my-peer"})
+		require.NoError(t, err)
+		require.NotNil(t, bundle)
+		return bundle.RootPEMs
+	}
+
+	testutil.RunStep(t, "duplicates in one write", func(t *testing.T) {
+		write(rootA, rootB, rootAReencoded, rootB)
+		require.Equal(t, []string{rootA, rootB}, storedRoots())
+	})
+
+	testutil.RunStep(t, "overlapping writes", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			write(rootB, rootC, rootAReencoded)
+			// rootA keeps its stored encoding.
+			require.Equal(t, []string{rootB, rootC, rootA}, storedRoots())
+		}
+	})
+
+	testutil.RunStep(t, "rotated out roots are dropped", func(t *testing.T) {
+		write(rootC)
+		require.Equal(t, []string{rootC}, storedRoots())
+	})
+}
+
+func TestPeeringBackend_TrustDomainMismatchPolicy(t *testing.T) {
+	const (
+		expected = "11111111-2222-3333-4444-555555555555.consul"
+		changed  = "66666666-7777-8888-9999-000000000000.consul"
+	)
+
+	cases := map[string]struct {
+		policy  PeeringTrustDomainMismatchPolicy
+		applied bool
+	}{
+		"default":         {policy: "", applied: false},
+		"strict-reject":   {policy: PeeringTrustDomainMismatchReject, applied: false},
+		"warn-and-update": {policy: PeeringTrustDomainMismatchWarn, applied: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			if tc.policy != "" {
+				cfg.PeeringTrustDomainMismatchPolicy = tc.policy
+			}
+			srv := &mockPeeringBackendServer{config: cfg, store: state.NewStateStore(nil)}
+			backend := NewPeeringBackend(srv)
+
+			require.NoError(t, srv.store.PeeringWrite(10, &pbpeering.PeeringWriteRequest{
+				Peering: &pbpeering.Peering{
+					ID:             "9e650110-ac74-4c5a-a6a8-9348b2bed4e9",
+					Name:           "my-peer",
+					PeerServerName: "server.dc2.peering." + expected,
+				},
+			}))
+			write := func(trustDomain string) error {
+				return backend.PeeringTrustBundleWrite(&pbpeering.PeeringTrustBundleWriteRequest{
+					PeeringTrustBundle: &pbpeering.PeeringTrustBundle{
+						TrustDomain: trustDomain,
+						PeerName:    "my-peer",
+						RootPEMs:    []string{"root"},
+					},
+				})
+			}
+
+			// A matching trust domain is always accepted, regardless of case.
+			require.NoError(t, write(strings.ToUpper(expected)))
+			require.Len(t, srv.applied, 1)
+
+			err := write(changed)
+			if tc.applied {
+				require.NoError(t, err)
+				require.Len(t, srv.applied, 2)
+			} else {
+				require.ErrorIs(t, err, ErrPeeringTrustDomainMismatch)
+				require.Contains(t, err.Error(), changed)
+				require.Len(t, srv.applied, 1)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package consul
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+// TokenCodec serializes peering tokens to and from the bytes handed to
+// operators. PeeringBackend layers version handling and validation on top of
+// the codec, so codecs only deal with the representation of the token. The
+// optional checksum is only added to tokens of the default codec, so other
+// codecs may produce any bytes.
+type TokenCodec interface {
+	Encode(tok *structs.PeeringToken) ([]byte, error)
+	Decode(raw []byte) (*structs.PeeringToken, error)
+}
+
+// base64JSONTokenCodec is the default TokenCodec. It encodes tokens as
+// base64-encoded JSON, gzipping the JSON first when compress is set and the
+// token is larger than peeringTokenCompressThreshold. Compressed tokens are
+// always accepted on decode. When key is set the (possibly compressed) JSON
+// is AES-GCM-encrypted with it before base64 encoding; unencrypted tokens are
+// still accepted on decode.
+type base64JSONTokenCodec struct {
+	compress bool
+	key      []byte
+}
+
+var _ TokenCodec = base64JSONTokenCodec{}
+
+func (c base64JSONTokenCodec) Encode(tok *structs.PeeringToken) ([]byte, error) {
+	jsonToken, err := json.Marshal(tok)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal token: %w", err)
+	}
+	if c.compress && len(jsonToken) > peeringTokenCompressThreshold {
+		jsonToken, err = compressToken(jsonToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress token: %w", err)
+		}
+	}
+	if len(c.key) > 0 {
+		jsonToken, err = encryptToken(c.key, jsonToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt token: %w", err)
+		}
+	}
+	return []byte(base64.StdEncoding.EncodeToString(jsonToken)), nil
+}
+
+func (c base64JSONTokenCodec) Decode(raw []byte) (*structs.PeeringToken, error) {
+	tokJSONRaw, err := base64.StdEncoding.DecodeString(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode token: %w", &tokenFormatError{kind: ErrTokenNotBase64, err: err})
+	}
+	if len(tokJSONRaw) > 0 && tokJSONRaw[0] == encryptedTokenHeader {
+		if len(c.key) == 0 {
+			return nil, ErrTokenEncrypted
+		}
+		tokJSONRaw, err = decryptToken(c.key, tokJSONRaw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if bytes.HasPrefix(tokJSONRaw, gzipMagic) {
+		tokJSONRaw, err = decompressToken(tokJSONRaw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress token: %w", err)
+		}
+	}
+	var tok structs.PeeringToken
+	if err := json.Unmarshal(tokJSONRaw, &tok); err != nil {
+		return nil, &tokenFormatError{kind: ErrTokenNotJSON, err: err}
+	}
+	return &tok, nil
+}
+
+// encryptedTokenHeader prefixes the payload of encrypted tokens. Plaintext
+// payloads begin with '{' or gzipMagic, so the three can never be confused.
+const encryptedTokenHeader byte = 0x01
+
+// encryptToken seals payload with AES-GCM under key, returning the header
+// byte followed by the nonce and ciphertext. The header is authenticated as
+// additional data.
+func encryptToken(key, payload []byte) ([]byte, error) {
+	gcm, err := newTokenGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 1+gcm.NonceSize(), 1+gcm.NonceSize()+len(payload)+gcm.Overhead())
+	out[0] = encryptedTokenHeader
+	if _, err := rand.Read(out[1:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return gcm.Seal(out, out[1:], payload, out[:1]), nil
+}
+
+// decryptToken reverses encryptToken.
+func decryptToken(key, sealed []byte) ([]byte, error) {
+	gcm, err := newTokenGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 1+gcm.NonceSize() {
+		return nil, ErrTokenDecryptionFailed
+	}
+	nonce, ciphertext := sealed[1:1+gcm.NonceSize()], sealed[1+gcm.NonceSize():]
+	payload, err := gcm.Open(nil, nonce, ciphertext, sealed[:1])
+	if err != nil {
+		return nil, ErrTokenDecryptionFailed
+	}
+	return payload, nil
+}
+
+func newTokenGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
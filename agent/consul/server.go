@@ -407,6 +407,9 @@ func NewServer(config *Config, flat Deps, externalGRPCServer *grpc.Server) (*Ser
 	if err := config.CheckACL(); err != nil {
 		return nil, err
 	}
+	if err := config.CheckPeering(); err != nil {
+		return nil, err
+	}
 
 	// Create the tombstone GC.
 	gc, err := state.NewTombstoneGC(config.TombstoneTTL, config.TombstoneTTLGranularity)
@@ -741,6 +744,7 @@ func NewServer(config *Config, flat Deps, externalGRPCServer *grpc.Server) (*Ser
 	}).Register(s.externalGRPCServer)
 
 	s.peeringBackend = NewPeeringBackend(s)
+	go s.peeringBackend.Run(&lib.StopChannelContext{StopCh: s.shutdownCh})
 	s.peerStreamServer = peerstream.NewServer(peerstream.Config{
 		Backend:        s.peeringBackend,
 		GetStore:       func() peerstream.StateStore { return s.FSM().State() },
@@ -823,9 +827,11 @@ func newGRPCHandlerFromConfig(deps Deps, config *Config, s *Server) connHandler
 			}
 			return s.ForwardGRPC(s.grpcConnPool, info, fn)
 		},
-		Datacenter:     config.Datacenter,
-		ConnectEnabled: config.ConnectEnabled,
-		PeeringEnabled: config.PeeringEnabled,
+		Datacenter:      config.Datacenter,
+		ConnectEnabled:  config.ConnectEnabled,
+		PeeringEnabled:  config.PeeringEnabled,
+		OperatorContact: config.PeeringOperatorContact,
+		ClusterName:     config.PeeringClusterName,
 	})
 	s.peeringServer = p
 
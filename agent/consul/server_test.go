@@ -184,6 +184,7 @@ func testServerConfig(t *testing.T) (string, *Config) {
 		},
 	}
 	config.PeeringEnabled = true
+	config.PeeringTokenVerifyEncoding = true
 	return dir, config
 }
 
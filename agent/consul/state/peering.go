@@ -21,8 +21,18 @@ const (
 	tablePeeringTrustBundles = "peering-trust-bundles"
 	tablePeeringSecrets      = "peering-secrets"
 	tablePeeringSecretUUIDs  = "peering-secret-uuids"
+
+	indexSecretID = "secret-id"
 )
 
+// ErrPeeringSecretsCASConflict is returned by a check-and-set secrets write
+// when the stored establishment secret no longer matches the expected one.
+var ErrPeeringSecretsCASConflict = errors.New("peering establishment secret was modified concurrently")
+
+// ErrPeeringCASConflict is returned by a check-and-set peering write when the
+// stored peering's ModifyIndex no longer matches the expected one.
+var ErrPeeringCASConflict = errors.New("peering was modified concurrently")
+
 func peeringTableSchema() *memdb.TableSchema {
 	return &memdb.TableSchema{
 		Name: tablePeering,
@@ -90,6 +100,15 @@ func peeringSecretsTableSchema() *memdb.TableSchema {
 					writeIndex: indexIDFromPeeringSecret,
 				},
 			},
+			indexSecretID: {
+				Name:         indexSecretID,
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: indexerMulti[string, *pbpeering.PeeringSecrets]{
+					readIndex:       indexFromUUIDString,
+					writeIndexMulti: multiIndexSecretIDsFromPeeringSecret,
+				},
+			},
 		},
 	}
 }
@@ -125,6 +144,35 @@ func indexIDFromPeeringSecret(p *pbpeering.PeeringSecrets) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// multiIndexSecretIDsFromPeeringSecret indexes the peering secrets by every
+// secret ID they hold, including used establishment secrets, so that the
+// owner of a secret can be looked up. Dialing peers store secrets chosen by
+// the remote peer, so IDs that are not UUIDs, which can never be looked up,
+// are left out rather than failing the write.
+func multiIndexSecretIDsFromPeeringSecret(p *pbpeering.PeeringSecrets) ([][]byte, error) {
+	ids := append([]string{
+		p.GetEstablishment().GetSecretID(),
+		p.GetStream().GetPendingSecretID(),
+		p.GetStream().GetActiveSecretID(),
+	}, p.GetUsedEstablishmentSecretIDs()...)
+
+	var vals [][]byte
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		v, err := indexFromUUIDString(id)
+		if err != nil {
+			continue
+		}
+		vals = append(vals, v)
+	}
+	if len(vals) == 0 {
+		return nil, errMissingValueForIndex
+	}
+	return vals, nil
+}
+
 func indexIDFromPeering(p *pbpeering.Peering) ([]byte, error) {
 	if p.ID == "" {
 		return nil, errMissingValueForIndex
@@ -263,6 +311,10 @@ func (s *Store) peeringSecretsWriteTxn(tx WriteTxn, req *pbpeering.SecretsWriteR
 	// Collect any overwritten UUIDs for deletion.
 	switch r := req.Request.(type) {
 	case *pbpeering.SecretsWriteRequest_GenerateToken:
+		if r.GenerateToken.GetCas() && existing.GetEstablishment().GetSecretID() != r.GenerateToken.GetPreviousEstablishmentSecret() {
+			return ErrPeeringSecretsCASConflict
+		}
+
 		// Store the newly-generated establishment secret, overwriting any that existed.
 		secrets.Establishment = &pbpeering.PeeringSecrets_Establishment{
 			SecretID: r.GenerateToken.GetEstablishmentSecret(),
@@ -272,6 +324,7 @@ func (s *Store) peeringSecretsWriteTxn(tx WriteTxn, req *pbpeering.SecretsWriteR
 		// This is to avoid invalidating stream secrets when a new peering token
 		// is generated.
 		secrets.Stream = existing.GetStream()
+		secrets.UsedEstablishmentSecretIDs = existing.GetUsedEstablishmentSecretIDs()
 
 		// When a new token is generated we replace any un-used establishment secrets.
 		if existingEstablishment := existing.GetEstablishment().GetSecretID(); existingEstablishment != "" {
@@ -290,6 +343,7 @@ func (s *Store) peeringSecretsWriteTxn(tx WriteTxn, req *pbpeering.SecretsWriteR
 			// Avoid invalidating existing active secrets when exchanging establishment secret for pending.
 			ActiveSecretID: existing.GetStream().GetActiveSecretID(),
 		}
+		secrets.UsedEstablishmentSecretIDs = append([]string(nil), existing.GetUsedEstablishmentSecretIDs()...)
 
 		// When exchanging an establishment secret we invalidate the existing establishment secret.
 		existingEstablishment := existing.GetEstablishment().GetSecretID()
@@ -305,6 +359,11 @@ func (s *Store) peeringSecretsWriteTxn(tx WriteTxn, req *pbpeering.SecretsWriteR
 			// we must not proceed because a newer one was generated.
 			return fmt.Errorf("invalid establishment secret")
 
+		case peering.OneTimeTokens():
+			// Secrets of one-time tokens are burned rather than freed, so that
+			// they are never handed out again and their reuse is recognized.
+			secrets.UsedEstablishmentSecretIDs = append(secrets.UsedEstablishmentSecretIDs, existingEstablishment)
+
 		default:
 			toDelete = append(toDelete, existingEstablishment)
 		}
@@ -336,6 +395,7 @@ func (s *Store) peeringSecretsWriteTxn(tx WriteTxn, req *pbpeering.SecretsWriteR
 
 		// Avoid invalidating existing establishment secrets when promoting pending secrets.
 		secrets.Establishment = existing.GetEstablishment()
+		secrets.UsedEstablishmentSecretIDs = existing.GetUsedEstablishmentSecretIDs()
 
 		// If there was previously an active stream secret it gets replaced in favor of the pending secret
 		// that is being promoted.
@@ -406,6 +466,7 @@ func peeringSecretsDeleteTxn(tx WriteTxn, peerID string, dialer bool) error {
 	if active := secrets.GetStream().GetActiveSecretID(); active != "" {
 		toDelete = append(toDelete, active)
 	}
+	toDelete = append(toDelete, secrets.GetUsedEstablishmentSecretIDs()...)
 	for _, id := range toDelete {
 		if err := tx.Delete(tablePeeringSecretUUIDs, id); err != nil {
 			return fmt.Errorf("failed to free UUID: %w", err)
@@ -436,6 +497,26 @@ func validateProposedPeeringSecretUUIDTxn(tx ReadTxn, secretID string) (bool, er
 	return secret == "", nil
 }
 
+// PeeringSecretOwner returns the ID of the peering whose secrets include the
+// given secret ID, or an empty string if no peering holds it.
+func (s *Store) PeeringSecretOwner(secretID string) (string, error) {
+	tx := s.db.ReadTxn()
+	defer tx.Abort()
+
+	raw, err := tx.First(tablePeeringSecrets, indexSecretID, secretID)
+	if err != nil {
+		return "", fmt.Errorf("failed peering secrets lookup: %w", err)
+	}
+	if raw == nil {
+		return "", nil
+	}
+	secrets, ok := raw.(*pbpeering.PeeringSecrets)
+	if !ok {
+		return "", fmt.Errorf("invalid type %T", raw)
+	}
+	return secrets.PeerID, nil
+}
+
 func (s *Store) PeeringReadByID(ws memdb.WatchSet, id string) (uint64, *pbpeering.Peering, error) {
 	tx := s.db.ReadTxn()
 	defer tx.Abort()
@@ -551,6 +632,10 @@ func (s *Store) PeeringWrite(idx uint64, req *pbpeering.PeeringWriteRequest) err
 		return err
 	}
 
+	if req.ExpectedModifyIndex != 0 && existing.GetModifyIndex() != req.ExpectedModifyIndex {
+		return ErrPeeringCASConflict
+	}
+
 	if existing != nil {
 		if req.Peering.ShouldDial() != existing.ShouldDial() {
 			return fmt.Errorf("Cannot switch peering dialing mode from %t to %t", existing.ShouldDial(), req.Peering.ShouldDial())
@@ -1226,6 +1311,7 @@ func (r *Restore) PeeringSecrets(p *pbpeering.PeeringSecrets) error {
 	if active := p.GetStream().GetActiveSecretID(); active != "" {
 		uuids = append(uuids, active)
 	}
+	uuids = append(uuids, p.GetUsedEstablishmentSecretIDs()...)
 
 	for _, id := range uuids {
 		if err := r.tx.Insert(tablePeeringSecretUUIDs, id); err != nil {
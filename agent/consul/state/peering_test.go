@@ -77,6 +77,7 @@ func insertTestPeeringSecret(t *testing.T, s *Store, secret *pbpeering.PeeringSe
 	if active := secret.GetStream().GetActiveSecretID(); active != "" {
 		uuids = append(uuids, active)
 	}
+	uuids = append(uuids, secret.GetUsedEstablishmentSecretIDs()...)
 
 	// Dialing peers do not track secret UUIDs because they don't generate them.
 	if !dialer {
@@ -277,6 +278,7 @@ func TestStore_PeeringSecretsWrite(t *testing.T) {
 			if active := seed.secrets.GetStream().GetActiveSecretID(); active != "" {
 				toInsert = append(toInsert, active)
 			}
+			toInsert = append(toInsert, seed.secrets.GetUsedEstablishmentSecretIDs()...)
 			for _, id := range toInsert {
 				require.NoError(t, tx.Insert(tablePeeringSecretUUIDs, id))
 			}
@@ -514,6 +516,64 @@ func TestStore_PeeringSecretsWrite(t *testing.T) {
 			},
 			expectUUIDs: []string{testSecretTwo},
 		},
+		{
+			name: "check-and-set replaces the expected establishment secret",
+			seed: &testSeed{
+				peering: &pbpeering.Peering{
+					Name: "foo",
+					ID:   testFooPeerID,
+				},
+				secrets: &pbpeering.PeeringSecrets{
+					PeerID: testFooPeerID,
+					Establishment: &pbpeering.PeeringSecrets_Establishment{
+						SecretID: testSecretOne,
+					},
+				},
+			},
+			input: &pbpeering.SecretsWriteRequest{
+				PeerID: testFooPeerID,
+				Request: &pbpeering.SecretsWriteRequest_GenerateToken{
+					GenerateToken: &pbpeering.SecretsWriteRequest_GenerateTokenRequest{
+						EstablishmentSecret:         testSecretTwo,
+						Cas:                         true,
+						PreviousEstablishmentSecret: testSecretOne,
+					},
+				},
+			},
+			expect: &pbpeering.PeeringSecrets{
+				PeerID: testFooPeerID,
+				Establishment: &pbpeering.PeeringSecrets_Establishment{
+					SecretID: testSecretTwo,
+				},
+			},
+			expectUUIDs: []string{testSecretTwo},
+		},
+		{
+			name: "check-and-set conflicts with a concurrently replaced establishment secret",
+			seed: &testSeed{
+				peering: &pbpeering.Peering{
+					Name: "foo",
+					ID:   testFooPeerID,
+				},
+				secrets: &pbpeering.PeeringSecrets{
+					PeerID: testFooPeerID,
+					Establishment: &pbpeering.PeeringSecrets_Establishment{
+						SecretID: testSecretThree,
+					},
+				},
+			},
+			input: &pbpeering.SecretsWriteRequest{
+				PeerID: testFooPeerID,
+				Request: &pbpeering.SecretsWriteRequest_GenerateToken{
+					GenerateToken: &pbpeering.SecretsWriteRequest_GenerateTokenRequest{
+						EstablishmentSecret:         testSecretTwo,
+						Cas:                         true,
+						PreviousEstablishmentSecret: testSecretOne,
+					},
+				},
+			},
+			expectErr: ErrPeeringSecretsCASConflict.Error(),
+		},
 		{
 			name: "cannot exchange secret without existing secrets",
 			seed: &testSeed{
@@ -616,6 +676,76 @@ func TestStore_PeeringSecretsWrite(t *testing.T) {
 			// Establishment secret testSecretOne is discarded when exchanging for a stream secret
 			expectUUIDs: []string{testSecretTwo},
 		},
+		{
+			name: "exchange secret burns one-time establishment secret",
+			seed: &testSeed{
+				peering: &pbpeering.Peering{
+					Name: "foo",
+					ID:   testFooPeerID,
+					Meta: map[string]string{pbpeering.MetaKeyOneTimeTokens: "true"},
+				},
+				secrets: &pbpeering.PeeringSecrets{
+					PeerID: testFooPeerID,
+					Establishment: &pbpeering.PeeringSecrets_Establishment{
+						SecretID: testSecretOne,
+					},
+				},
+			},
+			input: &pbpeering.SecretsWriteRequest{
+				PeerID: testFooPeerID,
+				Request: &pbpeering.SecretsWriteRequest_ExchangeSecret{
+					ExchangeSecret: &pbpeering.SecretsWriteRequest_ExchangeSecretRequest{
+						EstablishmentSecret: testSecretOne,
+						PendingStreamSecret: testSecretTwo,
+					},
+				},
+			},
+			expect: &pbpeering.PeeringSecrets{
+				PeerID: testFooPeerID,
+				Stream: &pbpeering.PeeringSecrets_Stream{
+					PendingSecretID: testSecretTwo,
+				},
+				UsedEstablishmentSecretIDs: []string{testSecretOne},
+			},
+			// The burned establishment secret stays reserved so that it can never be reissued.
+			expectUUIDs: []string{testSecretOne, testSecretTwo},
+		},
+		{
+			name: "generate new token keeps burned establishment secrets",
+			seed: &testSeed{
+				peering: &pbpeering.Peering{
+					Name: "foo",
+					ID:   testFooPeerID,
+					Meta: map[string]string{pbpeering.MetaKeyOneTimeTokens: "true"},
+				},
+				secrets: &pbpeering.PeeringSecrets{
+					PeerID: testFooPeerID,
+					Stream: &pbpeering.PeeringSecrets_Stream{
+						ActiveSecretID: testSecretTwo,
+					},
+					UsedEstablishmentSecretIDs: []string{testSecretOne},
+				},
+			},
+			input: &pbpeering.SecretsWriteRequest{
+				PeerID: testFooPeerID,
+				Request: &pbpeering.SecretsWriteRequest_GenerateToken{
+					GenerateToken: &pbpeering.SecretsWriteRequest_GenerateTokenRequest{
+						EstablishmentSecret: testSecretThree,
+					},
+				},
+			},
+			expect: &pbpeering.PeeringSecrets{
+				PeerID: testFooPeerID,
+				Establishment: &pbpeering.PeeringSecrets_Establishment{
+					SecretID: testSecretThree,
+				},
+				Stream: &pbpeering.PeeringSecrets_Stream{
+					ActiveSecretID: testSecretTwo,
+				},
+				UsedEstablishmentSecretIDs: []string{testSecretOne},
+			},
+			expectUUIDs: []string{testSecretOne, testSecretTwo, testSecretThree},
+		},
 		{
 			name: "exchange secret replaces pending stream secret",
 			seed: &testSeed{
@@ -773,11 +903,65 @@ func TestStore_PeeringSecretsWrite(t *testing.T) {
 	}
 }
 
+func TestStore_PeeringSecretOwner(t *testing.T) {
+	const (
+		establishmentID = "b4b9cbae-4bbd-454b-b7ae-441a5c89c3b9"
+		pendingID       = "0ba06390-bd77-4c52-8397-f88c0867157d"
+		activeID        = "0b8a3817-aca0-4c06-94b6-b0763a5cd013"
+		usedID          = "5c4e2ba4-3f6d-4ab3-9f0e-51c1dbd9a6b2"
+	)
+
+	s := NewStateStore(nil)
+	insertTestPeerings(t, s)
+	insertTestPeeringSecret(t, s, &pbpeering.PeeringSecrets{
+		PeerID: testFooPeerID,
+		Establishment: &pbpeering.PeeringSecrets_Establishment{
+			SecretID: establishmentID,
+		},
+		Stream: &pbpeering.PeeringSecrets_Stream{
+			PendingSecretID: pendingID,
+			ActiveSecretID:  activeID,
+		},
+		UsedEstablishmentSecretIDs: []string{usedID},
+	}, false)
+
+	for _, id := range []string{establishmentID, pendingID, activeID, usedID} {
+		owner, err := s.PeeringSecretOwner(id)
+		require.NoError(t, err)
+		require.Equal(t, testFooPeerID, owner)
+	}
+
+	owner, err := s.PeeringSecretOwner(testUUID())
+	require.NoError(t, err)
+	require.Empty(t, owner)
+
+	// Replaced secrets are no longer owned.
+	insertTestPeeringSecret(t, s, &pbpeering.PeeringSecrets{
+		PeerID: testFooPeerID,
+		Stream: &pbpeering.PeeringSecrets_Stream{
+			ActiveSecretID: activeID,
+		},
+	}, false)
+	owner, err = s.PeeringSecretOwner(establishmentID)
+	require.NoError(t, err)
+	require.Empty(t, owner)
+	owner, err = s.PeeringSecretOwner(activeID)
+	require.NoError(t, err)
+	require.Equal(t, testFooPeerID, owner)
+
+	// Nor are the secrets of deleted peerings.
+	require.NoError(t, s.PeeringSecretsDelete(10, testFooPeerID, false))
+	owner, err = s.PeeringSecretOwner(activeID)
+	require.NoError(t, err)
+	require.Empty(t, owner)
+}
+
 func TestStore_PeeringSecretsDelete(t *testing.T) {
 	const (
 		establishmentID = "b4b9cbae-4bbd-454b-b7ae-441a5c89c3b9"
 		pendingID       = "0ba06390-bd77-4c52-8397-f88c0867157d"
 		activeID        = "0b8a3817-aca0-4c06-94b6-b0763a5cd013"
+		usedID          = "5c4e2ba4-3f6d-4ab3-9f0e-51c1dbd9a6b2"
 	)
 
 	type testCase struct {
@@ -798,7 +982,7 @@ func TestStore_PeeringSecretsDelete(t *testing.T) {
 		require.NoError(t, err)
 		require.Nil(t, secrets)
 
-		uuids := []string{establishmentID, pendingID, activeID}
+		uuids := []string{establishmentID, pendingID, activeID, usedID}
 		for _, id := range uuids {
 			free, err := s.ValidateProposedPeeringSecretUUID(id)
 			require.NoError(t, err)
@@ -818,6 +1002,7 @@ func TestStore_PeeringSecretsDelete(t *testing.T) {
 					PendingSecretID: pendingID,
 					ActiveSecretID:  activeID,
 				},
+				UsedEstablishmentSecretIDs: []string{usedID},
 			},
 		},
 		"dialer": {
@@ -1243,6 +1428,48 @@ func TestStore_PeeringWrite(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "check-and-set conflicts with a concurrent write to baz",
+			input: &pbpeering.PeeringWriteRequest{
+				Peering: &pbpeering.Peering{
+					ID:                  testBazPeerID,
+					Name:                "baz",
+					State:               pbpeering.PeeringState_ACTIVE,
+					PeerServerAddresses: []string{"localhost:8502"},
+					Partition:           structs.NodeEnterpriseMetaInDefaultPartition().PartitionOrEmpty(),
+				},
+				ExpectedModifyIndex: 9,
+			},
+			expect: expectations{
+				err: ErrPeeringCASConflict.Error(),
+			},
+		},
+		{
+			name: "check-and-set update baz",
+			input: &pbpeering.PeeringWriteRequest{
+				Peering: &pbpeering.Peering{
+					ID:                  testBazPeerID,
+					Name:                "baz",
+					State:               pbpeering.PeeringState_FAILING,
+					PeerServerAddresses: []string{"localhost:8502"},
+					Partition:           structs.NodeEnterpriseMetaInDefaultPartition().PartitionOrEmpty(),
+				},
+				ExpectedModifyIndex: 10,
+			},
+			expect: expectations{
+				peering: &pbpeering.Peering{
+					ID:    testBazPeerID,
+					Name:  "baz",
+					State: pbpeering.PeeringState_FAILING,
+				},
+				secrets: &pbpeering.PeeringSecrets{
+					PeerID: testBazPeerID,
+					Stream: &pbpeering.PeeringSecrets_Stream{
+						ActiveSecretID: testBazSecretID,
+					},
+				},
+			},
+		},
 		{
 			name: "if no state was included in request it is inherited from existing",
 			input: &pbpeering.PeeringWriteRequest{
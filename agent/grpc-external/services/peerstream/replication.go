@@ -334,35 +334,33 @@ func (s *Server) handleUpdateService(
 	// Normalize the data into a convenient form for operation.
 	snap := newHealthSnapshot(structsNodes, partition, peerName)
 
+	// Register each node, then all services on that node, then all checks on
+	// that node. The backend coalesces these into as few raft applies as it can.
+	var reqs []*structs.RegisterRequest
 	for _, nodeSnap := range snap.Nodes {
-		// First register the node
-		req := nodeSnap.Node.ToRegisterRequest()
-		if err := s.Backend.CatalogRegister(&req); err != nil {
-			return fmt.Errorf("failed to register node: %w", err)
-		}
+		nodeReq := nodeSnap.Node.ToRegisterRequest()
+		reqs = append(reqs, &nodeReq)
 
-		// Then register all services on that node
-		for _, svcSnap := range nodeSnap.Services {
-			req.Service = svcSnap.Service
-			if err := s.Backend.CatalogRegister(&req); err != nil {
-				return fmt.Errorf("failed to register service: %w", err)
-			}
-		}
-		req.Service = nil
-
-		// Then register all checks on that node
 		var chks structs.HealthChecks
 		for _, svcSnap := range nodeSnap.Services {
+			svcReq := nodeSnap.Node.ToRegisterRequest()
+			svcReq.Service = svcSnap.Service
+			reqs = append(reqs, &svcReq)
+
 			for _, c := range svcSnap.Checks {
 				chks = append(chks, c)
 			}
 		}
 
-		req.Checks = chks
-		if err := s.Backend.CatalogRegister(&req); err != nil {
-			return fmt.Errorf("failed to register check: %w", err)
+		if len(chks) > 0 {
+			chkReq := nodeSnap.Node.ToRegisterRequest()
+			chkReq.Checks = chks
+			reqs = append(reqs, &chkReq)
 		}
 	}
+	if err := s.Backend.CatalogRegisterBatch(reqs); err != nil {
+		return fmt.Errorf("failed to register imported instances: %w", err)
+	}
 
 	//
 	// Now that the data received has been stored in the state store, the rest of this
@@ -1,6 +1,7 @@
 package peerstream
 
 import (
+	"context"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
@@ -100,10 +101,12 @@ type Backend interface {
 	GetLeaderAddress() string
 
 	ValidateProposedPeeringSecret(id string) (bool, error)
-	PeeringSecretsWrite(req *pbpeering.SecretsWriteRequest) error
+
+	PeeringSecretsWriteCtx(ctx context.Context, req *pbpeering.SecretsWriteRequest) error
 	PeeringTerminateByID(req *pbpeering.PeeringTerminateByIDRequest) error
 	PeeringTrustBundleWrite(req *pbpeering.PeeringTrustBundleWriteRequest) error
 	CatalogRegister(req *structs.RegisterRequest) error
+	CatalogRegisterBatch(reqs []*structs.RegisterRequest) error
 	CatalogDeregister(req *structs.DeregisterRequest) error
 	PeeringWrite(req *pbpeering.PeeringWriteRequest) error
 }
@@ -14,6 +14,12 @@ func TestServer_ExchangeSecret(t *testing.T) {
 	srv, store := newTestServer(t, nil)
 	_ = writePeeringToBeDialed(t, store, 1, "my-peer")
 
+	testutil.RunStep(t, "empty request is rejected", func(t *testing.T) {
+		resp, err := srv.ExchangeSecret(context.Background(), &pbpeerstream.ExchangeSecretRequest{})
+		testutil.RequireErrorContains(t, err, `rpc error: code = InvalidArgument desc = missing peer ID or establishment secret`)
+		require.Nil(t, resp)
+	})
+
 	testutil.RunStep(t, "unknown establishment secret is rejected", func(t *testing.T) {
 		resp, err := srv.ExchangeSecret(context.Background(), &pbpeerstream.ExchangeSecretRequest{
 			PeerID:              testPeerID,
@@ -53,3 +59,47 @@ func TestServer_ExchangeSecret(t *testing.T) {
 		require.Equal(t, secret, s.GetStream().GetPendingSecretID())
 	})
 }
+
+func TestServer_ExchangeSecret_OneTimeToken(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	require.NoError(t, store.PeeringWrite(1, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:   testPeerID,
+			Name: "my-peer",
+			Meta: map[string]string{pbpeering.MetaKeyOneTimeTokens: "true"},
+		},
+		SecretsRequest: &pbpeering.SecretsWriteRequest{
+			PeerID: testPeerID,
+			Request: &pbpeering.SecretsWriteRequest_GenerateToken{
+				GenerateToken: &pbpeering.SecretsWriteRequest_GenerateTokenRequest{
+					EstablishmentSecret: testEstablishmentSecretID,
+				},
+			},
+		},
+	}))
+
+	testutil.RunStep(t, "first exchange is accepted", func(t *testing.T) {
+		resp, err := srv.ExchangeSecret(context.Background(), &pbpeerstream.ExchangeSecretRequest{
+			PeerID:              testPeerID,
+			EstablishmentSecret: testEstablishmentSecretID,
+		})
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.StreamSecret)
+	})
+
+	testutil.RunStep(t, "used secret is recorded in the state store", func(t *testing.T) {
+		s, err := store.PeeringSecretsRead(nil, testPeerID)
+		require.NoError(t, err)
+		require.Nil(t, s.GetEstablishment())
+		require.Equal(t, []string{testEstablishmentSecretID}, s.GetUsedEstablishmentSecretIDs())
+	})
+
+	testutil.RunStep(t, "second exchange is rejected", func(t *testing.T) {
+		resp, err := srv.ExchangeSecret(context.Background(), &pbpeerstream.ExchangeSecretRequest{
+			PeerID:              testPeerID,
+			EstablishmentSecret: testEstablishmentSecretID,
+		})
+		testutil.RequireErrorContains(t, err, `rpc error: code = PermissionDenied desc = `+ErrTokenAlreadyUsed.Error())
+		require.Nil(t, resp)
+	})
+}
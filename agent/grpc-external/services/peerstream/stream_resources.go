@@ -3,6 +3,7 @@ package peerstream
 import (
 	"context"
 	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -25,6 +26,40 @@ import (
 	"github.com/hashicorp/consul/proto/pbpeerstream"
 )
 
+// ProtocolVersion is the highest version of the peering replication protocol
+// that this server speaks. Each side of a stream advertises it in its
+// subscription requests, and the lower of the two versions is used.
+const ProtocolVersion = 1
+
+// negotiateProtocolVersion returns the replication protocol version to use
+// with a peer that advertised the given version. Peers that predate protocol
+// versioning do not advertise one and speak version 1.
+func negotiateProtocolVersion(remote uint32) uint32 {
+	if remote == 0 {
+		remote = 1
+	}
+	if remote < ProtocolVersion {
+		return remote
+	}
+	return ProtocolVersion
+}
+
+// MissingExchangeSecretFieldsMessage is the status message of the
+// InvalidArgument error that ExchangeSecret returns for requests without a peer
+// ID or establishment secret. Peers send such empty requests to check that an
+// address serves the peering gRPC service.
+const MissingExchangeSecretFieldsMessage = "missing peer ID or establishment secret"
+
+// ErrTokenAlreadyUsed is returned, as a PermissionDenied status, when the
+// establishment secret of a one-time peering token that was already exchanged
+// is presented again.
+var ErrTokenAlreadyUsed = errors.New("peering token has already been used")
+
+// InvalidEstablishmentSecretMessage is the status message of the
+// PermissionDenied error that ExchangeSecret returns for unknown establishment
+// secrets.
+const InvalidEstablishmentSecretMessage = "invalid peering establishment secret"
+
 type BidirectionalStream interface {
 	Send(*pbpeerstream.ReplicationMessage) error
 	Recv() (*pbpeerstream.ReplicationMessage, error)
@@ -38,6 +73,10 @@ type BidirectionalStream interface {
 // Note that if the peering secret exchange fails, a peering token may need to be
 // re-generated, since the one-time initiation secret may have been invalidated.
 func (s *Server) ExchangeSecret(ctx context.Context, req *pbpeerstream.ExchangeSecretRequest) (*pbpeerstream.ExchangeSecretResponse, error) {
+	if req.PeerID == "" || req.EstablishmentSecret == "" {
+		return nil, grpcstatus.Error(codes.InvalidArgument, MissingExchangeSecretFieldsMessage)
+	}
+
 	// For private/internal gRPC handlers, protoc-gen-rpc-glue generates the
 	// requisite methods to satisfy the structs.RPCInfo interface using fields
 	// from the pbcommon package. This service is public, so we can't use those
@@ -69,7 +108,12 @@ func (s *Server) ExchangeSecret(ctx context.Context, req *pbpeerstream.ExchangeS
 		return nil, grpcstatus.Errorf(codes.Internal, "failed to read peering secret: %v", err)
 	}
 	if existing == nil || subtle.ConstantTimeCompare([]byte(existing.GetEstablishment().GetSecretID()), []byte(req.EstablishmentSecret)) == 0 {
-		return nil, grpcstatus.Error(codes.PermissionDenied, "invalid peering establishment secret")
+		for _, used := range existing.GetUsedEstablishmentSecretIDs() {
+			if subtle.ConstantTimeCompare([]byte(used), []byte(req.EstablishmentSecret)) == 1 {
+				return nil, grpcstatus.Error(codes.PermissionDenied, ErrTokenAlreadyUsed.Error())
+			}
+		}
+		return nil, grpcstatus.Error(codes.PermissionDenied, InvalidEstablishmentSecretMessage)
 	}
 
 	id, err := s.generateNewStreamSecret()
@@ -91,7 +135,7 @@ func (s *Server) ExchangeSecret(ctx context.Context, req *pbpeerstream.ExchangeS
 			},
 		},
 	}
-	err = s.Backend.PeeringSecretsWrite(writeReq)
+	err = s.Backend.PeeringSecretsWriteCtx(ctx, writeReq)
 	if err != nil {
 		return nil, grpcstatus.Errorf(codes.Internal, "failed to persist peering secret: %v", err)
 	}
@@ -215,7 +259,7 @@ func (s *Server) StreamResources(stream pbpeerstream.PeerStreamService_StreamRes
 				},
 			},
 		}
-		err = s.Backend.PeeringSecretsWrite(promoted)
+		err = s.Backend.PeeringSecretsWriteCtx(stream.Context(), promoted)
 		if err != nil {
 			return grpcstatus.Errorf(codes.Internal, "failed to persist peering secret: %v", err)
 		}
@@ -350,6 +394,9 @@ func (s *Server) realHandleStream(streamReq HandleStreamRequest) error {
 		sendMutex.Lock()
 		err := streamReq.Stream.Send(msg)
 		sendMutex.Unlock()
+		if err == nil {
+			s.Tracker.TrackBytes(0, proto.Size(msg))
+		}
 
 		// We only track send successes and errors for response types because this is meant to track
 		// resources, not request/ack messages.
@@ -371,8 +418,9 @@ func (s *Server) realHandleStream(streamReq HandleStreamRequest) error {
 		pbpeerstream.TypeURLPeeringServerAddresses,
 	} {
 		sub := makeReplicationRequest(&pbpeerstream.ReplicationMessage_Request{
-			ResourceURL: resourceURL,
-			PeerID:      streamReq.RemoteID,
+			ResourceURL:     resourceURL,
+			PeerID:          streamReq.RemoteID,
+			ProtocolVersion: ProtocolVersion,
 		})
 		if err := streamSend(sub); err != nil {
 			// TODO(peering) Test error handling in calls to Send/Recv
@@ -395,6 +443,7 @@ func (s *Server) realHandleStream(streamReq HandleStreamRequest) error {
 				return
 			}
 			logTraceRecv(logger, msg)
+			s.Tracker.TrackBytes(proto.Size(msg), 0)
 			select {
 			case recvCh <- msg:
 			case <-handleStreamCtx.Done():
@@ -559,6 +608,7 @@ func (s *Server) realHandleStream(streamReq HandleStreamRequest) error {
 					if remoteSubTracker.Subscribe(req.ResourceURL) {
 						logger.Info("subscribing to resource type", "resourceURL", req.ResourceURL)
 					}
+					status.TrackProtocolVersion(negotiateProtocolVersion(req.ProtocolVersion))
 					status.TrackAck()
 					continue
 				}
@@ -588,7 +638,9 @@ func (s *Server) realHandleStream(streamReq HandleStreamRequest) error {
 				// TODO(peering): Ensure there's a nonce
 				reply, err := s.processResponse(streamReq.PeerName, streamReq.Partition, status, resp)
 				if err != nil {
-					logger.Error("failed to persist resource", "resourceURL", resp.ResourceURL, "resourceID", resp.ResourceID)
+					// The reply is a NACK, so the peer knows the resource was not
+					// stored, for example because our backend rejected it.
+					logger.Error("failed to persist resource", "resourceURL", resp.ResourceURL, "resourceID", resp.ResourceID, "error", err)
 					status.TrackRecvError(err.Error())
 				} else {
 					status.TrackRecvResourceSuccess()
@@ -653,6 +705,9 @@ func (s *Server) realHandleStream(streamReq HandleStreamRequest) error {
 					logger.Error("failed to create ca roots response", "error", err)
 					continue
 				}
+				if bundle, ok := update.Result.(*pbpeering.PeeringTrustBundle); ok {
+					status.TrackSentCARoots(bundle.RootPEMs)
+				}
 
 			case update.CorrelationID == subServerAddrs:
 				resp, err = makeServerAddrsResponse(update)
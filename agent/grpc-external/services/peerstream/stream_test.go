@@ -3,6 +3,7 @@ package peerstream
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -580,6 +581,8 @@ func TestStreamResources_Server_StreamTracker(t *testing.T) {
 	status, ok := srv.StreamStatus(testPeerID)
 	require.True(t, ok)
 	lastSendSuccess = status.LastSendSuccess
+	sentCARootPEMs := status.SentCARootPEMs
+	firstConnected := status.FirstConnected
 
 	testutil.RunStep(t, "ack tracked as success", func(t *testing.T) {
 		ack := &pbpeerstream.ReplicationMessage{
@@ -604,6 +607,9 @@ func TestStreamResources_Server_StreamTracker(t *testing.T) {
 			LastSendSuccess:  lastSendSuccess,
 			LastAck:          lastSendAck,
 			ExportedServices: []string{},
+			SentCARootPEMs:   sentCARootPEMs,
+			FirstConnected:   firstConnected,
+			ProtocolVersion:  1,
 		}
 
 		retry.Run(t, func(r *retry.R) {
@@ -644,6 +650,9 @@ func TestStreamResources_Server_StreamTracker(t *testing.T) {
 			LastNack:         lastNack,
 			LastNackMessage:  lastNackMsg,
 			ExportedServices: []string{},
+			SentCARootPEMs:   sentCARootPEMs,
+			FirstConnected:   firstConnected,
+			ProtocolVersion:  1,
 		}
 
 		retry.Run(t, func(r *retry.R) {
@@ -697,6 +706,9 @@ func TestStreamResources_Server_StreamTracker(t *testing.T) {
 			LastNackMessage:         lastNackMsg,
 			LastRecvResourceSuccess: lastRecvResourceSuccess,
 			ExportedServices:        []string{},
+			SentCARootPEMs:          sentCARootPEMs,
+			FirstConnected:          firstConnected,
+			ProtocolVersion:         1,
 		}
 
 		retry.Run(t, func(r *retry.R) {
@@ -755,6 +767,9 @@ func TestStreamResources_Server_StreamTracker(t *testing.T) {
 			LastRecvError:           lastRecvError,
 			LastRecvErrorMessage:    lastRecvErrorMsg,
 			ExportedServices:        []string{},
+			SentCARootPEMs:          sentCARootPEMs,
+			FirstConnected:          firstConnected,
+			ProtocolVersion:         1,
 		}
 
 		retry.Run(t, func(r *retry.R) {
@@ -786,6 +801,9 @@ func TestStreamResources_Server_StreamTracker(t *testing.T) {
 			LastRecvErrorMessage:    lastRecvErrorMsg,
 			LastRecvHeartbeat:       lastRecvHeartbeat,
 			ExportedServices:        []string{},
+			SentCARootPEMs:          sentCARootPEMs,
+			FirstConnected:          firstConnected,
+			ProtocolVersion:         1,
 		}
 
 		retry.Run(t, func(r *retry.R) {
@@ -815,6 +833,9 @@ func TestStreamResources_Server_StreamTracker(t *testing.T) {
 			LastRecvErrorMessage:    lastRecvErrorMsg,
 			LastRecvHeartbeat:       lastRecvHeartbeat,
 			ExportedServices:        []string{},
+			SentCARootPEMs:          sentCARootPEMs,
+			FirstConnected:          firstConnected,
+			ProtocolVersion:         1,
 		}
 
 		retry.Run(t, func(r *retry.R) {
@@ -1401,7 +1422,8 @@ func makeClient(t *testing.T, srv *testServer, peerID string) *MockClient {
 					// The PeerID field is only set for the messages coming FROM
 					// the establishing side and are going to be empty from the
 					// other side.
-					PeerID: "",
+					PeerID:          "",
+					ProtocolVersion: ProtocolVersion,
 				},
 			},
 		},
@@ -1412,7 +1434,8 @@ func makeClient(t *testing.T, srv *testServer, peerID string) *MockClient {
 					// The PeerID field is only set for the messages coming FROM
 					// the establishing side and are going to be empty from the
 					// other side.
-					PeerID: "",
+					PeerID:          "",
+					ProtocolVersion: ProtocolVersion,
 				},
 			},
 		},
@@ -1423,7 +1446,8 @@ func makeClient(t *testing.T, srv *testServer, peerID string) *MockClient {
 					// The PeerID field is only set for the messages coming FROM
 					// the establishing side and are going to be empty from the
 					// other side.
-					PeerID: "",
+					PeerID:          "",
+					ProtocolVersion: ProtocolVersion,
 				},
 			},
 		},
@@ -1445,6 +1469,10 @@ type testStreamBackend struct {
 
 	leaderAddrLock sync.Mutex
 	leaderAddr     string
+
+	// registerErr, if set, is returned by CatalogRegister instead of
+	// registering, like a backend that rejects imported data.
+	registerErr error
 }
 
 var _ Backend = (*testStreamBackend)(nil)
@@ -1484,7 +1512,7 @@ func (b *testStreamBackend) ValidateProposedPeeringSecret(id string) (bool, erro
 	return true, nil
 }
 
-func (b *testStreamBackend) PeeringSecretsWrite(req *pbpeering.SecretsWriteRequest) error {
+func (b *testStreamBackend) PeeringSecretsWriteCtx(_ context.Context, req *pbpeering.SecretsWriteRequest) error {
 	return b.store.PeeringSecretsWrite(1, req)
 }
 
@@ -1494,9 +1522,22 @@ func (b *testStreamBackend) PeeringWrite(req *pbpeering.PeeringWriteRequest) err
 
 // CatalogRegister mocks catalog registrations through Raft by copying the logic of FSM.applyRegister.
 func (b *testStreamBackend) CatalogRegister(req *structs.RegisterRequest) error {
+	if b.registerErr != nil {
+		return b.registerErr
+	}
 	return b.store.EnsureRegistration(1, req)
 }
 
+// CatalogRegisterBatch mocks batched catalog registrations by registering each request in order.
+func (b *testStreamBackend) CatalogRegisterBatch(reqs []*structs.RegisterRequest) error {
+	for _, req := range reqs {
+		if err := b.CatalogRegister(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // CatalogDeregister mocks catalog de-registrations through Raft by copying the logic of FSM.applyDeregister.
 func (b *testStreamBackend) CatalogDeregister(req *structs.DeregisterRequest) error {
 	if req.ServiceID != "" {
@@ -1668,6 +1709,52 @@ func Test_processResponse_Validation(t *testing.T) {
 	}
 }
 
+func Test_processResponse_RejectedRegistration(t *testing.T) {
+	peerName := "billing"
+	peerID := "1fabcd52-1d46-49b0-b1d8-71559aee47f5"
+
+	srv, store := newTestServer(t, func(c *Config) {
+		backend := c.Backend.(*testStreamBackend)
+		backend.registerErr = errors.New("peering is quarantined")
+	})
+	require.NoError(t, store.PeeringWrite(31, &pbpeering.PeeringWriteRequest{
+		Peering: &pbpeering.Peering{
+			ID:   peerID,
+			Name: peerName,
+		},
+	}))
+
+	mst, err := srv.Tracker.Connected(peerID)
+	require.NoError(t, err)
+
+	in := &pbpeerstream.ReplicationMessage_Response{
+		ResourceURL: pbpeerstream.TypeURLExportedService,
+		ResourceID:  "api",
+		Nonce:       "1",
+		Operation:   pbpeerstream.Operation_OPERATION_UPSERT,
+		Resource: makeAnyPB(t, &pbpeerstream.ExportedService{
+			Nodes: []*pbservice.CheckServiceNode{{
+				Node: &pbservice.Node{
+					ID:       "af913374-68ea-41e5-82e8-6ffd3dffc461",
+					Node:     "node-foo",
+					PeerName: peerName,
+				},
+				Service: &pbservice.NodeService{
+					ID:       "api-1",
+					Service:  "api",
+					PeerName: peerName,
+				},
+			}},
+		}),
+	}
+
+	// Data the backend did not store must not be acknowledged.
+	reply, err := srv.processResponse(peerName, "", mst, in)
+	testutil.RequireErrorContains(t, err, "peering is quarantined")
+	require.Equal(t, int32(code.Code_INTERNAL), reply.GetRequest().GetError().GetCode())
+	require.Contains(t, reply.GetRequest().GetError().GetMessage(), "peering is quarantined")
+}
+
 // writePeeringToDialFrom creates a peering with the provided name and ensures
 // the PeerID field is set for the ID of the remote peer.
 func writePeeringToDialFrom(t *testing.T, store *state.Store, idx uint64, peerName string) *pbpeering.Peering {
@@ -2838,6 +2925,15 @@ func Test_processResponse_ExportedServiceUpdates(t *testing.T) {
 // We ensure it gets redacted when logging a ReplicationMessage_Open or a ReplicationMessage.
 // In the stream handler we only log the ReplicationMessage_Open, but testing both guards against
 // a change in that behavior.
+func Test_negotiateProtocolVersion(t *testing.T) {
+	// Peers that predate versioning speak version 1.
+	require.Equal(t, uint32(1), negotiateProtocolVersion(0))
+	require.Equal(t, uint32(1), negotiateProtocolVersion(1))
+
+	// Newer peers fall back to our version.
+	require.Equal(t, uint32(ProtocolVersion), negotiateProtocolVersion(ProtocolVersion+1))
+}
+
 func TestLogTraceProto(t *testing.T) {
 	type testCase struct {
 		input proto.Message
@@ -18,6 +18,9 @@ type Tracker struct {
 	// disconnected before the stream health is reported as non-healthy
 	heartbeatTimeout time.Duration
 
+	// throughput records bytes transferred across all streams.
+	throughput throughputTracker
+
 	// timeNow is a shim for testing.
 	timeNow func() time.Time
 }
@@ -137,6 +140,17 @@ func (t *Tracker) DeleteStatus(id string) {
 	delete(t.streams, id)
 }
 
+// TrackBytes records bytes received from and sent to peers.
+func (t *Tracker) TrackBytes(in, out int) {
+	t.throughput.record(in, out)
+}
+
+// Throughput returns the average bytes per second received from and sent to
+// all peers over the given window, which is capped at one hour.
+func (t *Tracker) Throughput(window time.Duration) (inBps, outBps float64) {
+	return t.throughput.rate(window)
+}
+
 // IsHealthy is a calculates the health of a peering status.
 // We define a peering as unhealthy if its status has been in the following
 // states for longer than the configured incomingHeartbeatTimeout.
@@ -199,6 +213,9 @@ type Status struct {
 	// If the status is not connected, DisconnectTime tracks when the stream was closed. Else it's zero.
 	DisconnectTime time.Time
 
+	// FirstConnected tracks when the stream for the peer was first connected.
+	FirstConnected time.Time
+
 	// LastAck tracks the time we received the last ACK for a resource replicated TO the peer.
 	LastAck time.Time
 
@@ -236,6 +253,13 @@ type Status struct {
 	ImportedServices []string
 	// ExportedServices keeps track of which service names a peer asks to export
 	ExportedServices []string
+
+	// SentCARootPEMs tracks the CA root PEMs in the trust bundle last sent TO the peer.
+	SentCARootPEMs []string
+
+	// ProtocolVersion is the replication protocol version negotiated with the peer.
+	// It is zero until the peer's first subscription request is received.
+	ProtocolVersion uint32
 }
 
 func (s *Status) GetImportedServicesCount() uint64 {
@@ -247,7 +271,7 @@ func (s *Status) GetExportedServicesCount() uint64 {
 }
 
 func newMutableStatus(now func() time.Time, connected bool) *MutableStatus {
-	return &MutableStatus{
+	s := &MutableStatus{
 		Status: Status{
 			Connected:      connected,
 			NeverConnected: !connected,
@@ -255,6 +279,10 @@ func newMutableStatus(now func() time.Time, connected bool) *MutableStatus {
 		timeNow: now,
 		doneCh:  make(chan struct{}),
 	}
+	if connected {
+		s.FirstConnected = now().UTC()
+	}
+	return s
 }
 
 func (s *MutableStatus) Done() <-chan struct{} {
@@ -311,6 +339,9 @@ func (s *MutableStatus) TrackNack(msg string) {
 func (s *MutableStatus) TrackConnected() {
 	s.mu.Lock()
 	s.Connected = true
+	if s.FirstConnected.IsZero() {
+		s.FirstConnected = s.timeNow().UTC()
+	}
 	s.DisconnectTime = time.Time{}
 	s.DisconnectErrorMessage = ""
 	s.mu.Unlock()
@@ -365,6 +396,22 @@ func (s *MutableStatus) SetImportedServices(serviceNames []structs.ServiceName)
 	}
 }
 
+// TrackSentCARoots tracks the CA root PEMs in the trust bundle sent to the peer.
+func (s *MutableStatus) TrackSentCARoots(rootPEMs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.SentCARootPEMs = make([]string, len(rootPEMs))
+	copy(s.SentCARootPEMs, rootPEMs)
+}
+
+// TrackProtocolVersion tracks the replication protocol version negotiated with the peer.
+func (s *MutableStatus) TrackProtocolVersion(version uint32) {
+	s.mu.Lock()
+	s.ProtocolVersion = version
+	s.mu.Unlock()
+}
+
 func (s *MutableStatus) GetImportedServicesCount() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
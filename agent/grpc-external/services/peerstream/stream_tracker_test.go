@@ -124,16 +124,21 @@ func TestTracker_EnsureConnectedDisconnected(t *testing.T) {
 	tracker.timeNow = it.Now
 
 	var (
-		statusPtr *MutableStatus
-		err       error
+		statusPtr      *MutableStatus
+		err            error
+		sequence       uint64
+		firstConnected time.Time
 	)
 
 	testutil.RunStep(t, "new stream", func(t *testing.T) {
 		statusPtr, err = tracker.Connected(peerID)
 		require.NoError(t, err)
+		sequence++
 
+		firstConnected = it.base.Add(time.Duration(sequence) * time.Second).UTC()
 		expect := Status{
-			Connected: true,
+			Connected:      true,
+			FirstConnected: firstConnected,
 		}
 
 		status, ok := tracker.StreamStatus(peerID)
@@ -147,7 +152,6 @@ func TestTracker_EnsureConnectedDisconnected(t *testing.T) {
 		require.Contains(t, err.Error(), `there is an active stream for the given PeerID "63b60245-c475-426b-b314-4588d210859d"`)
 	})
 
-	var sequence uint64
 	var lastSuccess time.Time
 
 	testutil.RunStep(t, "stream updated", func(t *testing.T) {
@@ -159,8 +163,9 @@ func TestTracker_EnsureConnectedDisconnected(t *testing.T) {
 
 		lastSuccess = it.base.Add(time.Duration(sequence) * time.Second).UTC()
 		expect := Status{
-			Connected: true,
-			LastAck:   lastSuccess,
+			Connected:      true,
+			FirstConnected: firstConnected,
+			LastAck:        lastSuccess,
 		}
 		require.Equal(t, expect, status)
 	})
@@ -172,6 +177,7 @@ func TestTracker_EnsureConnectedDisconnected(t *testing.T) {
 		expect := Status{
 			Connected:      false,
 			DisconnectTime: it.base.Add(time.Duration(sequence) * time.Second).UTC(),
+			FirstConnected: firstConnected,
 			LastAck:        lastSuccess,
 		}
 		status, ok := tracker.StreamStatus(peerID)
@@ -184,10 +190,12 @@ func TestTracker_EnsureConnectedDisconnected(t *testing.T) {
 		require.NoError(t, err)
 
 		expect := Status{
-			Connected: true,
-			LastAck:   lastSuccess,
+			Connected:      true,
+			FirstConnected: firstConnected,
+			LastAck:        lastSuccess,
 
 			// DisconnectTime gets cleared on re-connect.
+			// FirstConnected is not updated on re-connect.
 		}
 
 		status, ok := tracker.StreamStatus(peerID)
@@ -269,6 +277,7 @@ func TestTracker_connectedStreams(t *testing.T) {
 
 func TestMutableStatus_TrackConnected(t *testing.T) {
 	s := MutableStatus{
+		timeNow: time.Now,
 		Status: Status{
 			Connected:              false,
 			DisconnectTime:         time.Now(),
@@ -281,6 +290,7 @@ func TestMutableStatus_TrackConnected(t *testing.T) {
 	require.True(t, s.Connected)
 	require.Equal(t, time.Time{}, s.DisconnectTime)
 	require.Empty(t, s.DisconnectErrorMessage)
+	require.False(t, s.FirstConnected.IsZero())
 }
 
 func TestMutableStatus_TrackDisconnectedGracefully(t *testing.T) {
@@ -324,3 +334,45 @@ func TestMutableStatus_TrackDisconnectedDueToError(t *testing.T) {
 	require.Equal(t, disconnectTime, s.DisconnectTime)
 	require.Equal(t, "disconnect err", s.DisconnectErrorMessage)
 }
+
+func TestMutableStatus_TrackSentCARoots(t *testing.T) {
+	s := MutableStatus{}
+
+	roots := []string{"root-1", "root-2"}
+	s.TrackSentCARoots(roots)
+
+	// Mutating the input must not affect the tracked roots.
+	roots[0] = "changed"
+	require.Equal(t, []string{"root-1", "root-2"}, s.GetStatus().SentCARootPEMs)
+
+	s.TrackSentCARoots([]string{"root-3"})
+	require.Equal(t, []string{"root-3"}, s.GetStatus().SentCARootPEMs)
+}
+
+func TestTracker_Throughput(t *testing.T) {
+	tracker := NewTracker(0)
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker.throughput.timeNow = func() time.Time { return now }
+
+	tracker.TrackBytes(600, 60)
+	now = now.Add(30 * time.Second)
+	tracker.TrackBytes(600, 0)
+
+	in, out := tracker.Throughput(time.Minute)
+	require.Equal(t, float64(20), in)
+	require.Equal(t, float64(1), out)
+
+	// Bytes older than the window are not counted.
+	now = now.Add(45 * time.Second)
+	in, out = tracker.Throughput(time.Minute)
+	require.Equal(t, float64(10), in)
+	require.Equal(t, float64(0), out)
+
+	// Buckets are reused once they age out of the maximum window.
+	now = now.Add(maxThroughputWindow)
+	tracker.TrackBytes(60, 60)
+	in, out = tracker.Throughput(time.Hour)
+	require.InDelta(t, float64(60)/3600, in, 1e-9)
+	require.InDelta(t, float64(60)/3600, out, 1e-9)
+}
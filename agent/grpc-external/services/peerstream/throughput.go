@@ -0,0 +1,76 @@
+package peerstream
+
+import (
+	"sync"
+	"time"
+)
+
+// maxThroughputWindow is the longest window over which throughput can be
+// reported. Byte counts older than this are discarded.
+const maxThroughputWindow = time.Hour
+
+// throughputBucket holds the bytes transferred during one second.
+type throughputBucket struct {
+	second int64
+	in     uint64
+	out    uint64
+}
+
+// throughputTracker records bytes sent and received across all peering
+// streams in one-second buckets, keeping the last maxThroughputWindow.
+type throughputTracker struct {
+	mu      sync.Mutex
+	buckets [int(maxThroughputWindow / time.Second)]throughputBucket
+
+	// timeNow is a shim for testing. It is separate from the Tracker's clock
+	// because bytes are recorded for every message, which would otherwise
+	// advance test clocks that expect one tick per tracked event.
+	timeNow func() time.Time
+}
+
+func (t *throughputTracker) now() time.Time {
+	if t.timeNow == nil {
+		return time.Now()
+	}
+	return t.timeNow()
+}
+
+func (t *throughputTracker) record(in, out int) {
+	sec := t.now().Unix()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[sec%int64(len(t.buckets))]
+	if b.second != sec {
+		*b = throughputBucket{second: sec}
+	}
+	b.in += uint64(in)
+	b.out += uint64(out)
+}
+
+// rate returns the average bytes per second received and sent over the given
+// window ending now. Windows longer than maxThroughputWindow are clamped.
+func (t *throughputTracker) rate(window time.Duration) (inBps, outBps float64) {
+	if window > maxThroughputWindow {
+		window = maxThroughputWindow
+	}
+	seconds := int64(window / time.Second)
+	if seconds <= 0 {
+		return 0, 0
+	}
+	newest := t.now().Unix()
+	oldest := newest - seconds
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var in, out uint64
+	for _, b := range t.buckets {
+		if b.second > oldest && b.second <= newest {
+			in += b.in
+			out += b.out
+		}
+	}
+	return float64(in) / float64(seconds), float64(out) / float64(seconds)
+}
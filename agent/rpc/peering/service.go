@@ -24,7 +24,6 @@ import (
 	external "github.com/hashicorp/consul/agent/grpc-external"
 	"github.com/hashicorp/consul/agent/grpc-external/services/peerstream"
 	"github.com/hashicorp/consul/agent/structs"
-	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/consul/proto/pbpeering"
 	"github.com/hashicorp/consul/proto/pbpeerstream"
 )
@@ -75,6 +74,14 @@ type Config struct {
 	Datacenter     string
 	ConnectEnabled bool
 	PeeringEnabled bool
+
+	// OperatorContact is embedded in generated peering tokens so that the
+	// accepting operator knows who to contact about this cluster.
+	OperatorContact string
+
+	// ClusterName is embedded in generated peering tokens so that the
+	// accepting operator can tell which cluster a token came from.
+	ClusterName string
 }
 
 func NewServer(cfg Config) *Server {
@@ -118,9 +125,15 @@ type Backend interface {
 	// It returns the server name to validate, and the CA certificate to validate with.
 	GetTLSMaterials(generatingToken bool) (string, []string, error)
 
-	// GetServerAddresses returns the addresses used for establishing a peering connection.
-	// These may be server addresses or mesh gateway addresses if peering through mesh gateways.
-	GetServerAddresses() ([]string, error)
+	// GetTLSIntermediates returns the intermediate CA certificates that chain
+	// the server certificates to the CA roots returned by GetTLSMaterials.
+	GetTLSIntermediates() ([]string, error)
+
+	// GetServerAddressesForPartition returns the addresses used for establishing a peering
+	// connection to the given partition. These may be server addresses or mesh gateway
+	// addresses if peering through mesh gateways, in which case preferWAN selects the
+	// gateways' WAN addresses over their LAN addresses.
+	GetServerAddressesForPartition(ctx context.Context, partition string, preferWAN bool) ([]string, error)
 
 	// EncodeToken packages a peering token into a slice of bytes.
 	EncodeToken(tok *structs.PeeringToken) ([]byte, error)
@@ -150,9 +163,22 @@ type Backend interface {
 	// an existing peering.
 	CheckPeeringUUID(id string) (bool, error)
 
+	// GenerateUniquePeeringID returns a new UUID that is not associated with
+	// an existing peering.
+	GenerateUniquePeeringID() (string, error)
+
 	ValidateProposedPeeringSecret(id string) (bool, error)
 
-	PeeringWrite(req *pbpeering.PeeringWriteRequest) error
+	// GenerateEstablishmentSecret returns a new establishment secret that is
+	// not in use by any peering.
+	GenerateEstablishmentSecret() (string, error)
+
+	PeeringWriteCtx(ctx context.Context, req *pbpeering.PeeringWriteRequest) error
+
+	// CheckPeeringWriteRate returns an error wrapping
+	// structs.ErrRPCRateExceeded if the peering has been written by clients
+	// more often than the configured rate allows.
+	CheckPeeringWriteRate(peering *pbpeering.Peering) error
 
 	Store() Store
 }
@@ -169,6 +195,15 @@ type Store interface {
 
 var peeringNotEnabledErr = grpcstatus.Error(codes.FailedPrecondition, "peering must be enabled to use this endpoint")
 
+// checkPeeringWriteRate applies the per-peering write rate limit to a client
+// request, so that clients are told to back off with ResourceExhausted.
+func (s *Server) checkPeeringWriteRate(peering *pbpeering.Peering) error {
+	if err := s.Backend.CheckPeeringWriteRate(peering); err != nil {
+		return grpcstatus.Error(codes.ResourceExhausted, err.Error())
+	}
+	return nil
+}
+
 // GenerateToken implements the PeeringService RPC method to generate a
 // peering token which is the initial step in establishing a peering relationship
 // with other Consul clusters.
@@ -221,10 +256,26 @@ func (s *Server) GenerateToken(
 		return nil, err
 	}
 
+	if err := structs.ValidatePeeringTokenOperatorContact(s.Config.OperatorContact); err != nil {
+		return nil, err
+	}
+	if err := structs.ValidatePeeringTokenClusterName(s.Config.ClusterName); err != nil {
+		return nil, err
+	}
+
+	rateKey := &pbpeering.Peering{Name: req.PeerName, Partition: entMeta.PartitionOrEmpty()}
+	if err := s.checkPeeringWriteRate(rateKey); err != nil {
+		return nil, err
+	}
+
 	serverName, caPEMs, err := s.Backend.GetTLSMaterials(true)
 	if err != nil {
 		return nil, err
 	}
+	intermediatePEMs, err := s.Backend.GetTLSIntermediates()
+	if err != nil {
+		return nil, err
+	}
 
 	var (
 		peering  *pbpeering.Peering
@@ -239,7 +290,7 @@ func (s *Server) GenerateToken(
 		}
 
 		if peering == nil {
-			id, err := lib.GenerateUUID(s.Backend.CheckPeeringUUID)
+			id, err := s.Backend.GenerateUniquePeeringID()
 			if err != nil {
 				return resp, err
 			}
@@ -277,7 +328,7 @@ func (s *Server) GenerateToken(
 				},
 			},
 		}
-		if err := s.Backend.PeeringWrite(writeReq); err != nil {
+		if err := s.Backend.PeeringWriteCtx(ctx, writeReq); err != nil {
 			// There's a possible race where two servers call Generate Token at the
 			// same time with the same peer name for the first time. They both
 			// generate an ID and try to insert and only one wins. This detects the
@@ -298,7 +349,7 @@ func (s *Server) GenerateToken(
 	if len(req.ServerExternalAddresses) > 0 {
 		serverAddrs = req.ServerExternalAddresses
 	} else {
-		serverAddrs, err = s.Backend.GetServerAddresses()
+		serverAddrs, err = s.Backend.GetServerAddressesForPartition(ctx, entMeta.PartitionOrEmpty(), !req.UseLANMeshGatewayAddresses)
 		if err != nil {
 			return nil, err
 		}
@@ -308,9 +359,12 @@ func (s *Server) GenerateToken(
 		// Store the UUID so that we can do a global search when handling inbound streams.
 		PeerID:              peering.ID,
 		CA:                  caPEMs,
+		CAIntermediates:     intermediatePEMs,
 		ServerAddresses:     serverAddrs,
 		ServerName:          serverName,
 		EstablishmentSecret: secretID,
+		OperatorContact:     s.Config.OperatorContact,
+		ClusterName:         s.Config.ClusterName,
 	}
 
 	encoded, err := s.Backend.EncodeToken(&tok)
@@ -340,7 +394,7 @@ func (s *Server) Establish(
 	if err != nil {
 		return nil, err
 	}
-	if err := validatePeeringToken(tok); err != nil {
+	if err := ValidatePeeringToken(tok); err != nil {
 		return nil, err
 	}
 
@@ -389,7 +443,7 @@ func (s *Server) Establish(
 	var id string
 	serverAddrs := tok.ServerAddresses
 	if existing == nil {
-		id, err = lib.GenerateUUID(s.Backend.CheckPeeringUUID)
+		id, err = s.Backend.GenerateUniquePeeringID()
 		if err != nil {
 			return nil, err
 		}
@@ -407,20 +461,35 @@ func (s *Server) Establish(
 		return nil, err
 	}
 
+	// Thin tokens leave out the CA roots and intermediates, which were stored
+	// when the peering was first established.
+	peerCAPems, peerCAIntermediatePems := tok.CA, tok.CAIntermediates
+	if tok.CAOmitted {
+		if existing == nil || len(existing.PeerCAPems) == 0 {
+			return nil, fmt.Errorf("peering token does not include CA roots and none are stored for peer %q: generate a token that includes them", req.PeerName)
+		}
+		peerCAPems, peerCAIntermediatePems = existing.PeerCAPems, existing.PeerCAIntermediatePems
+	}
+
 	peering := &pbpeering.Peering{
-		ID:                  id,
-		Name:                req.PeerName,
-		PeerCAPems:          tok.CA,
-		PeerServerAddresses: serverAddrs,
-		PeerServerName:      tok.ServerName,
-		PeerID:              tok.PeerID,
-		Meta:                req.Meta,
-		State:               pbpeering.PeeringState_ESTABLISHING,
+		ID:                     id,
+		Name:                   req.PeerName,
+		PeerCAPems:             peerCAPems,
+		PeerCAIntermediatePems: peerCAIntermediatePems,
+		PeerServerAddresses:    serverAddrs,
+		PeerServerName:         tok.ServerName,
+		PeerID:                 tok.PeerID,
+		Meta:                   req.Meta,
+		State:                  pbpeering.PeeringState_ESTABLISHING,
 
 		// PartitionOrEmpty is used to avoid writing "default" in OSS.
 		Partition: entMeta.PartitionOrEmpty(),
 	}
 
+	if err := s.checkPeeringWriteRate(peering); err != nil {
+		return nil, err
+	}
+
 	tlsOption, err := peering.TLSDialOption()
 	if err != nil {
 		return nil, fmt.Errorf("failed to build TLS dial option from peering: %w", err)
@@ -464,7 +533,7 @@ func (s *Server) Establish(
 			},
 		},
 	}
-	if err := s.Backend.PeeringWrite(writeReq); err != nil {
+	if err := s.Backend.PeeringWriteCtx(ctx, writeReq); err != nil {
 		return nil, fmt.Errorf("failed to write peering: %w", err)
 	}
 	// TODO(peering): low prio: consider adding response details
@@ -640,11 +709,14 @@ func (s *Server) reconcilePeering(peering *pbpeering.Peering) *pbpeering.Peering
 	} else {
 		cp := copyPeering(peering)
 
-		// reconcile pbpeering.PeeringState_Active
-		if streamState.Connected {
-			cp.State = pbpeering.PeeringState_ACTIVE
-		} else if streamState.DisconnectErrorMessage != "" {
-			cp.State = pbpeering.PeeringState_FAILING
+		// reconcile pbpeering.PeeringState_Active. A quarantined peering keeps
+		// its state, since it was set by an operator rather than the stream.
+		if cp.State != pbpeering.PeeringState_QUARANTINED {
+			if streamState.Connected {
+				cp.State = pbpeering.PeeringState_ACTIVE
+			} else if streamState.DisconnectErrorMessage != "" {
+				cp.State = pbpeering.PeeringState_FAILING
+			}
 		}
 
 		latest := func(tt ...time.Time) time.Time {
@@ -722,7 +794,7 @@ func (s *Server) PeeringWrite(ctx context.Context, req *pbpeering.PeeringWriteRe
 		return nil, err
 	}
 	if peering == nil {
-		id, err = lib.GenerateUUID(s.Backend.CheckPeeringUUID)
+		id, err = s.Backend.GenerateUniquePeeringID()
 		if err != nil {
 			return nil, err
 		}
@@ -731,7 +803,11 @@ func (s *Server) PeeringWrite(ctx context.Context, req *pbpeering.PeeringWriteRe
 	}
 	req.Peering.ID = id
 
-	err = s.Backend.PeeringWrite(req)
+	if err := s.checkPeeringWriteRate(req.Peering); err != nil {
+		return nil, err
+	}
+
+	err = s.Backend.PeeringWriteCtx(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -809,7 +885,7 @@ func (s *Server) PeeringDelete(ctx context.Context, req *pbpeering.PeeringDelete
 			Partition: entMeta.PartitionOrEmpty(),
 		},
 	}
-	err = s.Backend.PeeringWrite(writeReq)
+	err = s.Backend.PeeringWriteCtx(ctx, writeReq)
 	if err != nil {
 		return nil, err
 	}
@@ -951,11 +1027,7 @@ func (s *Server) getExistingPeering(peerName, partition string) (*pbpeering.Peer
 }
 
 func (s *Server) generateNewEstablishmentSecret() (string, error) {
-	id, err := lib.GenerateUUID(s.Backend.ValidateProposedPeeringSecret)
-	if err != nil {
-		return "", err
-	}
-	return id, nil
+	return s.Backend.GenerateEstablishmentSecret()
 }
 
 // validatePeer enforces the following rule for an existing peering:
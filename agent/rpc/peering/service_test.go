@@ -209,6 +209,54 @@ func TestPeeringService_GenerateTokenExternalAddress(t *testing.T) {
 	require.Equal(t, []string{roots.Active().RootCert}, token.CA)
 }
 
+func TestPeeringService_GenerateTokenLANMeshGatewayAddresses(t *testing.T) {
+	// TODO(peering): see note on newTestServer, refactor to not use this
+	s := newTestServer(t, nil)
+	client := pbpeering.NewPeeringServiceClient(s.ClientConn(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	store := s.Server.FSM().State()
+	require.NoError(t, store.EnsureConfigEntry(1, &structs.MeshConfigEntry{
+		Peering: &structs.PeeringMeshConfig{PeerThroughMeshGateways: true},
+	}))
+	require.NoError(t, store.EnsureRegistration(2, &structs.RegisterRequest{
+		Node:    "gw-node",
+		Address: "10.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "mesh-gateway",
+			Service: "mesh-gateway",
+			Kind:    structs.ServiceKindMeshGateway,
+			Port:    443,
+			TaggedAddresses: map[string]structs.ServiceAddress{
+				structs.TaggedAddressWAN: {Address: "203.0.113.1", Port: 8443},
+			},
+		},
+	}))
+
+	generate := func(t *testing.T, useLAN bool) []string {
+		resp, err := client.GenerateToken(ctx, &pbpeering.GenerateTokenRequest{
+			PeerName:                   "peerB",
+			UseLANMeshGatewayAddresses: useLAN,
+		})
+		require.NoError(t, err)
+
+		tokenJSON, err := base64.StdEncoding.DecodeString(resp.PeeringToken)
+		require.NoError(t, err)
+		token := &structs.PeeringToken{}
+		require.NoError(t, json.Unmarshal(tokenJSON, token))
+		return token.ServerAddresses
+	}
+
+	testutil.RunStep(t, "WAN addresses by default", func(t *testing.T) {
+		require.Equal(t, []string{"203.0.113.1:8443"}, generate(t, false))
+	})
+
+	testutil.RunStep(t, "LAN addresses on request", func(t *testing.T) {
+		require.Equal(t, []string{"10.0.0.1:443"}, generate(t, true))
+	})
+}
+
 func TestPeeringService_GenerateToken_ACLEnforcement(t *testing.T) {
 	// TODO(peering): see note on newTestServer, refactor to not use this
 	s := newTestServer(t, func(conf *consul.Config) {
@@ -730,6 +778,91 @@ func TestPeeringService_Delete(t *testing.T) {
 	}
 }
 
+func TestPeeringService_WriteRateLimit(t *testing.T) {
+	// TODO(peering): see note on newTestServer, refactor to not use this
+	s := newTestServer(t, func(conf *consul.Config) {
+		// Slow enough that no token is refilled during the test.
+		conf.PeeringWriteRate = 0.001
+		conf.PeeringWriteBurst = 2
+	})
+	client := pbpeering.NewPeeringServiceClient(s.ClientConn(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	write := func() error {
+		_, err := client.PeeringWrite(ctx, &pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{
+				Name:                "foo",
+				PeerServerName:      "test",
+				PeerServerAddresses: []string{"addr1"},
+			},
+		})
+		return err
+	}
+
+	testutil.RunStep(t, "client writes are throttled", func(t *testing.T) {
+		require.NoError(t, write())
+		require.NoError(t, write())
+
+		err := write()
+		require.Error(t, err)
+		require.Equal(t, codes.ResourceExhausted, grpcstatus.Code(err))
+	})
+
+	testutil.RunStep(t, "deletion is not throttled", func(t *testing.T) {
+		_, err := client.PeeringDelete(ctx, &pbpeering.PeeringDeleteRequest{Name: "foo"})
+		require.NoError(t, err)
+
+		retry.Run(t, func(r *retry.R) {
+			_, resp, err := s.Server.FSM().State().PeeringRead(nil, state.Query{Value: "foo"})
+			require.NoError(r, err)
+			require.Nil(r, resp)
+		})
+	})
+}
+
+func TestPeeringService_WriteIdempotencyKey(t *testing.T) {
+	// TODO(peering): see note on newTestServer, refactor to not use this
+	s := newTestServer(t, nil)
+	client := pbpeering.NewPeeringServiceClient(s.ClientConn(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	write := func(addr string) error {
+		_, err := client.PeeringWrite(ctx, &pbpeering.PeeringWriteRequest{
+			Peering: &pbpeering.Peering{
+				Name:                "foo",
+				PeerServerName:      "test",
+				PeerServerAddresses: []string{addr},
+			},
+			IdempotencyKey: "establish-foo",
+		})
+		return err
+	}
+	read := func() *pbpeering.Peering {
+		_, p, err := s.Server.FSM().State().PeeringRead(nil, state.Query{Value: "foo"})
+		require.NoError(t, err)
+		require.NotNil(t, p)
+		return p
+	}
+
+	require.NoError(t, write("addr1"))
+	first := read()
+
+	// A retry with the same key returns the original result.
+	require.NoError(t, write("addr1"))
+	second := read()
+	require.Equal(t, first.ID, second.ID)
+	require.Equal(t, first.ModifyIndex, second.ModifyIndex)
+
+	// Reusing the key for a different write is rejected.
+	err := write("addr2")
+	require.Equal(t, codes.FailedPrecondition, grpcstatus.Code(err))
+	require.Equal(t, []string{"addr1"}, read().PeerServerAddresses)
+}
+
 func TestPeeringService_Delete_ACLEnforcement(t *testing.T) {
 	// TODO(peering): see note on newTestServer, refactor to not use this
 	s := newTestServer(t, func(conf *consul.Config) {
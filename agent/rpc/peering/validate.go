@@ -9,8 +9,8 @@ import (
 	"github.com/hashicorp/consul/agent/structs"
 )
 
-// validatePeeringToken ensures that the token has valid values.
-func validatePeeringToken(tok *structs.PeeringToken) error {
+// ValidatePeeringToken ensures that the token has valid values.
+func ValidatePeeringToken(tok *structs.PeeringToken) error {
 	// the CA values here should be valid x509 certs
 	for _, certStr := range tok.CA {
 		// TODO(peering): should we put these in a cert pool on the token?
@@ -38,7 +38,7 @@ func validatePeeringToken(tok *structs.PeeringToken) error {
 		}
 	}
 
-	if len(tok.CA) > 0 && tok.ServerName == "" {
+	if (len(tok.CA) > 0 || tok.CAOmitted) && tok.ServerName == "" {
 		return errPeeringTokenEmptyServerName
 	}
 
@@ -61,6 +61,14 @@ func TestValidatePeeringToken(t *testing.T) {
 			},
 			wantErr: errPeeringTokenEmptyServerName,
 		},
+		{
+			name: "thin token without server name",
+			token: &structs.PeeringToken{
+				ServerAddresses: []string{"1.2.3.4:80"},
+				CAOmitted:       true,
+			},
+			wantErr: errPeeringTokenEmptyServerName,
+		},
 		{
 			name: "invalid peer ID",
 			token: &structs.PeeringToken{
@@ -79,6 +87,15 @@ func TestValidatePeeringToken(t *testing.T) {
 				PeerID:          validPeerID,
 			},
 		},
+		{
+			name: "valid thin token",
+			token: &structs.PeeringToken{
+				ServerAddresses: []string{validAddress},
+				ServerName:      validServerName,
+				PeerID:          validPeerID,
+				CAOmitted:       true,
+			},
+		},
 		{
 			name: "valid token with hostname address",
 			token: &structs.PeeringToken{
@@ -92,7 +109,7 @@ func TestValidatePeeringToken(t *testing.T) {
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			err := validatePeeringToken(tc.token)
+			err := ValidatePeeringToken(tc.token)
 			if tc.wantErr != nil {
 				if err == nil {
 					t.Error("expected error but got nil")
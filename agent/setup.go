@@ -285,6 +285,8 @@ func getPrometheusDefs(cfg lib.TelemetryConfig, isServer bool) ([]prometheus.Gau
 		consul.ACLCounters,
 		consul.CatalogCounters,
 		consul.ClientCounters,
+		consul.PeeringTerminateCounters,
+		consul.PeeringTokenCounters,
 		consul.RPCCounters,
 		grpc.StatsCounters,
 		local.StateCounters,
@@ -334,6 +336,8 @@ func getPrometheusDefs(cfg lib.TelemetryConfig, isServer bool) ([]prometheus.Gau
 		consul.IntentionSummaries,
 		consul.KVSummaries,
 		consul.LeaderSummaries,
+		consul.PeeringTerminateSummaries,
+		consul.PeeringTokenSummaries,
 		consul.PreparedQuerySummaries,
 		consul.RPCSummaries,
 		consul.SegmentOSSSummaries,
@@ -3,6 +3,9 @@ package structs
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
 
 	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/types"
@@ -58,6 +61,13 @@ type PeeringMeshConfig struct {
 	// Additionally, mesh gateways will configure themselves to expose
 	// the local servers using a peering-specific SNI.
 	PeerThroughMeshGateways bool `alias:"peer_through_mesh_gateways"`
+
+	// ServerAddressDNSName is a DNS name that resolves to this cluster's
+	// servers. When set, peering tokens contain this name along with the
+	// servers' gRPC port in place of the servers' own addresses, for peers
+	// that cannot reach the servers by IP. It has no effect when
+	// PeerThroughMeshGateways is enabled.
+	ServerAddressDNSName string `alias:"server_address_dns_name"`
 }
 
 func (e *MeshConfigEntry) GetKind() string {
@@ -110,6 +120,15 @@ func (e *MeshConfigEntry) Validate() error {
 		}
 	}
 
+	if e.Peering != nil && e.Peering.ServerAddressDNSName != "" {
+		name := e.Peering.ServerAddressDNSName
+		// The port comes from the servers' configuration, so only a name is
+		// allowed here.
+		if _, ok := dns.IsDomainName(name); !ok || IsIP(name) || strings.ContainsAny(name, "*:/ ") {
+			return fmt.Errorf("peering ServerAddressDNSName %q must be a DNS name", name)
+		}
+	}
+
 	return e.validateEnterpriseMeta()
 }
 
@@ -162,6 +181,13 @@ func (e *MeshConfigEntry) PeerThroughMeshGateways() bool {
 	return e.Peering.PeerThroughMeshGateways
 }
 
+func (e *MeshConfigEntry) PeeringServerAddressDNSName() string {
+	if e == nil || e.Peering == nil {
+		return ""
+	}
+	return e.Peering.ServerAddressDNSName
+}
+
 func validateMeshDirectionalTLSConfig(cfg *MeshDirectionalTLSConfig) error {
 	if cfg == nil {
 		return nil
@@ -44,3 +44,30 @@ func TestMeshConfigEntry_PeerThroughMeshGateways(t *testing.T) {
 		})
 	}
 }
+
+func TestMeshConfigEntry_ValidateServerAddressDNSName(t *testing.T) {
+	tests := map[string]struct {
+		name      string
+		expectErr bool
+	}{
+		"unset":     {name: ""},
+		"hostname":  {name: "servers.dc1.example.com"},
+		"ip":        {name: "10.0.0.1", expectErr: true},
+		"wildcard":  {name: "*.example.com", expectErr: true},
+		"with port": {name: "servers.example.com:8503", expectErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			entry := &MeshConfigEntry{
+				Peering: &PeeringMeshConfig{ServerAddressDNSName: tc.name},
+			}
+			err := entry.Validate()
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.name, entry.PeeringServerAddressDNSName())
+		})
+	}
+}
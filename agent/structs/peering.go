@@ -1,5 +1,22 @@
 package structs
 
+import (
+	"fmt"
+	"time"
+)
+
+// PeeringTokenVersion is the version of the peering token format written by
+// this version of Consul. Tokens without a version are version 1.
+const PeeringTokenVersion = 1
+
+// PeeringTokenMaxOperatorContactLength is the maximum length of the operator
+// contact embedded in a peering token.
+const PeeringTokenMaxOperatorContactLength = 256
+
+// PeeringTokenMaxClusterNameLength is the maximum length of the cluster name
+// embedded in a peering token.
+const PeeringTokenMaxClusterNameLength = 128
+
 // PeeringToken identifies a peer in order for a connection to be established.
 type PeeringToken struct {
 	CA                  []string
@@ -7,6 +24,56 @@ type PeeringToken struct {
 	ServerName          string
 	PeerID              string
 	EstablishmentSecret string
+
+	// Version is the version of the token format. It is absent from tokens
+	// generated before the format was versioned, which are version 1.
+	Version int `json:",omitempty"`
+
+	// OperatorContact optionally identifies who operates the cluster that
+	// generated the token, such as an email address or team name. It is
+	// informational only and is not used to establish the peering.
+	OperatorContact string `json:",omitempty"`
+
+	// ClusterName is an optional human-readable name of the cluster that
+	// generated the token, for display when accepting it. It is not used to
+	// establish the peering.
+	ClusterName string `json:",omitempty"`
+
+	// CAOmitted is set on "thin" tokens, which leave out CA for re-establishing
+	// a peering whose dialer already holds the generating cluster's CA roots.
+	// The dialer reuses the roots it stored for the peering.
+	CAOmitted bool `json:",omitempty"`
+
+	// IssuedAt is when the token was generated. It is absent from tokens
+	// generated before tokens were timestamped.
+	IssuedAt *time.Time `json:",omitempty"`
+
+	// ExpiresAt optionally limits how long the token can be used. Tokens
+	// without it do not expire.
+	ExpiresAt *time.Time `json:",omitempty"`
+
+	// CAIntermediates holds the intermediate certificates that chain the
+	// generating cluster's server certificates to the roots in CA. They are
+	// kept apart from CA so that they are never trusted as roots.
+	CAIntermediates []string `json:",omitempty"`
+}
+
+// ValidatePeeringTokenOperatorContact checks that an operator contact fits
+// within PeeringTokenMaxOperatorContactLength.
+func ValidatePeeringTokenOperatorContact(contact string) error {
+	if len(contact) > PeeringTokenMaxOperatorContactLength {
+		return fmt.Errorf("operator contact must be at most %d characters, got %d", PeeringTokenMaxOperatorContactLength, len(contact))
+	}
+	return nil
+}
+
+// ValidatePeeringTokenClusterName checks that a cluster name fits within
+// PeeringTokenMaxClusterNameLength.
+func ValidatePeeringTokenClusterName(name string) error {
+	if len(name) > PeeringTokenMaxClusterNameLength {
+		return fmt.Errorf("cluster name must be at most %d characters, got %d", PeeringTokenMaxClusterNameLength, len(name))
+	}
+	return nil
 }
 
 type IndexedExportedServiceList struct {
@@ -57,7 +57,8 @@ type MeshHTTPConfig struct {
 }
 
 type PeeringMeshConfig struct {
-	PeerThroughMeshGateways bool `json:",omitempty" alias:"peer_through_mesh_gateways"`
+	PeerThroughMeshGateways bool   `json:",omitempty" alias:"peer_through_mesh_gateways"`
+	ServerAddressDNSName    string `json:",omitempty" alias:"server_address_dns_name"`
 }
 
 func (e *MeshConfigEntry) GetKind() string            { return MeshConfig }
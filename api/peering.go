@@ -37,6 +37,11 @@ const (
 
 	// PeeringStateTerminated means the peering relationship has been removed.
 	PeeringStateTerminated PeeringState = "TERMINATED"
+
+	// PeeringStateQuarantined means the peering was isolated by an operator:
+	// its connection is kept, but registrations imported from the peer are
+	// rejected until it is released.
+	PeeringStateQuarantined PeeringState = "QUARANTINED"
 )
 
 type Peering struct {
@@ -68,6 +73,9 @@ type Peering struct {
 	CreateIndex uint64
 	// ModifyIndex is the latest Raft index at which the Peering. was modified.
 	ModifyIndex uint64
+	// PeerCAIntermediatePems contains the intermediate CA certificates that
+	// chain the remote peer's server certificates to PeerCAPems.
+	PeerCAIntermediatePems []string `json:",omitempty"`
 }
 
 type PeeringStreamStatus struct {
@@ -98,6 +106,10 @@ type PeeringGenerateTokenRequest struct {
 	// load balancer(s) or external IPs to reach the servers from the dialing side, and will override any server
 	// addresses obtained from the "consul" service.
 	ServerExternalAddresses []string `json:",omitempty"`
+	// UseLANMeshGatewayAddresses puts the LAN addresses of the local mesh gateways
+	// into the generated token instead of their WAN addresses, for dialing peers
+	// on the same network. It only applies when peering through mesh gateways.
+	UseLANMeshGatewayAddresses bool `json:",omitempty"`
 }
 
 type PeeringGenerateTokenResponse struct {
@@ -543,12 +543,14 @@ func PeeringMeshConfigToStructs(s *PeeringMeshConfig, t *structs.PeeringMeshConf
 		return
 	}
 	t.PeerThroughMeshGateways = s.PeerThroughMeshGateways
+	t.ServerAddressDNSName = s.ServerAddressDNSName
 }
 func PeeringMeshConfigFromStructs(t *structs.PeeringMeshConfig, s *PeeringMeshConfig) {
 	if s == nil {
 		return
 	}
 	s.PeerThroughMeshGateways = t.PeerThroughMeshGateways
+	s.ServerAddressDNSName = t.ServerAddressDNSName
 }
 func RingHashConfigToStructs(s *RingHashConfig, t *structs.RingHashConfig) {
 	if s == nil {
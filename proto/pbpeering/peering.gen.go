@@ -40,6 +40,7 @@ func GenerateTokenRequestToAPI(s *GenerateTokenRequest, t *api.PeeringGenerateTo
 	t.Partition = s.Partition
 	t.Meta = s.Meta
 	t.ServerExternalAddresses = s.ServerExternalAddresses
+	t.UseLANMeshGatewayAddresses = s.UseLANMeshGatewayAddresses
 }
 func GenerateTokenRequestFromAPI(t *api.PeeringGenerateTokenRequest, s *GenerateTokenRequest) {
 	if s == nil {
@@ -49,6 +50,7 @@ func GenerateTokenRequestFromAPI(t *api.PeeringGenerateTokenRequest, s *Generate
 	s.Partition = t.Partition
 	s.Meta = t.Meta
 	s.ServerExternalAddresses = t.ServerExternalAddresses
+	s.UseLANMeshGatewayAddresses = t.UseLANMeshGatewayAddresses
 }
 func GenerateTokenResponseToAPI(s *GenerateTokenResponse, t *api.PeeringGenerateTokenResponse) {
 	if s == nil {
@@ -79,6 +81,7 @@ func PeeringToAPI(s *Peering, t *api.Peering) {
 	t.StreamStatus = StreamStatusToAPI(s.StreamStatus)
 	t.CreateIndex = s.CreateIndex
 	t.ModifyIndex = s.ModifyIndex
+	t.PeerCAIntermediatePems = s.PeerCAIntermediatePems
 }
 func PeeringFromAPI(t *api.Peering, s *Peering) {
 	if s == nil {
@@ -97,4 +100,5 @@ func PeeringFromAPI(t *api.Peering, s *Peering) {
 	s.StreamStatus = StreamStatusFromAPI(t.StreamStatus)
 	s.CreateIndex = t.CreateIndex
 	s.ModifyIndex = t.ModifyIndex
+	s.PeerCAIntermediatePems = t.PeerCAIntermediatePems
 }
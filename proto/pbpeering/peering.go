@@ -3,6 +3,7 @@ package pbpeering
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"time"
@@ -80,6 +81,16 @@ func (p *Peering) ShouldDial() bool {
 	return len(p.PeerServerAddresses) > 0
 }
 
+// MetaKeyOneTimeTokens is the reserved peering meta key that makes the tokens
+// generated for a peering one-time-use. Its value is "true" when enabled.
+const MetaKeyOneTimeTokens = structs.MetaKeyReservedPrefix + "one-time-token"
+
+// OneTimeTokens reports whether the establishment secrets of tokens generated
+// for the peering are burned once they are exchanged, rather than freed.
+func (p *Peering) OneTimeTokens() bool {
+	return p.GetMeta()[MetaKeyOneTimeTokens] == "true"
+}
+
 func (x PeeringState) GoString() string {
 	return x.String()
 }
@@ -113,6 +124,8 @@ func PeeringStateToAPI(s PeeringState) api.PeeringState {
 		return api.PeeringStateDeleting
 	case PeeringState_TERMINATED:
 		return api.PeeringStateTerminated
+	case PeeringState_QUARANTINED:
+		return api.PeeringStateQuarantined
 	case PeeringState_UNDEFINED:
 		fallthrough
 	default:
@@ -135,6 +148,8 @@ func PeeringStateFromAPI(t api.PeeringState) PeeringState {
 		return PeeringState_DELETING
 	case api.PeeringStateTerminated:
 		return PeeringState_TERMINATED
+	case api.PeeringStateQuarantined:
+		return PeeringState_QUARANTINED
 	case api.PeeringStateUndefined:
 		fallthrough
 	default:
@@ -227,11 +242,77 @@ func (p *Peering) TLSDialOption() (grpc.DialOption, error) {
 			ServerName: p.PeerServerName,
 			RootCAs:    pool,
 		}
+		if len(p.PeerCAIntermediatePems) > 0 {
+			verify, err := verifyWithIntermediates(pool, p.PeerServerName, p.PeerCAIntermediatePems)
+			if err != nil {
+				return nil, err
+			}
+			// crypto/tls only chains the server's certificate through the
+			// certificates the server presents, so the peer's intermediates
+			// are added by verifying the connection here instead.
+			cfg.InsecureSkipVerify = true
+			cfg.VerifyConnection = verify
+		}
 		tlsOption = grpc.WithTransportCredentials(credentials.NewTLS(&cfg))
 	}
 	return tlsOption, nil
 }
 
+// verifyWithIntermediates returns a tls.Config VerifyConnection function that
+// verifies the server's certificate for serverName against roots, chaining it
+// through both the certificates the server presents and intermediatePEMs.
+func verifyWithIntermediates(roots *x509.CertPool, serverName string, intermediatePEMs []string) (func(tls.ConnectionState) error, error) {
+	var intermediates []*x509.Certificate
+	for _, intermediate := range intermediatePEMs {
+		certs, err := parseCertsPEM(intermediate)
+		if err != nil {
+			return nil, err
+		}
+		intermediates = append(intermediates, certs...)
+	}
+
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("peer presented no certificates")
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       serverName,
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range intermediates {
+			opts.Intermediates.AddCert(cert)
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}, nil
+}
+
+// parseCertsPEM parses every certificate in the given PEM data.
+func parseCertsPEM(data string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse intermediate certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("failed to parse PEM %s", data)
+	}
+	return certs, nil
+}
+
 func (p *Peering) ToAPI() *api.Peering {
 	var t api.Peering
 	PeeringToAPI(p, &t)